@@ -16,6 +16,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -136,7 +137,7 @@ func main() {
 	}
 
 	fnCreate := func(id string, opts dbmgr.DBConnOptions) error {
-		fname := dbDir + id + ".db"
+		fname := path.Join(dbDir, id+".db")
 		connstr := "file:" + fname + opts.ConnstrOpts("rwc")
 		deck.Infof("creating test db %s with connstr %q", fname, connstr)
 		db, err := sql.Open("sqlite3", connstr)
@@ -155,6 +156,20 @@ func main() {
 		return nil
 	}
 
+	// a user may open a database if they're in any of its groups; this is all that's checked after md5 or SCRAM,
+	// which verify the password themselves
+	fnCheckDBUser := func(username, db string) (bool, error) {
+		if htgroups == nil {
+			return true, nil
+		}
+		for _, grp := range []string{db, db + "::read", db + "::write", db + "::ddl", db + "::admin"} {
+			if htgroups.IsUserInGroup(username, grp) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
 	fnAuthorize := func(username, pwd, db string) (bool, error) {
 		if htaccess == nil {
 			return true, nil
@@ -162,23 +177,37 @@ func main() {
 		if !htaccess.Match(username, pwd) {
 			return false, nil
 		}
-		if htgroups == nil {
+		return fnCheckDBUser(username, db)
+	}
+
+	// members of a database's group have every right on it; members of <db>::read, <db>::write, and so on have just
+	// that right. Rights are checked after authentication, so pwd is always empty and isn't checked here
+	fnCheckRight := func(username, pwd, db, right string) (bool, error) {
+		if htgroups == nil || htgroups.IsUserInGroup(username, db) {
 			return true, nil
 		}
-		return htgroups.IsUserInGroup(username, db), nil
+		return htgroups.IsUserInGroup(username, db+"::"+strings.TrimPrefix(right, "db::")), nil
+	}
+
+	// members of the server::admin group can create databases and manage users (through meta-DDL)
+	fnCheckServerAdmin := func(username string) (bool, error) {
+		return htgroups != nil && htgroups.IsUserInGroup(username, "server::admin"), nil
 	}
 
 	cfg := dbmgr.DBManagerConfig{
-		BaseDir:         dbDir,
-		MaxDBsOpen:      1000,
-		MaxIdleTime:     5 * time.Minute,
-		SweepEach:       30 * time.Second,
-		CheckpointEach:  5 * time.Minute,
-		FnGetDB:         fnGet,
-		FnNewDB:         fnCreate,
-		FnCheckDBAccess: fnAuthorize,
-		LogDbOpenClose:  true,
-		LogLevel:        rhzCfg.LogLevel,
+		BaseDir:            dbDir,
+		MaxDBsOpen:         1000,
+		MaxIdleTime:        5 * time.Minute,
+		SweepEach:          30 * time.Second,
+		CheckpointEach:     5 * time.Minute,
+		FnGetDB:            fnGet,
+		FnNewDB:            fnCreate,
+		FnCheckDBAccess:    fnAuthorize,
+		FnCheckDBUser:      fnCheckDBUser,
+		DFnCheckDBRight:    fnCheckRight,
+		FnCheckServerAdmin: fnCheckServerAdmin,
+		LogDbOpenClose:     true,
+		LogLevel:           rhzCfg.LogLevel,
 	}
 	mgr := rhizome.NewDBManager(cfg, dbmgr.DBConnOptions{
 		UseJModeWAL:           true,
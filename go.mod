@@ -2,16 +2,18 @@ module github.com/highgrav/rhizome
 
 go 1.20
 
+require (
+	github.com/alecthomas/participle/v2 v2.0.0
+	github.com/google/deck v1.1.0
+	github.com/jackc/pgproto3/v2 v2.3.2
+	github.com/jackc/pgtype v1.14.0
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/tg123/go-htpasswd v1.2.1
+	golang.org/x/crypto v0.6.0
+)
+
 require (
 	github.com/GehirnInc/crypt v0.0.0-20200316065508-bb7000b8a962 // indirect
-	github.com/alecthomas/participle/v2 v2.0.0 // indirect
-	github.com/alecthomas/repr v0.2.0 // indirect
-	github.com/google/deck v1.1.0 // indirect
-	github.com/jackc/chunkreader v1.0.0 // indirect
+	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
 	github.com/jackc/pgio v1.0.0 // indirect
-	github.com/jackc/pgproto3 v1.1.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.17 // indirect
-	github.com/pkg/errors v0.8.1 // indirect
-	github.com/tg123/go-htpasswd v1.2.1 // indirect
-	golang.org/x/crypto v0.6.0 // indirect
 )
@@ -4,10 +4,18 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/highgrav/rhizome/internal/constants"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
 	"github.com/mattn/go-sqlite3"
 )
 
 func Init(cfg RhizomeConfig) {
+	// types are registered globally, rather than per connection
+	for _, v := range cfg.Types {
+		if v.Name != "" && v.OID != 0 {
+			pgif.RegisterType(v)
+		}
+	}
 	for _, v := range sql.Drivers() {
 		if v == constants.DBDriverName {
 			return
@@ -47,21 +55,53 @@ func Init(cfg RhizomeConfig) {
 				}
 			}
 
-			if cfg.Authorizer != nil {
-				conn.RegisterAuthorizer(cfg.Authorizer)
-			}
-			if cfg.CommitHook != nil {
-				conn.RegisterCommitHook(cfg.CommitHook)
-			}
-			if cfg.PreUpdateHook != nil {
-				conn.RegisterPreUpdateHook(cfg.PreUpdateHook)
-			}
-			if cfg.RollbackHook != nil {
-				conn.RegisterRollbackHook(cfg.RollbackHook)
-			}
-			if cfg.UpdateHook != nil {
-				conn.RegisterUpdateHook(cfg.UpdateHook)
-			}
+			// the authorizer and hooks are always set, since the database manager passes them on to the tenant hooks
+			// of the connection's DBConn (and uses them to capture changes)
+			conn.RegisterAuthorizer(func(action int, arg1, arg2, arg3 string) int {
+				dbmgr.CaptureAuthorize(conn, action)
+				if cfg.Authorizer != nil {
+					if rc := cfg.Authorizer(action, arg1, arg2, arg3); rc != sqlite3.SQLITE_OK {
+						return rc
+					}
+				}
+				return dbmgr.TenantAuthorize(conn, action, arg1, arg2, arg3)
+			})
+			conn.RegisterCommitHook(func() int {
+				rc := 0
+				if cfg.CommitHook != nil {
+					rc = cfg.CommitHook()
+				}
+				if rc == 0 {
+					rc = dbmgr.TenantCommit(conn)
+				}
+				if rc != 0 {
+					dbmgr.CaptureRollback(conn)
+					return rc
+				}
+				dbmgr.CaptureCommit(conn)
+				return 0
+			})
+			conn.RegisterPreUpdateHook(func(data sqlite3.SQLitePreUpdateData) {
+				dbmgr.CaptureRow(data)
+				if cfg.PreUpdateHook != nil {
+					cfg.PreUpdateHook(data)
+				}
+			})
+			conn.RegisterRollbackHook(func() {
+				dbmgr.CaptureRollback(conn)
+				dbmgr.TenantRollback(conn)
+				if cfg.RollbackHook != nil {
+					cfg.RollbackHook()
+				}
+			})
+			// the backend also uses the update hook for LISTEN/NOTIFY on table channels
+			conn.RegisterUpdateHook(func(op int, db string, table string, rowid int64) {
+				pgif.RowChanged(conn, op, db, table, rowid)
+				dbmgr.TenantRowUpdated(conn, op, db, table, rowid)
+				if cfg.UpdateHook != nil {
+					cfg.UpdateHook(op, db, table, rowid)
+				}
+			})
 			return nil
 		},
 	})
@@ -0,0 +1,566 @@
+package dbmgr
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/google/deck"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Change data capture. With DBManagerConfig.CaptureChanges set, every row inserted, updated, or deleted in a tenant
+database is recorded with its before and after images, grouped by transaction, in a log file kept next to the database
+(<database file>-changes, one JSON ChangeSet per line). Each committed transaction gets the next position in the
+tenant's log, and DBManager.Subscribe() streams the transactions after a given position, first from the log and then
+as they commit, so a consumer that stores the last position it handled can pick up where it left off.
+
+Rows are captured with Sqlite's preupdate hook, which go-sqlite3 only compiles in with the sqlite_preupdate_hook build
+tag; without it Subscribe() returns ErrChangeFeedUnsupported. The hooks are registered on every connection by the driver
+rhizome.Init() registers, which passes them to CaptureRow(), CaptureCommit(), and CaptureRollback(); since those hooks
+only know the connection, changes are matched to a tenant by the connection's database file. Sqlite can still fail to
+commit after the commit hook has run, and has no hook for once it has, so the commit hook only stages a transaction's
+changes, and PublishChanges() writes them to the log once the commit has happened. The pg backend calls it whenever a
+transaction ends; otherwise it's called by the driver when the connection next prepares a transaction statement, or
+changes a row, outside of a transaction. Some caveats:
+  - a transaction that commits but can't be written to the log is missing from it (the error is logged);
+  - only the main database is captured, not attached or temp databases (including the backend's pg_catalog);
+  - changes undone by ROLLBACK TO SAVEPOINT, or by a failed statement inside a transaction, are still reported, since
+    Sqlite has no hook for either (the pg backend only lets a failed transaction roll back, so this only affects
+    savepoints there);
+  - TEXT and BLOB values look the same to the preupdate hook, so values are strings if they're valid UTF-8, and
+    []byte otherwise;
+  - WITHOUT ROWID tables report 0 for rowids.
+*/
+
+var ErrChangeFeedUnsupported = errors.New("change capture needs the sqlite_preupdate_hook build tag")
+var ErrChangeFeedDisabled = errors.New("change capture is not enabled on this server")
+
+// changeLogSuffix is appended to a database's filename to make its change log's
+const changeLogSuffix = "-changes"
+
+/*
+RowChange is a single row inserted, updated, or deleted. Old and New are the row's column values, in table order,
+before and after the change (Old is nil for inserts, and New for deletes).
+*/
+type RowChange struct {
+	Op       string     `json:"op"`
+	Table    string     `json:"table"`
+	OldRowID int64      `json:"old_rowid,omitempty"`
+	NewRowID int64      `json:"new_rowid,omitempty"`
+	Old      []logValue `json:"old,omitempty"`
+	New      []logValue `json:"new,omitempty"`
+}
+
+/*
+ChangeSet is the rows changed by a committed transaction, and its position in the tenant's change log.
+*/
+type ChangeSet struct {
+	Position  uint64      `json:"pos"`
+	Committed time.Time   `json:"time"`
+	Changes   []RowChange `json:"changes"`
+}
+
+/*
+OldValues() and NewValues() return a change's row images as plain values: nil, int64, float64, string, or []byte.
+*/
+func (rc RowChange) OldValues() []any {
+	return plainValues(rc.Old)
+}
+
+func (rc RowChange) NewValues() []any {
+	return plainValues(rc.New)
+}
+
+func plainValues(vals []logValue) []any {
+	if vals == nil {
+		return nil
+	}
+	out := make([]any, len(vals))
+	for i, v := range vals {
+		out[i] = v.V
+	}
+	return out
+}
+
+/*
+logValue is a column value in the change log. JSON can't tell integers from floats or strings from blobs, so floats
+are always written with a decimal point or exponent, blobs as {"b": <base64>}, and non-finite floats as {"f": "Inf"}.
+*/
+type logValue struct {
+	V any
+}
+
+func (lv logValue) MarshalJSON() ([]byte, error) {
+	switch v := lv.V.(type) {
+	case nil:
+		return []byte("null"), nil
+	case int64:
+		return strconv.AppendInt(nil, v, 10), nil
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return json.Marshal(map[string]string{"f": strconv.FormatFloat(v, 'g', -1, 64)})
+		}
+		b := strconv.AppendFloat(nil, v, 'g', -1, 64)
+		for _, c := range b {
+			if c == '.' || c == 'e' {
+				return b, nil
+			}
+		}
+		return append(b, ".0"...), nil
+	case string:
+		return json.Marshal(v)
+	case []byte:
+		return json.Marshal(map[string]string{"b": base64.StdEncoding.EncodeToString(v)})
+	}
+	return nil, errors.New("unexpected value in change log")
+}
+
+func (lv *logValue) UnmarshalJSON(b []byte) error {
+	if len(b) == 0 {
+		return errors.New("empty value in change log")
+	}
+	switch b[0] {
+	case 'n':
+		lv.V = nil
+	case '"':
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		lv.V = s
+	case '{':
+		var m map[string]string
+		if err := json.Unmarshal(b, &m); err != nil {
+			return err
+		}
+		if s, ok := m["b"]; ok {
+			blob, err := base64.StdEncoding.DecodeString(s)
+			lv.V = blob
+			return err
+		}
+		f, err := strconv.ParseFloat(m["f"], 64)
+		lv.V = f
+		return err
+	default:
+		for _, c := range b {
+			if c == '.' || c == 'e' || c == 'E' {
+				f, err := strconv.ParseFloat(string(b), 64)
+				lv.V = f
+				return err
+			}
+		}
+		n, err := strconv.ParseInt(string(b), 10, 64)
+		lv.V = n
+		return err
+	}
+	return nil
+}
+
+/*
+changeFeed is a tenant's change log.
+*/
+type changeFeed struct {
+	sync.Mutex
+	id      string
+	mgr     *DBManager
+	logPath string
+	file    *os.File
+	// next is the position the next transaction gets; 0 until the log has been opened
+	next uint64
+	// wake is closed (and replaced) whenever a transaction is added to the log
+	wake chan struct{}
+}
+
+/*
+changeFeeds are the feeds of all the databases being captured, by the path of the database file. It's a package
+variable (rather than belonging to a DBManager) because the hooks are registered by the driver, for every connection.
+*/
+var changeFeeds = struct {
+	sync.RWMutex
+	byPath map[string]*changeFeed
+}{byPath: make(map[string]*changeFeed)}
+
+// captureEnabled is set once any database is being captured, so the hooks cost next to nothing otherwise
+var captureEnabled atomic.Bool
+
+/*
+feedFor() returns the change feed of a database, registering it if need be.
+*/
+func feedFor(mgr *DBManager, id, dbPath string) *changeFeed {
+	if resolved, err := filepath.EvalSymlinks(dbPath); err == nil {
+		dbPath = resolved
+	}
+	if abs, err := filepath.Abs(dbPath); err == nil {
+		dbPath = abs
+	}
+	changeFeeds.Lock()
+	defer changeFeeds.Unlock()
+	if feed, ok := changeFeeds.byPath[dbPath]; ok {
+		return feed
+	}
+	feed := &changeFeed{id: id, mgr: mgr, logPath: dbPath + changeLogSuffix, wake: make(chan struct{})}
+	changeFeeds.byPath[dbPath] = feed
+	captureEnabled.Store(true)
+	return feed
+}
+
+/*
+feedForConn() returns the change feed of a connection's main database, or nil if it isn't being captured.
+*/
+func feedForConn(conn *sqlite3.SQLiteConn) *changeFeed {
+	path := conn.GetFilename("main")
+	if path == "" {
+		return nil
+	}
+	changeFeeds.RLock()
+	feed := changeFeeds.byPath[path]
+	changeFeeds.RUnlock()
+	if feed == nil {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil && resolved != path {
+			changeFeeds.RLock()
+			feed = changeFeeds.byPath[resolved]
+			changeFeeds.RUnlock()
+		}
+	}
+	return feed
+}
+
+/*
+open() opens the log for appending, finding the position of the last transaction in it. Called with the feed locked.
+*/
+func (feed *changeFeed) open() error {
+	if feed.file != nil {
+		return nil
+	}
+	last, size, err := lastPosition(feed.logPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(feed.logPath, os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	// drop any partly written last line, so the next transaction starts on a line of its own
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+	feed.file = f
+	feed.next = last + 1
+	return nil
+}
+
+/*
+lastPosition() reads a change log to find the position of the last transaction in it (0 for an empty or missing log),
+and the length of the log up to the end of its last complete line; a partly written line is left by a crash during a
+write.
+*/
+func lastPosition(logPath string) (uint64, int64, error) {
+	f, err := os.Open(logPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	var last uint64
+	var size int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return last, size, nil
+		} else if err != nil {
+			return 0, 0, err
+		}
+		size += int64(len(line))
+		var cs struct {
+			Position uint64 `json:"pos"`
+		}
+		if json.Unmarshal(line, &cs) == nil && cs.Position > last {
+			last = cs.Position
+		}
+	}
+}
+
+/*
+append() writes a committed transaction's changes to the log, and wakes up the subscriptions waiting for it.
+*/
+func (feed *changeFeed) append(changes []RowChange) error {
+	feed.Lock()
+	defer feed.Unlock()
+	if err := feed.open(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(ChangeSet{Position: feed.next, Committed: time.Now().UTC(), Changes: changes})
+	if err != nil {
+		return err
+	}
+	if _, err := feed.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := feed.file.Sync(); err != nil {
+		return err
+	}
+	feed.next++
+	close(feed.wake)
+	feed.wake = make(chan struct{})
+	return nil
+}
+
+func (feed *changeFeed) waiter() chan struct{} {
+	feed.Lock()
+	defer feed.Unlock()
+	return feed.wake
+}
+
+func (feed *changeFeed) close() {
+	feed.Lock()
+	defer feed.Unlock()
+	if feed.file != nil {
+		_ = feed.file.Close()
+		feed.file = nil
+	}
+}
+
+/*
+pendingChanges are the changes made by each connection's open transaction, by connection. Connections to databases
+that aren't captured get an entry with no feed, so they're only looked up once per transaction.
+*/
+var pendingChanges sync.Map
+
+type connChanges struct {
+	feed    *changeFeed
+	changes []RowChange
+	// committing is set by the commit hook; the changes are published once the commit is known to have happened
+	committing bool
+}
+
+/*
+captureRow() records a row change for the connection's open transaction.
+*/
+func captureRow(conn *sqlite3.SQLiteConn, change RowChange) {
+	val, ok := pendingChanges.Load(conn)
+	if ok && val.(*connChanges).committing {
+		if conn.AutoCommit() {
+			// the last transaction committed, but nothing has published it yet
+			PublishChanges(conn)
+			ok = false
+		} else {
+			// a COMMIT that fails with SQLITE_BUSY leaves its transaction open, and this carries it on
+			val.(*connChanges).committing = false
+		}
+	}
+	if !ok {
+		val = &connChanges{feed: feedForConn(conn)}
+		pendingChanges.Store(conn, val)
+	}
+	if cc := val.(*connChanges); cc.feed != nil {
+		cc.changes = append(cc.changes, change)
+	}
+}
+
+/*
+CaptureCommit() is called by a connection's commit hook, once the other hooks have let the commit go ahead, and stages
+the transaction's changes for PublishChanges().
+*/
+func CaptureCommit(conn *sqlite3.SQLiteConn) {
+	if !captureEnabled.Load() {
+		return
+	}
+	if val, ok := pendingChanges.Load(conn); ok {
+		val.(*connChanges).committing = true
+	}
+}
+
+/*
+CaptureAuthorize() is called by a connection's authorizer. A transaction statement prepared outside of a transaction
+means the last one has ended, so if its changes are still staged, it committed.
+*/
+func CaptureAuthorize(conn *sqlite3.SQLiteConn, action int) {
+	if action == sqlite3.SQLITE_TRANSACTION {
+		PublishChanges(conn)
+	}
+}
+
+/*
+PublishChanges() writes the changes of the transaction a connection has just committed to the change log, and wakes up
+the subscriptions waiting for them. It does nothing if the commit hook hasn't staged any changes (because the
+transaction was rolled back, or changed nothing that's captured), or if the connection is still in a transaction (as
+it is after a COMMIT that failed with SQLITE_BUSY).
+*/
+func PublishChanges(conn *sqlite3.SQLiteConn) {
+	if !captureEnabled.Load() || !conn.AutoCommit() {
+		return
+	}
+	val, ok := pendingChanges.Load(conn)
+	if !ok || !val.(*connChanges).committing {
+		return
+	}
+	pendingChanges.Delete(conn)
+	cc := val.(*connChanges)
+	if cc.feed == nil || len(cc.changes) == 0 {
+		return
+	}
+	if err := cc.feed.append(cc.changes); err != nil {
+		deck.Errorf("cannot write a committed transaction to the change log for db %s: %s", cc.feed.id, err.Error())
+	}
+}
+
+/*
+CaptureRollback() is called by a connection's rollback hook, and drops the transaction's changes.
+*/
+func CaptureRollback(conn *sqlite3.SQLiteConn) {
+	if captureEnabled.Load() {
+		pendingChanges.Delete(conn)
+	}
+}
+
+/*
+ChangeSubscription streams a tenant's committed transactions. ChangeSets arrive on C, in order, until the subscription
+is closed or fails (in which case C is closed and Err() reports why).
+*/
+type ChangeSubscription struct {
+	C    <-chan ChangeSet
+	feed *changeFeed
+	done chan struct{}
+	once sync.Once
+	err  atomic.Value
+}
+
+/*
+Subscribe() streams the transactions committed to a tenant database after fromPosition (0 for all of them).
+*/
+func (dbm *DBManager) Subscribe(tenantID string, fromPosition uint64) (*ChangeSubscription, error) {
+	if !changeCaptureSupported {
+		return nil, ErrChangeFeedUnsupported
+	}
+	if !dbm.Cfg.CaptureChanges {
+		return nil, ErrChangeFeedDisabled
+	}
+	if !IsValidDBName(tenantID) {
+		return nil, ErrInvalidDBName
+	}
+	if !dbm.Exists(tenantID) {
+		return nil, ErrDBDoesNotExist
+	}
+	fname, err := dbm.GetFilename(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	// the log is opened here, rather than at the first commit, so any partly written line is gone before it's read
+	feed := feedFor(dbm, tenantID, fname)
+	feed.Lock()
+	err = feed.open()
+	feed.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan ChangeSet)
+	sub := &ChangeSubscription{C: ch, feed: feed, done: make(chan struct{})}
+	go sub.run(ch, fromPosition)
+	return sub, nil
+}
+
+/*
+Close() ends the subscription.
+*/
+func (sub *ChangeSubscription) Close() {
+	sub.once.Do(func() { close(sub.done) })
+}
+
+/*
+Err() returns the error that ended the subscription, if any.
+*/
+func (sub *ChangeSubscription) Err() error {
+	if err, ok := sub.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+/*
+run() tails the change log, sending each transaction after the starting position.
+*/
+func (sub *ChangeSubscription) run(ch chan<- ChangeSet, from uint64) {
+	defer close(ch)
+	fail := func(err error) {
+		sub.err.Store(err)
+	}
+	var r *bufio.Reader
+	var partial []byte
+	for {
+		wake := sub.feed.waiter()
+		if r == nil {
+			f, err := os.Open(sub.feed.logPath)
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				// nothing has been committed yet
+			case err != nil:
+				fail(err)
+				return
+			default:
+				defer f.Close()
+				r = bufio.NewReader(f)
+			}
+		}
+		for r != nil {
+			line, err := r.ReadBytes('\n')
+			partial = append(partial, line...)
+			if err == io.EOF {
+				// a transaction may be being written; the rest of it comes with the wake-up
+				break
+			} else if err != nil {
+				fail(err)
+				return
+			}
+			var cs ChangeSet
+			err = json.Unmarshal(partial, &cs)
+			partial = partial[:0]
+			if err != nil {
+				fail(err)
+				return
+			}
+			if cs.Position <= from {
+				continue
+			}
+			select {
+			case ch <- cs:
+			case <-sub.done:
+				return
+			}
+		}
+		select {
+		case <-wake:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+/*
+closeChangeFeeds() closes the change logs of the databases a manager captures, when it shuts down.
+*/
+func (dbm *DBManager) closeChangeFeeds() {
+	changeFeeds.RLock()
+	defer changeFeeds.RUnlock()
+	for _, feed := range changeFeeds.byPath {
+		if feed.mgr == dbm {
+			feed.close()
+		}
+	}
+}
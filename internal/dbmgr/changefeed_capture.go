@@ -0,0 +1,56 @@
+//go:build sqlite_preupdate_hook
+
+package dbmgr
+
+import (
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"unicode/utf8"
+)
+
+const changeCaptureSupported = true
+
+/*
+CaptureRow() is called by a connection's preupdate hook, and records the row change for the connection's open
+transaction if its database is being captured.
+*/
+func CaptureRow(data sqlite3.SQLitePreUpdateData) {
+	if !captureEnabled.Load() || data.DatabaseName != "main" {
+		return
+	}
+	change := RowChange{Table: data.TableName}
+	switch data.Op {
+	case sqlite3.SQLITE_INSERT:
+		change.Op, change.NewRowID = "INSERT", data.NewRowID
+	case sqlite3.SQLITE_UPDATE:
+		change.Op, change.OldRowID, change.NewRowID = "UPDATE", data.OldRowID, data.NewRowID
+	case sqlite3.SQLITE_DELETE:
+		change.Op, change.OldRowID = "DELETE", data.OldRowID
+	default:
+		return
+	}
+	n := data.Count()
+	if data.Op != sqlite3.SQLITE_INSERT {
+		vals := make([]any, n)
+		if data.Old(vals...) == nil {
+			change.Old = rowImage(vals)
+		}
+	}
+	if data.Op != sqlite3.SQLITE_DELETE {
+		vals := make([]any, n)
+		if data.New(vals...) == nil {
+			change.New = rowImage(vals)
+		}
+	}
+	captureRow(data.Conn, change)
+}
+
+func rowImage(vals []any) []logValue {
+	img := make([]logValue, len(vals))
+	for i, v := range vals {
+		if b, ok := v.([]byte); ok && utf8.Valid(b) {
+			v = string(b)
+		}
+		img[i] = logValue{V: v}
+	}
+	return img
+}
@@ -0,0 +1,15 @@
+//go:build !sqlite_preupdate_hook
+
+package dbmgr
+
+import (
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+const changeCaptureSupported = false
+
+/*
+CaptureRow() does nothing without the sqlite_preupdate_hook build tag, since go-sqlite3 never calls the preupdate hook.
+*/
+func CaptureRow(data sqlite3.SQLitePreUpdateData) {
+}
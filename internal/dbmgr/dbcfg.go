@@ -7,11 +7,20 @@ type FnCreateNewDB func(id string, opts DBConnOptions) error
 
 type FnAddUser func(username, pwd string) error
 type FnDeleteUser func(username string) error
-type FnModifyUser func(username, action, db string, args ...any)
+type FnModifyUser func(username, action, db string, args ...any) error
 
 type FnCheckDBAccess func(username, pwd, db string) (bool, error)
+type FnCheckDBUser func(username, db string) (bool, error)
+
+/*
+FnCheckDBRight reports whether a user holds a right on a database. It's only asked once the session has authenticated,
+and the password isn't kept after that, so pwd is always "": the callback must look the right up by username alone,
+not re-verify the user's credentials.
+*/
 type FnCheckDBRight func(username, pwd, db, right string) (bool, error)
 
+type FnCheckServerAdmin func(username string) (bool, error)
+
 type DBManagerConfig struct {
 	LogLevel       int
 	BaseDir        string
@@ -20,6 +29,9 @@ type DBManagerConfig struct {
 	MaxIdleTime    time.Duration
 	SweepEach      time.Duration
 	CheckpointEach time.Duration
+	// CaptureChanges records row changes in each database's change log, for Subscribe(); needs the
+	// sqlite_preupdate_hook build tag
+	CaptureChanges bool
 
 	FnGetDB         FnGetFilenameFromID
 	FnNewDB         FnCreateNewDB
@@ -27,5 +39,24 @@ type DBManagerConfig struct {
 	FnDeleteUser    FnDeleteUser
 	FnModifyUser    FnModifyUser
 	FnCheckDBAccess FnCheckDBAccess
+	// FnCheckDBUser checks an authenticated user's access to a database when the backend never saw their password
+	// (md5 and SCRAM); without it, FnCheckDBAccess is called with an empty password
+	FnCheckDBUser FnCheckDBUser
+	// DFnCheckDBRight enforces user rights (db::read, db::write, db::ddl, db::admin) on each session, and is always
+	// given an empty password (see FnCheckDBRight); TableRights also lets rights be held on single tables (see
+	// rights.go)
 	DFnCheckDBRight FnCheckDBRight
+	TableRights     bool
+	// FnCheckServerAdmin reports whether a user may run any meta-DDL, including the statements that act on the whole
+	// server (CREATE DATABASE, and CREATE, ALTER, or DELETE USER); without it, only the statements on a single
+	// database can be run, by users holding db::admin on it
+	FnCheckServerAdmin FnCheckServerAdmin
+
+	// FnTenantClass puts a tenant in a class, for TenantHooks; TenantHooks are set on each DBConn's connections (see
+	// tenanthooks.go)
+	FnTenantClass FnTenantClass
+	TenantHooks   []TenantHooks
+
+	// Isolation keeps tenants from reaching outside their own database; it's on unless Isolation.Disabled is set
+	Isolation IsolationPolicy
 }
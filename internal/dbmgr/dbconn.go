@@ -23,6 +23,8 @@ type DBConn struct {
 	fnGet         FnGetFilenameFromID
 	User          string
 	PendingDelete bool
+	// ConnCtx is passed to the tenant hooks set on the DBConn's connections
+	ConnCtx *ConnContext
 }
 
 func OpenOrCreateDBConn(mgr *DBManager, grp *DBConnGroup, driver *sqlite3.SQLiteDriver, id string, fnGet FnGetFilenameFromID, fnCreate FnCreateNewDB, opts DBConnOptions) (*DBConn, error) {
@@ -32,8 +34,9 @@ func OpenOrCreateDBConn(mgr *DBManager, grp *DBConnGroup, driver *sqlite3.SQLite
 		return nil, err
 	}
 	connstr := "file:" + filepath + opts.ConnstrOpts("rw")
+	cc := newConnContext(mgr, id)
 
-	db, err := sql.Open(constants.DBDriverName, connstr)
+	db, err := openTenantDB(connstr, cc)
 
 	if err != nil || db.Ping() != nil {
 		// try to create the DB if necessary
@@ -41,7 +44,7 @@ func OpenOrCreateDBConn(mgr *DBManager, grp *DBConnGroup, driver *sqlite3.SQLite
 		if err2 != nil {
 			return nil, err2
 		}
-		db, err = sql.Open(constants.DBDriverName, connstr)
+		db, err = openTenantDB(connstr, cc)
 		if err != nil {
 			return nil, err
 		}
@@ -53,6 +56,9 @@ func OpenOrCreateDBConn(mgr *DBManager, grp *DBConnGroup, driver *sqlite3.SQLite
 	}
 	if mgr != nil {
 		mgr.UpdateStat(constants.StatOpenDbs, 1)
+		if mgr.Cfg.CaptureChanges {
+			feedFor(mgr, id, filepath)
+		}
 	}
 
 	dbc := &DBConn{
@@ -65,6 +71,7 @@ func OpenOrCreateDBConn(mgr *DBManager, grp *DBConnGroup, driver *sqlite3.SQLite
 		driver:        driver,
 		opts:          opts,
 		fnGet:         fnGet,
+		ConnCtx:       cc,
 	}
 
 	return dbc, nil
@@ -84,7 +91,8 @@ func OpenDBConn(mgr *DBManager, grp *DBConnGroup, driver *sqlite3.SQLiteDriver,
 	}
 
 	connstr := "file:" + filepath + opts.ConnstrOpts("rw")
-	db, err := sql.Open(constants.DBDriverName, connstr)
+	cc := newConnContext(mgr, id)
+	db, err := openTenantDB(connstr, cc)
 
 	if err != nil {
 		return nil, err
@@ -96,6 +104,9 @@ func OpenDBConn(mgr *DBManager, grp *DBConnGroup, driver *sqlite3.SQLiteDriver,
 	}
 	if mgr != nil {
 		mgr.UpdateStat(constants.StatOpenDbs, 1)
+		if mgr.Cfg.CaptureChanges {
+			feedFor(mgr, id, filepath)
+		}
 	}
 
 	dbc := &DBConn{
@@ -108,6 +119,7 @@ func OpenDBConn(mgr *DBManager, grp *DBConnGroup, driver *sqlite3.SQLiteDriver,
 		driver:        driver,
 		opts:          opts,
 		fnGet:         fnGet,
+		ConnCtx:       cc,
 	}
 	return dbc, nil
 }
@@ -124,6 +136,23 @@ func (dbc *DBConn) Authorize(username, pwd, db string) bool {
 	return v
 }
 
+/*
+AuthorizeUser() checks a user's access to a database once they've authenticated without giving the server their
+password (with md5 or SCRAM): FnCheckDBUser decides if it's set, and otherwise FnCheckDBAccess is given an empty
+password.
+*/
+func (dbc *DBConn) AuthorizeUser(username, db string) bool {
+	if dbc.Mgr.Cfg.FnCheckDBUser == nil {
+		return dbc.Authorize(username, "", db)
+	}
+	v, err := dbc.Mgr.Cfg.FnCheckDBUser(username, db)
+	if err != nil {
+		deck.Errorf("cannot check access for user %s on db %s: %s", username, db, err.Error())
+		return false
+	}
+	return v
+}
+
 // TODO -- no longer needed once we're separating connections
 func (dbc *DBConn) Reopen() error {
 	dbc.Lock()
@@ -141,7 +170,7 @@ func (dbc *DBConn) Reopen() error {
 	}
 
 	connstr := "file:" + filepath + dbc.opts.ConnstrOpts("rw")
-	db, err := sql.Open(constants.DBDriverName, connstr)
+	db, err := openTenantDB(connstr, dbc.ConnCtx)
 
 	if err != nil {
 		return err
@@ -173,6 +202,18 @@ func (dbc *DBConn) Reopen() error {
 }
 
 func (dbc *DBConn) Conn(ctx context.Context) (*sql.Conn, error) {
+	if dbc.DB == nil {
+		err := dbc.Reopen()
+		if err != nil {
+			deck.Errorf("failed reopening db %s: %q", dbc.ID, err.Error())
+			return nil, err
+		}
+	}
+	dbc.RLock()
+	defer dbc.RUnlock()
+	dbc.LastAccessed = time.Now()
+	dbc.PendingDelete = false
+
 	return dbc.DB.Conn(ctx)
 }
 
@@ -200,6 +241,7 @@ func (dbc *DBConn) Close() {
 	}
 	dbc.PendingDelete = true
 	dbc.DB = nil
+	dbc.ConnCtx.unbind()
 }
 
 func (dbc *DBConn) AuthEnabled() bool {
@@ -226,6 +268,13 @@ func (dbc *DBConn) AuthEnabled() bool {
 }
 
 func (dbc *DBConn) Exec(query string, args ...any) (sql.Result, error) {
+	return dbc.ExecContext(context.Background(), query, args...)
+}
+
+func (dbc *DBConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if dbc.Mgr.Cfg.LogLevel >= constants.LogLevelDebug {
+		deck.Infof("running exec %q on db %s", query, dbc.ID)
+	}
 	if dbc.DB == nil {
 		err := dbc.Reopen()
 		if err != nil {
@@ -237,7 +286,7 @@ func (dbc *DBConn) Exec(query string, args ...any) (sql.Result, error) {
 	dbc.LastAccessed = time.Now()
 	dbc.PendingDelete = false
 
-	r, err := dbc.DB.ExecContext(context.Background(), query, args...)
+	r, err := dbc.DB.ExecContext(ctx, query, args...)
 	if err != nil {
 		deck.Errorf("failed exec()ing query %q on db %q: %q", query, dbc.ID, err.Error())
 		return nil, err
@@ -273,6 +322,38 @@ func (dbc *DBConn) QueryContext(ctx context.Context, query string, args ...any)
 	return r, nil
 }
 
+func (dbc *DBConn) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	if dbc.DB == nil {
+		err := dbc.Reopen()
+		if err != nil {
+			deck.Errorf("failed reopening db %s: %q", dbc.ID, err.Error())
+			return nil, err
+		}
+	}
+	dbc.RLock()
+	defer dbc.RUnlock()
+	dbc.LastAccessed = time.Now()
+	dbc.PendingDelete = false
+
+	return dbc.DB.PrepareContext(ctx, query)
+}
+
+func (dbc *DBConn) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	if dbc.DB == nil {
+		err := dbc.Reopen()
+		if err != nil {
+			deck.Errorf("failed reopening db %s: %q", dbc.ID, err.Error())
+			return nil, err
+		}
+	}
+	dbc.RLock()
+	defer dbc.RUnlock()
+	dbc.LastAccessed = time.Now()
+	dbc.PendingDelete = false
+
+	return dbc.DB.BeginTx(ctx, opts)
+}
+
 func (dbc *DBConn) QueryRow(query string, args ...any) (*sql.Row, error) {
 	return dbc.QueryRowContext(context.Background(), query, args...)
 }
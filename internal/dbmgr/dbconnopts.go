@@ -28,7 +28,7 @@ type DBConnOptions struct {
 	SyncFull  bool
 	SyncOff   bool
 
-	LockModeExclusive      bool `opt:"_locking_mode=EXCLUSIVE""`
+	LockModeExclusive      bool `opt:"_locking_mode=EXCLUSIVE"`
 	CaseSensitiveLike      bool `opt:"_case_sensitive_like"`
 	ForeignKeys            bool `opt:"_foreign_keys"`
 	IgnoreCheckConstraints bool `opt:"_ignore_check_constraints"`
@@ -4,6 +4,8 @@ import (
 	"github.com/google/deck"
 	"github.com/highgrav/rhizome/internal/constants"
 	"github.com/mattn/go-sqlite3"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -166,8 +168,12 @@ func (dbm *DBManager) OpenOrCreate(id string) error {
 	if dbm.Stats[constants.StatOpenDbs].Load() > int64(dbm.Cfg.MaxDBsOpen) {
 		return ErrTooManyDBsOpen
 	}
-	dbm.Lock()
-	defer dbm.Unlock()
+	if !dbm.Exists(id) {
+		if err := dbm.create(id); err != nil {
+			deck.Errorf("failed to create database %s: %s", id, err.Error())
+			return err
+		}
+	}
 	db, err := NewDBConnGroup(id)
 	if err != nil {
 		deck.Errorf("failed to open or create database %s: %s", id, err.Error())
@@ -177,6 +183,59 @@ func (dbm *DBManager) OpenOrCreate(id string) error {
 	return nil
 }
 
+/*
+Exists() reports whether the backing file for a database ID is present.
+*/
+func (dbm *DBManager) Exists(id string) bool {
+	if dbm.GetFilename == nil {
+		return false
+	}
+	fname, err := dbm.GetFilename(id)
+	if err != nil {
+		return false
+	}
+	fst, err := os.Stat(fname)
+	if err != nil || fst.IsDir() {
+		return false
+	}
+	return true
+}
+
+/*
+Create() creates a new database file using the configured FnNewDB hook. It does not open the database.
+*/
+func (dbm *DBManager) Create(id string) error {
+	if !IsValidDBName(id) {
+		return ErrInvalidDBName
+	}
+	dbm.Lock()
+	defer dbm.Unlock()
+	if dbm.Exists(id) {
+		return ErrDBAlreadyExists
+	}
+	return dbm.create(id)
+}
+
+func (dbm *DBManager) create(id string) error {
+	if dbm.CreateDb == nil {
+		return ErrCannotCreateDB
+	}
+	if dbm.Cfg.LogDbOpenClose {
+		deck.Infof("Creating db %s", id)
+	}
+	return dbm.CreateDb(id, dbm.DefaultOpts)
+}
+
+/*
+IsValidDBName() rejects database IDs that could escape the database directory when turned into a filename.
+*/
+func IsValidDBName(id string) bool {
+	if strings.TrimSpace(id) == "" || strings.Contains(id, "..") {
+		return false
+	}
+	return !strings.ContainsAny(id, "/\\\x00")
+}
+
 func (dbm *DBManager) Close() {
 	dbm.Lock()
 	defer dbm.Unlock()
@@ -184,6 +243,7 @@ func (dbm *DBManager) Close() {
 	for k, _ := range dbm.DBs {
 		dbm.CloseDB(k)
 	}
+	dbm.closeChangeFeeds()
 }
 
 func (dbm *DBManager) CloseDB(id string) {
@@ -9,3 +9,6 @@ var ErrCriticalCannotOpen = errors.New("critical error, cannot open database")
 var ErrDBDoesNotExist = errors.New("db does not exist")
 var ErrWrongDBServer = errors.New("db doesn not exist on this server")
 var ErrTooManyDBsOpen = errors.New("cannot open db: too many connections")
+var ErrDBAlreadyExists = errors.New("db already exists")
+var ErrCannotCreateDB = errors.New("db creation is not enabled on this server")
+var ErrInvalidDBName = errors.New("invalid db name")
@@ -0,0 +1,249 @@
+package dbmgr
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+Tenant isolation. SQL from clients goes straight to Sqlite, which would happily ATTACH another tenant's file, VACUUM
+INTO an arbitrary path, or run a PRAGMA that changes the whole process, so unless DBManagerConfig.Isolation.Disabled is
+set, every DBConn's connections are held to a policy, through the authorizer and the connection's limits:
+  - ATTACH is denied, except for the files in AttachAllowed and private ':memory:' databases, and
+    SQLITE_LIMIT_ATTACHED leaves room for no more than AttachAllowed (and VACUUM INTO, if it's allowed); only the
+    files in AttachAllowed can be detached again;
+  - VACUUM INTO is only allowed into the directory FnVacuumIntoDir gives for the tenant, and only to a file that
+    doesn't exist yet, so nothing already there can be attached, read, or overwritten;
+  - ATTACH of a computed filename (or a parameter) is denied, since the authorizer only sees an empty name. A plain
+    VACUUM attaches its temporary database the same way, so tenants can't run it; DBManager.Vacuum() can. No
+    attached database can be used unless it's the main one, a temporary or in-memory one, one of AttachAllowed, or a
+    file the connection has just written with VACUUM INTO;
+  - load_extension() and fts3_tokenizer() are denied;
+  - only the PRAGMAs in safePragmas (and AllowPragmas) can be run, and only some of them can be set.
+*/
+
+/*
+IsolationPolicy configures tenant isolation; it's on unless Disabled is set. SQLITE_LIMIT_ATTACHED allows one
+database for each of AttachAllowed, and one for VACUUM INTO if FnVacuumIntoDir is set, so it's 0 if neither is. The
+system catalogs the backend attaches to each session are attached before the limit applies (see pgif's
+attachCatalog()).
+*/
+type IsolationPolicy struct {
+	Disabled bool
+	// AttachAllowed are the database files tenants may ATTACH
+	AttachAllowed []string
+	// AllowPragmas are PRAGMAs tenants may run and set, besides the safe ones
+	AllowPragmas []string
+	// FnVacuumIntoDir returns the directory a tenant may VACUUM INTO, or "" if it may not
+	FnVacuumIntoDir func(tenantID string) string
+}
+
+/*
+safePragmas are the PRAGMAs tenants may run, and whether they may be given a value (or, for the ones that take one,
+an argument).
+*/
+var safePragmas = map[string]bool{
+	"analysis_limit": true, "application_id": true, "auto_vacuum": false, "automatic_index": true,
+	"busy_timeout": true, "cache_size": true, "cache_spill": true, "case_sensitive_like": true,
+	"collation_list": false, "compile_options": false, "data_version": false, "database_list": false,
+	"defer_foreign_keys": true, "encoding": false, "foreign_key_check": true, "foreign_key_list": true,
+	"foreign_keys": true, "freelist_count": false, "function_list": false, "incremental_vacuum": true,
+	"index_info": true, "index_list": true, "index_xinfo": true, "integrity_check": true, "journal_mode": false,
+	"journal_size_limit": false, "max_page_count": false, "module_list": false, "optimize": true,
+	"page_count": false, "page_size": false, "pragma_list": false, "query_only": true, "quick_check": true,
+	"recursive_triggers": true, "reverse_unordered_selects": true, "schema_version": false, "secure_delete": false,
+	"synchronous": false, "table_info": true, "table_list": true, "table_xinfo": true, "temp_store": true,
+	"user_version": true, "wal_autocheckpoint": false, "wal_checkpoint": true,
+}
+
+// deniedFunctions reach outside the tenant's database
+var deniedFunctions = map[string]bool{"load_extension": true, "fts3_tokenizer": true}
+
+/*
+isolationRules are a policy, made ready for a tenant's connections.
+*/
+type isolationRules struct {
+	// attach are the files that may be attached, as given and as absolute paths
+	attach    map[string]bool
+	nattach   int
+	pragmas   map[string]bool
+	vacuumDir string
+
+	mu sync.Mutex
+	// vacuumed are the files written by VACUUM INTO, which has to use them while it's running
+	vacuumed map[string]bool
+}
+
+func newIsolationRules(policy IsolationPolicy, tenantID string) *isolationRules {
+	rules := &isolationRules{
+		attach:   make(map[string]bool),
+		nattach:  len(policy.AttachAllowed),
+		pragmas:  make(map[string]bool),
+		vacuumed: make(map[string]bool),
+	}
+	for _, f := range policy.AttachAllowed {
+		rules.attach[f] = true
+		if abs, err := filepath.Abs(f); err == nil {
+			rules.attach[abs] = true
+		}
+		if resolved, err := filepath.EvalSymlinks(f); err == nil {
+			rules.attach[resolved] = true
+		}
+	}
+	for _, p := range policy.AllowPragmas {
+		rules.pragmas[strings.ToLower(p)] = true
+	}
+	if policy.FnVacuumIntoDir != nil {
+		if dir := policy.FnVacuumIntoDir(tenantID); dir != "" {
+			if abs, err := filepath.Abs(dir); err == nil {
+				rules.vacuumDir = abs
+			}
+		}
+	}
+	return rules
+}
+
+/*
+attachSlots() is the most databases the policy lets a connection attach: the allowed files, and the one VACUUM INTO
+attaches.
+*/
+func (rules *isolationRules) attachSlots() int {
+	if rules.vacuumDir != "" {
+		return rules.nattach + 1
+	}
+	return rules.nattach
+}
+
+func (rules *isolationRules) attachAllowed(file string) bool {
+	// "" is a filename that isn't known until the ATTACH runs, or VACUUM's temporary database
+	if file == "" {
+		return false
+	}
+	if file == ":memory:" || rules.attach[file] {
+		return true
+	}
+	// URIs could name any file, with any options, so only the allowed ones are
+	if strings.HasPrefix(file, "file:") {
+		return false
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	if rules.attach[abs] {
+		return true
+	}
+	if rules.vacuumDir == "" || !rules.vacuumTarget(abs) {
+		return false
+	}
+	rules.mu.Lock()
+	rules.vacuumed[abs] = true
+	rules.mu.Unlock()
+	return true
+}
+
+/*
+useAllowed() reports whether a statement may use an attached database, by its schema name, in case one got attached
+some way the authorizer didn't see.
+*/
+func (rules *isolationRules) useAllowed(conn *sqlite3.SQLiteConn, schema string) bool {
+	if schema == "" || strings.EqualFold(schema, "main") || strings.EqualFold(schema, "temp") {
+		return true
+	}
+	// temporary and in-memory databases have no filename
+	file := conn.GetFilename(schema)
+	if file == "" || rules.attach[file] {
+		return true
+	}
+	rules.mu.Lock()
+	defer rules.mu.Unlock()
+	return rules.vacuumed[file]
+}
+
+/*
+vacuumTarget() reports whether a file can be a VACUUM INTO target: a new file, in the tenant's directory once any
+symlinks are followed.
+*/
+func (rules *isolationRules) vacuumTarget(abs string) bool {
+	if _, err := os.Lstat(abs); !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return false
+	}
+	root, err := filepath.EvalSymlinks(rules.vacuumDir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+/*
+authorize() is the part of the authorizer that enforces the isolation policy.
+*/
+func (rules *isolationRules) authorize(conn *sqlite3.SQLiteConn, action int, arg1, arg2, arg3 string) int {
+	// the database is the first argument for ALTER TABLE, and the third for everything else that has one
+	schema := arg3
+	if action == sqlite3.SQLITE_ALTER_TABLE {
+		schema = arg1
+	}
+	if !rules.useAllowed(conn, schema) {
+		return sqlite3.SQLITE_DENY
+	}
+	switch action {
+	case sqlite3.SQLITE_ATTACH:
+		if !rules.attachAllowed(arg1) {
+			return sqlite3.SQLITE_DENY
+		}
+	case sqlite3.SQLITE_DETACH:
+		if len(rules.attach) == 0 || !rules.attach[conn.GetFilename(arg1)] {
+			return sqlite3.SQLITE_DENY
+		}
+	case sqlite3.SQLITE_FUNCTION:
+		if deniedFunctions[strings.ToLower(arg2)] {
+			return sqlite3.SQLITE_DENY
+		}
+	case sqlite3.SQLITE_PRAGMA:
+		name := strings.ToLower(arg1)
+		if rules.pragmas[name] {
+			return sqlite3.SQLITE_OK
+		}
+		if settable, ok := safePragmas[name]; !ok || (arg2 != "" && !settable) {
+			return sqlite3.SQLITE_DENY
+		}
+	}
+	return sqlite3.SQLITE_OK
+}
+
+/*
+Vacuum() runs VACUUM on a tenant database, on a connection of its own, without the tenant's hooks or any session.
+*/
+func (dbm *DBManager) Vacuum(tenantID string) error {
+	if !IsValidDBName(tenantID) {
+		return ErrInvalidDBName
+	}
+	if !dbm.Exists(tenantID) {
+		return ErrDBDoesNotExist
+	}
+	fname, err := dbm.GetFilename(tenantID)
+	if err != nil {
+		return err
+	}
+	// the plain go-sqlite3 driver, without any of the hooks
+	db, err := sql.Open("sqlite3", "file:"+fname+dbm.DefaultOpts.ConnstrOpts("rw"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(context.Background(), "VACUUM")
+	return err
+}
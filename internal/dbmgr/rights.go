@@ -0,0 +1,172 @@
+package dbmgr
+
+import (
+	"github.com/google/deck"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"strings"
+	"sync"
+)
+
+/*
+User rights. When DBManagerConfig.DFnCheckDBRight is set, every statement a session runs against its tenant database is
+checked, through the Sqlite authorizer, for the rights it needs:
+  - db::read to read a table;
+  - db::write to insert, update, or delete rows;
+  - db::ddl to create, alter, or drop tables, indexes, views, and triggers (and to ANALYZE or REINDEX);
+  - db::admin for everything else that changes the database file or the server's view of it: PRAGMAs that set a value
+    (other than the session-local ones in sessionPragmas) and ATTACH or DETACH of a file.
+db::admin implies all of the others. With DBManagerConfig.TableRights set, a user without db::read or db::write can
+still be given them for single tables, as db::read:<table> and db::write:<table>.
+
+Only the main database is checked: temp tables, and the system catalogs the backend attaches, are the session's own.
+The callback is asked about each right once per session, and its answers are cached; since the password isn't kept
+after authentication, it's always given an empty one.
+*/
+
+const (
+	RightRead  = "db::read"
+	RightWrite = "db::write"
+	RightDDL   = "db::ddl"
+	RightAdmin = "db::admin"
+)
+
+// sessionPragmas only affect the connection that sets them, so setting them doesn't need db::admin
+var sessionPragmas = map[string]bool{
+	"busy_timeout": true, "cache_size": true, "temp_store": true, "foreign_keys": true, "defer_foreign_keys": true,
+	"recursive_triggers": true, "case_sensitive_like": true, "query_only": true,
+}
+
+// schemaPragmas take an argument, but only read the schema (the system catalogs use them)
+var schemaPragmas = map[string]bool{
+	"table_info": true, "table_xinfo": true, "table_list": true, "index_list": true, "index_info": true,
+	"index_xinfo": true, "foreign_key_list": true, "foreign_key_check": true, "integrity_check": true,
+	"quick_check": true,
+}
+
+/*
+sessionRights caches a session's answers from the rights callback.
+*/
+type sessionRights struct {
+	mu     sync.Mutex
+	check  FnCheckDBRight
+	tables bool
+	cache  map[string]bool
+}
+
+/*
+HasRight() reports whether the connection's user holds a right on its tenant (always true if rights aren't being
+enforced).
+*/
+func (cc *ConnContext) HasRight(right string) bool {
+	if cc.rights == nil {
+		return true
+	}
+	if cc.checkRight(right) {
+		return true
+	}
+	return right != RightAdmin && cc.checkRight(RightAdmin)
+}
+
+func (cc *ConnContext) checkRight(right string) bool {
+	rights := cc.rights
+	username := cc.Username()
+	rights.mu.Lock()
+	held, ok := rights.cache[right]
+	rights.mu.Unlock()
+	if ok {
+		return held
+	}
+	held, err := rights.check(username, "", cc.TenantID, right)
+	if err != nil {
+		// errors aren't cached, so the next statement asks again
+		deck.Errorf("cannot check right %s for user %s on db %s: %s", right, username, cc.TenantID, err.Error())
+		return false
+	}
+	rights.mu.Lock()
+	rights.cache[right] = held
+	rights.mu.Unlock()
+	return held
+}
+
+/*
+allowed() reports whether the user holds a right, either on the whole database or (for table rights) on the table.
+*/
+func (cc *ConnContext) allowed(right, table string) bool {
+	if cc.HasRight(right) {
+		return true
+	}
+	return table != "" && cc.rights.tables && cc.HasRight(right+":"+table)
+}
+
+/*
+requiredRight() returns the right an authorizer action needs, and the table it's on if table rights apply, or "" if
+it needs none.
+*/
+func requiredRight(action int, arg1, arg2, arg3 string) (string, string) {
+	switch action {
+	case sqlite3.SQLITE_READ:
+		if arg3 != "main" || isSchemaTable(arg1) {
+			return "", ""
+		}
+		return RightRead, arg1
+	case sqlite3.SQLITE_INSERT, sqlite3.SQLITE_UPDATE, sqlite3.SQLITE_DELETE:
+		if arg3 != "main" {
+			return "", ""
+		}
+		// DDL changes sqlite_schema too
+		if isSchemaTable(arg1) {
+			return RightDDL, ""
+		}
+		return RightWrite, arg1
+	case sqlite3.SQLITE_CREATE_TABLE, sqlite3.SQLITE_CREATE_INDEX, sqlite3.SQLITE_CREATE_VIEW,
+		sqlite3.SQLITE_CREATE_TRIGGER, sqlite3.SQLITE_CREATE_VTABLE, sqlite3.SQLITE_DROP_TABLE,
+		sqlite3.SQLITE_DROP_INDEX, sqlite3.SQLITE_DROP_VIEW, sqlite3.SQLITE_DROP_TRIGGER, sqlite3.SQLITE_DROP_VTABLE,
+		sqlite3.SQLITE_ANALYZE, sqlite3.SQLITE_REINDEX:
+		if arg3 != "main" {
+			return "", ""
+		}
+		return RightDDL, ""
+	case sqlite3.SQLITE_ALTER_TABLE:
+		// the database is the first argument here
+		if arg1 != "main" {
+			return "", ""
+		}
+		return RightDDL, ""
+	case sqlite3.SQLITE_PRAGMA:
+		name := strings.ToLower(arg1)
+		if arg2 == "" || sessionPragmas[name] || schemaPragmas[name] || (arg3 != "" && arg3 != "main") {
+			return "", ""
+		}
+		return RightAdmin, ""
+	case sqlite3.SQLITE_ATTACH:
+		// the backend attaches in-memory databases for the system catalogs; a computed filename comes through as ""
+		if arg1 == ":memory:" {
+			return "", ""
+		}
+		return RightAdmin, ""
+	case sqlite3.SQLITE_DETACH:
+		return RightAdmin, ""
+	}
+	return "", ""
+}
+
+func isSchemaTable(table string) bool {
+	switch strings.ToLower(table) {
+	case "sqlite_master", "sqlite_schema":
+		return true
+	}
+	return false
+}
+
+/*
+authorizeRights() is the part of the authorizer that enforces the user's rights.
+*/
+func (cc *ConnContext) authorizeRights(action int, arg1, arg2, arg3 string) int {
+	if cc.rights == nil {
+		return sqlite3.SQLITE_OK
+	}
+	if right, table := requiredRight(action, arg1, arg2, arg3); right != "" && !cc.allowed(right, table) {
+		return sqlite3.SQLITE_DENY
+	}
+	return sqlite3.SQLITE_OK
+}
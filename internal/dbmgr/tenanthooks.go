@@ -0,0 +1,326 @@
+package dbmgr
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/highgrav/rhizome/internal/constants"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Tenant hooks. The driver that rhizome.Init() registers sets the same functions and hooks on every connection, which
+can't tell which tenant, user, or session they're working for. TenantHooks are set on a DBConn's connections as they're
+opened, for every tenant, a class of tenants (see DBManagerConfig.FnTenantClass), or a single tenant, and their
+functions and hooks are given the DBConn's ConnContext.
+
+Functions are registered on the connection itself. Sqlite only has one authorizer and one of each hook per connection,
+so those are the driver's, which pass them on to TenantAuthorize(), TenantRowUpdated(), TenantCommit(), and
+TenantRollback() after the global ones from RhizomeConfig.
+*/
+
+/*
+ConnContext identifies who a DBConn's connections are working for. The tenant and its class are known when the DBConn
+is opened; the user is filled in once the session has authenticated, and the session ID once it's registered, so hooks
+should read them when they're called rather than when they're set.
+*/
+type ConnContext struct {
+	TenantID string
+	Class    string
+
+	mu        sync.RWMutex
+	username  string
+	sessionID uint32
+	// hooks are the TenantHooks that apply to the tenant
+	hooks []*TenantHooks
+	// rights are the user's rights, if they're being enforced (see rights.go)
+	rights *sessionRights
+	// isolation is the tenant isolation policy, unless it's disabled (see isolation.go)
+	isolation *isolationRules
+	// conns are the connections bound to the context, so they can be unbound when the DBConn is closed
+	conns []*sqlite3.SQLiteConn
+}
+
+func (cc *ConnContext) Username() string {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.username
+}
+
+func (cc *ConnContext) SessionID() uint32 {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.sessionID
+}
+
+func (cc *ConnContext) SetUser(username string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.username = username
+	if cc.rights != nil {
+		cc.rights.mu.Lock()
+		cc.rights.cache = make(map[string]bool)
+		cc.rights.mu.Unlock()
+	}
+}
+
+func (cc *ConnContext) SetSessionID(id uint32) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.sessionID = id
+}
+
+/*
+TenantFunction is a SQL function registered per connection. Fn is given the connection's context and returns the
+function itself, which can be anything go-sqlite3's RegisterFunc() accepts.
+*/
+type TenantFunction struct {
+	Name   string
+	Fn     func(cc *ConnContext) any
+	IsPure bool
+}
+
+type FnTenantClass func(tenantID string) string
+type FnTenantAuthorizer func(cc *ConnContext, action int, arg1, arg2, arg3 string) int
+type FnTenantUpdateHook func(cc *ConnContext, op int, db, table string, rowid int64)
+type FnTenantCommitHook func(cc *ConnContext) int
+type FnTenantRollbackHook func(cc *ConnContext)
+
+/*
+TenantHooks are functions and hooks set on the connections of a single tenant (if Tenant is set), of every tenant in
+a class (if Class is set), or of every tenant (if neither is). When several TenantHooks apply, their functions are all
+registered (a later one with the same name wins), and their hooks are all called, in order; the first authorizer or
+commit hook that doesn't return 0 (SQLITE_OK) decides.
+*/
+type TenantHooks struct {
+	Tenant       string
+	Class        string
+	Functions    []TenantFunction
+	Authorizer   FnTenantAuthorizer
+	UpdateHook   FnTenantUpdateHook
+	CommitHook   FnTenantCommitHook
+	RollbackHook FnTenantRollbackHook
+}
+
+func (th *TenantHooks) appliesTo(cc *ConnContext) bool {
+	return (th.Tenant == "" || th.Tenant == cc.TenantID) && (th.Class == "" || th.Class == cc.Class)
+}
+
+func (th *TenantHooks) hasCallbacks() bool {
+	return th.Authorizer != nil || th.UpdateHook != nil || th.CommitHook != nil || th.RollbackHook != nil
+}
+
+/*
+builtinTenantFunctions are registered on every DBConn's connections.
+*/
+var builtinTenantFunctions = []TenantFunction{
+	{"current_tenant", func(cc *ConnContext) any { return func() string { return cc.TenantID } }, false},
+}
+
+/*
+newConnContext() makes the context for a new DBConn on a tenant, picking out the hooks that apply to it.
+*/
+func newConnContext(mgr *DBManager, id string) *ConnContext {
+	cc := &ConnContext{TenantID: id}
+	if mgr == nil {
+		return cc
+	}
+	if mgr.Cfg.FnTenantClass != nil {
+		cc.Class = mgr.Cfg.FnTenantClass(id)
+	}
+	if !mgr.Cfg.Isolation.Disabled {
+		cc.isolation = newIsolationRules(mgr.Cfg.Isolation, id)
+	}
+	if mgr.Cfg.DFnCheckDBRight != nil {
+		cc.rights = &sessionRights{check: mgr.Cfg.DFnCheckDBRight, tables: mgr.Cfg.TableRights, cache: make(map[string]bool)}
+	}
+	for i := range mgr.Cfg.TenantHooks {
+		if th := &mgr.Cfg.TenantHooks[i]; th.appliesTo(cc) {
+			cc.hooks = append(cc.hooks, th)
+		}
+	}
+	return cc
+}
+
+/*
+boundConns are the contexts of the connections that have tenant hooks to call, by connection; anyBound is set once
+there are any, so the driver's hooks cost next to nothing otherwise.
+*/
+var boundConns sync.Map
+var anyBound atomic.Bool
+
+/*
+bind() registers the context's functions on a newly opened connection, and its hooks if it has any.
+*/
+func (cc *ConnContext) bind(conn *sqlite3.SQLiteConn) error {
+	for _, f := range builtinTenantFunctions {
+		if err := conn.RegisterFunc(f.Name, f.Fn(cc), f.IsPure); err != nil {
+			return fmt.Errorf("cannot register function %s: %w", f.Name, err)
+		}
+	}
+	if cc.isolation != nil {
+		conn.SetLimit(sqlite3.SQLITE_LIMIT_ATTACHED, cc.isolation.attachSlots())
+	}
+	callbacks := cc.rights != nil || cc.isolation != nil
+	for _, th := range cc.hooks {
+		for _, f := range th.Functions {
+			if f.Name == "" || f.Fn == nil {
+				continue
+			}
+			if err := conn.RegisterFunc(f.Name, f.Fn(cc), f.IsPure); err != nil {
+				return fmt.Errorf("cannot register tenant function %s: %w", f.Name, err)
+			}
+		}
+		callbacks = callbacks || th.hasCallbacks()
+	}
+	if !callbacks {
+		return nil
+	}
+	cc.mu.Lock()
+	cc.conns = append(cc.conns, conn)
+	cc.mu.Unlock()
+	boundConns.Store(conn, cc)
+	anyBound.Store(true)
+	return nil
+}
+
+/*
+unbind() forgets the context's connections, once the DBConn is closed.
+*/
+func (cc *ConnContext) unbind() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for _, conn := range cc.conns {
+		boundConns.Delete(conn)
+	}
+	cc.conns = nil
+}
+
+func contextFor(conn *sqlite3.SQLiteConn) *ConnContext {
+	if !anyBound.Load() {
+		return nil
+	}
+	if val, ok := boundConns.Load(conn); ok {
+		return val.(*ConnContext)
+	}
+	return nil
+}
+
+/*
+TenantAuthorize() is called by a connection's authorizer, and enforces the isolation policy and the user's rights
+before running the tenant authorizers that apply to it.
+*/
+func TenantAuthorize(conn *sqlite3.SQLiteConn, action int, arg1, arg2, arg3 string) int {
+	cc := contextFor(conn)
+	if cc == nil {
+		return sqlite3.SQLITE_OK
+	}
+	if cc.isolation != nil {
+		if rc := cc.isolation.authorize(conn, action, arg1, arg2, arg3); rc != sqlite3.SQLITE_OK {
+			return rc
+		}
+	}
+	if rc := cc.authorizeRights(action, arg1, arg2, arg3); rc != sqlite3.SQLITE_OK {
+		return rc
+	}
+	for _, th := range cc.hooks {
+		if th.Authorizer != nil {
+			if rc := th.Authorizer(cc, action, arg1, arg2, arg3); rc != sqlite3.SQLITE_OK {
+				return rc
+			}
+		}
+	}
+	return sqlite3.SQLITE_OK
+}
+
+/*
+TenantRowUpdated() is called by a connection's update hook.
+*/
+func TenantRowUpdated(conn *sqlite3.SQLiteConn, op int, db, table string, rowid int64) {
+	cc := contextFor(conn)
+	if cc == nil {
+		return
+	}
+	for _, th := range cc.hooks {
+		if th.UpdateHook != nil {
+			th.UpdateHook(cc, op, db, table, rowid)
+		}
+	}
+}
+
+/*
+TenantCommit() is called by a connection's commit hook; a non-zero result turns the commit into a rollback.
+*/
+func TenantCommit(conn *sqlite3.SQLiteConn) int {
+	cc := contextFor(conn)
+	if cc == nil {
+		return 0
+	}
+	for _, th := range cc.hooks {
+		if th.CommitHook != nil {
+			if rc := th.CommitHook(cc); rc != 0 {
+				return rc
+			}
+		}
+	}
+	return 0
+}
+
+/*
+TenantRollback() is called by a connection's rollback hook.
+*/
+func TenantRollback(conn *sqlite3.SQLiteConn) {
+	cc := contextFor(conn)
+	if cc == nil {
+		return
+	}
+	for _, th := range cc.hooks {
+		if th.RollbackHook != nil {
+			th.RollbackHook(cc)
+		}
+	}
+}
+
+/*
+tenantConnector opens connections with the driver that rhizome.Init() registered, and binds them to a DBConn's context.
+*/
+type tenantConnector struct {
+	drv     driver.Driver
+	dsn     string
+	connCtx *ConnContext
+}
+
+func (tc *tenantConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := tc.drv.Open(tc.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if sc, ok := conn.(*sqlite3.SQLiteConn); ok {
+		if err := tc.connCtx.bind(sc); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (tc *tenantConnector) Driver() driver.Driver {
+	return tc.drv
+}
+
+/*
+openTenantDB() is sql.Open() for a DBConn: its connections are bound to the DBConn's context.
+*/
+func openTenantDB(connstr string, cc *ConnContext) (*sql.DB, error) {
+	// this just looks up the driver; nothing is opened until the first connection is needed
+	db, err := sql.Open(constants.DBDriverName, connstr)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	_ = db.Close()
+	return sql.OpenDB(&tenantConnector{drv: drv, dsn: connstr, connCtx: cc}), nil
+}
@@ -0,0 +1,188 @@
+package pgif
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/deck"
+	"github.com/highgrav/rhizome/internal/constants"
+	"github.com/jackc/pgproto3/v2"
+	"strings"
+)
+
+var ErrNoUserSecret = errors.New("no user secret lookup is configured")
+
+func authFailed(username string) error {
+	return newPgError("28P01", "password authentication failed for user %q", username)
+}
+
+/*
+authMethod() returns the auth method to use for a database and user, defaulting to cleartext passwords for
+compatibility with older configs.
+*/
+func (rz *RhizomeBackend) authMethod(db, username string) AuthMethod {
+	if rz.cfg.FnGetAuthMethod != nil {
+		if method := rz.cfg.FnGetAuthMethod(db, username); method != "" {
+			return method
+		}
+	}
+	if rz.cfg.AuthMethod == "" {
+		return AuthMethodPassword
+	}
+	return rz.cfg.AuthMethod
+}
+
+/*
+userSecret() looks up the stored secret for a user. Lookup failures are logged here and surface to the client only as
+a failed authentication, so that a client can't use them to probe for valid usernames.
+*/
+func (rz *RhizomeBackend) userSecret(db, username string) (string, error) {
+	if rz.cfg.FnGetUserSecret == nil {
+		deck.Errorf("cannot authenticate %q on db %s: %s", username, db, ErrNoUserSecret.Error())
+		return "", ErrNoUserSecret
+	}
+	secret, err := rz.cfg.FnGetUserSecret(db, username)
+	if err == nil && secret == "" {
+		err = fmt.Errorf("no secret stored for user %q", username)
+	}
+	if err != nil {
+		if rz.cfg.LogLevel >= constants.LogLevelDebug {
+			deck.Infof("secret lookup for %q on db %s failed: %s", username, db, err.Error())
+		}
+		return "", err
+	}
+	return secret, nil
+}
+
+/*
+authenticate() runs the authentication exchange for the method configured for the database and user. It returns nil
+once the client has proven its identity; the caller is responsible for sending AuthenticationOk.
+*/
+func (rz *RhizomeBackend) authenticate(db, username string) error {
+	method := rz.authMethod(db, username)
+	if rz.cfg.LogLevel >= constants.LogLevelDebug {
+		deck.Infof("authenticating %q on db %s with %s", username, db, method)
+	}
+	switch method {
+	case AuthMethodPassword:
+		if err := writePgMsgs(rz.conn, &pgproto3.AuthenticationCleartextPassword{}); err != nil {
+			return err
+		}
+		return rz.processPwd()
+	case AuthMethodMD5:
+		secret, err := rz.userSecret(db, username)
+		// as in Postgres, md5 is upgraded to SCRAM when that's all we have a secret for
+		if err == nil && isScramSecret(secret) {
+			err = rz.authSCRAM(username, secret, nil)
+		} else {
+			err = rz.authMD5(username, secret, err)
+		}
+		if err != nil {
+			return err
+		}
+		return rz.checkDBAccess(db, username)
+	case AuthMethodScramSHA256:
+		secret, err := rz.userSecret(db, username)
+		if err := rz.authSCRAM(username, secret, err); err != nil {
+			return err
+		}
+		return rz.checkDBAccess(db, username)
+	default:
+		return newPgError("28000", "unsupported authentication method %q", method)
+	}
+}
+
+/*
+checkDBAccess() checks that a user who has proven who they are with md5 or SCRAM may open the database. Neither
+exchange reveals the password, so this goes by the username alone (see DBConn.AuthorizeUser()).
+*/
+func (rz *RhizomeBackend) checkDBAccess(db, username string) error {
+	if !rz.db.AuthorizeUser(username, db) {
+		return newPgError("28000", "user %q is not allowed to access database %q", username, db)
+	}
+	return nil
+}
+
+/*
+receiveAuthMsg() reads the client's reply to an authentication request, telling the backend how to decode it (several
+different messages share the 'p' type byte).
+*/
+func (rz *RhizomeBackend) receiveAuthMsg(authType uint32) (pgproto3.FrontendMessage, error) {
+	if err := rz.backend.SetAuthType(authType); err != nil {
+		return nil, err
+	}
+	return rz.backend.Receive()
+}
+
+/*
+authMD5() runs the md5 exchange: the client sends "md5" + md5(md5(password + username) + salt), which we can check
+against an md5 secret without knowing the password.
+*/
+func (rz *RhizomeBackend) authMD5(username, secret string, secretErr error) error {
+	var salt [4]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return err
+	}
+	if err := writePgMsgs(rz.conn, &pgproto3.AuthenticationMD5Password{Salt: salt}); err != nil {
+		return err
+	}
+	msg, err := rz.receiveAuthMsg(pgproto3.AuthTypeMD5Password)
+	if err != nil {
+		return err
+	}
+	pwdMsg, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return newPgError("08P01", "expected password response, got %T", msg)
+	}
+	// finish the exchange before failing, so unknown users look the same as bad passwords
+	if secretErr != nil {
+		return authFailed(username)
+	}
+	if !isMD5Secret(secret) {
+		secret = NewMD5Secret(username, secret)
+	}
+	sum := md5.Sum(append([]byte(secret[3:]), salt[:]...))
+	expected := "md5" + hex.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(pwdMsg.Password)) != 1 {
+		return authFailed(username)
+	}
+	return nil
+}
+
+/*
+NewMD5Secret() returns the md5 secret for a user, in the format used by Postgres.
+*/
+func NewMD5Secret(username, password string) string {
+	sum := md5.Sum([]byte(password + username))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+func isMD5Secret(secret string) bool {
+	if len(secret) != 35 || !strings.HasPrefix(secret, "md5") {
+		return false
+	}
+	_, err := hex.DecodeString(secret[3:])
+	return err == nil
+}
+
+/*
+verifyPassword() checks a cleartext password against a stored secret of any supported format.
+*/
+func verifyPassword(secret, username, password string) bool {
+	switch {
+	case isScramSecret(secret):
+		stored, err := parseScramSecret(secret)
+		if err != nil {
+			return false
+		}
+		derived := newScramSecret(password, stored.Salt, stored.Iterations)
+		return subtle.ConstantTimeCompare(derived.StoredKey, stored.StoredKey) == 1
+	case isMD5Secret(secret):
+		return subtle.ConstantTimeCompare([]byte(NewMD5Secret(username, password)), []byte(secret)) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(password), []byte(secret)) == 1
+	}
+}
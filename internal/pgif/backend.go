@@ -1,6 +1,7 @@
 package pgif
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"database/sql"
@@ -13,18 +14,39 @@ import (
 	"io"
 	"net"
 	"path"
-	"strings"
+	"sync"
 )
 
 type RhizomeBackend struct {
 	ctx     context.Context
 	backend *pgproto3.Backend
 	conn    net.Conn
+	// out buffers everything sent to the client after startup; see flushAfter()
+	out     *bufio.Writer
 	dbmgr   *dbmgr.DBManager
 	db      *dbmgr.DBConn
 	stmts   map[string]*RhizomePreparedStatement
 	portals map[string]*RhizomePortal
 	cfg     *BackendConfig
+
+	// pid and secretKey identify this session to CancelRequests; cancelFn cancels the request currently running.
+	pid       uint32
+	secretKey uint32
+	cancelMu  sync.Mutex
+	cancelFn  context.CancelFunc
+
+	// sqlConn is the Sqlite connection dedicated to this session, so that session state (transactions, temp tables,
+	// PRAGMAs, last_insert_rowid(), and so on) persists between statements; txStatus is its transaction status.
+	sqlConn  *sql.Conn
+	txStatus byte
+
+	// ignoreTillSync is set after an error in an extended query flow, until the client sends Sync
+	ignoreTillSync bool
+
+	// params are the session's run-time parameters (see settings.go)
+	params *sessionParams
+	// notify is the session's LISTEN/NOTIFY state (see notify.go)
+	notify sessionNotify
 }
 
 type RhizomePreparedStatement struct {
@@ -32,6 +54,18 @@ type RhizomePreparedStatement struct {
 	Stmt         string
 	PreparedStmt *sql.Stmt
 	ParamOIDs    []uint32
+	info         stmtInfo
+	// cols are the statement's result columns, for Describe
+	cols   []resultCol
+	params stmtParams
+	// catalog is set for statements that use the system catalogs, which are brought up to date before they run
+	catalog bool
+}
+
+func (stmt *RhizomePreparedStatement) close() {
+	if stmt.PreparedStmt != nil {
+		_ = stmt.PreparedStmt.Close()
+	}
 }
 
 type RhizomePortal struct {
@@ -41,24 +75,30 @@ type RhizomePortal struct {
 	ResultsUserBinaryFormatting []bool
 	Params                      []any
 	Cfg                         BackendConfig
+
+	// cursor is the open result set of a row-returning portal that has been partly fetched
+	cursor *portalCursor
+	// complete is set once a row-returning portal has sent all of its rows
+	complete bool
 }
 
 func NewRhizomeBackend(ctx context.Context, conn net.Conn, db *dbmgr.DBManager, cfg BackendConfig) *RhizomeBackend {
 	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
 	handler := &RhizomeBackend{
-		ctx:     ctx,
-		backend: backend,
-		conn:    conn,
-		dbmgr:   db,
-		cfg:     &cfg,
-		stmts:   make(map[string]*RhizomePreparedStatement),
-		portals: make(map[string]*RhizomePortal),
+		ctx:      ctx,
+		backend:  backend,
+		conn:     conn,
+		dbmgr:    db,
+		cfg:      &cfg,
+		txStatus: txIdle,
+		stmts:    make(map[string]*RhizomePreparedStatement),
+		portals:  make(map[string]*RhizomePortal),
 	}
 	return handler
 }
 
 func (rz *RhizomeBackend) upgradeToTLS() error {
-	if rz.cfg.UseTLS == false || rz.cfg.TLSKeyName == "" || rz.cfg.TLSCertName == "" {
+	if rz.cfg.UseTLS == false || (rz.cfg.TLS == nil && (rz.cfg.TLSKeyName == "" || rz.cfg.TLSCertName == "")) {
 		_, err := rz.conn.Write([]byte("N"))
 		if err != nil {
 			deck.Errorf("error upgrading tls: %s", err.Error())
@@ -99,6 +139,9 @@ func (rz *RhizomeBackend) upgradeToTLS() error {
 	}
 	rz.conn = net.Conn(sslConn)
 	rz.backend = pgproto3.NewBackend(pgproto3.NewChunkReader(rz.conn), rz.conn)
+	if rz.out != nil {
+		rz.out.Reset(rz.conn)
+	}
 	return nil
 }
 
@@ -121,6 +164,13 @@ func (rz *RhizomeBackend) processStart() error {
 			return rz.processStart()
 		}
 		return nil
+	case *pgproto3.CancelRequest:
+		// cancel requests arrive on their own connection, which is closed as soon as the request is handled
+		ok := sessions.cancel(startMsg.ProcessID, startMsg.SecretKey)
+		if rz.cfg.LogLevel >= constants.LogLevelDebug {
+			deck.Infof("Detected FE CancelRequest msg for pid %d (matched: %t)\n", startMsg.ProcessID, ok)
+		}
+		return errCancelRequest
 	case *pgproto3.StartupMessage:
 		var dbconn *dbmgr.DBConn
 		var err error = nil
@@ -139,22 +189,37 @@ func (rz *RhizomeBackend) processStart() error {
 		if err != nil {
 			writePgMsgs(rz.conn,
 				&pgproto3.ErrorResponse{
-					Message: "error opening or unknown database " + dbname + ": " + err.Error(),
+					Severity:            "FATAL",
+					SeverityUnlocalized: "FATAL",
+					Code:                "3D000",
+					Message:             "error opening or unknown database " + dbname + ": " + err.Error(),
 				},
 			)
 			return err
 		}
 		dbconn.User = username
+		dbconn.ConnCtx.SetUser(username)
 
 		rz.db = dbconn
-		buf := []byte{}
-		buf = (&pgproto3.AuthenticationCleartextPassword{}).Encode(buf)
-		_, err = rz.conn.Write(buf)
-		return rz.processPwd()
+		if err := rz.authenticate(dbname, username); err != nil {
+			return err
+		}
+		rz.sqlConn, err = rz.db.Conn(rz.ctx)
+		if err != nil {
+			return fmt.Errorf("error opening connection to db %s: %w", dbname, err)
+		}
+		// the session works without the catalogs, so this isn't fatal
+		if err := rz.attachCatalog(); err != nil {
+			deck.Errorf("cannot set up system catalogs for db %s: %s", dbname, err.Error())
+		}
+		rz.initParams(startMsg.Parameters)
+		if err := rz.startNotify(); err != nil {
+			deck.Errorf("cannot set up notifications for db %s: %s", dbname, err.Error())
+		}
+		return rz.completeStartup()
 	default:
 		return fmt.Errorf("unknown pg startup msg: %#v", startMsg)
 	}
-	return nil
 }
 
 func (rz *RhizomeBackend) processPwd() error {
@@ -174,60 +239,109 @@ func (rz *RhizomeBackend) processPwd() error {
 		}
 		return rz.processPwd()
 	case *pgproto3.PasswordMessage:
-
+		if rz.cfg.FnGetUserSecret != nil {
+			secret, err := rz.userSecret(rz.db.ID, rz.db.User)
+			if err != nil || !verifyPassword(secret, rz.db.User, pwdMsg.Password) {
+				return authFailed(rz.db.User)
+			}
+		}
 		if rz.db.Authorize(rz.db.User, pwdMsg.Password, rz.db.ID) == false {
 			return errors.New("not authorized")
 		}
-
-		buf := (&pgproto3.AuthenticationOk{}).Encode(nil)
-		buf = (&pgproto3.ParameterStatus{
-			Name:  "client_encoding",
-			Value: "UTF8",
-		}).Encode(buf)
-		buf = (&pgproto3.ParameterStatus{
-			Name:  "server_encoding",
-			Value: "UTF8",
-		}).Encode(buf)
-
-		if rz.cfg.ServerVersion != "" {
-			buf = (&pgproto3.ParameterStatus{
-				Name:  "server_version",
-				Value: rz.cfg.ServerVersion,
-			}).Encode(buf)
-		}
-
-		buf = (&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(buf)
-		_, err = rz.conn.Write(buf)
-		if err != nil {
-			return fmt.Errorf("error sending ready for query: %w", err)
-		}
 		return nil
 	default:
 		return fmt.Errorf("unknown pg startup msg: %#v", pwdMsg)
 	}
+}
+
+/*
+completeStartup() is called once the client is authenticated: it registers the session and sends the client the
+session's parameters and cancellation key.
+*/
+func (rz *RhizomeBackend) completeStartup() error {
+	if err := sessions.register(rz); err != nil {
+		return fmt.Errorf("error registering session: %w", err)
+	}
+	rz.db.ConnCtx.SetSessionID(rz.pid)
+
+	buf := (&pgproto3.AuthenticationOk{}).Encode(nil)
+	for _, ps := range rz.paramReports() {
+		buf = ps.Encode(buf)
+	}
+	buf = (&pgproto3.BackendKeyData{
+		ProcessID: rz.pid,
+		SecretKey: rz.secretKey,
+	}).Encode(buf)
+	buf = rz.readyForQuery().Encode(buf)
+	_, err := rz.conn.Write(buf)
+	if err != nil {
+		return fmt.Errorf("error sending ready for query: %w", err)
+	}
+	rz.out = bufio.NewWriterSize(rz.conn, rz.cfg.flushThreshold())
 	return nil
 }
 
+/*
+flushAfter() sends buffered output to the client once a message has been handled. Like Postgres, we hold back the
+responses to the messages of an extended query flow until the client sends Sync or Flush, so that a pipelined flow
+goes out in as few writes as possible; anything else is answered straight away. Output is also written whenever the
+buffer fills up, which is what keeps large results streaming instead of piling up in memory.
+*/
+func (rz *RhizomeBackend) flushAfter(msg pgproto3.FrontendMessage) error {
+	switch msg.(type) {
+	case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close:
+		return nil
+	}
+	return rz.out.Flush()
+}
+
 func (rz *RhizomeBackend) Run() error {
 	defer func() {
 		rz.close()
 	}()
 	err := rz.processStart()
+	if errors.Is(err, errCancelRequest) {
+		return nil
+	}
 	if err != nil {
-		var buf []byte
-		buf = (&pgproto3.ErrorResponse{
-			Severity: "fatal",
+		resp := &pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "28000",
 			Message:  "not authorized",
-		}).Encode(buf)
-		_, err = rz.conn.Write(buf)
+		}
+		var pgerr *pgError
+		if errors.As(err, &pgerr) {
+			resp.Code = pgerr.Code
+			resp.Message = pgerr.Message
+		}
+		_, werr := rz.conn.Write(resp.Encode(nil))
+		if werr != nil {
+			return werr
+		}
 		return err
 	}
+	var msg pgproto3.FrontendMessage
 	for {
+		if err := rz.flushAfter(msg); err != nil {
+			return err
+		}
 		// process messages
-		msg, err := rz.backend.Receive()
+		rz.waitForClient()
+		msg, err = rz.backend.Receive()
 		if err != nil {
 			return err
 		}
+		rz.awaken()
+		if rz.ignoreTillSync {
+			switch msg.(type) {
+			case *pgproto3.Sync, *pgproto3.Terminate:
+			default:
+				if rz.cfg.LogLevel >= constants.LogLevelDebug {
+					deck.Infof("ignoring %T until Sync", msg)
+				}
+				continue
+			}
+		}
 		switch msg := msg.(type) {
 		case *pgproto3.Bind:
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
@@ -240,11 +354,7 @@ func (rz *RhizomeBackend) Run() error {
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("received unsupported cancel request")
 			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
+			writePgMsgs(rz.out, toErrorResponse(errUnsupportedMessage))
 		case *pgproto3.Close:
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("Detected FE Close msg: %+v\n", msg)
@@ -252,33 +362,12 @@ func (rz *RhizomeBackend) Run() error {
 			if err := rz.handleClose(msg); err != nil {
 				return err
 			}
-		case *pgproto3.CopyData:
+		case *pgproto3.CopyData, *pgproto3.CopyDone, *pgproto3.CopyFail:
+			// Copy messages are consumed by handleCopy(); any that arrive here belong to a COPY that has already
+			// failed, and Postgres silently drops them.
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
-				deck.Infof("received unsupported copy request")
+				deck.Infof("dropping copy message outside of COPY: %T", msg)
 			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
-		case *pgproto3.CopyDone:
-			if rz.cfg.LogLevel >= constants.LogLevelDebug {
-				deck.Infof("received unsupported copy done request")
-			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
-		case *pgproto3.CopyFail:
-			if rz.cfg.LogLevel >= constants.LogLevelDebug {
-				deck.Infof("received unsupported copy fail request")
-			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
 		case *pgproto3.Describe:
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("Detected FE Describe msg: %+v\n", msg)
@@ -304,47 +393,27 @@ func (rz *RhizomeBackend) Run() error {
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("received unsupported function call request")
 			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
+			writePgMsgs(rz.out, toErrorResponse(errUnsupportedMessage))
 		case *pgproto3.GSSEncRequest:
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("received unsupported gssenc request")
 			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
+			writePgMsgs(rz.out, toErrorResponse(errUnsupportedMessage))
 		case *pgproto3.PasswordMessage:
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("received out of band password request")
 			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
+			writePgMsgs(rz.out, toErrorResponse(errUnsupportedMessage))
 		case *pgproto3.SASLInitialResponse:
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("received unsupported sasl initial request")
 			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
+			writePgMsgs(rz.out, toErrorResponse(errUnsupportedMessage))
 		case *pgproto3.SASLResponse:
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("received unsupported sasl response request")
 			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
+			writePgMsgs(rz.out, toErrorResponse(errUnsupportedMessage))
 		case *pgproto3.SSLRequest:
 			err := rz.upgradeToTLS()
 			if err != nil {
@@ -354,11 +423,7 @@ func (rz *RhizomeBackend) Run() error {
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("received out of sequence startup request")
 			}
-			writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{
-					Message: "unsupported option",
-				},
-			)
+			writePgMsgs(rz.out, toErrorResponse(errUnsupportedMessage))
 		case *pgproto3.Sync:
 			if rz.cfg.LogLevel >= constants.LogLevelDebug {
 				deck.Infof("Detected FE Sync msg: %+v\n", msg)
@@ -387,7 +452,6 @@ func (rz *RhizomeBackend) Run() error {
 			return fmt.Errorf("received unknown message from client: %#v", msg)
 		}
 	}
-	return nil
 }
 
 func (rz *RhizomeBackend) close() error {
@@ -403,14 +467,8 @@ func (rz *RhizomeBackend) handleQuery(msg *pgproto3.Query) error {
 		// TODO -- convert to deck logging
 		deck.Infof("handling query %q\n", msg.String)
 	}
-	if strings.HasPrefix(strings.TrimSpace(msg.String), "[[") {
-		if rz.cfg.LogLevel >= constants.LogLevelDebug {
-			deck.Infof("detected MetaDDL, rerouting...")
-			// TODO -- route meta-DDL here (for now just ACK and move on)
-			return writePgMsgs(rz.conn,
-				&pgproto3.ReadyForQuery{TxStatus: 'E'},
-			)
-		}
+	if IsMetaDDL(msg.String) {
+		return rz.handleMetaDDL(msg)
 	}
 
 	// Validation check to make sure the database is open
@@ -418,42 +476,123 @@ func (rz *RhizomeBackend) handleQuery(msg *pgproto3.Query) error {
 		return ErrDBNotOpen
 	}
 
-	// Run the query and check for errors
-	rows, err := rz.db.QueryContext(rz.ctx, msg.String)
-
+	query, err := translateSQL(msg.String, queryDialect(msg.String, rz.cfg.Dialect))
 	if err != nil {
-		return writePgMsgs(rz.conn,
-			&pgproto3.ErrorResponse{Message: err.Error()},
-			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		rz.afterStmt(stmtInfo{}, err)
+		return writePgMsgs(rz.out, toErrorResponse(err), rz.readyForQuery())
+	}
+	if isBlankSQL(query) {
+		return writePgMsgs(rz.out,
+			&pgproto3.EmptyQueryResponse{},
+			rz.readyForQuery(),
 		)
 	}
-	defer rows.Close()
-	if err = rows.Err(); err != nil {
+	if stmt, tail := splitFirstStmt(query); !isBlankSQL(tail) {
+		return rz.handleMultiQuery(stmt, tail)
+	}
+	if firstKeyword(query) == "COPY" {
+		return rz.handleCopy(query)
+	}
+
+	info := classifyStmt(query)
+	handled, tag, notice, err := rz.beforeStmt(info)
+	var msgs []pgproto3.Message
+	if notice != nil {
+		msgs = append(msgs, notice)
+	}
+	switch {
+	case err != nil:
+		msgs = append(msgs, toErrorResponse(err))
+	case handled:
+		msgs = append(msgs, &pgproto3.CommandComplete{CommandTag: tag})
+	default:
+		ctx, done := rz.startQuery()
+		err := rz.runStmt(ctx, query, info)
+		err = rz.queryError(ctx, err)
+		done()
+		rz.afterStmt(info, err)
+		if err != nil {
+			msgs = append(msgs, toErrorResponse(err))
+		}
+	}
+
+	// Mark ready for next query.
+	msgs = append(msgs, rz.readyForQuery())
+	return writePgMsgs(rz.out, msgs...)
+}
+
+/*
+runStmt() runs a single statement for a simple Query, streaming its RowDescription, DataRows, and CommandComplete to
+the client.
+*/
+func (rz *RhizomeBackend) runStmt(ctx context.Context, query string, info stmtInfo) error {
+	if usesCatalog(query) {
+		if err := rz.refreshCatalog(ctx); err != nil {
+			return err
+		}
+	}
+	if isSessionStmt(info) {
+		msgs, err := rz.sessionStmtMsgs(query, true)
+		if err != nil {
+			return err
+		}
+		return writePgMsgs(rz.out, msgs...)
+	}
+	q := rz.querier()
+	// Statements that can't return rows are Exec()ed, so that we can report how many rows they affected
+	if !info.ReturnsRows {
+		res, err := q.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		return writePgMsgs(rz.out, &pgproto3.CommandComplete{CommandTag: info.tag(info.rowsAffected(res))})
+	}
+
+	// Run the query and check for errors
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
 	// translate the Sqlite response to something PG clients can understand
-	// Convert col descriptions
-	cols, err := rows.ColumnTypes()
+	cts, err := rows.ColumnTypes()
 	if err != nil {
 		return err
 	}
-	buf := convertColTypesToPgRowDescriptions(cols).Encode(nil)
-	// Convert rows
-	pgrows, err := convertRowsToPgRows(rows, cols)
-	if err != nil {
+	// read the first row before describing the columns, so that columns with no declared type can be typed by value
+	var first []any
+	if rows.Next() {
+		if first, err = scanRow(rows, len(cts)); err != nil {
+			return err
+		}
+	} else if err := rows.Err(); err != nil {
 		return err
 	}
-	for _, pgrow := range pgrows {
-		buf = pgrow.Encode(buf)
+	cols := resultCols(cts, first)
+	if len(cols) > 0 {
+		// simple queries always return text
+		if err := writePgMsgs(rz.out, describeCols(cols, nil)); err != nil {
+			return err
+		}
+	}
+	rw := rz.newRowWriter()
+	var n int64
+	if first != nil {
+		pgrow, err := encodePgRow(first, cols, nil, rw.enc)
+		if err != nil {
+			return err
+		}
+		if err := rw.writeRow(pgrow); err != nil {
+			return err
+		}
+		rest, _, err := rw.writeRows(rows, cols, nil, 0)
+		if err != nil {
+			return err
+		}
+		n = 1 + rest
 	}
-
-	// Mark command complete and ready for next query.
-	buf = (&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}).Encode(buf)
-	buf = (&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(buf)
-
-	_, err = rz.conn.Write(buf)
-	return nil
+	return writePgMsgs(rz.out, &pgproto3.CommandComplete{CommandTag: info.tag(n)})
 }
 
 /*
@@ -479,28 +618,58 @@ func (rz *RhizomeBackend) handleParse(msg *pgproto3.Parse) error {
 	if rz.cfg.LogLevel >= constants.LogLevelDebug {
 		deck.Infof("Parsing query %q\n", msg.Query)
 	}
-	pstmt, err := rz.db.DB.PrepareContext(rz.ctx, msg.Query)
+	if old, ok := rz.stmts[msg.Name]; ok {
+		// the unnamed statement is replaced by each Parse, but named ones have to be closed first
+		if msg.Name != "" {
+			return rz.extendedError(newPgError("42P05", "prepared statement %q already exists", msg.Name))
+		}
+		old.close()
+		delete(rz.stmts, msg.Name)
+	}
+	query, err := translateSQL(msg.Query, queryDialect(msg.Query, rz.cfg.Dialect))
 	if err != nil {
-		return writePgMsgs(rz.conn,
-			&pgproto3.ErrorResponse{
-				Message: err.Error(),
-			},
-		)
+		return rz.extendedError(err)
+	}
+	// as in Postgres, a prepared statement is a single statement, rather than the first of several
+	if _, tail := splitFirstStmt(query); !isBlankSQL(tail) {
+		return rz.extendedError(newPgError("42601", "cannot insert multiple commands into a prepared statement"))
+	}
+	info := classifyStmt(query)
+	var pstmt *sql.Stmt
+	var cols []resultCol
+	nslots := 0
+	if isSessionStmt(info) {
+		// session statements (SET, LISTEN, and so on) never reach Sqlite
+		if cols, err = sessionStmtCols(query); err != nil {
+			return rz.extendedError(err)
+		}
+	} else if !isBlankSQL(query) {
+		pstmt, err = rz.sqlConn.PrepareContext(rz.ctx, query)
+		if err != nil {
+			return rz.extendedError(err)
+		}
+		cols, nslots, err = describeStmt(rz.sqlConn, query)
+		if err != nil {
+			_ = pstmt.Close()
+			return rz.extendedError(err)
+		}
 	}
 
+	toks := significant(tokenizeSQL(query))
+	params := mapParams(toks, nslots)
 	stmt := RhizomePreparedStatement{
 		ID:           msg.Name,
-		Stmt:         msg.Query,
+		Stmt:         query,
 		PreparedStmt: pstmt,
-		ParamOIDs:    make([]uint32, 0),
-	}
-	for _, v := range msg.ParameterOIDs {
-		stmt.ParamOIDs = append(stmt.ParamOIDs, v)
+		ParamOIDs:    rz.paramTypes(toks, params, msg.ParameterOIDs),
+		info:         info,
+		cols:         cols,
+		params:       params,
+		catalog:      usesCatalog(query),
 	}
 
 	rz.stmts[msg.Name] = &stmt
-	// TODO -- do we need to send ReadyForQuery?
-	return writePgMsgs(rz.conn,
+	return writePgMsgs(rz.out,
 		&pgproto3.ParseComplete{},
 	)
 }
@@ -508,11 +677,13 @@ func (rz *RhizomeBackend) handleParse(msg *pgproto3.Parse) error {
 func (rz *RhizomeBackend) handleBind(msg *pgproto3.Bind) error {
 	stmtptr, ok := rz.stmts[msg.PreparedStatement]
 	if !ok || stmtptr == nil {
-		return writePgMsgs(rz.conn,
-			&pgproto3.ErrorResponse{
-				Message: "statement '" + msg.PreparedStatement + "' does not exist",
-			},
-		)
+		return rz.extendedError(newPgError("26000", "prepared statement %q does not exist", msg.PreparedStatement))
+	}
+	if old, ok := rz.portals[msg.DestinationPortal]; ok {
+		if msg.DestinationPortal != "" {
+			return rz.extendedError(newPgError("42P03", "portal %q already exists", msg.DestinationPortal))
+		}
+		old.closeCursor()
 	}
 	portal := &RhizomePortal{
 		ID:                          msg.DestinationPortal,
@@ -528,6 +699,9 @@ func (rz *RhizomeBackend) handleBind(msg *pgproto3.Bind) error {
 		}
 		portal.ParamsUseBinaryFormatting = append(portal.ParamsUseBinaryFormatting, b)
 	}
+	if n := len(msg.ResultFormatCodes); n > 1 && n != len(stmtptr.cols) {
+		return rz.extendedError(newPgError("08P01", "bind message has %d result formats but query has %d columns", n, len(stmtptr.cols)))
+	}
 	for _, v := range msg.ResultFormatCodes {
 		var b bool
 		if v > 0 {
@@ -535,12 +709,25 @@ func (rz *RhizomeBackend) handleBind(msg *pgproto3.Bind) error {
 		}
 		portal.ResultsUserBinaryFormatting = append(portal.ResultsUserBinaryFormatting, b)
 	}
-	for _, v := range msg.Parameters {
-		portal.Params = append(portal.Params, v)
+	if len(msg.Parameters) != len(stmtptr.ParamOIDs) {
+		return rz.extendedError(newPgError("08P01", "bind message supplies %d parameters, but prepared statement %q requires %d",
+			len(msg.Parameters), msg.PreparedStatement, len(stmtptr.ParamOIDs)))
 	}
+	if n := len(msg.ParameterFormatCodes); n > 1 && n != len(msg.Parameters) {
+		return rz.extendedError(newPgError("08P01", "bind message has %d parameter formats but %d parameters", n, len(msg.Parameters)))
+	}
+	vals := make([]any, len(msg.Parameters))
+	for i, v := range msg.Parameters {
+		val, err := typeForOID(stmtptr.ParamOIDs[i]).decode(v, formatCode(portal.ParamsUseBinaryFormatting, i))
+		if err != nil {
+			return rz.extendedError(err)
+		}
+		vals[i] = val
+	}
+	portal.Params = stmtptr.params.bindArgs(vals)
 	rz.portals[msg.DestinationPortal] = portal
 
-	return writePgMsgs(rz.conn,
+	return writePgMsgs(rz.out,
 		&pgproto3.BindComplete{},
 	)
 }
@@ -551,128 +738,160 @@ func (rz *RhizomeBackend) handleExecute(msg *pgproto3.Execute) error {
 	}
 	portalptr, ok := rz.portals[msg.Portal]
 	if !ok || portalptr == nil {
-		return writePgMsgs(rz.conn,
-			&pgproto3.ErrorResponse{
-				Message: "portal '" + msg.Portal + "' does not exist",
-			},
-		)
+		return rz.extendedError(newPgError("34000", "portal %q does not exist", msg.Portal))
 	}
 	if rz.cfg.LogLevel >= constants.LogLevelDebug {
 		deck.Infof("Attempting to execute stmt ID %q\n", portalptr.StmtID)
 	}
 	stmtptr, ok := rz.stmts[portalptr.StmtID]
 	if !ok || stmtptr == nil {
-		return writePgMsgs(rz.conn,
-			&pgproto3.ErrorResponse{
-				Message: "statement '" + portalptr.StmtID + "' does not exist",
-			},
-		)
+		return rz.extendedError(newPgError("26000", "prepared statement %q does not exist", portalptr.StmtID))
 	}
 	if rz.cfg.LogLevel >= constants.LogLevelDebug {
 		deck.Infof("Attempting to execute stmt literal %q\n", stmtptr.Stmt)
 	}
+	session := isSessionStmt(stmtptr.info)
+	if stmtptr.PreparedStmt == nil && !session {
+		return writePgMsgs(rz.out, &pgproto3.EmptyQueryResponse{})
+	}
 
-	rows, err := stmtptr.PreparedStmt.QueryContext(rz.ctx, portalptr.Params...)
-	if err != nil {
-		return writePgMsgs(rz.conn,
-			&pgproto3.ErrorResponse{
-				Message: err.Error(),
-			},
-		)
+	handled, tag, notice, err := rz.beforeStmt(stmtptr.info)
+	if notice != nil {
+		if err := writePgMsgs(rz.out, notice); err != nil {
+			return err
+		}
 	}
-	cols, err := rows.ColumnTypes()
+	switch {
+	case err != nil:
+		return rz.extendedError(err)
+	case handled:
+		return writePgMsgs(rz.out, &pgproto3.CommandComplete{CommandTag: tag})
+	}
+	if session {
+		var msgs []pgproto3.Message
+		if msgs, err = rz.sessionStmtMsgs(stmtptr.Stmt, false); err == nil {
+			err = writePgMsgs(rz.out, msgs...)
+		}
+	} else {
+		if stmtptr.catalog && portalptr.cursor == nil {
+			err = rz.refreshCatalog(rz.ctx)
+		}
+		if err == nil {
+			err = rz.executeStmt(stmtptr, portalptr, msg.MaxRows)
+		}
+	}
+	rz.afterStmt(stmtptr.info, err)
 	if err != nil {
-		return writePgMsgs(rz.conn,
-			&pgproto3.ErrorResponse{
-				Message: err.Error(),
-			},
-		)
+		deck.Errorf("failed to execute portal %q: %s", msg.Portal, err.Error())
+		return rz.extendedError(err)
 	}
+	return nil
+}
 
-	buf := make([]byte, 0)
-	pgrows, err := convertRowsToPgRows(rows, cols)
-	if err != nil {
-		deck.Errorf("failed to convert rows for executed query: %s", err.Error())
-		return err
+/*
+executeStmt() runs a bound prepared statement and sends the client its result: a CommandComplete for statements that
+don't return rows, or the next batch of up to maxRows rows from the portal for those that do.
+*/
+func (rz *RhizomeBackend) executeStmt(stmtptr *RhizomePreparedStatement, portalptr *RhizomePortal, maxRows uint32) error {
+	if stmtptr.info.ReturnsRows {
+		return rz.fetchPortal(stmtptr, portalptr, maxRows)
 	}
-	for _, pgrow := range pgrows {
-		buf = pgrow.Encode(buf)
+	ctx, done := rz.startQuery()
+	defer done()
+	res, err := stmtptr.PreparedStmt.ExecContext(ctx, portalptr.Params...)
+	if err != nil {
+		return rz.queryError(ctx, err)
 	}
-
-	// Mark command complete and ready for next query.
-	buf = (&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}).Encode(buf)
-	buf = (&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(buf)
-	_, err = rz.conn.Write(buf)
-	return nil
+	return writePgMsgs(rz.out, &pgproto3.CommandComplete{CommandTag: stmtptr.info.tag(stmtptr.info.rowsAffected(res))})
 }
 
+/*
+handleSync() ends an extended query flow (and any error recovery), and is the only extended query message that is
+answered with ReadyForQuery.
+*/
 func (rz *RhizomeBackend) handleSync(msg *pgproto3.Sync) error {
-	return writePgMsgs(rz.conn,
-		&pgproto3.ReadyForQuery{
-			TxStatus: 'I',
-		},
+	rz.ignoreTillSync = false
+	// outside of a transaction block, Sync ends the implicit transaction that the flow's portals belong to
+	if rz.txStatus != txInBlock {
+		rz.closePortals()
+	}
+	return writePgMsgs(rz.out,
+		rz.readyForQuery(),
+	)
+}
+
+/*
+extendedError() reports an error in an extended query flow. Postgres skips the rest of the flow after an error, so we
+ignore everything the client sends until its next Sync.
+*/
+func (rz *RhizomeBackend) extendedError(err error) error {
+	rz.ignoreTillSync = true
+	return writePgMsgs(rz.out,
+		toErrorResponse(err),
 	)
 }
 
 func (rz *RhizomeBackend) handleDescribe(msg *pgproto3.Describe) error {
 	// RowDescription OR NoData OR ErrorResponse
 	if msg.ObjectType == 'P' || msg.ObjectType == 'p' {
-		_, ok := rz.portals[msg.Name]
+		portal, ok := rz.portals[msg.Name]
 		if !ok {
-			return writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{},
-			)
+			return rz.extendedError(newPgError("34000", "portal %q does not exist", msg.Name))
 		}
-		return writePgMsgs(rz.conn,
-			&pgproto3.NoData{},
+		st, ok := rz.stmts[portal.StmtID]
+		if !ok {
+			return rz.extendedError(newPgError("26000", "prepared statement %q does not exist", portal.StmtID))
+		}
+		return writePgMsgs(rz.out,
+			st.rowDescription(portal.ResultsUserBinaryFormatting),
 		)
 	}
 	if msg.ObjectType == 'S' || msg.ObjectType == 's' {
 		st, ok := rz.stmts[msg.Name]
 		if !ok {
-			return writePgMsgs(rz.conn,
-				&pgproto3.ErrorResponse{},
-			)
+			return rz.extendedError(newPgError("26000", "prepared statement %q does not exist", msg.Name))
 		}
-		return writePgMsgs(rz.conn,
+		return writePgMsgs(rz.out,
 			&pgproto3.ParameterDescription{
 				ParameterOIDs: st.ParamOIDs,
 			},
+			// the result formats aren't known until Bind, so statements are described as text
+			st.rowDescription(nil),
 		)
 	}
-	return writePgMsgs(rz.conn,
-		&pgproto3.NoData{},
-	)
+	return rz.extendedError(newPgError("08P01", "invalid DESCRIBE message subtype %d", msg.ObjectType))
 }
 
 func (rz *RhizomeBackend) handleClose(msg *pgproto3.Close) error {
 	if msg.ObjectType == 'S' || msg.ObjectType == 's' {
 		s, ok := rz.stmts[msg.Name]
 		if ok {
-			_ = s.PreparedStmt.Close()
+			s.close()
 			delete(rz.stmts, msg.Name)
 		}
 	} else if msg.ObjectType == 'P' || msg.ObjectType == 'p' {
-		delete(rz.portals, msg.Name)
+		if portal, ok := rz.portals[msg.Name]; ok {
+			portal.closeCursor()
+			delete(rz.portals, msg.Name)
+		}
 	}
-	return writePgMsgs(rz.conn,
+	return writePgMsgs(rz.out,
 		&pgproto3.CloseComplete{},
 	)
 }
 
+/*
+handleFlush() asks us to send any pending output, which the Run() loop does once the message has been handled.
+*/
 func (rz *RhizomeBackend) handleFlush(msg *pgproto3.Flush) error {
-	return writePgMsgs(rz.conn,
-		&pgproto3.ReadyForQuery{
-			TxStatus: 'I',
-		},
-	)
+	return nil
 }
 
 /*
 See https://www.postgresql.org/docs/current/errcodes-appendix.html for codes
 */
 func (rz *RhizomeBackend) CloseConnection(code, msg string) error {
-	return writePgMsgs(rz.conn,
+	return writePgMsgs(rz.out,
 		&pgproto3.ErrorResponse{
 			Severity: "FATAL",
 			Message:  msg,
@@ -682,6 +901,23 @@ func (rz *RhizomeBackend) CloseConnection(code, msg string) error {
 }
 
 func (rz *RhizomeBackend) cleanup() error {
+	sessions.unregister(rz)
+	rz.stopNotify()
+	rz.closePortals()
+	for id, s := range rz.stmts {
+		s.close()
+		delete(rz.stmts, id)
+	}
+	if rz.sqlConn != nil {
+		// don't hand a connection with an open transaction back to the pool
+		if !connAutoCommit(rz.sqlConn) {
+			_, _ = rz.sqlConn.ExecContext(context.Background(), "ROLLBACK")
+		}
+		if err := rz.sqlConn.Close(); err != nil {
+			deck.Errorf("error releasing connection on db %s: %s", rz.db.ID, err.Error())
+		}
+		rz.sqlConn = nil
+	}
 	if rz.db != nil {
 		rz.db.Close()
 	}
@@ -4,14 +4,91 @@ import "crypto/tls"
 
 type FnAuthorizeUser func(string, string) (bool, error)
 
+/*
+AuthMethod selects how clients prove their identity; the names match the methods in Postgres' pg_hba.conf.
+*/
+type AuthMethod string
+
+const (
+	AuthMethodPassword    AuthMethod = "password"
+	AuthMethodMD5         AuthMethod = "md5"
+	AuthMethodScramSHA256 AuthMethod = "scram-sha-256"
+)
+
+/*
+FnGetAuthMethod picks the auth method for a database and user, overriding BackendConfig.AuthMethod. Returning the
+empty string falls back to the server-wide method.
+*/
+type FnGetAuthMethod func(db, username string) AuthMethod
+
+/*
+FnGetUserSecret looks up the stored secret for a user connecting to a database, in the same formats Postgres keeps in
+pg_authid.rolpassword: "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>" (see NewScramSecret()), or
+"md5<hex digest>" (see NewMD5Secret()). Plaintext secrets are accepted but discouraged. Returning an error (or an
+empty secret) fails authentication, so the lookup also acts as the access check for the md5 and scram-sha-256
+methods, which never see the user's password.
+*/
+type FnGetUserSecret func(db, username string) (string, error)
+
+/*
+InvalidValuePolicy decides what happens to a result value that can't be converted to its column's type (text in an
+INTEGER column, say), which Sqlite allows but Postgres never would.
+*/
+type InvalidValuePolicy string
+
+const (
+	// InvalidValuePassthrough sends the value as it is, as text (the default). Binary results still fail.
+	InvalidValuePassthrough InvalidValuePolicy = "passthrough"
+	// InvalidValueNull sends the value as NULL
+	InvalidValueNull InvalidValuePolicy = "null"
+	// InvalidValueError fails the query
+	InvalidValueError InvalidValuePolicy = "error"
+)
+
+/*
+DialectMode controls the translation of Postgres-specific SQL into Sqlite's dialect (see translate.go).
+*/
+type DialectMode string
+
+const (
+	// DialectOff passes queries to Sqlite untouched (the default)
+	DialectOff DialectMode = "off"
+	// DialectBestEffort translates what it can, and passes anything else through for Sqlite to make of it what it can
+	DialectBestEffort DialectMode = "best-effort"
+	// DialectStrict translates what it can, and rejects queries with constructs it can't translate
+	DialectStrict DialectMode = "strict"
+)
+
 type BackendConfig struct {
 	ServerName      string
 	LogLevel        int
 	ServerVersion   string
 	FnAuthorizeUser FnAuthorizeUser
+	AuthMethod      AuthMethod
+	FnGetAuthMethod FnGetAuthMethod
+	FnGetUserSecret FnGetUserSecret
 	UseTLS          bool
 	TLSCertDir      string
 	TLSCertName     string
 	TLSKeyName      string
 	TLS             *tls.Config
+	// FlushThreshold is how many bytes of output are buffered before they're written to the client (default 64KiB)
+	FlushThreshold int
+	// MaxResultBytes caps the size of the rows a single query can return; 0 means no limit
+	MaxResultBytes int64
+	// InvalidValues is what to do with result values that don't fit their column's type
+	InvalidValues InvalidValuePolicy
+	// Dialect is whether (and how strictly) queries are translated from Postgres' SQL dialect to Sqlite's
+	Dialect DialectMode
+	// TableChannels sends a notification on a table's channel for each row changed in it (see notify.go)
+	TableChannels bool
+}
+
+const defaultFlushThreshold = 64 * 1024
+
+func (cfg *BackendConfig) flushThreshold() int {
+	if cfg.FlushThreshold <= 0 {
+		return defaultFlushThreshold
+	}
+	return cfg.FlushThreshold
 }
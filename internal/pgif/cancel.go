@@ -0,0 +1,155 @@
+package pgif
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+Query cancellation follows the Postgres scheme: after authentication every session is given a process ID and secret
+key (sent to the client in BackendKeyData), and a client cancels a running query by opening a fresh connection and
+sending a CancelRequest carrying that pair. Sessions are tracked in a server-wide registry so that the cancelling
+connection can find the session it targets; cancelling interrupts the session's in-flight Sqlite statement (database/sql
+hands the context cancellation to go-sqlite3, which calls sqlite3_interrupt() on the underlying connection).
+*/
+
+var errCancelRequest = errors.New("cancel request handled")
+
+type sessionRegistry struct {
+	sync.Mutex
+	sessions map[uint32]*RhizomeBackend
+}
+
+var sessions = &sessionRegistry{
+	sessions: make(map[uint32]*RhizomeBackend),
+}
+
+/*
+register() assigns the session a unique process ID and a random secret key and adds it to the registry.
+*/
+func (reg *sessionRegistry) register(rz *RhizomeBackend) error {
+	var b [8]byte
+	reg.Lock()
+	defer reg.Unlock()
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		pid := binary.BigEndian.Uint32(b[:4]) & 0x7fffffff
+		if _, ok := reg.sessions[pid]; ok || pid == 0 {
+			continue
+		}
+		rz.pid = pid
+		rz.secretKey = binary.BigEndian.Uint32(b[4:])
+		reg.sessions[pid] = rz
+		return nil
+	}
+}
+
+func (reg *sessionRegistry) unregister(rz *RhizomeBackend) {
+	if rz.pid == 0 {
+		return
+	}
+	reg.Lock()
+	defer reg.Unlock()
+	if reg.sessions[rz.pid] == rz {
+		delete(reg.sessions, rz.pid)
+	}
+}
+
+/*
+cancel() interrupts the current query of the session matching the process ID and secret key, if there is one. Like
+Postgres, a request that doesn't match anything is silently ignored.
+*/
+func (reg *sessionRegistry) cancel(pid, secretKey uint32) bool {
+	reg.Lock()
+	rz, ok := reg.sessions[pid]
+	reg.Unlock()
+	if !ok || subtle.ConstantTimeEq(int32(rz.secretKey), int32(secretKey)) != 1 {
+		return false
+	}
+	return rz.cancelQuery()
+}
+
+/*
+startQuery() returns the context that a single client request (a simple Query, an Execute, or a COPY) should run
+under, along with the func to call when the request is finished. Only that request is interrupted by a cancel, or by
+running past the session's statement_timeout.
+*/
+func (rz *RhizomeBackend) startQuery() (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if d := rz.statementTimeout(); d > 0 {
+		ctx, cancel = context.WithTimeout(rz.ctx, d)
+	} else {
+		ctx, cancel = context.WithCancel(rz.ctx)
+	}
+	done := rz.watchQuery(cancel)
+	return ctx, func() {
+		done()
+		cancel()
+	}
+}
+
+/*
+startFetch() is startQuery() for a request that runs under a longer-lived context than its own, like fetching from a
+portal's cursor: until the returned func is called, a cancel request cancels the context, and so does running past
+statement_timeout, with context.DeadlineExceeded as the cause. So the timeout covers each Execute, not the cursor's
+whole life.
+*/
+func (rz *RhizomeBackend) startFetch(cancel context.CancelCauseFunc) func() {
+	done := rz.watchQuery(func() { cancel(context.Canceled) })
+	var timer *time.Timer
+	if d := rz.statementTimeout(); d > 0 {
+		timer = time.AfterFunc(d, func() { cancel(context.DeadlineExceeded) })
+	}
+	return func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		done()
+	}
+}
+
+/*
+watchQuery() makes cancel the func that a cancel request calls until the returned func is called.
+*/
+func (rz *RhizomeBackend) watchQuery(cancel context.CancelFunc) func() {
+	rz.cancelMu.Lock()
+	rz.cancelFn = cancel
+	rz.cancelMu.Unlock()
+	return func() {
+		rz.cancelMu.Lock()
+		rz.cancelFn = nil
+		rz.cancelMu.Unlock()
+	}
+}
+
+func (rz *RhizomeBackend) cancelQuery() bool {
+	rz.cancelMu.Lock()
+	defer rz.cancelMu.Unlock()
+	if rz.cancelFn == nil {
+		return false
+	}
+	rz.cancelFn()
+	return true
+}
+
+/*
+queryError() reports errors caused by a cancelled (or timed out) query as query_canceled, and passes anything else
+through.
+*/
+func (rz *RhizomeBackend) queryError(ctx context.Context, err error) error {
+	if err != nil && context.Cause(ctx) == context.DeadlineExceeded && rz.ctx.Err() == nil {
+		return newPgError("57014", "canceling statement due to statement timeout")
+	}
+	if err != nil && ctx.Err() != nil && rz.ctx.Err() == nil {
+		return newPgError("57014", "canceling statement due to user request")
+	}
+	return err
+}
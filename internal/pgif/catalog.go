@@ -0,0 +1,822 @@
+package pgif
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jackc/pgtype"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+System catalogs. Tools like psql, DBeaver and pgAdmin, and ORMs' schema introspection, find out about a database by
+querying pg_catalog and information_schema. We emulate the parts of them those queries use most: each session's
+connection gets two in-memory databases attached as pg_catalog and information_schema, holding tables with the
+Postgres names and columns, which are filled in from sqlite_schema and the table_info, index_list, index_info and
+foreign_key_list PRAGMAs whenever a query uses them and the tenant's schema has changed since they were last filled in.
+Tables are reported as belonging to the public schema, and the functions catalog queries call (format_type(),
+pg_get_expr(), pg_table_is_visible(), and so on) are registered on the connection.
+
+The catalog tables are WITHOUT ROWID tables, so filling them in doesn't disturb last_insert_rowid(), and they are filled
+in inside a savepoint on the session's own connection, so a transaction that rolls back takes its catalog changes with
+it.
+*/
+
+// OIDs of the objects that aren't derived from the tenant's schema
+const (
+	catalogNamespaceOID = 11
+	publicNamespaceOID  = 2200
+	infoSchemaOID       = 13000
+	ownerOID            = 10
+	databaseOID         = 16383
+	heapAMOID           = 2
+	btreeAMOID          = 403
+	// relations get firstRelOID plus their rowid in sqlite_schema
+	firstRelOID = 16384
+	// INTEGER PRIMARY KEYs have no index of their own, so their _pkey indexes are numbered from here
+	firstPKeyOID = 1 << 30
+)
+
+var catalogDDL = []string{
+	`CREATE TABLE pg_catalog.rz_catalog (schema_version INTEGER PRIMARY KEY) WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_namespace (oid INTEGER PRIMARY KEY, nspname TEXT, nspowner INTEGER DEFAULT 10,
+		nspacl TEXT) WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_class (oid INTEGER PRIMARY KEY, relname TEXT, relnamespace INTEGER DEFAULT 2200,
+		reltype INTEGER DEFAULT 0, reloftype INTEGER DEFAULT 0, relowner INTEGER DEFAULT 10, relam INTEGER DEFAULT 0,
+		relfilenode INTEGER DEFAULT 0, reltablespace INTEGER DEFAULT 0, relpages INTEGER DEFAULT 0,
+		reltuples REAL DEFAULT -1, relallvisible INTEGER DEFAULT 0, reltoastrelid INTEGER DEFAULT 0,
+		relhasindex BOOLEAN DEFAULT FALSE, relisshared BOOLEAN DEFAULT FALSE, relpersistence TEXT DEFAULT 'p',
+		relkind TEXT, relnatts INTEGER DEFAULT 0, relchecks INTEGER DEFAULT 0, relhasrules BOOLEAN DEFAULT FALSE,
+		relhastriggers BOOLEAN DEFAULT FALSE, relhassubclass BOOLEAN DEFAULT FALSE,
+		relrowsecurity BOOLEAN DEFAULT FALSE, relforcerowsecurity BOOLEAN DEFAULT FALSE,
+		relispopulated BOOLEAN DEFAULT TRUE, relreplident TEXT DEFAULT 'd', relispartition BOOLEAN DEFAULT FALSE,
+		relacl TEXT, reloptions TEXT, relpartbound TEXT) WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_attribute (attrelid INTEGER, attname TEXT, atttypid INTEGER,
+		attstattarget INTEGER DEFAULT -1, attlen INTEGER, attnum INTEGER, attndims INTEGER DEFAULT 0,
+		attcacheoff INTEGER DEFAULT -1, atttypmod INTEGER DEFAULT -1, attbyval BOOLEAN DEFAULT FALSE,
+		attstorage TEXT DEFAULT 'p', attalign TEXT DEFAULT 'i', attnotnull BOOLEAN DEFAULT FALSE,
+		atthasdef BOOLEAN DEFAULT FALSE, atthasmissing BOOLEAN DEFAULT FALSE, attidentity TEXT DEFAULT '',
+		attgenerated TEXT DEFAULT '', attisdropped BOOLEAN DEFAULT FALSE, attislocal BOOLEAN DEFAULT TRUE,
+		attinhcount INTEGER DEFAULT 0, attcollation INTEGER DEFAULT 0, attacl TEXT, attoptions TEXT,
+		PRIMARY KEY (attrelid, attnum)) WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_attrdef (oid INTEGER PRIMARY KEY, adrelid INTEGER, adnum INTEGER, adbin TEXT)
+		WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_index (indexrelid INTEGER PRIMARY KEY, indrelid INTEGER, indnatts INTEGER,
+		indnkeyatts INTEGER, indisunique BOOLEAN, indisprimary BOOLEAN, indisexclusion BOOLEAN DEFAULT FALSE,
+		indimmediate BOOLEAN DEFAULT TRUE, indisclustered BOOLEAN DEFAULT FALSE, indisvalid BOOLEAN DEFAULT TRUE,
+		indcheckxmin BOOLEAN DEFAULT FALSE, indisready BOOLEAN DEFAULT TRUE, indislive BOOLEAN DEFAULT TRUE,
+		indisreplident BOOLEAN DEFAULT FALSE, indkey TEXT, indcollation TEXT DEFAULT '', indclass TEXT DEFAULT '',
+		indoption TEXT DEFAULT '', indexprs TEXT, indpred TEXT) WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_type (oid INTEGER PRIMARY KEY, typname TEXT, typnamespace INTEGER DEFAULT 11,
+		typowner INTEGER DEFAULT 10, typlen INTEGER, typbyval BOOLEAN, typtype TEXT DEFAULT 'b', typcategory TEXT,
+		typispreferred BOOLEAN DEFAULT FALSE, typisdefined BOOLEAN DEFAULT TRUE, typdelim TEXT DEFAULT ',',
+		typrelid INTEGER DEFAULT 0, typelem INTEGER DEFAULT 0, typarray INTEGER DEFAULT 0,
+		typnotnull BOOLEAN DEFAULT FALSE, typbasetype INTEGER DEFAULT 0, typtypmod INTEGER DEFAULT -1,
+		typndims INTEGER DEFAULT 0, typcollation INTEGER DEFAULT 0, typdefault TEXT) WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_am (oid INTEGER PRIMARY KEY, amname TEXT, amtype TEXT) WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_collation (oid INTEGER PRIMARY KEY, collname TEXT, collnamespace INTEGER DEFAULT 11,
+		collowner INTEGER DEFAULT 10, collprovider TEXT DEFAULT 'c', collisdeterministic BOOLEAN DEFAULT TRUE,
+		collencoding INTEGER DEFAULT -1, collcollate TEXT, collctype TEXT) WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_database (oid INTEGER PRIMARY KEY, datname TEXT, datdba INTEGER DEFAULT 10,
+		encoding INTEGER DEFAULT 6, datcollate TEXT DEFAULT 'C', datctype TEXT DEFAULT 'C',
+		datistemplate BOOLEAN DEFAULT FALSE, datallowconn BOOLEAN DEFAULT TRUE, datconnlimit INTEGER DEFAULT -1,
+		dattablespace INTEGER DEFAULT 1663, datacl TEXT) WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_roles (oid INTEGER PRIMARY KEY, rolname TEXT, rolsuper BOOLEAN DEFAULT FALSE,
+		rolinherit BOOLEAN DEFAULT TRUE, rolcreaterole BOOLEAN DEFAULT FALSE, rolcreatedb BOOLEAN DEFAULT FALSE,
+		rolcanlogin BOOLEAN DEFAULT TRUE, rolreplication BOOLEAN DEFAULT FALSE, rolconnlimit INTEGER DEFAULT -1,
+		rolpassword TEXT DEFAULT '********', rolvaliduntil TEXT, rolbypassrls BOOLEAN DEFAULT FALSE, rolconfig TEXT)
+		WITHOUT ROWID`,
+	`CREATE TABLE pg_catalog.pg_settings (name TEXT PRIMARY KEY, setting TEXT, unit TEXT, category TEXT,
+		short_desc TEXT, context TEXT DEFAULT 'user', vartype TEXT DEFAULT 'string', source TEXT DEFAULT 'default',
+		boot_val TEXT, reset_val TEXT) WITHOUT ROWID`,
+	`CREATE TABLE information_schema.tables (table_catalog TEXT, table_schema TEXT, table_name TEXT, table_type TEXT,
+		is_insertable_into TEXT, is_typed TEXT DEFAULT 'NO', PRIMARY KEY (table_schema, table_name)) WITHOUT ROWID`,
+	`CREATE TABLE information_schema.columns (table_catalog TEXT, table_schema TEXT, table_name TEXT,
+		column_name TEXT, ordinal_position INTEGER, column_default TEXT, is_nullable TEXT, data_type TEXT,
+		character_maximum_length INTEGER, numeric_precision INTEGER, numeric_scale INTEGER,
+		datetime_precision INTEGER, udt_catalog TEXT, udt_schema TEXT DEFAULT 'pg_catalog', udt_name TEXT,
+		is_identity TEXT DEFAULT 'NO', identity_generation TEXT, is_generated TEXT DEFAULT 'NEVER',
+		is_updatable TEXT, PRIMARY KEY (table_schema, table_name, ordinal_position)) WITHOUT ROWID`,
+	`CREATE TABLE information_schema.table_constraints (constraint_catalog TEXT, constraint_schema TEXT,
+		constraint_name TEXT, table_catalog TEXT, table_schema TEXT, table_name TEXT, constraint_type TEXT,
+		is_deferrable TEXT DEFAULT 'NO', initially_deferred TEXT DEFAULT 'NO',
+		PRIMARY KEY (constraint_schema, constraint_name)) WITHOUT ROWID`,
+	`CREATE TABLE information_schema.key_column_usage (constraint_catalog TEXT, constraint_schema TEXT,
+		constraint_name TEXT, table_catalog TEXT, table_schema TEXT, table_name TEXT, column_name TEXT,
+		ordinal_position INTEGER, position_in_unique_constraint INTEGER,
+		PRIMARY KEY (constraint_schema, constraint_name, ordinal_position)) WITHOUT ROWID`,
+}
+
+// catalogNames are the names that mark a query as using the catalogs (lower-cased)
+// catalogDBs are the in-memory databases attached to hold the catalogs
+var catalogDBs = []string{"pg_catalog", "information_schema"}
+
+var catalogNames = map[string]bool{
+	"pg_catalog": true, "information_schema": true, "regclass": true, "pg_namespace": true, "pg_class": true,
+	"pg_attribute": true, "pg_attrdef": true, "pg_index": true, "pg_type": true, "pg_am": true, "pg_collation": true,
+	"pg_database": true, "pg_roles": true, "pg_settings": true,
+}
+
+/*
+usesCatalog() reports whether a query refers to the system catalogs.
+*/
+func usesCatalog(query string) bool {
+	// a quick check first, since this is called for every query
+	lower := strings.ToLower(query)
+	if !strings.Contains(lower, "pg_") && !strings.Contains(lower, "information_schema") &&
+		!strings.Contains(lower, "regclass") {
+		return false
+	}
+	for _, tok := range tokenizeSQL(query) {
+		if (tok.Kind == tokWord || tok.Kind == tokQuotedIdent) && catalogNames[strings.ToLower(tok.ident())] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+queryDialect() returns the dialect translation to use for a query. Catalog queries come from Postgres tools, so they
+are always translated.
+*/
+func queryDialect(query string, mode DialectMode) DialectMode {
+	if mode != DialectBestEffort && mode != DialectStrict && usesCatalog(query) {
+		return DialectBestEffort
+	}
+	return mode
+}
+
+/*
+attachCatalog() attaches and sets up the catalog databases on the session's connection (which may already have them,
+if it was used by an earlier session), and registers the catalog functions.
+*/
+func (rz *RhizomeBackend) attachCatalog() error {
+	ctx := rz.ctx
+	rows, err := rz.sqlConn.QueryContext(ctx, "SELECT name FROM pragma_database_list WHERE name = 'pg_catalog'")
+	if err != nil {
+		return err
+	}
+	attached := rows.Next()
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if !attached {
+		// the isolation policy only leaves room for the databases tenants may attach, so the catalogs are attached
+		// before it's lowered again; Sqlite counts them against the limit, so they keep slots of their own
+		err := rz.sqlConn.Raw(func(dc any) error {
+			sc, ok := dc.(*sqlite3.SQLiteConn)
+			if !ok {
+				return nil
+			}
+			// Sqlite caps the limit at the most it was built to allow
+			limit := sc.SetLimit(sqlite3.SQLITE_LIMIT_ATTACHED, math.MaxInt32)
+			defer sc.SetLimit(sqlite3.SQLITE_LIMIT_ATTACHED, limit+len(catalogDBs))
+			for _, name := range catalogDBs {
+				if _, err := sc.Exec("ATTACH DATABASE ':memory:' AS "+name, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, stmt := range catalogDDL {
+			if _, err := rz.sqlConn.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		if err := rz.fillStaticCatalog(ctx); err != nil {
+			return err
+		}
+	}
+	// the database and role are the session's, which may not be the last session's
+	stmts := []struct {
+		query string
+		args  []any
+	}{
+		{"DELETE FROM pg_catalog.pg_database", nil},
+		{"INSERT INTO pg_catalog.pg_database (oid, datname) VALUES (?, ?)", []any{databaseOID, rz.db.ID}},
+		{"DELETE FROM pg_catalog.pg_roles", nil},
+		{"INSERT INTO pg_catalog.pg_roles (oid, rolname) VALUES (?, ?)", []any{ownerOID, rz.db.User}},
+	}
+	for _, stmt := range stmts {
+		if _, err := rz.sqlConn.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+	return rz.sqlConn.Raw(func(dc any) error {
+		sc, ok := dc.(*sqlite3.SQLiteConn)
+		if !ok {
+			return nil
+		}
+		return rz.registerCatalogFuncs(sc)
+	})
+}
+
+/*
+fillSettings() refills pg_settings from the session's parameters, if they've changed since it was last filled.
+*/
+func (rz *RhizomeBackend) fillSettings(ctx context.Context) error {
+	if rz.params == nil || !rz.params.changed {
+		return nil
+	}
+	if _, err := rz.sqlConn.ExecContext(ctx, "DELETE FROM pg_catalog.pg_settings"); err != nil {
+		return err
+	}
+	for _, row := range rz.settingsRows() {
+		reset := rz.params.resets[strings.ToLower(row[0])]
+		if _, err := rz.sqlConn.ExecContext(ctx,
+			"INSERT INTO pg_catalog.pg_settings (name, setting, short_desc, boot_val, reset_val) VALUES (?, ?, ?, ?, ?)",
+			row[0], row[1], row[2], reset, reset); err != nil {
+			return err
+		}
+	}
+	rz.params.changed = false
+	return nil
+}
+
+/*
+fillStaticCatalog() fills in the catalog tables that don't depend on the tenant's schema.
+*/
+func (rz *RhizomeBackend) fillStaticCatalog(ctx context.Context) error {
+	for _, ns := range []struct {
+		oid  int
+		name string
+	}{{catalogNamespaceOID, "pg_catalog"}, {publicNamespaceOID, "public"}, {infoSchemaOID, "information_schema"}} {
+		if _, err := rz.sqlConn.ExecContext(ctx, "INSERT INTO pg_catalog.pg_namespace (oid, nspname) VALUES (?, ?)",
+			ns.oid, ns.name); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range []string{
+		"INSERT INTO pg_catalog.pg_am VALUES (2, 'heap', 't'), (403, 'btree', 'i')",
+		"INSERT INTO pg_catalog.pg_collation (oid, collname, collprovider, collcollate, collctype) VALUES " +
+			"(100, 'default', 'd', '', ''), (950, 'C', 'c', 'C', 'C'), (951, 'POSIX', 'c', 'POSIX', 'POSIX')",
+	} {
+		if _, err := rz.sqlConn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	for _, t := range registeredTypes() {
+		if _, err := rz.sqlConn.ExecContext(ctx,
+			"INSERT INTO pg_catalog.pg_type (oid, typname, typlen, typbyval, typcategory) VALUES (?, ?, ?, ?, ?)",
+			t.OID, t.Name, t.Size, t.Size > 0 && t.Size <= 8, typeCategory(t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+registerCatalogFuncs() registers the functions catalog queries call. Postgres' own versions look things up in the
+catalogs; ours answer from what we know about the session.
+*/
+func (rz *RhizomeBackend) registerCatalogFuncs(sc *sqlite3.SQLiteConn) error {
+	user := rz.db.User
+	dbname := rz.db.ID
+	patterns := make(map[string]*regexp.Regexp)
+	funcs := []struct {
+		name string
+		fn   any
+		pure bool
+	}{
+		{"format_type", func(oid, typmod any) any {
+			n, ok := oid.(int64)
+			if !ok {
+				return nil
+			}
+			mod, _ := typmod.(int64)
+			if typmod == nil {
+				mod = -1
+			}
+			return formatType(uint32(n), mod)
+		}, true},
+		{"pg_get_expr", func(expr any, relid any, pretty ...any) any { return expr }, true},
+		{"pg_table_is_visible", func(oid any) bool { return true }, true},
+		{"current_schema", func() string { return "public" }, true},
+		{"current_database", func() string { return dbname }, true},
+		{"pg_get_userbyid", func(oid int64) string {
+			if oid == ownerOID {
+				return user
+			}
+			return fmt.Sprintf("unknown (OID=%d)", oid)
+		}, true},
+		{"obj_description", func(args ...any) any { return nil }, true},
+		{"col_description", func(relid, attnum any) any { return nil }, true},
+		// X REGEXP Y calls regexp(Y, X); the dialect translation turns Postgres' ~ into REGEXP
+		{"regexp", func(pattern, s string) (bool, error) {
+			re, ok := patterns[pattern]
+			if !ok {
+				var err error
+				if re, err = regexp.Compile(pattern); err != nil {
+					return false, newPgError("2201B", "invalid regular expression: %s", err.Error())
+				}
+				if len(patterns) > 100 {
+					patterns = make(map[string]*regexp.Regexp)
+				}
+				patterns[pattern] = re
+			}
+			return re.MatchString(s), nil
+		}, true},
+	}
+	for _, f := range funcs {
+		if err := sc.RegisterFunc(f.name, f.fn, f.pure); err != nil {
+			return fmt.Errorf("cannot register catalog function %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+/*
+refreshCatalog() brings the catalog tables up to date with the tenant's schema, if they aren't already.
+*/
+func (rz *RhizomeBackend) refreshCatalog(ctx context.Context) error {
+	if rz.sqlConn == nil || rz.txStatus == txFailed {
+		return nil
+	}
+	var current, filled int64
+	if err := rz.sqlConn.QueryRowContext(ctx, "PRAGMA main.schema_version").Scan(&current); err != nil {
+		return err
+	}
+	err := rz.sqlConn.QueryRowContext(ctx, "SELECT schema_version FROM pg_catalog.rz_catalog").Scan(&filled)
+	switch {
+	case err == sql.ErrNoRows:
+		filled = -1
+	case err != nil:
+		// not attached, most likely; the query will fail with a better message than ours
+		return nil
+	}
+	if err := rz.fillSettings(ctx); err != nil {
+		return err
+	}
+	if filled == current {
+		return nil
+	}
+
+	schema, err := readSchema(ctx, rz.sqlConn)
+	if err != nil {
+		return err
+	}
+	if _, err := rz.sqlConn.ExecContext(ctx, "SAVEPOINT rz_catalog"); err != nil {
+		return err
+	}
+	if err = fillCatalog(ctx, rz.sqlConn, rz.db.ID, schema, current); err != nil {
+		_, _ = rz.sqlConn.ExecContext(ctx, "ROLLBACK TO rz_catalog")
+	}
+	if _, relErr := rz.sqlConn.ExecContext(ctx, "RELEASE rz_catalog"); err == nil {
+		err = relErr
+	}
+	return err
+}
+
+type catalogCol struct {
+	name     string
+	decl     string
+	notNull  bool
+	dflt     sql.NullString
+	pk       int
+	identity bool
+}
+
+type catalogIndex struct {
+	oid     int64
+	name    string
+	unique  bool
+	primary bool
+	// constraint is set for indexes that implement a PRIMARY KEY or UNIQUE constraint
+	constraint bool
+	cols       []int
+}
+
+type catalogFKey struct {
+	name string
+	from []string
+}
+
+type catalogRel struct {
+	oid      int64
+	name     string
+	kind     string
+	cols     []catalogCol
+	indexes  []catalogIndex
+	fkeys    []catalogFKey
+	triggers bool
+}
+
+/*
+readSchema() reads the tables and views of the tenant's database, with their columns, indexes, and foreign keys.
+*/
+func readSchema(ctx context.Context, conn *sql.Conn) ([]*catalogRel, error) {
+	var rels []*catalogRel
+	byName := make(map[string]*catalogRel)
+	indexOIDs := make(map[string]int64)
+	rows, err := conn.QueryContext(ctx, `SELECT rowid, type, name, tbl_name FROM main.sqlite_schema
+		WHERE name NOT LIKE 'sqlite\_%' ESCAPE '\' OR name LIKE 'sqlite\_autoindex\_%' ESCAPE '\'
+		ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	var triggered []string
+	for rows.Next() {
+		var rowid int64
+		var typ, name, table string
+		if err := rows.Scan(&rowid, &typ, &name, &table); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		switch typ {
+		case "table", "view":
+			rel := &catalogRel{oid: firstRelOID + rowid, name: name, kind: "r"}
+			if typ == "view" {
+				rel.kind = "v"
+			}
+			rels = append(rels, rel)
+			byName[name] = rel
+		case "index":
+			indexOIDs[name] = firstRelOID + rowid
+		case "trigger":
+			triggered = append(triggered, table)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	for _, table := range triggered {
+		if rel, ok := byName[table]; ok {
+			rel.triggers = true
+		}
+	}
+
+	for _, rel := range rels {
+		if err := readColumns(ctx, conn, rel); err != nil {
+			return nil, err
+		}
+		if rel.kind != "r" {
+			continue
+		}
+		if err := readIndexes(ctx, conn, rel, indexOIDs); err != nil {
+			return nil, err
+		}
+		if err := readForeignKeys(ctx, conn, rel); err != nil {
+			return nil, err
+		}
+	}
+	return rels, nil
+}
+
+func readColumns(ctx context.Context, conn *sql.Conn, rel *catalogRel) error {
+	rows, err := conn.QueryContext(ctx,
+		`SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?, 'main') ORDER BY cid`, rel.name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	npk := 0
+	for rows.Next() {
+		var col catalogCol
+		if err := rows.Scan(&col.name, &col.decl, &col.notNull, &col.dflt, &col.pk); err != nil {
+			return err
+		}
+		if col.pk > 0 {
+			npk++
+		}
+		rel.cols = append(rel.cols, col)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// a lone INTEGER PRIMARY KEY is the rowid, which Sqlite fills in like an identity column
+	for i := range rel.cols {
+		if npk == 1 && rel.cols[i].pk == 1 && strings.EqualFold(rel.cols[i].decl, "INTEGER") && rel.kind == "r" {
+			rel.cols[i].identity = true
+		}
+	}
+	return nil
+}
+
+func readIndexes(ctx context.Context, conn *sql.Conn, rel *catalogRel, indexOIDs map[string]int64) error {
+	rows, err := conn.QueryContext(ctx,
+		`SELECT name, "unique", origin FROM pragma_index_list(?, 'main') ORDER BY seq`, rel.name)
+	if err != nil {
+		return err
+	}
+	var indexes []catalogIndex
+	hasPK := false
+	for rows.Next() {
+		var idx catalogIndex
+		var origin string
+		if err := rows.Scan(&idx.name, &idx.unique, &origin); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		idx.oid = indexOIDs[idx.name]
+		idx.primary = origin == "pk"
+		idx.constraint = origin == "pk" || origin == "u"
+		hasPK = hasPK || idx.primary
+		indexes = append(indexes, idx)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for i := range indexes {
+		idx := &indexes[i]
+		cols, err := conn.QueryContext(ctx, `SELECT cid, name FROM pragma_index_info(?, 'main') ORDER BY seqno`, idx.name)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for cols.Next() {
+			var cid int
+			var name sql.NullString
+			if err := cols.Scan(&cid, &name); err != nil {
+				_ = cols.Close()
+				return err
+			}
+			// the rowid (-1) and expressions (-2) have no attribute number
+			if cid < 0 {
+				cid = -1
+			}
+			idx.cols = append(idx.cols, cid+1)
+			names = append(names, name.String)
+		}
+		if err := cols.Close(); err != nil {
+			return err
+		}
+		// constraints' indexes get the names Postgres would give them (as in constraint violations)
+		switch {
+		case idx.primary:
+			idx.name = rel.name + "_pkey"
+		case idx.constraint:
+			idx.name = rel.name + "_" + strings.Join(names, "_") + "_key"
+		}
+	}
+
+	if !hasPK {
+		for i, col := range rel.cols {
+			if col.identity {
+				indexes = append([]catalogIndex{{oid: firstPKeyOID + rel.oid, name: rel.name + "_pkey", unique: true,
+					primary: true, constraint: true, cols: []int{i + 1}}}, indexes...)
+			}
+		}
+	}
+	rel.indexes = indexes
+	return nil
+}
+
+func readForeignKeys(ctx context.Context, conn *sql.Conn, rel *catalogRel) error {
+	rows, err := conn.QueryContext(ctx, `SELECT id, "from" FROM pragma_foreign_key_list(?, 'main') ORDER BY id, seq`,
+		rel.name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	last := -1
+	for rows.Next() {
+		var id int
+		var from string
+		if err := rows.Scan(&id, &from); err != nil {
+			return err
+		}
+		if id != last {
+			rel.fkeys = append(rel.fkeys, catalogFKey{})
+			last = id
+		}
+		fk := &rel.fkeys[len(rel.fkeys)-1]
+		fk.from = append(fk.from, from)
+	}
+	for i := range rel.fkeys {
+		rel.fkeys[i].name = rel.name + "_" + strings.Join(rel.fkeys[i].from, "_") + "_fkey"
+	}
+	return rows.Err()
+}
+
+/*
+fillCatalog() replaces the schema-derived contents of the catalog tables.
+*/
+func fillCatalog(ctx context.Context, conn *sql.Conn, dbname string, schema []*catalogRel, version int64) error {
+	for _, table := range []string{
+		"pg_catalog.rz_catalog", "pg_catalog.pg_class", "pg_catalog.pg_attribute", "pg_catalog.pg_attrdef",
+		"pg_catalog.pg_index", "information_schema.tables", "information_schema.columns",
+		"information_schema.table_constraints", "information_schema.key_column_usage",
+	} {
+		if _, err := conn.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+			return err
+		}
+	}
+	var err error
+	exec := func(query string, args ...any) {
+		if err == nil {
+			_, err = conn.ExecContext(ctx, query, args...)
+		}
+	}
+
+	for _, rel := range schema {
+		am := heapAMOID
+		if rel.kind == "v" {
+			am = 0
+		}
+		exec(`INSERT INTO pg_catalog.pg_class (oid, relname, relam, relkind, relnatts, relhasindex, relhastriggers)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, rel.oid, rel.name, am, rel.kind, len(rel.cols), len(rel.indexes) > 0,
+			rel.triggers)
+		tableType, insertable := "BASE TABLE", "YES"
+		if rel.kind == "v" {
+			tableType, insertable = "VIEW", "NO"
+		}
+		exec(`INSERT INTO information_schema.tables (table_catalog, table_schema, table_name, table_type,
+			is_insertable_into) VALUES (?, 'public', ?, ?, ?)`, dbname, rel.name, tableType, insertable)
+
+		for i, col := range rel.cols {
+			fillColumn(exec, dbname, rel, i+1, col)
+		}
+
+		for _, idx := range rel.indexes {
+			keys := make([]string, len(idx.cols))
+			for i, attnum := range idx.cols {
+				keys[i] = strconv.Itoa(attnum)
+			}
+			exec(`INSERT INTO pg_catalog.pg_class (oid, relname, relam, relkind, relnatts) VALUES (?, ?, ?, 'i', ?)`,
+				idx.oid, idx.name, btreeAMOID, len(idx.cols))
+			exec(`INSERT INTO pg_catalog.pg_index (indexrelid, indrelid, indnatts, indnkeyatts, indisunique,
+				indisprimary, indkey) VALUES (?, ?, ?, ?, ?, ?, ?)`, idx.oid, rel.oid, len(idx.cols), len(idx.cols),
+				idx.unique, idx.primary, strings.Join(keys, " "))
+			if !idx.constraint {
+				continue
+			}
+			kind := "UNIQUE"
+			if idx.primary {
+				kind = "PRIMARY KEY"
+			}
+			var names []string
+			for _, attnum := range idx.cols {
+				if attnum > 0 {
+					names = append(names, rel.cols[attnum-1].name)
+				}
+			}
+			fillConstraint(exec, dbname, rel.name, idx.name, kind, names)
+		}
+		for _, fk := range rel.fkeys {
+			fillConstraint(exec, dbname, rel.name, fk.name, "FOREIGN KEY", fk.from)
+		}
+	}
+	exec("INSERT INTO pg_catalog.rz_catalog (schema_version) VALUES (?)", version)
+	return err
+}
+
+func fillColumn(exec func(string, ...any), dbname string, rel *catalogRel, attnum int, col catalogCol) {
+	typ := columnType(col.decl, nil)
+	typmod := declTypmod(col.decl, typ)
+	notNull := col.notNull || col.pk > 0
+	identity, identityGen, attIdentity := "NO", sql.NullString{}, ""
+	if col.identity {
+		identity, identityGen, attIdentity = "YES", sql.NullString{String: "BY DEFAULT", Valid: true}, "d"
+	}
+	exec(`INSERT INTO pg_catalog.pg_attribute (attrelid, attname, atttypid, attlen, attnum, atttypmod, attbyval,
+		attnotnull, atthasdef, attidentity) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, rel.oid, col.name, typ.OID,
+		typ.Size, attnum, typmod, typ.Size > 0 && typ.Size <= 8, notNull, col.dflt.Valid, attIdentity)
+	if col.dflt.Valid {
+		exec("INSERT INTO pg_catalog.pg_attrdef (oid, adrelid, adnum, adbin) VALUES (?, ?, ?, ?)",
+			rel.oid*1000+int64(attnum), rel.oid, attnum, col.dflt.String)
+	}
+
+	var maxLen, precision, scale, dtPrecision sql.NullInt64
+	switch typ.OID {
+	case pgtype.VarcharOID, pgtype.BPCharOID:
+		if typmod >= 4 {
+			maxLen = sql.NullInt64{Int64: typmod - 4, Valid: true}
+		}
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID:
+		precision = sql.NullInt64{Int64: int64(typ.Size) * 8, Valid: true}
+		scale = sql.NullInt64{Valid: true}
+	case pgtype.Float4OID:
+		precision = sql.NullInt64{Int64: 24, Valid: true}
+	case pgtype.Float8OID:
+		precision = sql.NullInt64{Int64: 53, Valid: true}
+	case pgtype.NumericOID:
+		if typmod >= 4 {
+			precision = sql.NullInt64{Int64: (typmod - 4) >> 16, Valid: true}
+			scale = sql.NullInt64{Int64: (typmod - 4) & 0xffff, Valid: true}
+		}
+	case pgtype.DateOID:
+		dtPrecision = sql.NullInt64{Valid: true}
+	case pgtype.TimeOID, pgtype.TimestampOID, pgtype.TimestamptzOID:
+		dtPrecision = sql.NullInt64{Int64: 6, Valid: true}
+	}
+	isNullable, updatable := "YES", "YES"
+	if notNull {
+		isNullable = "NO"
+	}
+	if rel.kind == "v" {
+		updatable = "NO"
+	}
+	exec(`INSERT INTO information_schema.columns (table_catalog, table_schema, table_name, column_name,
+		ordinal_position, column_default, is_nullable, data_type, character_maximum_length, numeric_precision,
+		numeric_scale, datetime_precision, udt_catalog, udt_name, is_identity, identity_generation, is_updatable)
+		VALUES (?, 'public', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbname, rel.name, col.name, attnum, col.dflt,
+		isNullable, formatType(typ.OID, -1), maxLen, precision, scale, dtPrecision, dbname, typ.Name, identity,
+		identityGen, updatable)
+}
+
+func fillConstraint(exec func(string, ...any), dbname, table, name, kind string, cols []string) {
+	exec(`INSERT OR IGNORE INTO information_schema.table_constraints (constraint_catalog, constraint_schema,
+		constraint_name, table_catalog, table_schema, table_name, constraint_type)
+		VALUES (?, 'public', ?, ?, 'public', ?, ?)`, dbname, name, dbname, table, kind)
+	for i, col := range cols {
+		var position sql.NullInt64
+		if kind == "FOREIGN KEY" {
+			position = sql.NullInt64{Int64: int64(i + 1), Valid: true}
+		}
+		exec(`INSERT OR IGNORE INTO information_schema.key_column_usage (constraint_catalog, constraint_schema,
+			constraint_name, table_catalog, table_schema, table_name, column_name, ordinal_position,
+			position_in_unique_constraint) VALUES (?, 'public', ?, ?, 'public', ?, ?, ?, ?)`, dbname, name, dbname,
+			table, col, i+1, position)
+	}
+}
+
+// sqlTypeNames are the names format_type() gives types, where they aren't the types' own names
+var sqlTypeNames = map[uint32]string{
+	pgtype.Int8OID: "bigint", pgtype.Int4OID: "integer", pgtype.Int2OID: "smallint",
+	pgtype.Float8OID: "double precision", pgtype.Float4OID: "real", pgtype.BoolOID: "boolean",
+	pgtype.VarcharOID: "character varying", pgtype.BPCharOID: "character",
+	pgtype.TimestamptzOID: "timestamp with time zone", pgtype.TimestampOID: "timestamp without time zone",
+	pgtype.TimeOID: "time without time zone",
+}
+
+/*
+formatType() returns the SQL name of a type, with its modifier (if it has one), as Postgres' format_type() does.
+*/
+func formatType(oid uint32, typmod int64) string {
+	t := typeForOID(oid)
+	if t.Name == "unknown" {
+		return "???"
+	}
+	name, ok := sqlTypeNames[oid]
+	if !ok {
+		name = t.Name
+	}
+	if typmod < 4 {
+		return name
+	}
+	switch oid {
+	case pgtype.VarcharOID, pgtype.BPCharOID:
+		return fmt.Sprintf("%s(%d)", name, typmod-4)
+	case pgtype.NumericOID:
+		return fmt.Sprintf("%s(%d,%d)", name, (typmod-4)>>16, (typmod-4)&0xffff)
+	}
+	return name
+}
+
+/*
+declTypmod() returns the Postgres type modifier for a declared column type: the length of a varchar(n) or char(n), or
+the precision and scale of a numeric(p,s).
+*/
+func declTypmod(decl string, t *PgType) int64 {
+	open, close := strings.IndexByte(decl, '('), strings.IndexByte(decl, ')')
+	if open < 0 || close < open {
+		return -1
+	}
+	args := strings.Split(decl[open+1:close], ",")
+	nums := make([]int64, len(args))
+	for i, arg := range args {
+		n, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 32)
+		if err != nil || n < 0 {
+			return -1
+		}
+		nums[i] = n
+	}
+	switch t.OID {
+	case pgtype.VarcharOID, pgtype.BPCharOID:
+		return nums[0] + 4
+	case pgtype.NumericOID:
+		scale := int64(0)
+		if len(nums) > 1 {
+			scale = nums[1]
+		}
+		return (nums[0]<<16 | scale) + 4
+	}
+	return -1
+}
+
+/*
+typeCategory() returns the pg_type.typcategory of a type.
+*/
+func typeCategory(t *PgType) string {
+	switch t.OID {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		return "N"
+	case pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID:
+		return "S"
+	case pgtype.BoolOID:
+		return "B"
+	case pgtype.DateOID, pgtype.TimeOID, pgtype.TimestampOID, pgtype.TimestamptzOID:
+		return "D"
+	case pgtype.IntervalOID:
+		return "T"
+	}
+	return "U"
+}
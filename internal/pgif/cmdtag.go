@@ -0,0 +1,130 @@
+package pgif
+
+import (
+	"database/sql"
+	"strconv"
+)
+
+/*
+stmtInfo describes what kind of statement a query is, which decides whether we run it with Exec (and report the rows
+it affected) or with Query (and report the rows it returned), and what CommandComplete tag the client gets.
+*/
+type stmtInfo struct {
+	// Command is the command name used in the tag, e.g. "INSERT" or "CREATE TABLE"
+	Command     string
+	ReturnsRows bool
+	// CountsRows is set for commands whose tag ends with a row count
+	CountsRows bool
+	// Savepoint is set for ROLLBACK TO SAVEPOINT, which doesn't end the transaction
+	Savepoint bool
+}
+
+/*
+tag() builds the CommandComplete tag for the statement, given the number of rows it affected or returned. INSERT tags
+carry an OID (always 0 in modern Postgres) before the count.
+*/
+func (info stmtInfo) tag(n int64) []byte {
+	switch {
+	case info.Command == "INSERT":
+		return []byte("INSERT 0 " + strconv.FormatInt(n, 10))
+	case info.CountsRows:
+		return []byte(info.Command + " " + strconv.FormatInt(n, 10))
+	default:
+		return []byte(info.Command)
+	}
+}
+
+/*
+rowsAffected() returns the row count to report for a statement run through Exec. Sqlite's changes() count is left
+over from the last DML statement, so it's only meaningful for INSERT, UPDATE, and DELETE.
+*/
+func (info stmtInfo) rowsAffected(res sql.Result) int64 {
+	if !info.CountsRows || res == nil {
+		return 0
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// objectKinds are the words that can follow CREATE/DROP/ALTER and name the kind of object, in Postgres' tags
+var objectKinds = map[string]bool{
+	"TABLE": true, "INDEX": true, "VIEW": true, "TRIGGER": true, "SCHEMA": true, "DATABASE": true,
+	"SEQUENCE": true, "FUNCTION": true, "TYPE": true, "EXTENSION": true, "ROLE": true, "USER": true,
+}
+
+/*
+classifyStmt() works out what kind of statement a (single) query is from its leading keywords. Anything we don't
+recognize is assumed to possibly return rows, and tagged with its first keyword.
+*/
+func classifyStmt(query string) stmtInfo {
+	toks := significant(tokenizeSQL(query))
+	i := 0
+	for i < len(toks) && toks[i].isOp("(") {
+		i++
+	}
+	if i >= len(toks) {
+		return stmtInfo{}
+	}
+	verb := toks[i].upper()
+	if verb == "WITH" {
+		// the statement's verb is the first top-level keyword after the common table expressions
+		depth := 0
+		for i++; i < len(toks); i++ {
+			if toks[i].isOp("(") {
+				depth++
+			} else if toks[i].isOp(")") {
+				depth--
+			} else if depth == 0 {
+				if kw := toks[i].upper(); kw == "SELECT" || kw == "VALUES" || kw == "INSERT" || kw == "REPLACE" ||
+					kw == "UPDATE" || kw == "DELETE" {
+					verb = kw
+					break
+				}
+			}
+		}
+	}
+	returning := false
+	for _, tok := range toks[i:] {
+		if tok.is("RETURNING") {
+			returning = true
+			break
+		}
+	}
+
+	switch verb {
+	case "SELECT", "VALUES", "TABLE":
+		return stmtInfo{Command: "SELECT", ReturnsRows: true, CountsRows: true}
+	case "INSERT", "REPLACE":
+		return stmtInfo{Command: "INSERT", ReturnsRows: returning, CountsRows: true}
+	case "UPDATE", "DELETE":
+		return stmtInfo{Command: verb, ReturnsRows: returning, CountsRows: true}
+	case "BEGIN", "START":
+		return stmtInfo{Command: "BEGIN"}
+	case "COMMIT", "END":
+		return stmtInfo{Command: "COMMIT"}
+	case "ROLLBACK", "ABORT":
+		for _, tok := range toks[i:] {
+			if tok.is("TO") {
+				return stmtInfo{Command: "ROLLBACK", Savepoint: true}
+			}
+		}
+		return stmtInfo{Command: "ROLLBACK"}
+	case "SAVEPOINT", "RELEASE", "LISTEN", "UNLISTEN", "NOTIFY", "VACUUM", "ANALYZE", "REINDEX", "ATTACH", "DETACH":
+		return stmtInfo{Command: verb}
+	case "CREATE", "DROP", "ALTER":
+		// skip modifiers (CREATE UNIQUE INDEX, CREATE TEMP TABLE, CREATE VIRTUAL TABLE, ...) to find the object kind
+		for j := i + 1; j < len(toks) && j <= i+3; j++ {
+			if kind := toks[j].upper(); objectKinds[kind] {
+				return stmtInfo{Command: verb + " " + kind}
+			}
+		}
+		return stmtInfo{Command: verb}
+	case "":
+		return stmtInfo{ReturnsRows: true}
+	default:
+		return stmtInfo{Command: verb, ReturnsRows: true}
+	}
+}
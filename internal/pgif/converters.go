@@ -2,98 +2,683 @@ package pgif
 
 import (
 	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgtype"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 )
 
 /*
-Helper function to convert Sqlite types. Note that we only support bigint, 64-bit floats, text, and bytea fields.
-// TODO -- support bool and datetime as derived data types?
-Notes:
-  - Dates are sent back in CCYY-MM-DD with a column length of 4
-  - Timestamps are sent back as CCYY-MM-DD HH:mm:SS-zz (e.g., 2004-10-19 03:23:54-05) with a column length of 8
-  - Booleans are 't' or 'f' with a column length of 1
+getPgTypeFromSqliteType() and getPgTypeFromDeclType() return the OID a column is sent as, going by its declared type
+(see the type registry in types.go). Columns with no declared type are text.
 */
 func getPgTypeFromSqliteType(col *sql.ColumnType) uint32 {
-	strn := strings.ToLower(col.DatabaseTypeName())
-	if strn == "integer" || strn == "int" || strn == "tinyint" || strn == "smallint" || strn == "mediumint" || strn == "bigint" || strn == "unsigned big int" || strn == "int2" || strn == "int8" {
+	return getPgTypeFromDeclType(col.DatabaseTypeName())
+}
+
+func getPgTypeFromDeclType(decltype string) uint32 {
+	return columnType(decltype, nil).OID
+}
+
+/*
+scanRow() scans the row that rows is currently positioned on.
+*/
+func scanRow(rows *sql.Rows, ncols int) ([]any, error) {
+	refs := make([]any, ncols)
+	vals := make([]any, ncols)
+	for i := range refs {
+		refs[i] = &vals[i]
+	}
+	if err := rows.Scan(refs...); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+/*
+valueEncoding holds the settings that decide how values are sent: what to do with values that don't fit their column's
+type, and the session's time zone, which timestamptz values are shown in.
+*/
+type valueEncoding struct {
+	invalid InvalidValuePolicy
+	loc     *time.Location
+}
+
+/*
+encodePgRow() converts a scanned row into a DataRow, encoding each column as its type in the format the client asked
+for in Bind (see formatCode()).
+*/
+func encodePgRow(vals []any, cols []resultCol, formats []bool, enc valueEncoding) (*pgproto3.DataRow, error) {
+	pgrow := pgproto3.DataRow{
+		Values: make([][]byte, len(vals)),
+	}
+	for i, val := range vals {
+		data, err := encodeValue(cols[i].Type, cols[i].Name, val, formatCode(formats, i), enc)
+		if err != nil {
+			return nil, err
+		}
+		pgrow.Values[i] = data
+	}
+	return &pgrow, nil
+}
+
+/*
+encodeValue() encodes a value from the named column as its type, dealing with values that don't fit the type according
+to enc.invalid.
+*/
+func encodeValue(t *PgType, name string, val any, format int16, enc valueEncoding) ([]byte, error) {
+	if t.OID == pgtype.TimestamptzOID && enc.loc != nil && format == 0 {
+		if tm, err := toTime(val); err == nil {
+			val = tm.In(enc.loc)
+		}
+	}
+	data, err := t.encode(val, format)
+	if err == nil {
+		return data, nil
+	}
+	switch {
+	case enc.invalid == InvalidValueNull:
+		return nil, nil
+	case format == 1:
+		return nil, newPgError("22P03", "cannot send value of column %q in binary format: %s", name, err.Error())
+	case enc.invalid == InvalidValueError:
+		return nil, newPgError("22P02", "invalid value in column %q of type %s: %s", name, t.Name, err.Error())
+	}
+	return rawText(val), nil
+}
+
+/*
+scanPgRow() converts the row that rows is currently positioned on into a DataRow.
+*/
+func scanPgRow(rows *sql.Rows, cols []resultCol, formats []bool, enc valueEncoding) (*pgproto3.DataRow, error) {
+	vals, err := scanRow(rows, len(cols))
+	if err != nil {
+		return nil, err
+	}
+	return encodePgRow(vals, cols, formats, enc)
+}
+
+/*
+encodeTextValue() converts a single value scanned from Sqlite into the PG text representation of the column's type, the
+way Postgres itself would print it. A nil return is a SQL NULL. Sqlite will store anything in any column, so a value
+may not be convertible to its column's type at all, which is an error (see BackendConfig.InvalidValues).
+*/
+func encodeTextValue(val any, pgtyp uint32) ([]byte, error) {
+	if val == nil {
+		return nil, nil
+	}
+	switch pgtyp {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID:
+		i, err := toInt64(val)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, i, 10), nil
+	case pgtype.Float4OID:
+		f, err := toFloat64(val)
+		if err != nil {
+			return nil, err
+		}
+		return formatFloat(f, 32), nil
+	case pgtype.Float8OID:
+		f, err := toFloat64(val)
+		if err != nil {
+			return nil, err
+		}
+		return formatFloat(f, 64), nil
+	case pgtype.NumericOID:
+		switch v := val.(type) {
+		case int64:
+			return strconv.AppendInt(nil, v, 10), nil
+		case float64:
+			if math.IsNaN(v) {
+				return []byte("NaN"), nil
+			}
+			if math.IsInf(v, 0) {
+				return nil, fmt.Errorf("cannot convert %v to numeric", v)
+			}
+			return strconv.AppendFloat(nil, v, 'f', -1, 64), nil
+		}
+		var n pgtype.Numeric
+		if err := n.Set(toSettable(val)); err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimSpace(fmt.Sprint(toSettable(val)))), nil
+	case pgtype.BoolOID:
+		b, ok := toBool(val)
+		if !ok {
+			return nil, fmt.Errorf("cannot convert %v to boolean", val)
+		}
+		if b {
+			return []byte("t"), nil
+		}
+		return []byte("f"), nil
+	case pgtype.ByteaOID:
+		var data []byte
+		switch v := val.(type) {
+		case []byte:
+			data = v
+		case string:
+			data = []byte(v)
+		default:
+			data = rawText(val)
+		}
+		buf := make([]byte, 2+hex.EncodedLen(len(data)))
+		copy(buf, `\x`)
+		hex.Encode(buf[2:], data)
+		return buf, nil
+	case pgtype.DateOID:
+		t, err := toTime(val)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(t.Format("2006-01-02")), nil
+	case pgtype.TimeOID:
+		t, err := toTimeOfDay(val)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(t.Format("15:04:05.999999")), nil
+	case pgtype.TimestampOID:
+		t, err := toTime(val)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(t.Format("2006-01-02 15:04:05.999999")), nil
+	case pgtype.TimestamptzOID:
+		t, err := toTime(val)
+		if err != nil {
+			return nil, err
+		}
+		return formatTimestamptz(t), nil
+	case pgtype.UUIDOID:
+		var u pgtype.UUID
+		if err := u.Set(toSettable(val)); err != nil {
+			return nil, err
+		}
+		return u.EncodeText(nil, nil)
+	}
+	return rawText(val), nil
+}
+
+/*
+rawText() is the text for a value as it is, regardless of its column's type.
+*/
+func rawText(val any) []byte {
+	switch v := val.(type) {
+	case nil:
+		return nil
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	case int64:
+		return strconv.AppendInt(nil, v, 10)
+	case float64:
+		return formatFloat(v, 64)
+	case bool:
+		if v {
+			return []byte("t")
+		}
+		return []byte("f")
+	case time.Time:
+		return formatTimestamptz(v)
+	}
+	return []byte(fmt.Sprint(val))
+}
+
+/*
+formatFloat() prints a float the way Postgres does: the shortest text that reads back as the same value, switching to
+exponent form for very large and very small magnitudes.
+*/
+func formatFloat(f float64, bits int) []byte {
+	switch {
+	case math.IsNaN(f):
+		return []byte("NaN")
+	case math.IsInf(f, 1):
+		return []byte("Infinity")
+	case math.IsInf(f, -1):
+		return []byte("-Infinity")
+	}
+	// Postgres uses exponent form once the exponent reaches the type's guaranteed decimal digits (FLT_DIG / DBL_DIG)
+	maxExp := 15
+	if bits == 32 {
+		maxExp = 6
+	}
+	exp := 0
+	if f != 0 {
+		exp = int(math.Floor(math.Log10(math.Abs(f))))
+		// Log10 can be out by one right at a power of ten, so check against the exponent strconv gives
+		e := strconv.FormatFloat(f, 'e', -1, bits)
+		if n, err := strconv.Atoi(e[strings.IndexByte(e, 'e')+1:]); err == nil {
+			exp = n
+		}
+	}
+	if exp < -4 || exp >= maxExp {
+		return strconv.AppendFloat(nil, f, 'e', -1, bits)
+	}
+	return strconv.AppendFloat(nil, f, 'f', -1, bits)
+}
+
+/*
+formatTimestamptz() prints a time in ISO form with its UTC offset, as "2004-10-19 10:23:54.5+02" (or "+05:30" for
+offsets that aren't whole hours).
+*/
+func formatTimestamptz(t time.Time) []byte {
+	buf := []byte(t.Format("2006-01-02 15:04:05.999999"))
+	_, offset := t.Zone()
+	sign := byte('+')
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	buf = append(buf, sign)
+	buf = append(buf, fmt.Sprintf("%02d", offset/3600)...)
+	if mins := offset % 3600 / 60; mins != 0 {
+		buf = append(buf, fmt.Sprintf(":%02d", mins)...)
+	}
+	return buf
+}
+
+/*
+decodeTextValue() converts a PG text-format value into something Sqlite will store sensibly for a column of the given
+PG type. Most values can be passed through as strings and left to Sqlite's type affinity; booleans and bytea are the
+exceptions, since Sqlite has no way to recognize 't' or '\x0102' for what they are.
+*/
+func decodeTextValue(val string, pgtyp uint32) any {
+	switch pgtyp {
+	case pgtype.BoolOID:
+		if b, ok := parseBool(val); ok {
+			if b {
+				return int64(1)
+			}
+			return int64(0)
+		}
+	case pgtype.ByteaOID:
+		if strings.HasPrefix(val, `\x`) {
+			if b, err := hex.DecodeString(val[2:]); err == nil {
+				return b
+			}
+		}
+		return []byte(val)
+	}
+	return val
+}
+
+/*
+paramType() maps the type a client gave for a parameter onto the handful of types we convert values for.
+*/
+func paramType(oid uint32) uint32 {
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
 		return pgtype.Int8OID
-	} else if strn == "float" || strn == "real" || strn == "double" || strn == "double precision" || strings.HasPrefix(strn, "decimal") {
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
 		return pgtype.Float8OID
-	} else if strn == "blob" {
-		return pgtype.ByteaOID
-	} else if strn == "datetime" {
+	case pgtype.TimestampOID:
 		return pgtype.TimestamptzOID
-	} else if strn == "boolean" {
-		return pgtype.BoolOID
-	} else if strn == "date" {
-		return pgtype.DateOID
 	}
-	return pgtype.TextOID
+	return oid
 }
 
-func convertRowsToPgRows(rows *sql.Rows, cols []*sql.ColumnType) ([]*pgproto3.DataRow, error) {
-	datarows := make([]*pgproto3.DataRow, 0)
+/*
+decodeParam() converts a parameter value from Bind (in text or binary format) into a value to bind to Sqlite. Numbers
+are bound as numbers, so that they compare properly with numeric columns; a nil value is a SQL NULL.
+*/
+func decodeParam(data []byte, format int16, oid uint32) (any, error) {
+	if data == nil {
+		return nil, nil
+	}
+	if format == 1 {
+		val, err := decodeBinaryValue(data, oid)
+		if err != nil {
+			return nil, newPgError("22P03", "incorrect binary data format in bind parameter")
+		}
+		return val, nil
+	}
+	typ := paramType(oid)
+	switch typ {
+	case pgtype.Int8OID:
+		i, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, newPgError("22P02", "invalid input syntax for type bigint: %q", string(data))
+		}
+		return i, nil
+	case pgtype.Float8OID:
+		f, err := parseFloat(string(data))
+		if err != nil {
+			return nil, newPgError("22P02", "invalid input syntax for type double precision: %q", string(data))
+		}
+		return f, nil
+	case pgtype.BoolOID:
+		if _, ok := parseBool(string(data)); !ok {
+			return nil, newPgError("22P02", "invalid input syntax for type boolean: %q", string(data))
+		}
+	}
+	return decodeTextValue(string(data), typ), nil
+}
 
-	for rows.Next() {
-		refs := make([]any, len(cols))
-		vals := make([]any, len(cols))
-		for i, _ := range refs {
-			refs[i] = &vals[i]
+func parseBool(val string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "t", "true", "y", "yes", "on", "1":
+		return true, true
+	case "f", "false", "n", "no", "off", "0":
+		return false, true
+	}
+	return false, false
+}
+
+func isTruthy(val string) bool {
+	b, _ := parseBool(val)
+	return b
+}
+
+// Postgres binary dates and timestamps are relative to 2000-01-01
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+/*
+floorDiv() divides, rounding down rather than towards zero, so that times before the epoch fall in the right day or
+second.
+*/
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+var errBadBinaryLength = errors.New("unexpected length for binary value")
+
+/*
+encodeBinaryValue() converts a value scanned from Sqlite into PG binary format for the given PG type.
+*/
+func encodeBinaryValue(val any, pgtyp uint32) ([]byte, error) {
+	if val == nil {
+		return nil, nil
+	}
+	switch pgtyp {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID:
+		i, err := toInt64(val)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case pgtyp == pgtype.Int8OID:
+			return binary.BigEndian.AppendUint64(nil, uint64(i)), nil
+		case pgtyp == pgtype.Int4OID && i >= math.MinInt32 && i <= math.MaxInt32:
+			return binary.BigEndian.AppendUint32(nil, uint32(int32(i))), nil
+		case pgtyp == pgtype.Int2OID && i >= math.MinInt16 && i <= math.MaxInt16:
+			return binary.BigEndian.AppendUint16(nil, uint16(int16(i))), nil
 		}
-		err := rows.Scan(refs...)
+		return nil, fmt.Errorf("%d is out of range", i)
+	case pgtype.Float4OID:
+		f, err := toFloat64(val)
 		if err != nil {
-			return datarows, err
+			return nil, err
 		}
-		pgrow := pgproto3.DataRow{
-			Values: make([][]byte, len(vals)),
+		return binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(f))), nil
+	case pgtype.Float8OID:
+		f, err := toFloat64(val)
+		if err != nil {
+			return nil, err
 		}
-		for i, _ := range vals {
-			if vals[i] == nil {
-				pgrow.Values[i] = nil
-				continue
-			}
-			pgtyp := getPgTypeFromSqliteType(cols[i])
-			if pgtyp == pgtype.Int8OID {
-				v := vals[i].(int64)
-				pgrow.Values[i] = []byte(fmt.Sprintf("%d", v))
-			} else if pgtyp == pgtype.Float8OID {
-				v := vals[i].(float64)
-				pgrow.Values[i] = []byte(fmt.Sprintf("%f", v))
-			} else if pgtyp == pgtype.ByteaOID {
-				pgrow.Values[i] = []byte(fmt.Sprint(vals[i]))
-			} else {
-				pgrow.Values[i] = []byte(fmt.Sprint(vals[i]))
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(f)), nil
+	case pgtype.BoolOID:
+		if b, ok := toBool(val); ok {
+			if b {
+				return []byte{1}, nil
 			}
+			return []byte{0}, nil
+		}
+		return nil, fmt.Errorf("cannot convert %v to boolean", val)
+	case pgtype.DateOID:
+		t, err := toTime(val)
+		if err != nil {
+			return nil, err
+		}
+		days := floorDiv(t.Unix()-pgEpoch.Unix(), 24*60*60)
+		if days < math.MinInt32 || days > math.MaxInt32 {
+			return nil, fmt.Errorf("date %s is out of range", t.Format("2006-01-02"))
+		}
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(days))), nil
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		t, err := toTime(val)
+		if err != nil {
+			return nil, err
+		}
+		us := (t.Unix()-pgEpoch.Unix())*1e6 + int64(t.Nanosecond()/1e3)
+		return binary.BigEndian.AppendUint64(nil, uint64(us)), nil
+	case pgtype.NumericOID:
+		var n pgtype.Numeric
+		if err := n.Set(toSettable(val)); err != nil {
+			return nil, err
+		}
+		return n.EncodeBinary(nil, nil)
+	case pgtype.UUIDOID:
+		var u pgtype.UUID
+		if err := u.Set(toSettable(val)); err != nil {
+			return nil, err
 		}
-		datarows = append(datarows, &pgrow)
+		return u.EncodeBinary(nil, nil)
+	case pgtype.ByteaOID:
+		switch v := val.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			return []byte(v), nil
+		}
+	}
+	// text and anything else we don't have a binary form for are sent as their text
+	return encodeTextValue(val, pgtyp)
+}
+
+/*
+toSettable() turns the []byte Sqlite returns for text into a string, which is what pgtype's Set() expects for text
+input (it takes a []byte to be the raw binary value).
+*/
+func toSettable(val any) any {
+	if b, ok := val.([]byte); ok {
+		return string(b)
+	}
+	return val
+}
+
+/*
+decodeBinaryValue() converts a PG binary-format value into a Go value suitable for binding to a Sqlite statement.
+Integer and float widths are taken from the length of the data, since clients may send an int4 for an int8 column.
+*/
+func decodeBinaryValue(data []byte, pgtyp uint32) (any, error) {
+	switch pgtyp {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID:
+		switch len(data) {
+		case 2:
+			return int64(int16(binary.BigEndian.Uint16(data))), nil
+		case 4:
+			return int64(int32(binary.BigEndian.Uint32(data))), nil
+		case 8:
+			return int64(binary.BigEndian.Uint64(data)), nil
+		}
+		return nil, errBadBinaryLength
+	case pgtype.Float4OID, pgtype.Float8OID:
+		switch len(data) {
+		case 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+		case 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+		}
+		return nil, errBadBinaryLength
+	case pgtype.BoolOID:
+		if len(data) != 1 {
+			return nil, errBadBinaryLength
+		}
+		return int64(data[0]), nil
+	case pgtype.DateOID:
+		if len(data) != 4 {
+			return nil, errBadBinaryLength
+		}
+		days := int32(binary.BigEndian.Uint32(data))
+		return pgEpoch.AddDate(0, 0, int(days)).Format("2006-01-02"), nil
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		if len(data) != 8 {
+			return nil, errBadBinaryLength
+		}
+		us := int64(binary.BigEndian.Uint64(data))
+		sec := floorDiv(us, 1e6)
+		return time.Unix(pgEpoch.Unix()+sec, (us-sec*1e6)*1e3).UTC(), nil
+	case pgtype.NumericOID:
+		// numerics are bound as text, so that Sqlite can decide whether they fit in an integer or a real
+		var n pgtype.Numeric
+		if err := n.DecodeBinary(nil, data); err != nil {
+			return nil, err
+		}
+		txt, err := n.EncodeText(nil, nil)
+		return string(txt), err
+	case pgtype.UUIDOID:
+		var u pgtype.UUID
+		if err := u.DecodeBinary(nil, data); err != nil {
+			return nil, err
+		}
+		txt, err := u.EncodeText(nil, nil)
+		return string(txt), err
+	case pgtype.ByteaOID:
+		return append([]byte{}, data...), nil
 	}
-	return datarows, nil
+	return string(data), nil
 }
 
-func convertColTypesToPgRowDescriptions(cols []*sql.ColumnType) *pgproto3.RowDescription {
-	descs := &pgproto3.RowDescription{}
-	for _, col := range cols {
-		typ := getPgTypeFromSqliteType(col)
-		fd := pgproto3.FieldDescription{
-			Name:                 []byte(col.Name()),
-			TableOID:             0,
-			TableAttributeNumber: 0,
-			DataTypeOID:          typ,
-			DataTypeSize:         -1,
-			TypeModifier:         -1,
-			Format:               0,
+func toInt64(val any) (int64, error) {
+	switch v := val.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, fmt.Errorf("%v is not an integer", v)
+		}
+		return int64(v), nil
+	case bool:
+		if v {
+			return 1, nil
 		}
-		if typ == pgtype.Int8OID || typ == pgtype.Float8OID {
-			fd.DataTypeSize = 8
-			fd.Format = 0
-		} else if typ == pgtype.ByteaOID {
-			fd.Format = 1
+		return 0, nil
+	case []byte:
+		return strconv.ParseInt(strings.TrimSpace(string(v)), 10, 64)
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	}
+	return 0, fmt.Errorf("cannot convert %v to integer", val)
+}
+
+func toFloat64(val any) (float64, error) {
+	switch v := val.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case []byte:
+		return parseFloat(string(v))
+	case string:
+		return parseFloat(v)
+	}
+	return 0, fmt.Errorf("cannot convert %v to float", val)
+}
+
+/*
+parseFloat() parses a float, accepting the spellings Postgres uses for the special values.
+*/
+func parseFloat(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	switch strings.ToLower(s) {
+	case "nan":
+		return math.NaN(), nil
+	case "infinity", "+infinity", "inf", "+inf":
+		return math.Inf(1), nil
+	case "-infinity", "-inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func toBool(val any) (bool, bool) {
+	switch v := val.(type) {
+	case bool:
+		return v, true
+	case int64:
+		return v != 0, true
+	case float64:
+		return v != 0, true
+	case []byte:
+		return parseBool(string(v))
+	case string:
+		return parseBool(v)
+	}
+	return false, false
+}
+
+// Layouts Sqlite (and the go-sqlite3 driver) commonly use for dates and times stored as text
+var sqliteTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func toTime(val any) (time.Time, error) {
+	switch v := val.(type) {
+	case time.Time:
+		return v, nil
+	case int64:
+		return time.Unix(v, 0).UTC(), nil
+	case float64:
+		// Sqlite julian day numbers
+		return time.UnixMilli(int64((v - 2440587.5) * 86400000)).UTC(), nil
+	case []byte:
+		return parseSqliteTime(string(v))
+	case string:
+		return parseSqliteTime(v)
+	}
+	return time.Time{}, fmt.Errorf("cannot convert %v to time", val)
+}
+
+/*
+toTimeOfDay() converts a value from a time column, which Sqlite keeps as text such as "12:34:56" (or as a full
+timestamp, of which we take the time).
+*/
+func toTimeOfDay(val any) (time.Time, error) {
+	var s string
+	switch v := val.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return toTime(val)
+	}
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"15:04:05.999999999", "15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
 		}
+	}
+	return parseSqliteTime(s)
+}
 
-		descs.Fields = append(descs.Fields, fd)
+func parseSqliteTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range sqliteTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
 	}
-	return descs
+	return time.Time{}, fmt.Errorf("cannot parse %q as a time", s)
 }
@@ -0,0 +1,1122 @@
+package pgif
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/deck"
+	"github.com/highgrav/rhizome/internal/constants"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"io"
+	"strings"
+)
+
+/*
+Support for COPY ... FROM STDIN and COPY ... TO STDOUT (see https://www.postgresql.org/docs/current/sql-copy.html).
+Copying to or from server-side files or programs is deliberately unsupported, since that would let a tenant reach
+outside its own database.
+
+The flow for COPY FROM STDIN is:
+FE: Query
+BE: CopyInResponse
+FE: CopyData*, then CopyDone OR CopyFail
+BE: CommandComplete OR ErrorResponse, then ReadyForQuery
+
+The flow for COPY TO STDOUT is:
+FE: Query
+BE: CopyOutResponse, CopyData*, CopyDone, CommandComplete (or ErrorResponse), ReadyForQuery
+*/
+
+type copyFormat int
+
+const (
+	copyFormatText copyFormat = iota
+	copyFormatCSV
+	copyFormatBinary
+)
+
+// Flush copy-out data to the client once this much has been buffered
+const copyOutFlushSize = 64 * 1024
+
+var copyBinarySignature = []byte("PGCOPY\n\377\r\n\000")
+
+type copyStmt struct {
+	Table        string
+	TableSchema  string
+	TableName    string
+	Columns      []string
+	Query        string
+	FromStdin    bool
+	Format       copyFormat
+	Delimiter    byte
+	Null         string
+	NullSet      bool
+	Header       bool
+	Quote        byte
+	Escape       byte
+	ForceQuote   []string
+	ForceAll     bool
+	ForceNotNull []string
+	ForceNull    []string
+}
+
+/*
+parseCopyStmt() parses both the current option-list syntax and the pre-9.0 syntax still sent by some clients
+(e.g., "COPY t FROM STDIN WITH CSV HEADER").
+*/
+func parseCopyStmt(query string) (*copyStmt, error) {
+	toks := significant(tokenizeSQL(query))
+	for len(toks) > 0 && toks[len(toks)-1].isOp(";") {
+		toks = toks[:len(toks)-1]
+	}
+	if len(toks) < 4 || !toks[0].is("COPY") {
+		return nil, newPgError("42601", "invalid COPY statement")
+	}
+	stmt := &copyStmt{}
+	i := 1
+	if toks[i].is("BINARY") {
+		stmt.Format = copyFormatBinary
+		i++
+	}
+	if toks[i].isOp("(") {
+		// COPY (query) TO ...
+		end := matchParen(toks, i)
+		if end < 0 {
+			return nil, newPgError("42601", "unterminated subquery in COPY")
+		}
+		stmt.Query = strings.TrimSpace(query[toks[i].Pos+1 : toks[end].Pos])
+		i = end + 1
+	} else {
+		if toks[i].Kind != tokWord && toks[i].Kind != tokQuotedIdent {
+			return nil, newPgError("42601", "expected table name in COPY")
+		}
+		stmt.TableName = toks[i].ident()
+		stmt.Table = quoteIdent(stmt.TableName)
+		i++
+		if i+1 < len(toks) && toks[i].isOp(".") {
+			stmt.TableSchema = stmt.TableName
+			stmt.TableName = toks[i+1].ident()
+			stmt.Table = quoteIdent(stmt.TableSchema) + "." + quoteIdent(stmt.TableName)
+			i += 2
+		}
+		if i < len(toks) && toks[i].isOp("(") {
+			end := matchParen(toks, i)
+			if end < 0 {
+				return nil, newPgError("42601", "unterminated column list in COPY")
+			}
+			stmt.Columns = identList(toks[i+1 : end])
+			i = end + 1
+		}
+	}
+	if i >= len(toks) {
+		return nil, newPgError("42601", "expected FROM or TO in COPY")
+	}
+	switch toks[i].upper() {
+	case "FROM":
+		stmt.FromStdin = true
+	case "TO":
+	default:
+		return nil, newPgError("42601", "expected FROM or TO in COPY")
+	}
+	i++
+	if i >= len(toks) || !(toks[i].is("STDIN") || toks[i].is("STDOUT")) {
+		return nil, newPgError("0A000", "COPY only supports STDIN and STDOUT")
+	}
+	if stmt.FromStdin && stmt.Query != "" {
+		return nil, newPgError("42601", "COPY FROM cannot be used with a query")
+	}
+	i++
+
+	if err := stmt.parseOptions(toks[i:]); err != nil {
+		return nil, err
+	}
+	return stmt, stmt.setDefaults()
+}
+
+func (stmt *copyStmt) parseOptions(toks []sqlToken) error {
+	i := 0
+	if i < len(toks) && toks[i].is("WITH") {
+		i++
+	}
+	if i < len(toks) && toks[i].isOp("(") {
+		end := matchParen(toks, i)
+		if end != len(toks)-1 {
+			return newPgError("42601", "invalid COPY option list")
+		}
+		for _, opt := range splitOnCommas(toks[i+1 : end]) {
+			if len(opt) == 0 {
+				continue
+			}
+			if err := stmt.setOption(strings.ToUpper(opt[0].Text), opt[1:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// legacy options
+	for i < len(toks) {
+		kw := toks[i].upper()
+		i++
+		var arg []sqlToken
+		switch kw {
+		case "BINARY":
+			kw = "FORMAT"
+			arg = []sqlToken{{Kind: tokWord, Text: "binary"}}
+		case "CSV":
+			kw = "FORMAT"
+			arg = []sqlToken{{Kind: tokWord, Text: "csv"}}
+		case "HEADER":
+		case "DELIMITER", "NULL", "QUOTE", "ESCAPE":
+			if i < len(toks) && toks[i].is("AS") {
+				i++
+			}
+			if i >= len(toks) {
+				return newPgError("42601", "missing value for COPY option %s", kw)
+			}
+			arg = toks[i : i+1]
+			i++
+		case "FORCE":
+			if i < len(toks) && toks[i].is("QUOTE") {
+				kw = "FORCE_QUOTE"
+				i++
+			} else if i+1 < len(toks) && toks[i].is("NOT") && toks[i+1].is("NULL") {
+				kw = "FORCE_NOT_NULL"
+				i += 2
+			} else {
+				return newPgError("42601", "invalid FORCE option in COPY")
+			}
+			start := i
+			for i < len(toks) && (toks[i].isOp(",") || toks[i].isOp("*") || (toks[i].Kind != tokOp && !isCopyLegacyKeyword(toks[i]))) {
+				i++
+			}
+			arg = toks[start:i]
+		case "WHERE":
+			return newPgError("0A000", "COPY FROM ... WHERE is not supported")
+		default:
+			return newPgError("42601", "unrecognized COPY option %q", kw)
+		}
+		if err := stmt.setOption(kw, arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isCopyLegacyKeyword(tok sqlToken) bool {
+	switch tok.upper() {
+	case "BINARY", "CSV", "HEADER", "DELIMITER", "NULL", "QUOTE", "ESCAPE", "FORCE":
+		return true
+	}
+	return false
+}
+
+func (stmt *copyStmt) setOption(name string, arg []sqlToken) error {
+	val := ""
+	if len(arg) > 0 {
+		val = arg[0].unquote()
+	}
+	switch name {
+	case "FORMAT":
+		switch strings.ToLower(val) {
+		case "text":
+			stmt.Format = copyFormatText
+		case "csv":
+			stmt.Format = copyFormatCSV
+		case "binary":
+			stmt.Format = copyFormatBinary
+		default:
+			return newPgError("22023", "COPY format %q not recognized", val)
+		}
+	case "HEADER":
+		stmt.Header = len(arg) == 0 || isTruthy(val)
+	case "DELIMITER":
+		if len(val) != 1 {
+			return newPgError("22023", "COPY delimiter must be a single one-byte character")
+		}
+		stmt.Delimiter = val[0]
+	case "NULL":
+		stmt.Null = val
+		stmt.NullSet = true
+		if len(arg) == 0 {
+			return newPgError("42601", "COPY NULL requires a value")
+		}
+	case "QUOTE":
+		if len(val) != 1 {
+			return newPgError("22023", "COPY quote must be a single one-byte character")
+		}
+		stmt.Quote = val[0]
+	case "ESCAPE":
+		if len(val) != 1 {
+			return newPgError("22023", "COPY escape must be a single one-byte character")
+		}
+		stmt.Escape = val[0]
+	case "FORCE_QUOTE":
+		if len(arg) == 1 && arg[0].isOp("*") {
+			stmt.ForceAll = true
+		} else {
+			stmt.ForceQuote = identList(stripParens(arg))
+		}
+	case "FORCE_NOT_NULL":
+		stmt.ForceNotNull = identList(stripParens(arg))
+	case "FORCE_NULL":
+		stmt.ForceNull = identList(stripParens(arg))
+	case "ENCODING":
+		if !strings.EqualFold(strings.ReplaceAll(val, "-", ""), "UTF8") {
+			return newPgError("0A000", "COPY only supports UTF8 encoding")
+		}
+	case "FREEZE", "OIDS":
+		// accepted and ignored
+	default:
+		return newPgError("42601", "option %q not recognized", strings.ToLower(name))
+	}
+	return nil
+}
+
+func (stmt *copyStmt) setDefaults() error {
+	if stmt.Delimiter == 0 {
+		stmt.Delimiter = '\t'
+		if stmt.Format == copyFormatCSV {
+			stmt.Delimiter = ','
+		}
+	}
+	if !stmt.NullSet && stmt.Format == copyFormatText {
+		stmt.Null = `\N`
+	}
+	if stmt.Quote == 0 {
+		stmt.Quote = '"'
+	}
+	if stmt.Escape == 0 {
+		stmt.Escape = stmt.Quote
+	}
+	if stmt.Format != copyFormatCSV && (stmt.ForceAll || len(stmt.ForceQuote) > 0 || len(stmt.ForceNull) > 0 || len(stmt.ForceNotNull) > 0) {
+		return newPgError("0A000", "COPY FORCE options are only available in CSV mode")
+	}
+	if stmt.Format == copyFormatBinary && stmt.Header {
+		return newPgError("0A000", "cannot specify HEADER in BINARY mode")
+	}
+	return nil
+}
+
+func (stmt *copyStmt) formatCode() int16 {
+	if stmt.Format == copyFormatBinary {
+		return 1
+	}
+	return 0
+}
+
+func stripParens(toks []sqlToken) []sqlToken {
+	if len(toks) >= 2 && toks[0].isOp("(") && toks[len(toks)-1].isOp(")") {
+		return toks[1 : len(toks)-1]
+	}
+	return toks
+}
+
+func splitOnCommas(toks []sqlToken) [][]sqlToken {
+	parts := make([][]sqlToken, 0)
+	depth := 0
+	start := 0
+	for i, tok := range toks {
+		if tok.isOp("(") {
+			depth++
+		} else if tok.isOp(")") {
+			depth--
+		} else if tok.isOp(",") && depth == 0 {
+			parts = append(parts, toks[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, toks[start:])
+}
+
+func identList(toks []sqlToken) []string {
+	names := make([]string, 0)
+	for _, tok := range toks {
+		if tok.Kind == tokWord || tok.Kind == tokQuotedIdent {
+			names = append(names, tok.ident())
+		}
+	}
+	return names
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+handleCopy() runs a COPY statement received in a simple Query message.
+*/
+func (rz *RhizomeBackend) handleCopy(query string) error {
+	stmt, err := parseCopyStmt(query)
+	if err != nil {
+		return writePgMsgs(rz.out,
+			toErrorResponse(err),
+			rz.readyForQuery(),
+		)
+	}
+	if rz.txStatus == txFailed {
+		return writePgMsgs(rz.out,
+			toErrorResponse(newPgError("25P02", "current transaction is aborted, commands ignored until end of transaction block")),
+			rz.readyForQuery(),
+		)
+	}
+	ctx, done := rz.startQuery()
+	defer done()
+	if stmt.FromStdin {
+		return rz.handleCopyIn(ctx, stmt)
+	}
+	return rz.handleCopyOut(ctx, stmt)
+}
+
+type copyColumn struct {
+	Name   string
+	PgType uint32
+}
+
+/*
+copyTargetColumns() resolves the columns (and their PG types) that a COPY FROM will insert into.
+*/
+func (rz *RhizomeBackend) copyTargetColumns(ctx context.Context, stmt *copyStmt) ([]copyColumn, error) {
+	all, err := rz.tableColumns(ctx, stmt.TableSchema, stmt.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(all) == 0 {
+		return nil, newPgError("42P01", "relation %q does not exist", stmt.TableName)
+	}
+	if len(stmt.Columns) == 0 {
+		return all, nil
+	}
+	cols := make([]copyColumn, 0, len(stmt.Columns))
+	for _, name := range stmt.Columns {
+		found := false
+		for _, col := range all {
+			if strings.EqualFold(col.Name, name) {
+				cols = append(cols, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, newPgError("42703", "column %q of relation %q does not exist", name, stmt.TableName)
+		}
+	}
+	return cols, nil
+}
+
+/*
+tableColumns() returns the columns of a table, in order, or nothing if there's no such table.
+*/
+func (rz *RhizomeBackend) tableColumns(ctx context.Context, schema, table string) ([]copyColumn, error) {
+	pragma := "PRAGMA table_info(" + quoteIdent(table) + ")"
+	if schema != "" {
+		pragma = "PRAGMA " + quoteIdent(schema) + ".table_info(" + quoteIdent(table) + ")"
+	}
+	rows, err := rz.querier().QueryContext(ctx, pragma)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := make([]copyColumn, 0)
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, decltype string
+		var dflt any
+		if err := rows.Scan(&cid, &name, &decltype, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		all = append(all, copyColumn{Name: name, PgType: getPgTypeFromDeclType(decltype)})
+	}
+	return all, rows.Err()
+}
+
+func (rz *RhizomeBackend) handleCopyIn(ctx context.Context, stmt *copyStmt) error {
+	cols, err := rz.copyTargetColumns(ctx, stmt)
+	if err != nil {
+		return writePgMsgs(rz.out,
+			toErrorResponse(err),
+			rz.readyForQuery(),
+		)
+	}
+
+	// Outside of a transaction block the COPY runs in a transaction of its own; inside one, a failed COPY fails the
+	// whole transaction, as in Postgres.
+	var tx *sql.Tx
+	q := rz.querier()
+	if rz.txStatus == txIdle {
+		tx, err = rz.sqlConn.BeginTx(ctx, nil)
+		if err != nil {
+			return writePgMsgs(rz.out,
+				toErrorResponse(err),
+				rz.readyForQuery(),
+			)
+		}
+		q = tx
+	}
+	abort := func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		} else {
+			rz.txStatus = txFailed
+		}
+	}
+	names := make([]string, len(cols))
+	placeholders := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = quoteIdent(col.Name)
+		placeholders[i] = "?"
+	}
+	ins, err := q.PrepareContext(ctx, "INSERT INTO "+stmt.Table+" ("+strings.Join(names, ", ")+") VALUES ("+strings.Join(placeholders, ", ")+")")
+	if err != nil {
+		abort()
+		return writePgMsgs(rz.out,
+			toErrorResponse(err),
+			rz.readyForQuery(),
+		)
+	}
+	defer ins.Close()
+
+	resp := &pgproto3.CopyInResponse{
+		OverallFormat:     byte(stmt.formatCode()),
+		ColumnFormatCodes: make([]uint16, len(cols)),
+	}
+	for i := range resp.ColumnFormatCodes {
+		resp.ColumnFormatCodes[i] = uint16(stmt.formatCode())
+	}
+	if err := writePgMsgs(rz.out, resp); err != nil {
+		abort()
+		return err
+	}
+	// the client won't start sending data until it has seen CopyInResponse
+	if err := rz.out.Flush(); err != nil {
+		abort()
+		return err
+	}
+
+	src := &copyInReader{rz: rz}
+	reader := newCopyRecordReader(stmt, bufio.NewReader(src), cols)
+	var count int64
+	for {
+		rec, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && len(rec) != len(cols) {
+			if len(rec) > len(cols) {
+				err = newPgError("22P04", "extra data after last expected column")
+			} else {
+				err = newPgError("22P04", "missing data for column %q", cols[len(rec)].Name)
+			}
+		}
+		if err == nil {
+			_, err = ins.ExecContext(ctx, rec...)
+		}
+		if err != nil {
+			abort()
+			if src.connErr != nil {
+				return src.connErr
+			}
+			err = rz.queryError(ctx, err)
+			if _, ok := err.(*pgError); !ok {
+				err = fmt.Errorf("COPY %s, line %d: %w", stmt.TableName, count+1, err)
+			}
+			deck.Errorf("COPY FROM STDIN failed on db %s: %s", rz.db.ID, err.Error())
+			return writePgMsgs(rz.out,
+				toErrorResponse(err),
+				rz.readyForQuery(),
+			)
+		}
+		count++
+	}
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return writePgMsgs(rz.out,
+				toErrorResponse(err),
+				rz.readyForQuery(),
+			)
+		}
+		rz.endTxChanges()
+	}
+	if rz.cfg.LogLevel >= constants.LogLevelDebug {
+		deck.Infof("copied %d rows into %s on db %s", count, stmt.TableName, rz.db.ID)
+	}
+	return writePgMsgs(rz.out,
+		&pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("COPY %d", count))},
+		rz.readyForQuery(),
+	)
+}
+
+func (rz *RhizomeBackend) handleCopyOut(ctx context.Context, stmt *copyStmt) error {
+	query := stmt.Query
+	if query == "" {
+		sel := "*"
+		if len(stmt.Columns) > 0 {
+			quoted := make([]string, len(stmt.Columns))
+			for i, c := range stmt.Columns {
+				quoted[i] = quoteIdent(c)
+			}
+			sel = strings.Join(quoted, ", ")
+		}
+		query = "SELECT " + sel + " FROM " + stmt.Table
+	}
+	rows, err := rz.querier().QueryContext(ctx, query)
+	if err != nil {
+		return writePgMsgs(rz.out,
+			toErrorResponse(err),
+			rz.readyForQuery(),
+		)
+	}
+	defer rows.Close()
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return writePgMsgs(rz.out,
+			toErrorResponse(err),
+			rz.readyForQuery(),
+		)
+	}
+	cols := make([]copyColumn, len(colTypes))
+	resp := &pgproto3.CopyOutResponse{
+		OverallFormat:     byte(stmt.formatCode()),
+		ColumnFormatCodes: make([]uint16, len(colTypes)),
+	}
+	for i, ct := range colTypes {
+		cols[i] = copyColumn{Name: ct.Name(), PgType: getPgTypeFromSqliteType(ct)}
+		resp.ColumnFormatCodes[i] = uint16(stmt.formatCode())
+	}
+	buf := resp.Encode(nil)
+	w := &copyRecordWriter{stmt: stmt, cols: cols, enc: rz.valueEncoding()}
+	if hdr := w.header(); hdr != nil {
+		buf = (&pgproto3.CopyData{Data: hdr}).Encode(buf)
+	}
+
+	var count int64
+	vals := make([]any, len(cols))
+	refs := make([]any, len(cols))
+	for i := range refs {
+		refs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(refs...); err != nil {
+			return rz.abortCopyOut(buf, err)
+		}
+		data, err := w.encode(vals)
+		if err != nil {
+			return rz.abortCopyOut(buf, err)
+		}
+		buf = (&pgproto3.CopyData{Data: data}).Encode(buf)
+		count++
+		if len(buf) >= copyOutFlushSize {
+			if _, err := rz.out.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return rz.abortCopyOut(buf, rz.queryError(ctx, err))
+	}
+	if stmt.Format == copyFormatBinary {
+		buf = (&pgproto3.CopyData{Data: []byte{0xff, 0xff}}).Encode(buf)
+	}
+	buf = (&pgproto3.CopyDone{}).Encode(buf)
+	buf = (&pgproto3.CommandComplete{CommandTag: []byte(fmt.Sprintf("COPY %d", count))}).Encode(buf)
+	buf = rz.readyForQuery().Encode(buf)
+	_, err = rz.out.Write(buf)
+	return err
+}
+
+func (rz *RhizomeBackend) abortCopyOut(buf []byte, err error) error {
+	deck.Errorf("COPY TO STDOUT failed on db %s: %s", rz.db.ID, err.Error())
+	if rz.txStatus != txIdle {
+		rz.txStatus = txFailed
+	}
+	buf = toErrorResponse(err).Encode(buf)
+	buf = rz.readyForQuery().Encode(buf)
+	_, werr := rz.out.Write(buf)
+	return werr
+}
+
+/*
+copyInReader presents the CopyData messages sent by the client as a single byte stream. CopyDone ends the stream
+and CopyFail turns into an error; Flush and Sync are ignored while copying, as in Postgres.
+*/
+type copyInReader struct {
+	rz      *RhizomeBackend
+	buf     []byte
+	done    bool
+	connErr error
+}
+
+func (cr *copyInReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		msg, err := cr.rz.backend.Receive()
+		if err != nil {
+			cr.connErr = err
+			return 0, err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			cr.buf = append(cr.buf[:0], msg.Data...)
+		case *pgproto3.CopyDone:
+			cr.done = true
+		case *pgproto3.CopyFail:
+			cr.done = true
+			return 0, newPgError("57014", "COPY from stdin failed: %s", msg.Message)
+		case *pgproto3.Flush, *pgproto3.Sync:
+		default:
+			cr.done = true
+			return 0, newPgError("08P01", "unexpected message type %T during COPY from stdin", msg)
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+type copyRecordReader interface {
+	next() ([]any, error)
+}
+
+func newCopyRecordReader(stmt *copyStmt, r *bufio.Reader, cols []copyColumn) copyRecordReader {
+	switch stmt.Format {
+	case copyFormatBinary:
+		return &copyBinaryReader{r: r, cols: cols}
+	case copyFormatCSV:
+		return &copyCSVReader{r: r, stmt: stmt, cols: cols, skipHeader: stmt.Header}
+	}
+	return &copyTextReader{r: r, stmt: stmt, cols: cols, skipHeader: stmt.Header}
+}
+
+/*
+copyTextReader reads Postgres' default tab-delimited format, where backslash escapes are used for special
+characters and \N is NULL.
+*/
+type copyTextReader struct {
+	r          *bufio.Reader
+	stmt       *copyStmt
+	cols       []copyColumn
+	skipHeader bool
+}
+
+func (cr *copyTextReader) next() ([]any, error) {
+	line, err := cr.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return nil, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == `\.` {
+		return nil, io.EOF
+	}
+	if cr.skipHeader {
+		cr.skipHeader = false
+		return cr.next()
+	}
+	rec := make([]any, 0, len(cr.cols))
+	start := 0
+	for i := 0; i <= len(line); i++ {
+		if i < len(line) && line[i] == '\\' {
+			i++
+			continue
+		}
+		if i == len(line) || line[i] == cr.stmt.Delimiter {
+			raw := line[start:i]
+			start = i + 1
+			if raw == cr.stmt.Null {
+				rec = append(rec, nil)
+				continue
+			}
+			rec = append(rec, decodeTextValue(unescapeCopyText(raw), cr.colType(len(rec))))
+		}
+	}
+	return rec, nil
+}
+
+func (cr *copyTextReader) colType(i int) uint32 {
+	if i < len(cr.cols) {
+		return cr.cols[i].PgType
+	}
+	return pgtype.TextOID
+}
+
+func unescapeCopyText(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i == len(s)-1 {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		c = s[i]
+		switch {
+		case c >= '0' && c <= '7':
+			v := 0
+			j := 0
+			for ; j < 3 && i+j < len(s) && s[i+j] >= '0' && s[i+j] <= '7'; j++ {
+				v = v*8 + int(s[i+j]-'0')
+			}
+			sb.WriteByte(byte(v))
+			i += j - 1
+		case c == 'x' && i+1 < len(s) && isHexDigit(s[i+1]):
+			v := 0
+			j := 1
+			for ; j < 3 && i+j < len(s) && isHexDigit(s[i+j]); j++ {
+				v = v*16 + hexValue(s[i+j])
+			}
+			sb.WriteByte(byte(v))
+			i += j - 1
+		default:
+			sb.WriteString(unescapeBackslashes(`\` + string(c)))
+		}
+	}
+	return sb.String()
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	}
+	return int(c-'A') + 10
+}
+
+/*
+copyCSVReader reads CSV data as Postgres writes it: an unquoted empty value (or whatever NULL is set to) is NULL,
+while a quoted empty value is an empty string. Quoted values may span lines.
+*/
+type copyCSVReader struct {
+	r          *bufio.Reader
+	stmt       *copyStmt
+	cols       []copyColumn
+	skipHeader bool
+}
+
+func (cr *copyCSVReader) next() ([]any, error) {
+	rec := make([]any, 0, len(cr.cols))
+	var field bytes.Buffer
+	quoted := false
+	inQuotes := false
+	sawData := false
+
+	finishField := func() {
+		name := ""
+		if len(rec) < len(cr.cols) {
+			name = cr.cols[len(rec)].Name
+		}
+		val := field.String()
+		isNull := val == cr.stmt.Null && (!quoted || containsFold(cr.stmt.ForceNull, name))
+		if isNull && !quoted && containsFold(cr.stmt.ForceNotNull, name) {
+			isNull = false
+		}
+		if isNull {
+			rec = append(rec, nil)
+		} else {
+			typ := uint32(pgtype.TextOID)
+			if len(rec) < len(cr.cols) {
+				typ = cr.cols[len(rec)].PgType
+			}
+			rec = append(rec, decodeTextValue(val, typ))
+		}
+		field.Reset()
+		quoted = false
+	}
+
+	for {
+		b, err := cr.r.ReadByte()
+		if err == io.EOF {
+			if inQuotes {
+				return nil, newPgError("22P04", "unterminated CSV quoted field")
+			}
+			if !sawData {
+				return nil, io.EOF
+			}
+			finishField()
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sawData = true
+		if inQuotes {
+			if b == cr.stmt.Escape && cr.stmt.Escape != cr.stmt.Quote {
+				nb, err := cr.r.ReadByte()
+				if err == nil && (nb == cr.stmt.Quote || nb == cr.stmt.Escape) {
+					field.WriteByte(nb)
+					continue
+				}
+				if err == nil {
+					_ = cr.r.UnreadByte()
+				}
+				field.WriteByte(b)
+				continue
+			}
+			if b == cr.stmt.Quote {
+				nb, err := cr.r.ReadByte()
+				if err == nil && nb == cr.stmt.Quote && cr.stmt.Escape == cr.stmt.Quote {
+					field.WriteByte(nb)
+					continue
+				}
+				if err == nil {
+					_ = cr.r.UnreadByte()
+				}
+				inQuotes = false
+				continue
+			}
+			field.WriteByte(b)
+			continue
+		}
+		if b == cr.stmt.Quote {
+			inQuotes = true
+			quoted = true
+			continue
+		}
+		if b == cr.stmt.Delimiter {
+			finishField()
+			continue
+		}
+		if b == '\r' || b == '\n' {
+			if b == '\r' {
+				if nb, err := cr.r.ReadByte(); err == nil && nb != '\n' {
+					_ = cr.r.UnreadByte()
+				}
+			}
+			finishField()
+			break
+		}
+		field.WriteByte(b)
+	}
+
+	if len(rec) == 1 && rec[0] == `\.` {
+		return nil, io.EOF
+	}
+	if cr.skipHeader {
+		cr.skipHeader = false
+		return cr.next()
+	}
+	return rec, nil
+}
+
+/*
+copyBinaryReader reads Postgres' binary COPY format: a fixed signature and header, followed by tuples of
+length-prefixed values, and a trailer of -1.
+*/
+type copyBinaryReader struct {
+	r       *bufio.Reader
+	cols    []copyColumn
+	started bool
+}
+
+func (cr *copyBinaryReader) next() ([]any, error) {
+	if !cr.started {
+		sig := make([]byte, len(copyBinarySignature))
+		if _, err := io.ReadFull(cr.r, sig); err != nil {
+			return nil, newPgError("22P04", "COPY file signature not recognized")
+		}
+		if !bytes.Equal(sig, copyBinarySignature) {
+			return nil, newPgError("22P04", "COPY file signature not recognized")
+		}
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(cr.r, hdr); err != nil {
+			return nil, newPgError("22P04", "invalid COPY file header (missing length)")
+		}
+		extLen := binary.BigEndian.Uint32(hdr[4:])
+		if _, err := cr.r.Discard(int(extLen)); err != nil {
+			return nil, newPgError("22P04", "invalid COPY file header (wrong length)")
+		}
+		cr.started = true
+	}
+	var count int16
+	if err := binary.Read(cr.r, binary.BigEndian, &count); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, newPgError("22P04", "unexpected EOF in COPY data")
+	}
+	if count == -1 {
+		// trailer; drain anything left so we see CopyDone
+		_, _ = io.Copy(io.Discard, cr.r)
+		return nil, io.EOF
+	}
+	if int(count) != len(cr.cols) {
+		return nil, newPgError("22P04", "row field count is %d, expected %d", count, len(cr.cols))
+	}
+	rec := make([]any, count)
+	for i := range rec {
+		var size int32
+		if err := binary.Read(cr.r, binary.BigEndian, &size); err != nil {
+			return nil, newPgError("22P04", "unexpected EOF in COPY data")
+		}
+		if size == -1 {
+			continue
+		}
+		if size < 0 {
+			return nil, newPgError("22P04", "invalid field size")
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(cr.r, data); err != nil {
+			return nil, newPgError("22P04", "unexpected EOF in COPY data")
+		}
+		v, err := decodeBinaryValue(data, cr.cols[i].PgType)
+		if err != nil {
+			return nil, newPgError("22P03", "invalid binary value for column %q: %s", cr.cols[i].Name, err.Error())
+		}
+		rec[i] = v
+	}
+	return rec, nil
+}
+
+/*
+copyRecordWriter formats rows for COPY TO STDOUT.
+*/
+type copyRecordWriter struct {
+	stmt *copyStmt
+	cols []copyColumn
+	enc  valueEncoding
+}
+
+func (w *copyRecordWriter) header() []byte {
+	switch w.stmt.Format {
+	case copyFormatBinary:
+		hdr := append([]byte{}, copyBinarySignature...)
+		return append(hdr, 0, 0, 0, 0, 0, 0, 0, 0)
+	case copyFormatCSV:
+		if !w.stmt.Header {
+			return nil
+		}
+		vals := make([][]byte, len(w.cols))
+		for i, col := range w.cols {
+			vals[i] = []byte(col.Name)
+		}
+		return w.encodeCSV(vals, true)
+	}
+	if !w.stmt.Header {
+		return nil
+	}
+	vals := make([][]byte, len(w.cols))
+	for i, col := range w.cols {
+		vals[i] = []byte(col.Name)
+	}
+	return w.encodeText(vals)
+}
+
+func (w *copyRecordWriter) encode(vals []any) ([]byte, error) {
+	if w.stmt.Format == copyFormatBinary {
+		buf := make([]byte, 2, 64)
+		binary.BigEndian.PutUint16(buf, uint16(len(vals)))
+		for i, v := range vals {
+			data, err := encodeValue(typeForOID(w.cols[i].PgType), w.cols[i].Name, v, 1, w.enc)
+			if err != nil {
+				return nil, err
+			}
+			if data == nil {
+				buf = append(buf, 0xff, 0xff, 0xff, 0xff)
+				continue
+			}
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+			buf = append(buf, data...)
+		}
+		return buf, nil
+	}
+	encoded := make([][]byte, len(vals))
+	for i, v := range vals {
+		data, err := encodeValue(typeForOID(w.cols[i].PgType), w.cols[i].Name, v, 0, w.enc)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = data
+	}
+	if w.stmt.Format == copyFormatCSV {
+		return w.encodeCSV(encoded, false), nil
+	}
+	return w.encodeText(encoded), nil
+}
+
+func (w *copyRecordWriter) encodeText(vals [][]byte) []byte {
+	var buf bytes.Buffer
+	for i, v := range vals {
+		if i > 0 {
+			buf.WriteByte(w.stmt.Delimiter)
+		}
+		if v == nil {
+			buf.WriteString(w.stmt.Null)
+			continue
+		}
+		for _, c := range v {
+			switch c {
+			case '\\':
+				buf.WriteString(`\\`)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			case '\b':
+				buf.WriteString(`\b`)
+			case '\f':
+				buf.WriteString(`\f`)
+			case '\v':
+				buf.WriteString(`\v`)
+			default:
+				if c == w.stmt.Delimiter {
+					buf.WriteByte('\\')
+				}
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func (w *copyRecordWriter) encodeCSV(vals [][]byte, isHeader bool) []byte {
+	var buf bytes.Buffer
+	for i, v := range vals {
+		if i > 0 {
+			buf.WriteByte(w.stmt.Delimiter)
+		}
+		if v == nil {
+			buf.WriteString(w.stmt.Null)
+			continue
+		}
+		force := !isHeader && (w.stmt.ForceAll || containsFold(w.stmt.ForceQuote, w.cols[i].Name))
+		if !force && string(v) != w.stmt.Null && !bytes.ContainsAny(v, string([]byte{w.stmt.Delimiter, w.stmt.Quote, '\r', '\n'})) {
+			buf.Write(v)
+			continue
+		}
+		buf.WriteByte(w.stmt.Quote)
+		for _, c := range v {
+			if c == w.stmt.Quote || c == w.stmt.Escape {
+				buf.WriteByte(w.stmt.Escape)
+			}
+			buf.WriteByte(c)
+		}
+		buf.WriteByte(w.stmt.Quote)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
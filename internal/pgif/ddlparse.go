@@ -1,70 +1,146 @@
 package pgif
 
 import (
+	"github.com/alecthomas/participle/v2"
 	"github.com/alecthomas/participle/v2/lexer"
+	"strings"
 )
 
 /*
 These are definitions for basic meta-DDL parsing. Meta-DDL are statements within '[['...']]' tags, such as:
 [[CREATE DATABASE 'MyDatabase' AS 'My Personal Database' WITH NOCONFLICT;]]
 [[CREATE USER 'bob@example.com' WITH PWD 'some-password';]]
+[[ALTER USER 'bob@example.com' WITH PWD 'new-password';]]
 [[ADD USER 'bob@example.com' TO DB 'MyDatabase';]]
 [[REMOVE USER ' jane@example.com' FROM DB 'MyDatabase';]]
 [[DELETE USER 'jane@example.com';]]
 [[ADD RIGHT 'db::admin' TO 'bob@example.com' ON DB 'MyDatabase';]]
-*/
-
-type Boolean bool
+[[REMOVE RIGHT 'db::admin' FROM 'bob@example.com' ON DB 'MyDatabase';]]
 
-func (b *Boolean) Capture(values []string) error {
-	*b = values[0] == "TRUE"
-	return nil
-}
+Several statements may share a single set of tags, so long as they are separated by semicolons.
+*/
 
 var ddlLexer = lexer.MustSimple([]lexer.SimpleRule{
-	{`Keyword`, `(?i)\b([[|]]|CREATE|DATABASE|AS|WITH|NOCONFLICT|USER|ADD|RENOVE|DELETE|FROM|DB|RIGHT|TO|ON)\b`},
-	{`Ident`, `[a-zA-Z_][a-zA-Z0-9_]*`},
-	{`Number`, `[-+]?\d*\.?\d+([eE][-+]?\d+)?`},
-	{`String`, `'[^']*'|"[^"]*"`},
-	{`Operators`, `<>|!=|<=|>=|[-+*/%,.()=<>]`},
-	{"whitespace", `\s+`},
+	{Name: `Open`, Pattern: `\[\[`},
+	{Name: `Close`, Pattern: `\]\]`},
+	{Name: `Keyword`, Pattern: `(?i)\b(CREATE|ALTER|DATABASE|AS|WITH|NOCONFLICT|PWD|PASSWORD|USER|ADD|REMOVE|DELETE|DROP|FROM|DB|RIGHT|TO|ON)\b`},
+	{Name: `Ident`, Pattern: `[a-zA-Z_][a-zA-Z0-9_]*`},
+	{Name: `String`, Pattern: `'[^']*'|"[^"]*"`},
+	{Name: `Terminator`, Pattern: `;`},
+	{Name: "whitespace", Pattern: `\s+`},
 })
 
-/*
-var DdlParser = participle.MustBuild[Ddl](
+var ddlParser = participle.MustBuild[Ddl](
 	participle.Lexer(ddlLexer),
 	participle.Unquote("String"),
-	participle.CaseInsensitive("Keyword"))
-*/
-type Ddl struct {
-}
+	participle.CaseInsensitive("Keyword"),
+	participle.UseLookahead(2))
 
-type DdlValue struct {
-	Number  *float64 ` | @Number`
-	String  *string  ` | @String`
-	Boolean *Boolean ` | @("TRUE" | "FALSE")`
+type Ddl struct {
+	Stmts []*DdlStmt `parser:"'[[' ( @@ ';'* )+ ']]'"`
 }
 
 type DdlStmt struct {
+	CreateDB         *DdlStmtCreateDB         `parser:"@@"`
+	AddUser          *DdlStmtAddUser          `parser:"| @@"`
+	UpdateUser       *DdlStmtUpdateUser       `parser:"| @@"`
+	DeleteUser       *DdlStmtDeleteUser       `parser:"| @@"`
+	AddUserToDB      *DdlStmtAddUserToDB      `parser:"| @@"`
+	RemoveUserFromDB *DdlStmtRemoveUserFromDB `parser:"| @@"`
+	AddUserRight     *DdlStmtAddUserRight     `parser:"| @@"`
+	RemoveUserRight  *DdlStmtRemoveUserRight  `parser:"| @@"`
 }
 
 type DdlStmtCreateDB struct {
+	ID          string `parser:"'CREATE' 'DATABASE' @String"`
+	Description string `parser:"( 'AS' @String )?"`
+	NoConflict  bool   `parser:"( 'WITH' @'NOCONFLICT' )?"`
 }
 
 type DdlStmtDropDB struct {
 }
 
 type DdlStmtAddUser struct {
+	Username string `parser:"'CREATE' 'USER' @String"`
+	Password string `parser:"'WITH' ( 'PWD' | 'PASSWORD' ) @String"`
 }
 
 type DdlStmtUpdateUser struct {
+	Username string `parser:"'ALTER' 'USER' @String"`
+	Password string `parser:"'WITH' ( 'PWD' | 'PASSWORD' ) @String"`
 }
 
 type DdlStmtDeleteUser struct {
+	Username string `parser:"( 'DELETE' | 'DROP' ) 'USER' @String"`
+}
+
+type DdlStmtAddUserToDB struct {
+	Username string `parser:"'ADD' 'USER' @String"`
+	DB       string `parser:"'TO' 'DB' @String"`
+}
+
+type DdlStmtRemoveUserFromDB struct {
+	Username string `parser:"'REMOVE' 'USER' @String"`
+	DB       string `parser:"'FROM' 'DB' @String"`
 }
 
 type DdlStmtAddUserRight struct {
+	Right    string `parser:"'ADD' 'RIGHT' @String"`
+	Username string `parser:"'TO' @String"`
+	DB       string `parser:"'ON' 'DB' @String"`
 }
 
 type DdlStmtRemoveUserRight struct {
+	Right    string `parser:"'REMOVE' 'RIGHT' @String"`
+	Username string `parser:"'FROM' @String"`
+	DB       string `parser:"'ON' 'DB' @String"`
+}
+
+/*
+IsMetaDDL() reports whether a query string should be routed to the meta-DDL handler rather than to Sqlite.
+*/
+func IsMetaDDL(query string) bool {
+	return strings.HasPrefix(strings.TrimSpace(query), "[[")
+}
+
+/*
+ParseMetaDDL() parses a '[['...']]'-delimited block of meta-DDL statements. Quoted names are returned with any
+surrounding whitespace removed.
+*/
+func ParseMetaDDL(query string) (*Ddl, error) {
+	ddl, err := ddlParser.ParseString("", strings.TrimSpace(query))
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range ddl.Stmts {
+		stmt.trim()
+	}
+	return ddl, nil
+}
+
+func (stmt *DdlStmt) trim() {
+	switch {
+	case stmt.CreateDB != nil:
+		stmt.CreateDB.ID = strings.TrimSpace(stmt.CreateDB.ID)
+	case stmt.AddUser != nil:
+		stmt.AddUser.Username = strings.TrimSpace(stmt.AddUser.Username)
+	case stmt.UpdateUser != nil:
+		stmt.UpdateUser.Username = strings.TrimSpace(stmt.UpdateUser.Username)
+	case stmt.DeleteUser != nil:
+		stmt.DeleteUser.Username = strings.TrimSpace(stmt.DeleteUser.Username)
+	case stmt.AddUserToDB != nil:
+		stmt.AddUserToDB.Username = strings.TrimSpace(stmt.AddUserToDB.Username)
+		stmt.AddUserToDB.DB = strings.TrimSpace(stmt.AddUserToDB.DB)
+	case stmt.RemoveUserFromDB != nil:
+		stmt.RemoveUserFromDB.Username = strings.TrimSpace(stmt.RemoveUserFromDB.Username)
+		stmt.RemoveUserFromDB.DB = strings.TrimSpace(stmt.RemoveUserFromDB.DB)
+	case stmt.AddUserRight != nil:
+		stmt.AddUserRight.Right = strings.TrimSpace(stmt.AddUserRight.Right)
+		stmt.AddUserRight.Username = strings.TrimSpace(stmt.AddUserRight.Username)
+		stmt.AddUserRight.DB = strings.TrimSpace(stmt.AddUserRight.DB)
+	case stmt.RemoveUserRight != nil:
+		stmt.RemoveUserRight.Right = strings.TrimSpace(stmt.RemoveUserRight.Right)
+		stmt.RemoveUserRight.Username = strings.TrimSpace(stmt.RemoveUserRight.Username)
+		stmt.RemoveUserRight.DB = strings.TrimSpace(stmt.RemoveUserRight.DB)
+	}
 }
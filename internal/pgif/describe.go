@@ -0,0 +1,129 @@
+package pgif
+
+import (
+	"database/sql"
+	"github.com/jackc/pgproto3/v2"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+/*
+Describe support. Clients describe a statement (or portal) before executing it to learn the types of its parameters
+and result columns, which they need in order to decode the rows. Sqlite can tell us the result columns of a prepared
+statement without running it: the names, and the declared types of columns that come straight from a table, via
+sqlite3_column_decltype(). Columns computed by expressions have no declared type; a prepared statement describes them
+as text, but when we've already got a row in hand (simple queries) we type them by its values.
+*/
+
+// resultCol describes a single result column, and the PG type it's sent as
+type resultCol struct {
+	Name     string
+	DeclType string
+	Type     *PgType
+}
+
+func newResultCol(name, decltype string, sample any) resultCol {
+	return resultCol{Name: name, DeclType: decltype, Type: columnType(decltype, sample)}
+}
+
+/*
+resultCols() describes the result columns of a running query, typing any columns with no declared type by the values
+in sample (which may be nil).
+*/
+func resultCols(cts []*sql.ColumnType, sample []any) []resultCol {
+	cols := make([]resultCol, len(cts))
+	for i, ct := range cts {
+		var val any
+		if i < len(sample) {
+			val = sample[i]
+		}
+		cols[i] = newResultCol(ct.Name(), ct.DatabaseTypeName(), val)
+	}
+	return cols
+}
+
+/*
+describeStmt() returns the result columns of a query, and the number of parameter slots Sqlite gave it
+(sqlite3_bind_parameter_count()), without running it. It prepares the query again on the session's connection, since
+database/sql doesn't expose the driver statement behind a *sql.Stmt.
+*/
+func describeStmt(conn *sql.Conn, query string) ([]resultCol, int, error) {
+	var cols []resultCol
+	nslots := 0
+	err := conn.Raw(func(dc any) error {
+		sc, ok := dc.(*sqlite3.SQLiteConn)
+		if !ok {
+			return nil
+		}
+		ds, err := sc.Prepare(query)
+		if err != nil {
+			return err
+		}
+		defer ds.Close()
+		nslots = ds.NumInput()
+		// binding doesn't step the statement, so this runs nothing; it just gets us a SQLiteRows to ask about columns
+		dr, err := ds.Query(nil)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+		rows, ok := dr.(*sqlite3.SQLiteRows)
+		if !ok {
+			return nil
+		}
+		names, decltypes := rows.Columns(), rows.DeclTypes()
+		for i, name := range names {
+			cols = append(cols, newResultCol(name, decltypes[i], nil))
+		}
+		return nil
+	})
+	return cols, nslots, err
+}
+
+func newFieldDescription(name string, typ *PgType, format int16) pgproto3.FieldDescription {
+	return pgproto3.FieldDescription{
+		Name:         []byte(name),
+		DataTypeOID:  typ.OID,
+		DataTypeSize: typ.Size,
+		TypeModifier: -1,
+		Format:       format,
+	}
+}
+
+/*
+describeCols() builds the RowDescription for a statement's result columns, using the result format codes from Bind
+(none means all text, one applies to every column, otherwise there's one per column).
+*/
+func describeCols(cols []resultCol, formats []bool) *pgproto3.RowDescription {
+	desc := &pgproto3.RowDescription{Fields: make([]pgproto3.FieldDescription, 0, len(cols))}
+	for i, col := range cols {
+		desc.Fields = append(desc.Fields, newFieldDescription(col.Name, col.Type, formatCode(formats, i)))
+	}
+	return desc
+}
+
+/*
+formatCode() returns the format code (0 for text, 1 for binary) for the i'th value, given the format codes from a Bind
+message, which may be empty (all text), a single code for every value, or one code per value.
+*/
+func formatCode(formats []bool, i int) int16 {
+	switch {
+	case len(formats) == 1:
+		i = 0
+	case i >= len(formats):
+		return 0
+	}
+	if formats[i] {
+		return 1
+	}
+	return 0
+}
+
+/*
+rowDescription() returns the RowDescription for a statement, or NoData if it doesn't return rows.
+*/
+func (stmt *RhizomePreparedStatement) rowDescription(formats []bool) pgproto3.BackendMessage {
+	if !stmt.info.ReturnsRows || len(stmt.cols) == 0 {
+		return &pgproto3.NoData{}
+	}
+	return describeCols(stmt.cols, formats)
+}
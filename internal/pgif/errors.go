@@ -1,5 +1,62 @@
 package pgif
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgproto3/v2"
+)
 
 var ErrDBNotOpen = errors.New("database is not open")
+var ErrMetaDDLNotConfigured = errors.New("this meta-DDL command is not configured on this server")
+
+// errUnsupportedMessage is sent for protocol messages we don't handle (or don't expect at that point)
+var errUnsupportedMessage = newPgError("0A000", "unsupported option")
+
+/*
+pgError is an error that carries a Postgres SQLSTATE code (see https://www.postgresql.org/docs/current/errcodes-appendix.html),
+and optionally the other fields of an ErrorResponse.
+*/
+type pgError struct {
+	Code       string
+	Message    string
+	Detail     string
+	Hint       string
+	Schema     string
+	Table      string
+	Column     string
+	Constraint string
+}
+
+func (e *pgError) Error() string {
+	return e.Message
+}
+
+func newPgError(code, format string, args ...any) *pgError {
+	return &pgError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+/*
+toErrorResponse() converts an error into an ErrorResponse, using the SQLSTATE code (and other fields) if the error
+carries them or comes from Sqlite (see fromSqliteError()), and internal_error otherwise.
+*/
+func toErrorResponse(err error) *pgproto3.ErrorResponse {
+	resp := &pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                "XX000",
+		Message:             err.Error(),
+	}
+	if pgerr, ok := asPgError(err); ok {
+		resp.Code = pgerr.Code
+		resp.Detail = pgerr.Detail
+		resp.Hint = pgerr.Hint
+		resp.SchemaName = pgerr.Schema
+		resp.TableName = pgerr.Table
+		resp.ColumnName = pgerr.Column
+		resp.ConstraintName = pgerr.Constraint
+	}
+	return resp
+}
@@ -1,6 +1,10 @@
 package pgif
 
 import (
+	"errors"
+	"github.com/google/deck"
+	"github.com/highgrav/rhizome/internal/constants"
+	"github.com/highgrav/rhizome/internal/dbmgr"
 	"github.com/jackc/pgproto3/v2"
 )
 
@@ -9,37 +13,213 @@ type MetaCommandType string
 const (
 	MetaAddUserCmd          MetaCommandType = "adduser"
 	MetaDeleteUserCmd       MetaCommandType = "deluser"
+	MetaSetUserPwdCmd       MetaCommandType = "setpwd"
 	MetaAddUserToDbCmd      MetaCommandType = "dbadduser"
 	MetaRemoveUserFromDbCmd MetaCommandType = "dbremuser"
 	MetaAddUserRight        MetaCommandType = "adduserright"
 	MetaRemoveUserRight     MetaCommandType = "remuserright"
 )
 
-func (rz RhizomeBackend) handleBackupDb(msg *pgproto3.Query) error {
+/*
+handleMetaDDL() parses and runs a block of meta-DDL, sending a CommandComplete for each statement that succeeds.
+Execution stops at the first failing statement, which is reported as an ErrorResponse.
+*/
+func (rz *RhizomeBackend) handleMetaDDL(msg *pgproto3.Query) error {
+	if rz.cfg.LogLevel >= constants.LogLevelDebug {
+		deck.Infof("detected MetaDDL, rerouting...")
+	}
+	ddl, err := ParseMetaDDL(msg.String)
+	if err != nil {
+		return writePgMsgs(rz.out,
+			&pgproto3.ErrorResponse{
+				Severity: "ERROR",
+				Code:     "42601",
+				Message:  "invalid meta-DDL: " + err.Error(),
+			},
+			rz.readyForQuery(),
+		)
+	}
+	// every statement is checked before any of them runs
+	for _, stmt := range ddl.Stmts {
+		if !rz.metaDDLAllowed(stmt) {
+			return writePgMsgs(rz.out,
+				&pgproto3.ErrorResponse{
+					Severity: "ERROR",
+					Code:     "42501",
+					Message:  "permission denied to run meta-DDL" + stmt.scope(),
+				},
+				rz.readyForQuery(),
+			)
+		}
+	}
 
-	return nil
+	var buf []byte
+	for _, stmt := range ddl.Stmts {
+		var tag string
+		switch {
+		case stmt.CreateDB != nil:
+			tag, err = "CREATE DATABASE", rz.handleCreateDb(stmt.CreateDB)
+		case stmt.AddUser != nil:
+			tag, err = "CREATE USER", rz.handleAddUser(stmt.AddUser)
+		case stmt.UpdateUser != nil:
+			tag, err = "ALTER USER", rz.handleUpdateUser(stmt.UpdateUser)
+		case stmt.DeleteUser != nil:
+			tag, err = "DELETE USER", rz.handleDeleteUser(stmt.DeleteUser)
+		case stmt.AddUserToDB != nil:
+			tag, err = "ADD USER", rz.handleAddUserToDb(stmt.AddUserToDB)
+		case stmt.RemoveUserFromDB != nil:
+			tag, err = "REMOVE USER", rz.handleRemoveUserFromDb(stmt.RemoveUserFromDB)
+		case stmt.AddUserRight != nil:
+			tag, err = "ADD RIGHT", rz.handleAddUserRight(stmt.AddUserRight)
+		case stmt.RemoveUserRight != nil:
+			tag, err = "REMOVE RIGHT", rz.handleRemoveUserRight(stmt.RemoveUserRight)
+		default:
+			err = errors.New("unrecognized meta-DDL statement")
+		}
+		if err != nil {
+			deck.Errorf("meta-DDL %s failed: %s", tag, err.Error())
+			buf = (&pgproto3.ErrorResponse{
+				Severity: "ERROR",
+				Code:     metaDDLErrorCode(err),
+				Message:  err.Error(),
+			}).Encode(buf)
+			break
+		}
+		buf = (&pgproto3.CommandComplete{CommandTag: []byte(tag)}).Encode(buf)
+	}
+	buf = rz.readyForQuery().Encode(buf)
+	_, err = rz.out.Write(buf)
+	return err
 }
 
-func (rz RhizomeBackend) handleCreateDb(msg *pgproto3.Query) error {
-	return nil
+/*
+targetDB() returns the database a statement acts on, or "" if it acts on the whole server: creating databases, and
+creating, changing, or deleting users, who may belong to any database.
+*/
+func (stmt *DdlStmt) targetDB() string {
+	switch {
+	case stmt.AddUserToDB != nil:
+		return stmt.AddUserToDB.DB
+	case stmt.RemoveUserFromDB != nil:
+		return stmt.RemoveUserFromDB.DB
+	case stmt.AddUserRight != nil:
+		return stmt.AddUserRight.DB
+	case stmt.RemoveUserRight != nil:
+		return stmt.RemoveUserRight.DB
+	}
+	return ""
 }
 
-func (rz RhizomeBackend) handleAddUser(msg *pgproto3.Query) error {
-	return nil
+func (stmt *DdlStmt) scope() string {
+	if db := stmt.targetDB(); db != "" {
+		return " on database " + db
+	}
+	return " on the server"
 }
 
-func (rz RhizomeBackend) handleDeleteUser(msg *pgproto3.Query) error {
-	return nil
+/*
+metaDDLAllowed() reports whether the session's user may run a meta-DDL statement. Statements on the whole server need
+FnCheckServerAdmin to allow the user; statements on a single database need db::admin on that database (not the
+session's), through DFnCheckDBRight, unless the user is a server admin. Without either hook, nobody may run meta-DDL.
+*/
+func (rz *RhizomeBackend) metaDDLAllowed(stmt *DdlStmt) bool {
+	if rz.db == nil {
+		return false
+	}
+	username := rz.db.User
+	if fn := rz.dbmgr.Cfg.FnCheckServerAdmin; fn != nil {
+		ok, err := fn(username)
+		if err != nil {
+			deck.Errorf("cannot check whether user %s is a server admin: %s", username, err.Error())
+		} else if ok {
+			return true
+		}
+	}
+	db := stmt.targetDB()
+	if db == "" || rz.dbmgr.Cfg.DFnCheckDBRight == nil {
+		return false
+	}
+	// rights checks are never given a password (see dbmgr.FnCheckDBRight)
+	ok, err := rz.dbmgr.Cfg.DFnCheckDBRight(username, "", db, dbmgr.RightAdmin)
+	if err != nil {
+		deck.Errorf("cannot check right %s for user %s on db %s: %s", dbmgr.RightAdmin, username, db, err.Error())
+		return false
+	}
+	return ok
 }
 
-func (rz RhizomeBackend) handleUpdateUser(msg *pgproto3.Query) error {
-	return nil
+func metaDDLErrorCode(err error) string {
+	switch {
+	case errors.Is(err, dbmgr.ErrDBAlreadyExists):
+		// duplicate_database
+		return "42P04"
+	case errors.Is(err, dbmgr.ErrInvalidDBName):
+		// invalid_name
+		return "42602"
+	case errors.Is(err, ErrMetaDDLNotConfigured), errors.Is(err, dbmgr.ErrCannotCreateDB):
+		// feature_not_supported
+		return "0A000"
+	}
+	// internal_error
+	return "XX000"
 }
 
-func (rz RhizomeBackend) handleAddUserToDb(msg *pgproto3.Query) error {
+func (rz *RhizomeBackend) handleBackupDb(msg *pgproto3.Query) error {
+
 	return nil
 }
 
-func (rz RhizomeBackend) handleRemoveUserFromDb(msg *pgproto3.Query) error {
-	return nil
+func (rz *RhizomeBackend) handleCreateDb(stmt *DdlStmtCreateDB) error {
+	// the name is checked before anything looks for it on disk
+	if !dbmgr.IsValidDBName(stmt.ID) {
+		return dbmgr.ErrInvalidDBName
+	}
+	if stmt.NoConflict && rz.dbmgr.Exists(stmt.ID) {
+		return nil
+	}
+	if rz.cfg.LogLevel >= constants.LogLevelInformational {
+		deck.Infof("creating database %q (%q)", stmt.ID, stmt.Description)
+	}
+	return rz.dbmgr.Create(stmt.ID)
+}
+
+func (rz *RhizomeBackend) handleAddUser(stmt *DdlStmtAddUser) error {
+	if rz.dbmgr.Cfg.FnAddUser == nil {
+		return ErrMetaDDLNotConfigured
+	}
+	return rz.dbmgr.Cfg.FnAddUser(stmt.Username, stmt.Password)
+}
+
+func (rz *RhizomeBackend) handleDeleteUser(stmt *DdlStmtDeleteUser) error {
+	if rz.dbmgr.Cfg.FnDeleteUser == nil {
+		return ErrMetaDDLNotConfigured
+	}
+	return rz.dbmgr.Cfg.FnDeleteUser(stmt.Username)
+}
+
+func (rz *RhizomeBackend) handleUpdateUser(stmt *DdlStmtUpdateUser) error {
+	return rz.modifyUser(stmt.Username, MetaSetUserPwdCmd, "", stmt.Password)
+}
+
+func (rz *RhizomeBackend) handleAddUserToDb(stmt *DdlStmtAddUserToDB) error {
+	return rz.modifyUser(stmt.Username, MetaAddUserToDbCmd, stmt.DB)
+}
+
+func (rz *RhizomeBackend) handleRemoveUserFromDb(stmt *DdlStmtRemoveUserFromDB) error {
+	return rz.modifyUser(stmt.Username, MetaRemoveUserFromDbCmd, stmt.DB)
+}
+
+func (rz *RhizomeBackend) handleAddUserRight(stmt *DdlStmtAddUserRight) error {
+	return rz.modifyUser(stmt.Username, MetaAddUserRight, stmt.DB, stmt.Right)
+}
+
+func (rz *RhizomeBackend) handleRemoveUserRight(stmt *DdlStmtRemoveUserRight) error {
+	return rz.modifyUser(stmt.Username, MetaRemoveUserRight, stmt.DB, stmt.Right)
+}
+
+func (rz *RhizomeBackend) modifyUser(username string, action MetaCommandType, db string, args ...any) error {
+	if rz.dbmgr.Cfg.FnModifyUser == nil {
+		return ErrMetaDDLNotConfigured
+	}
+	return rz.dbmgr.Cfg.FnModifyUser(username, string(action), db, args...)
 }
@@ -0,0 +1,156 @@
+package pgif
+
+import (
+	"context"
+	"github.com/jackc/pgproto3/v2"
+)
+
+/*
+Simple queries with several statements. Clients (migration tools in particular) send whole scripts as a single Query
+message, and Postgres runs each statement in turn, sending each one's results, and stopping at the first error. Unless
+the script manages transactions itself, it all runs in one implicit transaction, so that an error part way through
+leaves nothing behind.
+
+We split the script with our own tokenizer, at the semicolons sqlite3_complete() would end a statement at.
+Statements are split one at a time, just before they run.
+*/
+
+/*
+splitFirstStmt() splits the first statement off a query at the first semicolon outside of strings, identifiers,
+comments, and trigger bodies, which follows the rules of sqlite3_complete().
+*/
+func splitFirstStmt(query string) (stmt, tail string) {
+	var prev []sqlToken
+	inTrigger, inBody := false, false
+	for _, tok := range tokenizeSQL(query) {
+		if tok.Kind == tokSpace || tok.Kind == tokComment {
+			continue
+		}
+		switch {
+		case tok.isOp(";"):
+			if !inBody {
+				return query[:tok.Pos+1], query[tok.Pos+1:]
+			}
+			if len(prev) > 0 && prev[len(prev)-1].is("END") {
+				inBody = false
+				return query[:tok.Pos+1], query[tok.Pos+1:]
+			}
+		case tok.is("TRIGGER") && isCreateTrigger(prev):
+			inTrigger = true
+		case tok.is("BEGIN") && inTrigger:
+			inBody = true
+		}
+		prev = append(prev, tok)
+	}
+	return query, ""
+}
+
+func isCreateTrigger(prev []sqlToken) bool {
+	switch {
+	case len(prev) == 1:
+		return prev[0].is("CREATE")
+	case len(prev) == 2:
+		return prev[0].is("CREATE") && (prev[1].is("TEMP") || prev[1].is("TEMPORARY"))
+	}
+	return false
+}
+
+/*
+handleMultiQuery() runs a simple query made up of several statements, the first of which has already been split off.
+*/
+func (rz *RhizomeBackend) handleMultiQuery(stmt, tail string) error {
+	ctx, done := rz.startQuery()
+	implicit := false
+	var err error
+	for {
+		if !isBlankSQL(stmt) {
+			if err = rz.runScriptStmt(ctx, stmt, &implicit); err != nil {
+				err = rz.queryError(ctx, err)
+				break
+			}
+		}
+		if isBlankSQL(tail) {
+			break
+		}
+		stmt, tail = splitFirstStmt(tail)
+	}
+	done()
+
+	var msgs []pgproto3.Message
+	if err != nil {
+		msgs = append(msgs, toErrorResponse(err))
+	}
+	if implicit {
+		end := "COMMIT"
+		if err != nil {
+			end = "ROLLBACK"
+		}
+		committed := err == nil
+		if _, endErr := rz.sqlConn.ExecContext(rz.ctx, end); endErr != nil {
+			committed = false
+			if err == nil {
+				msgs = append(msgs, toErrorResponse(endErr))
+			}
+			if !connAutoCommit(rz.sqlConn) {
+				_, _ = rz.sqlConn.ExecContext(rz.ctx, "ROLLBACK")
+			}
+		}
+		rz.endTx(committed)
+		rz.txStatus = txIdle
+	}
+	msgs = append(msgs, rz.readyForQuery())
+	return writePgMsgs(rz.out, msgs...)
+}
+
+/*
+runScriptStmt() runs one statement of a multi-statement query. Outside of a transaction block it opens the implicit
+transaction the rest of the script runs in; a BEGIN in the script turns that into an ordinary transaction block, and a
+COMMIT or ROLLBACK ends it (with the same warning Postgres gives).
+*/
+func (rz *RhizomeBackend) runScriptStmt(ctx context.Context, stmt string, implicit *bool) error {
+	if firstKeyword(stmt) == "COPY" {
+		return newPgError("0A000", "COPY is not supported in a query with several statements")
+	}
+	info := classifyStmt(stmt)
+	isEnd := info.Command == "COMMIT" || (info.Command == "ROLLBACK" && !info.Savepoint)
+	if !*implicit && rz.txStatus == txIdle && info.Command != "BEGIN" && !isEnd {
+		if _, err := rz.sqlConn.ExecContext(ctx, "BEGIN"); err != nil {
+			return err
+		}
+		*implicit = true
+	}
+
+	if *implicit {
+		switch {
+		case info.Command == "BEGIN":
+			*implicit = false
+			rz.txStatus = txInBlock
+			return writePgMsgs(rz.out, &pgproto3.CommandComplete{CommandTag: info.tag(0)})
+		case isEnd:
+			if _, err := rz.sqlConn.ExecContext(ctx, info.Command); err != nil {
+				return err
+			}
+			*implicit = false
+			rz.endTx(info.Command == "COMMIT")
+			return writePgMsgs(rz.out, txWarning("25P01", "there is no transaction in progress"),
+				&pgproto3.CommandComplete{CommandTag: info.tag(0)})
+		}
+		return rz.runStmt(ctx, stmt, info)
+	}
+
+	handled, tag, notice, err := rz.beforeStmt(info)
+	if notice != nil {
+		if err := writePgMsgs(rz.out, notice); err != nil {
+			return err
+		}
+	}
+	switch {
+	case err != nil:
+		return err
+	case handled:
+		return writePgMsgs(rz.out, &pgproto3.CommandComplete{CommandTag: tag})
+	}
+	err = rz.runStmt(ctx, stmt, info)
+	rz.afterStmt(info, err)
+	return err
+}
@@ -0,0 +1,370 @@
+package pgif
+
+import (
+	"github.com/jackc/pgproto3/v2"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+LISTEN and NOTIFY. Notifications are scoped to a tenant database: a NOTIFY reaches the sessions (of any user) connected
+to the same database that are listening on its channel, and nothing else. As in Postgres:
+  - notifications (and LISTENs and UNLISTENs) made in a transaction take effect when it commits, and are dropped if it
+    rolls back; identical notifications in one transaction are sent once;
+  - a session that is idle gets its notifications straight away, while a busy one gets them just before its next
+    ReadyForQuery outside of a transaction block.
+Setting BackendConfig.TableChannels also sends a notification on the channel TableChannelPrefix + <table> for every
+row inserted, updated, or deleted, with a payload like "INSERT 42" (the command and the rowid). Rows are seen through
+the connection's update hook, so this needs the driver registered by rhizome.Init(), which passes every row change to
+RowChanged(). Sqlite doesn't call the update hook for WITHOUT ROWID tables, so their changes aren't notified.
+*/
+
+// TableChannelPrefix is prefixed to a table's name to make the channel its row changes are notified on
+const TableChannelPrefix = "rz_table_"
+
+// maxNotifyPayload is Postgres' limit on the size of a notification's payload
+const maxNotifyPayload = 8000
+
+/*
+notifyHub tracks which sessions are listening on which channels.
+*/
+type notifyHub struct {
+	sync.Mutex
+	// listeners are the sessions listening on each channel, by database ID and then channel
+	listeners map[string]map[string]map[*RhizomeBackend]bool
+}
+
+var notifications = &notifyHub{
+	listeners: make(map[string]map[string]map[*RhizomeBackend]bool),
+}
+
+func (hub *notifyHub) listen(rz *RhizomeBackend, channel string) {
+	hub.Lock()
+	defer hub.Unlock()
+	channels, ok := hub.listeners[rz.db.ID]
+	if !ok {
+		channels = make(map[string]map[*RhizomeBackend]bool)
+		hub.listeners[rz.db.ID] = channels
+	}
+	if channels[channel] == nil {
+		channels[channel] = make(map[*RhizomeBackend]bool)
+	}
+	channels[channel][rz] = true
+}
+
+func (hub *notifyHub) unlisten(rz *RhizomeBackend, channel string) {
+	hub.Lock()
+	defer hub.Unlock()
+	channels := hub.listeners[rz.db.ID]
+	delete(channels[channel], rz)
+	if len(channels[channel]) == 0 {
+		delete(channels, channel)
+	}
+	if len(channels) == 0 {
+		delete(hub.listeners, rz.db.ID)
+	}
+}
+
+/*
+publish() hands notifications sent to a database to the sessions listening for them.
+*/
+func (hub *notifyHub) publish(dbID string, msgs []pgproto3.NotificationResponse) {
+	deliveries := make(map[*RhizomeBackend][]pgproto3.NotificationResponse)
+	hub.Lock()
+	for _, msg := range msgs {
+		for rz := range hub.listeners[dbID][msg.Channel] {
+			deliveries[rz] = append(deliveries[rz], msg)
+		}
+	}
+	hub.Unlock()
+	for rz, msgs := range deliveries {
+		rz.deliver(msgs)
+	}
+}
+
+/*
+sessionNotify is a session's LISTEN/NOTIFY state.
+*/
+type sessionNotify struct {
+	// listening are the channels the session is listening on
+	listening map[string]bool
+	// sent and listens are the notifications and the LISTENs/UNLISTENs of the current transaction; seen has the
+	// channel and payload of each notification sent
+	sent    []pgproto3.NotificationResponse
+	seen    map[[2]string]bool
+	listens []listenAction
+
+	// mu guards the rest, which are shared with the sessions sending notifications
+	mu sync.Mutex
+	// pending are notifications that haven't been sent to the client yet
+	pending []pgproto3.NotificationResponse
+	// ready is set once a ReadyForQuery has been queued for the client, and idle while the session is waiting for the
+	// client outside of a transaction, with nothing left to send, when notifications can be written to it at any time
+	ready bool
+	idle  bool
+}
+
+// listenAction is a LISTEN or UNLISTEN; an UNLISTEN with no channel is UNLISTEN *
+type listenAction struct {
+	channel string
+	listen  bool
+}
+
+/*
+notifyStmt is a parsed LISTEN, UNLISTEN, or NOTIFY.
+*/
+type notifyStmt struct {
+	verb    string
+	channel string
+	payload string
+}
+
+/*
+parseNotifyStmt() parses a LISTEN, UNLISTEN, or NOTIFY. Channels are identifiers, so unquoted names are folded to lower
+case.
+*/
+func parseNotifyStmt(query string) (*notifyStmt, error) {
+	toks := significant(tokenizeSQL(query))
+	for len(toks) > 0 && toks[len(toks)-1].isOp(";") {
+		toks = toks[:len(toks)-1]
+	}
+	if len(toks) == 0 {
+		return nil, newPgError("42601", "syntax error")
+	}
+	stmt := &notifyStmt{verb: toks[0].upper()}
+	syntaxErr := newPgError("42601", "syntax error in %s statement", stmt.verb)
+	switch {
+	case len(toks) == 2 && stmt.verb == "UNLISTEN" && toks[1].isOp("*"):
+		return stmt, nil
+	case len(toks) < 2 || (toks[1].Kind != tokWord && toks[1].Kind != tokQuotedIdent):
+		return nil, syntaxErr
+	}
+	stmt.channel = toks[1].ident()
+	if toks[1].Kind == tokWord {
+		stmt.channel = strings.ToLower(stmt.channel)
+	}
+	switch {
+	case len(toks) == 2:
+	case len(toks) == 4 && stmt.verb == "NOTIFY" && toks[2].isOp(",") && toks[3].Kind == tokString:
+		stmt.payload = toks[3].unquote()
+	default:
+		return nil, syntaxErr
+	}
+	return stmt, nil
+}
+
+/*
+runNotifyStmt() carries out a LISTEN, UNLISTEN, or NOTIFY.
+*/
+func (rz *RhizomeBackend) runNotifyStmt(query string) (string, error) {
+	stmt, err := parseNotifyStmt(query)
+	if err != nil {
+		return "", err
+	}
+	switch stmt.verb {
+	case "LISTEN":
+		rz.notify.listens = append(rz.notify.listens, listenAction{channel: stmt.channel, listen: true})
+	case "UNLISTEN":
+		rz.notify.listens = append(rz.notify.listens, listenAction{channel: stmt.channel})
+	default:
+		err = rz.queueNotification(stmt.channel, stmt.payload)
+	}
+	return stmt.verb, err
+}
+
+/*
+queueNotification() adds a notification to the current transaction, unless an identical one is already there.
+*/
+func (rz *RhizomeBackend) queueNotification(channel, payload string) error {
+	switch {
+	case channel == "":
+		return newPgError("22023", "channel name cannot be empty")
+	case len(channel) > 63:
+		return newPgError("22023", "channel name too long")
+	case len(payload) >= maxNotifyPayload:
+		return newPgError("22023", "payload string too long")
+	}
+	key := [2]string{channel, payload}
+	if rz.notify.seen[key] {
+		return nil
+	}
+	if rz.notify.seen == nil {
+		rz.notify.seen = make(map[[2]string]bool)
+	}
+	rz.notify.seen[key] = true
+	rz.notify.sent = append(rz.notify.sent, pgproto3.NotificationResponse{PID: rz.pid, Channel: channel, Payload: payload})
+	return nil
+}
+
+/*
+endTxNotify() is called when a transaction ends: if it committed, its LISTENs and UNLISTENs take effect and its
+notifications are sent.
+*/
+func (rz *RhizomeBackend) endTxNotify(committed bool) {
+	n := &rz.notify
+	if committed {
+		for _, action := range n.listens {
+			switch {
+			case action.listen && !n.listening[action.channel]:
+				if n.listening == nil {
+					n.listening = make(map[string]bool)
+				}
+				n.listening[action.channel] = true
+				notifications.listen(rz, action.channel)
+			case !action.listen:
+				for channel := range n.listening {
+					if action.channel == "" || action.channel == channel {
+						delete(n.listening, channel)
+						notifications.unlisten(rz, channel)
+					}
+				}
+			}
+		}
+		if len(n.sent) > 0 {
+			notifications.publish(rz.db.ID, n.sent)
+		}
+	}
+	n.sent, n.seen, n.listens = nil, nil, nil
+}
+
+/*
+deliver() queues notifications for the session's client, writing them out straight away if the session is idle.
+*/
+func (rz *RhizomeBackend) deliver(msgs []pgproto3.NotificationResponse) {
+	rz.notify.mu.Lock()
+	rz.notify.pending = append(rz.notify.pending, msgs...)
+	idle := rz.notify.idle
+	rz.notify.mu.Unlock()
+	if idle {
+		// the sender shouldn't wait on another session's client
+		go rz.flushNotifications()
+	}
+}
+
+/*
+flushNotifications() writes any pending notifications to an idle session's client.
+*/
+func (rz *RhizomeBackend) flushNotifications() {
+	rz.notify.mu.Lock()
+	defer rz.notify.mu.Unlock()
+	if !rz.notify.idle || len(rz.notify.pending) == 0 {
+		return
+	}
+	var buf []byte
+	for i := range rz.notify.pending {
+		buf = rz.notify.pending[i].Encode(buf)
+	}
+	rz.notify.pending = nil
+	_, _ = rz.conn.Write(buf)
+}
+
+/*
+readyNotifications() returns the notifications to send with a ReadyForQuery: all of the pending ones outside of a
+transaction block, and none inside one.
+*/
+func (rz *RhizomeBackend) readyNotifications() []pgproto3.NotificationResponse {
+	rz.notify.mu.Lock()
+	defer rz.notify.mu.Unlock()
+	rz.notify.ready = true
+	if rz.txStatus != txIdle {
+		return nil
+	}
+	msgs := rz.notify.pending
+	rz.notify.pending = nil
+	return msgs
+}
+
+/*
+waitForClient() is called when the session has sent everything it has and is about to wait for the client's next
+message. If it's waiting for a new query outside of a transaction, notifications are sent as they arrive until the
+client's message comes in (and awaken() is called).
+*/
+func (rz *RhizomeBackend) waitForClient() {
+	rz.notify.mu.Lock()
+	rz.notify.idle = rz.notify.ready && rz.txStatus == txIdle
+	idle := rz.notify.idle && len(rz.notify.pending) > 0
+	rz.notify.mu.Unlock()
+	if idle {
+		rz.flushNotifications()
+	}
+}
+
+func (rz *RhizomeBackend) awaken() {
+	rz.notify.mu.Lock()
+	rz.notify.idle, rz.notify.ready = false, false
+	rz.notify.mu.Unlock()
+}
+
+/*
+stopNotify() removes a closing session from every channel it was listening on.
+*/
+func (rz *RhizomeBackend) stopNotify() {
+	for channel := range rz.notify.listening {
+		notifications.unlisten(rz, channel)
+	}
+	rz.notify.listening = nil
+	rz.notify.mu.Lock()
+	rz.notify.idle = false
+	rz.notify.mu.Unlock()
+	if rz.sqlConn != nil {
+		_ = rz.sqlConn.Raw(func(dc any) error {
+			if sc, ok := dc.(*sqlite3.SQLiteConn); ok {
+				rowListeners.Delete(sc)
+			}
+			return nil
+		})
+	}
+}
+
+// rowListeners are the sessions that want their connection's row changes, by connection
+var rowListeners sync.Map
+
+/*
+startNotify() registers pg_notify() on the session's connection and, if the server notifies row changes, has
+RowChanged() pass the connection's changes to the session.
+*/
+func (rz *RhizomeBackend) startNotify() error {
+	return rz.sqlConn.Raw(func(dc any) error {
+		sc, ok := dc.(*sqlite3.SQLiteConn)
+		if !ok {
+			return nil
+		}
+		if rz.cfg.TableChannels {
+			rowListeners.Store(sc, rz)
+		}
+		return sc.RegisterFunc("pg_notify", func(channel, payload any) (any, error) {
+			ch, _ := channel.(string)
+			p, _ := payload.(string)
+			if b, ok := payload.([]byte); ok {
+				p = string(b)
+			}
+			return nil, rz.queueNotification(ch, p)
+		}, false)
+	})
+}
+
+/*
+RowChanged() is called by the update hook of every connection opened by the driver rhizome.Init() registers. Changes
+made on a session's connection are notified on the table's channel when the session's transaction commits.
+*/
+func RowChanged(conn *sqlite3.SQLiteConn, op int, db, table string, rowid int64) {
+	val, ok := rowListeners.Load(conn)
+	if !ok || db != "main" {
+		return
+	}
+	var verb string
+	switch op {
+	case sqlite3.SQLITE_INSERT:
+		verb = "INSERT"
+	case sqlite3.SQLITE_UPDATE:
+		verb = "UPDATE"
+	case sqlite3.SQLITE_DELETE:
+		verb = "DELETE"
+	default:
+		return
+	}
+	rz := val.(*RhizomeBackend)
+	_ = rz.queueNotification(TableChannelPrefix+table, verb+" "+strconv.FormatInt(rowid, 10))
+}
@@ -0,0 +1,336 @@
+package pgif
+
+import (
+	"context"
+	"github.com/google/deck"
+	"github.com/highgrav/rhizome/internal/constants"
+	"github.com/jackc/pgtype"
+	"strconv"
+	"strings"
+)
+
+/*
+Statement parameters. Clients usually leave it to the server to work out parameter types (sending 0 OIDs in Parse), and
+Postgres does that from context: in WHERE id = $1, $1 takes the type of id. Sqlite doesn't type parameters at all, so
+we do a rough version of the same thing from the statement's tokens, which matters because values bound as the wrong
+kind compare wrongly in Sqlite (a blob is never equal to an integer). We also take care of the difference in
+parameter numbering: Sqlite numbers $N parameters in order of appearance rather than by N.
+*/
+
+/*
+stmtParams describes a prepared statement's parameters as the client sees them (count, and the type of each) and how
+they map onto Sqlite's parameter slots.
+*/
+type stmtParams struct {
+	count int
+	// slots[i] is the (0-based) client parameter bound to Sqlite's parameter i+1
+	slots []int
+	// nums maps the position of each parameter token in the query to its (0-based) client parameter
+	nums map[int]int
+}
+
+/*
+mapParams() works out which client parameter each of a statement's nslots Sqlite parameter slots refers to, mirroring
+the way Sqlite assigns slots: ? takes the next slot, ?NNN takes slot NNN, and named parameters ($N, :name, @name) take
+the next slot the first time they appear. $N is client parameter N; other kinds are numbered by slot.
+*/
+func mapParams(toks []sqlToken, nslots int) stmtParams {
+	params := stmtParams{slots: make([]int, nslots), nums: make(map[int]int)}
+	for i := range params.slots {
+		params.slots[i] = -1
+	}
+	next := 0
+	named := make(map[string]int)
+	for _, tok := range toks {
+		if tok.Kind != tokParam {
+			continue
+		}
+		var slot, num int
+		switch {
+		case tok.Text == "?":
+			next++
+			slot, num = next, next
+		case tok.Text[0] == '?':
+			slot, _ = strconv.Atoi(tok.Text[1:])
+			num = slot
+			if slot > next {
+				next = slot
+			}
+		default:
+			if s, ok := named[tok.Text]; ok {
+				slot = s
+			} else {
+				next++
+				slot = next
+				named[tok.Text] = slot
+			}
+			num = slot
+			if n, err := strconv.Atoi(tok.Text[1:]); err == nil && tok.Text[0] == '$' {
+				num = n
+			}
+		}
+		if slot < 1 || slot > nslots || num < 1 {
+			continue
+		}
+		params.slots[slot-1] = num - 1
+		params.nums[tok.Pos] = num - 1
+		if num > params.count {
+			params.count = num
+		}
+	}
+	for _, num := range params.slots {
+		if num < 0 {
+			// we've misread the statement somehow, so fall back to binding parameters in order
+			for i := range params.slots {
+				params.slots[i] = i
+			}
+			params.count = nslots
+			break
+		}
+	}
+	return params
+}
+
+/*
+bindArgs() arranges the client's parameter values in Sqlite's slot order.
+*/
+func (params stmtParams) bindArgs(vals []any) []any {
+	args := make([]any, len(params.slots))
+	for i, num := range params.slots {
+		if num < len(vals) {
+			args[i] = vals[num]
+		}
+	}
+	return args
+}
+
+// comparisonOps are the operators whose operands we assume to have the same type
+var comparisonOps = map[string]bool{
+	"=": true, "==": true, "<>": true, "!=": true, "<": true, ">": true, "<=": true, ">=": true,
+	"LIKE": true, "GLOB": true, "IS": true,
+}
+
+func isComparison(tok sqlToken) bool {
+	if tok.Kind == tokWord {
+		return comparisonOps[tok.upper()]
+	}
+	return tok.Kind == tokOp && comparisonOps[tok.Text]
+}
+
+// clauseKeywords are words that can follow a table name in FROM, and so can't be an alias
+var clauseKeywords = map[string]bool{
+	"WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true, "CROSS": true,
+	"NATURAL": true, "OUTER": true, "ON": true, "USING": true, "GROUP": true, "ORDER": true, "LIMIT": true,
+	"HAVING": true, "WINDOW": true, "UNION": true, "EXCEPT": true, "INTERSECT": true, "SET": true, "VALUES": true,
+	"DEFAULT": true, "SELECT": true, "RETURNING": true, "OFFSET": true, "INDEXED": true, "NOT": true, "AS": true,
+}
+
+/*
+readTableName() reads a (possibly schema-qualified) table name starting at toks[i], returning the index after it.
+*/
+func readTableName(toks []sqlToken, i int) (schema, table string, next int) {
+	if i >= len(toks) || (toks[i].Kind != tokWord && toks[i].Kind != tokQuotedIdent) {
+		return "", "", i
+	}
+	table = toks[i].ident()
+	i++
+	if i+1 < len(toks) && toks[i].isOp(".") && (toks[i+1].Kind == tokWord || toks[i+1].Kind == tokQuotedIdent) {
+		schema, table = table, toks[i+1].ident()
+		i += 2
+	}
+	return schema, table, i
+}
+
+/*
+inferParamTypes() guesses the type of each client parameter from the columns it's compared with, assigned to, or
+inserted into. Parameters it can't place are left out of the result.
+*/
+func (rz *RhizomeBackend) inferParamTypes(ctx context.Context, toks []sqlToken, params stmtParams) map[int]uint32 {
+	types := make(map[int]uint32)
+	colTypes := make(map[string]uint32)
+	tableCols := func(schema, table string) []copyColumn {
+		cols, err := rz.tableColumns(ctx, schema, table)
+		if err != nil && rz.cfg.LogLevel >= constants.LogLevelDebug {
+			deck.Infof("could not look up columns of %s for parameter types: %s", table, err.Error())
+		}
+		for _, col := range cols {
+			if _, ok := colTypes[strings.ToLower(col.Name)]; !ok {
+				colTypes[strings.ToLower(col.Name)] = col.PgType
+			}
+		}
+		return cols
+	}
+	setType := func(tok sqlToken, typ uint32) {
+		if num, ok := params.nums[tok.Pos]; ok && tok.Kind == tokParam {
+			if _, ok := types[num]; !ok {
+				types[num] = typ
+			}
+		}
+	}
+
+	// collect the columns of every table the statement refers to, and handle INSERT ... VALUES on the way
+	for i := 0; i < len(toks); i++ {
+		switch toks[i].upper() {
+		case "FROM", "JOIN", "UPDATE":
+			for j := i + 1; ; {
+				schema, table, next := readTableName(toks, j)
+				if table == "" {
+					break
+				}
+				tableCols(schema, table)
+				// skip an alias
+				if next < len(toks) && toks[next].is("AS") {
+					next += 2
+				} else if next < len(toks) && toks[next].Kind == tokWord && !clauseKeywords[toks[next].upper()] {
+					next++
+				}
+				if next >= len(toks) || !toks[next].isOp(",") {
+					break
+				}
+				j = next + 1
+			}
+		case "INTO":
+			schema, table, next := readTableName(toks, i+1)
+			if table == "" {
+				continue
+			}
+			cols := tableCols(schema, table)
+			targets := make([]uint32, 0, len(cols))
+			if next < len(toks) && toks[next].isOp("(") {
+				byName := make(map[string]uint32)
+				for _, col := range cols {
+					byName[strings.ToLower(col.Name)] = col.PgType
+				}
+				for next++; next < len(toks) && !toks[next].isOp(")"); next++ {
+					if !toks[next].isOp(",") {
+						targets = append(targets, byName[strings.ToLower(toks[next].ident())])
+					}
+				}
+				next++
+			} else {
+				for _, col := range cols {
+					targets = append(targets, col.PgType)
+				}
+			}
+			if next >= len(toks) || !toks[next].is("VALUES") {
+				continue
+			}
+			// match each tuple element that is just a parameter with its target column
+			elemParam := func(j, pos int) {
+				if j+1 < len(toks) && toks[j].Kind == tokParam && (toks[j+1].isOp(",") || toks[j+1].isOp(")")) &&
+					pos < len(targets) && targets[pos] != 0 {
+					setType(toks[j], targets[pos])
+				}
+			}
+			depth, pos := 0, 0
+			for j := next + 1; j < len(toks); j++ {
+				switch {
+				case toks[j].isOp("("):
+					depth++
+					if depth == 1 {
+						pos = 0
+						elemParam(j+1, pos)
+					}
+				case toks[j].isOp(")"):
+					depth--
+				case toks[j].isOp(","):
+					if depth == 1 {
+						pos++
+						elemParam(j+1, pos)
+					}
+				case depth == 0:
+					// the end of the VALUES list
+					j = len(toks)
+				}
+			}
+		}
+	}
+
+	colType := func(j int) (uint32, bool) {
+		if j < 0 || j >= len(toks) || (toks[j].Kind != tokWord && toks[j].Kind != tokQuotedIdent) {
+			return 0, false
+		}
+		typ, ok := colTypes[strings.ToLower(toks[j].ident())]
+		return typ, ok
+	}
+	for i, tok := range toks {
+		if tok.Kind != tokParam {
+			continue
+		}
+		prev := i - 1
+		if prev >= 0 && toks[prev].is("NOT") {
+			prev--
+		}
+		switch {
+		case prev >= 0 && (toks[prev].is("LIMIT") || toks[prev].is("OFFSET")):
+			setType(tok, pgtype.Int8OID)
+		case prev >= 0 && isComparison(toks[prev]):
+			if typ, ok := colType(prev - 1); ok {
+				setType(tok, typ)
+			}
+		case i+2 < len(toks) && isComparison(toks[i+1]):
+			j := i + 2
+			// a qualified column on the right-hand side: $1 = t.col
+			if j+2 < len(toks) && toks[j+1].isOp(".") {
+				j += 2
+			}
+			if typ, ok := colType(j); ok {
+				setType(tok, typ)
+			}
+		case prev >= 0 && toks[prev].is("BETWEEN"):
+			if typ, ok := colType(prev - 1); ok {
+				setType(tok, typ)
+			}
+		case prev >= 2 && toks[prev].is("AND") && toks[prev-2].is("BETWEEN"):
+			if typ, ok := colType(prev - 3); ok {
+				setType(tok, typ)
+			}
+		default:
+			// an element of an IN list: col IN (..., $1, ...)
+			j := i - 1
+			for j >= 0 && (toks[j].isOp(",") || toks[j].Kind == tokParam || toks[j].Kind == tokNumber || toks[j].Kind == tokString) {
+				j--
+			}
+			if j >= 1 && toks[j].isOp("(") {
+				j--
+				if j >= 0 && toks[j].is("IN") {
+					if j >= 1 && toks[j-1].is("NOT") {
+						j--
+					}
+					if typ, ok := colType(j - 1); ok {
+						setType(tok, typ)
+					}
+				}
+			}
+		}
+	}
+	return types
+}
+
+/*
+paramTypes() returns the type of each of a statement's client parameters: the OIDs the client gave in Parse where it
+gave them, otherwise whatever we could infer, otherwise text (which Sqlite will convert to suit the column it meets).
+*/
+func (rz *RhizomeBackend) paramTypes(toks []sqlToken, params stmtParams, clientOIDs []uint32) []uint32 {
+	count := params.count
+	if len(clientOIDs) > count {
+		count = len(clientOIDs)
+	}
+	oids := make([]uint32, count)
+	var inferred map[int]uint32
+	for i := range oids {
+		if i < len(clientOIDs) && clientOIDs[i] != 0 {
+			oids[i] = clientOIDs[i]
+			continue
+		}
+		if inferred == nil {
+			inferred = rz.inferParamTypes(rz.ctx, toks, params)
+		}
+		if typ, ok := inferred[i]; ok {
+			oids[i] = typ
+		} else {
+			oids[i] = pgtype.TextOID
+		}
+	}
+	return oids
+}
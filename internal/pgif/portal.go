@@ -0,0 +1,94 @@
+package pgif
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jackc/pgproto3/v2"
+)
+
+/*
+Portal cursors. An Execute with a row limit (MaxRows > 0) returns at most that many rows followed by PortalSuspended,
+and the next Execute of the same portal carries on where the last one stopped. To do that, a portal keeps its
+*sql.Rows open between Executes. As in Postgres, the cursor lives until the portal is closed or rebound, the
+transaction it belongs to ends, or (outside of a transaction block) the next Sync.
+*/
+
+type portalCursor struct {
+	rows *sql.Rows
+	cols []resultCol
+	out  *rowWriter
+	// ctx outlives any single Execute, since the rows are closed when it's done
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+func (cur *portalCursor) close() {
+	_ = cur.rows.Close()
+	cur.cancel(nil)
+}
+
+func (portal *RhizomePortal) closeCursor() {
+	if portal.cursor != nil {
+		portal.cursor.close()
+		portal.cursor = nil
+	}
+}
+
+/*
+closePortals() drops all of the session's portals, closing any open cursors.
+*/
+func (rz *RhizomeBackend) closePortals() {
+	for id, portal := range rz.portals {
+		portal.closeCursor()
+		delete(rz.portals, id)
+	}
+}
+
+/*
+fetchPortal() streams up to maxRows rows (or all rows, if maxRows is 0) from a portal for a row-returning statement,
+opening its cursor on the first call. The batch ends with PortalSuspended if the limit was reached, or with
+CommandComplete once the rows run out.
+*/
+func (rz *RhizomeBackend) fetchPortal(stmtptr *RhizomePreparedStatement, portal *RhizomePortal, maxRows uint32) error {
+	if portal.complete {
+		return writePgMsgs(rz.out, &pgproto3.CommandComplete{CommandTag: stmtptr.info.tag(0)})
+	}
+	if portal.cursor == nil {
+		ctx, cancel := context.WithCancelCause(rz.ctx)
+		done := rz.startFetch(cancel)
+		rows, err := stmtptr.PreparedStmt.QueryContext(ctx, portal.Params...)
+		done()
+		if err != nil {
+			err = rz.queryError(ctx, err)
+			cancel(nil)
+			return err
+		}
+		cols := stmtptr.cols
+		if names, err := rows.Columns(); err != nil || len(names) != len(cols) {
+			// we couldn't describe the statement when it was parsed, so go by what the query says now
+			cts, err := rows.ColumnTypes()
+			if err != nil {
+				_ = rows.Close()
+				cancel(nil)
+				return err
+			}
+			cols = resultCols(cts, nil)
+		}
+		portal.cursor = &portalCursor{rows: rows, cols: cols, out: rz.newRowWriter(), ctx: ctx, cancel: cancel}
+	}
+	cur := portal.cursor
+	done := rz.startFetch(cur.cancel)
+	n, finished, err := cur.out.writeRows(cur.rows, cur.cols, portal.ResultsUserBinaryFormatting, int64(maxRows))
+	done()
+	if err != nil {
+		err = rz.queryError(cur.ctx, err)
+		portal.closeCursor()
+		return err
+	}
+	if !finished {
+		return writePgMsgs(rz.out, &pgproto3.PortalSuspended{})
+	}
+	portal.closeCursor()
+	portal.complete = true
+	return writePgMsgs(rz.out, &pgproto3.CommandComplete{CommandTag: stmtptr.info.tag(n)})
+}
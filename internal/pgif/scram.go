@@ -0,0 +1,326 @@
+package pgif
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/google/deck"
+	"github.com/jackc/pgproto3/v2"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+/*
+SCRAM-SHA-256 authentication (RFC 5802 and RFC 7677), as implemented by Postgres. When the connection is using TLS we
+also offer SCRAM-SHA-256-PLUS with tls-server-end-point channel binding (RFC 5929), which ties the exchange to our
+certificate so that a man in the middle can't relay it. Passwords are used as raw UTF-8 bytes without SASLprep
+normalization, which is what Postgres does for any password that isn't already normalized.
+*/
+
+const (
+	scramMechanism     = "SCRAM-SHA-256"
+	scramPlusMechanism = "SCRAM-SHA-256-PLUS"
+	scramChannelBind   = "tls-server-end-point"
+	scramIterations    = 4096
+	scramSaltLen       = 16
+	scramNonceLen      = 18
+)
+
+type scramSecret struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+func isScramSecret(secret string) bool {
+	return strings.HasPrefix(secret, scramMechanism+"$")
+}
+
+/*
+parseScramSecret() parses a secret in the Postgres format "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>".
+*/
+func parseScramSecret(secret string) (*scramSecret, error) {
+	parts := strings.Split(secret, "$")
+	if len(parts) != 3 || parts[0] != scramMechanism {
+		return nil, fmt.Errorf("invalid SCRAM secret")
+	}
+	iterSalt := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return nil, fmt.Errorf("invalid SCRAM secret")
+	}
+	s := &scramSecret{}
+	var err error
+	if s.Iterations, err = strconv.Atoi(iterSalt[0]); err != nil || s.Iterations < 1 {
+		return nil, fmt.Errorf("invalid SCRAM iteration count")
+	}
+	if s.Salt, err = base64.StdEncoding.DecodeString(iterSalt[1]); err != nil {
+		return nil, fmt.Errorf("invalid SCRAM salt: %w", err)
+	}
+	if s.StoredKey, err = base64.StdEncoding.DecodeString(keys[0]); err != nil || len(s.StoredKey) != sha256.Size {
+		return nil, fmt.Errorf("invalid SCRAM stored key")
+	}
+	if s.ServerKey, err = base64.StdEncoding.DecodeString(keys[1]); err != nil || len(s.ServerKey) != sha256.Size {
+		return nil, fmt.Errorf("invalid SCRAM server key")
+	}
+	return s, nil
+}
+
+func (s *scramSecret) String() string {
+	return fmt.Sprintf("%s$%d:%s$%s:%s", scramMechanism, s.Iterations,
+		base64.StdEncoding.EncodeToString(s.Salt),
+		base64.StdEncoding.EncodeToString(s.StoredKey),
+		base64.StdEncoding.EncodeToString(s.ServerKey))
+}
+
+func newScramSecret(password string, salt []byte, iterations int) *scramSecret {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &scramSecret{
+		Iterations: iterations,
+		Salt:       salt,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}
+}
+
+/*
+NewScramSecret() derives a SCRAM-SHA-256 secret from a password, with a random salt, for storage by the application.
+*/
+func NewScramSecret(password string) (string, error) {
+	salt := make([]byte, scramSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return newScramSecret(password, salt, scramIterations).String(), nil
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+var scramMockKey = func() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}()
+
+/*
+mockScramSecret() returns a secret that no password matches, with a salt that is stable for each username. We run the
+full exchange with it for unknown users so that they can't be told apart from real ones.
+*/
+func mockScramSecret(username string) *scramSecret {
+	return &scramSecret{
+		Iterations: scramIterations,
+		Salt:       scramHMAC(scramMockKey, username)[:scramSaltLen],
+		StoredKey:  make([]byte, sha256.Size),
+		ServerKey:  make([]byte, sha256.Size),
+	}
+}
+
+/*
+tlsServerEndPoint() returns the tls-server-end-point channel binding data for the connection (a hash of our
+certificate), or nil if the connection isn't using TLS.
+*/
+func (rz *RhizomeBackend) tlsServerEndPoint() []byte {
+	if _, ok := rz.conn.(*tls.Conn); !ok || rz.cfg.TLS == nil || len(rz.cfg.TLS.Certificates) == 0 {
+		return nil
+	}
+	cert := rz.cfg.TLS.Certificates[0]
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			deck.Errorf("could not parse tls certificate for channel binding: %s", err.Error())
+			return nil
+		}
+	}
+	// RFC 5929: use the certificate's signature hash, except that MD5 and SHA-1 are replaced by SHA-256
+	var h hash.Hash
+	switch leaf.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = sha512.New()
+	default:
+		h = sha256.New()
+	}
+	h.Write(leaf.Raw)
+	return h.Sum(nil)
+}
+
+/*
+parseScramAttrs() splits a SCRAM message into its attributes ("r=...,s=..." and so on).
+*/
+func parseScramAttrs(msg string) map[byte]string {
+	attrs := make(map[byte]string)
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) >= 2 && part[1] == '=' {
+			if _, ok := attrs[part[0]]; !ok {
+				attrs[part[0]] = part[2:]
+			}
+		}
+	}
+	return attrs
+}
+
+/*
+authSCRAM() runs the SASL exchange:
+BE: AuthenticationSASL (the mechanisms we support)
+FE: SASLInitialResponse (client-first-message)
+BE: AuthenticationSASLContinue (server-first-message)
+FE: SASLResponse (client-final-message, with the client's proof)
+BE: AuthenticationSASLFinal (server-final-message, with our proof)
+*/
+func (rz *RhizomeBackend) authSCRAM(username, secret string, secretErr error) error {
+	var stored *scramSecret
+	valid := secretErr == nil
+	if valid {
+		var err error
+		switch {
+		case isScramSecret(secret):
+			stored, err = parseScramSecret(secret)
+		case isMD5Secret(secret):
+			err = fmt.Errorf("md5 secrets cannot be used with SCRAM authentication")
+		default:
+			salt := make([]byte, scramSaltLen)
+			if _, err = rand.Read(salt); err == nil {
+				stored = newScramSecret(secret, salt, scramIterations)
+			}
+		}
+		if err != nil {
+			deck.Errorf("cannot use stored secret for user %q: %s", username, err.Error())
+			valid = false
+		}
+	}
+	if !valid {
+		stored = mockScramSecret(username)
+	}
+
+	cbindData := rz.tlsServerEndPoint()
+	mechs := []string{scramMechanism}
+	if cbindData != nil {
+		mechs = []string{scramPlusMechanism, scramMechanism}
+	}
+	if err := writePgMsgs(rz.conn, &pgproto3.AuthenticationSASL{AuthMechanisms: mechs}); err != nil {
+		return err
+	}
+
+	// client-first-message: gs2-header ("n,," / "y,," / "p=<cb-name>,,") followed by "n=<user>,r=<client nonce>"
+	msg, err := rz.receiveAuthMsg(pgproto3.AuthTypeSASL)
+	if err != nil {
+		return err
+	}
+	initMsg, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok {
+		return newPgError("08P01", "expected SASL initial response, got %T", msg)
+	}
+	if initMsg.AuthMechanism != scramMechanism && (initMsg.AuthMechanism != scramPlusMechanism || cbindData == nil) {
+		return newPgError("08P01", "client selected an invalid SASL authentication mechanism")
+	}
+	gs2 := strings.SplitN(string(initMsg.Data), ",", 3)
+	if len(gs2) != 3 {
+		return newPgError("08P01", "malformed SCRAM message")
+	}
+	switch {
+	case gs2[0] == "n":
+		if initMsg.AuthMechanism == scramPlusMechanism {
+			return newPgError("08P01", "channel binding is required with %s", scramPlusMechanism)
+		}
+	case gs2[0] == "y":
+		// the client supports channel binding but thinks we don't; if we do, someone stripped it from our offer
+		if cbindData != nil {
+			return newPgError("28000", "SCRAM channel binding negotiation error")
+		}
+	case gs2[0] == "p="+scramChannelBind:
+		if initMsg.AuthMechanism != scramPlusMechanism {
+			return newPgError("08P01", "channel binding was requested without %s", scramPlusMechanism)
+		}
+	case strings.HasPrefix(gs2[0], "p="):
+		return newPgError("0A000", "unsupported SCRAM channel binding type %q", gs2[0][2:])
+	default:
+		return newPgError("08P01", "malformed SCRAM message")
+	}
+	if gs2[1] != "" {
+		return newPgError("0A000", "client uses authorization identity, but it is not supported")
+	}
+	gs2Header := gs2[0] + "," + gs2[1] + ","
+	clientFirstBare := gs2[2]
+	clientNonce, ok := parseScramAttrs(clientFirstBare)['r']
+	if !ok || clientNonce == "" || strings.HasPrefix(clientFirstBare, "m=") {
+		return newPgError("08P01", "malformed SCRAM message")
+	}
+
+	serverNonce := make([]byte, scramNonceLen)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return err
+	}
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(stored.Salt), stored.Iterations)
+	if err := writePgMsgs(rz.conn, &pgproto3.AuthenticationSASLContinue{Data: []byte(serverFirst)}); err != nil {
+		return err
+	}
+
+	// client-final-message: "c=<channel binding>,r=<nonce>,p=<proof>"
+	msg, err = rz.receiveAuthMsg(pgproto3.AuthTypeSASLContinue)
+	if err != nil {
+		return err
+	}
+	respMsg, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return newPgError("08P01", "expected SASL response, got %T", msg)
+	}
+	clientFinal := string(respMsg.Data)
+	proofAt := strings.LastIndex(clientFinal, ",p=")
+	if proofAt < 0 {
+		return newPgError("08P01", "malformed SCRAM message")
+	}
+	clientFinalNoProof := clientFinal[:proofAt]
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofAt+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return newPgError("08P01", "malformed SCRAM message")
+	}
+	attrs := parseScramAttrs(clientFinalNoProof)
+	expectedCbind := []byte(gs2Header)
+	if gs2[0] != "n" && gs2[0] != "y" {
+		expectedCbind = append(expectedCbind, cbindData...)
+	}
+	if attrs['c'] != base64.StdEncoding.EncodeToString(expectedCbind) {
+		return newPgError("28000", "SCRAM channel binding check failed")
+	}
+	if attrs['r'] != nonce {
+		return newPgError("08P01", "SCRAM nonce mismatch")
+	}
+
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalNoProof
+	clientSig := scramHMAC(stored.StoredKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSig[i]
+	}
+	computed := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(computed[:], stored.StoredKey) != 1 || !valid {
+		return authFailed(username)
+	}
+
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(stored.ServerKey, authMessage))
+	if err := writePgMsgs(rz.conn, &pgproto3.AuthenticationSASLFinal{Data: []byte(serverFinal)}); err != nil {
+		return err
+	}
+	return rz.backend.SetAuthType(pgproto3.AuthTypeOk)
+}
@@ -0,0 +1,785 @@
+package pgif
+
+import (
+	"fmt"
+	"github.com/google/deck"
+	"github.com/highgrav/rhizome/internal/constants"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Session parameters. Drivers set and read a handful of Postgres' run-time parameters as soon as they connect (SET
+application_name, SET TIME ZONE, SHOW server_version, ...), and expect to be told the values of some of them
+(ParameterStatus) at startup and whenever they change. We keep each session's parameters here, intercept SET, SHOW,
+and RESET before they reach Sqlite, and apply the parameters that have a Sqlite equivalent:
+  - TimeZone, once a client sets it, is the zone timestamptz values are shown in;
+  - statement_timeout is a deadline for each query;
+  - lock_timeout is Sqlite's busy timeout (how long to wait for another connection's lock).
+The rest are checked and reported, but have no effect. As in Postgres, a SET in a transaction that rolls back is undone,
+and SET LOCAL only lasts until the end of the transaction.
+*/
+
+/*
+paramDef describes a parameter we know about.
+*/
+type paramDef struct {
+	// name is the parameter's canonical name; names are matched case-insensitively
+	name string
+	dflt string
+	// report is set for parameters the client is sent a ParameterStatus for
+	report   bool
+	readOnly bool
+	// check validates a new value and returns it as it should be shown; nil accepts any value
+	check func(val string) (string, error)
+	desc  string
+}
+
+var paramDefs = []*paramDef{
+	{name: "application_name", report: true, desc: "Sets the application name to be reported in statistics and logs."},
+	{name: "client_encoding", dflt: "UTF8", report: true, check: checkEncoding, desc: "Sets the client's character set encoding."},
+	{name: "client_min_messages", dflt: "notice", check: checkEnum("debug5", "debug4", "debug3", "debug2", "debug1", "log", "notice", "warning", "error"),
+		desc: "Sets the message levels that are sent to the client."},
+	{name: "DateStyle", dflt: "ISO, MDY", report: true, check: checkDateStyle, desc: "Sets the display format for date and time values."},
+	{name: "default_transaction_isolation", dflt: "serializable", check: checkEnum("serializable", "repeatable read", "read committed", "read uncommitted"),
+		desc: "Sets the transaction isolation level of each new transaction."},
+	{name: "extra_float_digits", dflt: "1", check: checkIntRange(-15, 3), desc: "Sets the number of digits displayed for floating-point values."},
+	{name: "idle_in_transaction_session_timeout", dflt: "0", check: checkDuration,
+		desc: "Sets the maximum allowed idle time between queries, when in a transaction."},
+	{name: "integer_datetimes", dflt: "on", report: true, readOnly: true, desc: "Shows whether datetimes are integer based."},
+	{name: "IntervalStyle", dflt: "postgres", report: true, check: checkEnum("postgres"), desc: "Sets the display format for interval values."},
+	{name: "is_superuser", dflt: "off", report: true, readOnly: true, desc: "Shows whether the current user is a superuser."},
+	{name: "lock_timeout", dflt: "0", check: checkDuration, desc: "Sets the maximum allowed duration of any wait for a lock."},
+	{name: "search_path", dflt: `"$user", public`, desc: "Sets the schema search order for names that are not schema-qualified."},
+	{name: "server_encoding", dflt: "UTF8", report: true, readOnly: true, desc: "Shows the server (database) character set encoding."},
+	{name: "server_version", report: true, readOnly: true, desc: "Shows the server version."},
+	{name: "session_authorization", report: true, readOnly: true, desc: "Sets the session user name."},
+	{name: "standard_conforming_strings", dflt: "on", report: true, check: checkEnum("on"),
+		desc: "Causes '...' strings to treat backslashes literally."},
+	{name: "statement_timeout", dflt: "0", check: checkDuration, desc: "Sets the maximum allowed duration of any statement."},
+	{name: "TimeZone", dflt: "UTC", report: true, check: checkTimeZone, desc: "Sets the time zone for displaying and interpreting time stamps."},
+	{name: "transaction_isolation", dflt: "serializable", readOnly: true, desc: "Sets the current transaction's isolation level."},
+}
+
+var paramsByName = func() map[string]*paramDef {
+	m := make(map[string]*paramDef, len(paramDefs))
+	for _, def := range paramDefs {
+		m[strings.ToLower(def.name)] = def
+	}
+	return m
+}()
+
+/*
+sessionParams holds a session's parameter values, keyed by lower-cased name.
+*/
+type sessionParams struct {
+	values map[string]string
+	// resets are the values RESET goes back to: the defaults, or what the client asked for at startup
+	resets map[string]string
+	// saved are the values as they were before the first SET in the current transaction, and local the parameters
+	// SET LOCAL in it
+	saved map[string]string
+	local map[string]bool
+	// reported are the values the client was last sent a ParameterStatus for
+	reported map[string]string
+	// busyTimeout is the connection's own busy timeout, which lock_timeout = 0 goes back to
+	busyTimeout int64
+	// changed is set when pg_settings needs refilling
+	changed bool
+	// zoneSet is set once the client has chosen a TimeZone; until then timestamptz values keep the offset they were
+	// stored with
+	zoneSet bool
+}
+
+/*
+initParams() sets up the session's parameters, taking any the client sent in its StartupMessage (including -c options)
+that are valid.
+*/
+func (rz *RhizomeBackend) initParams(startup map[string]string) {
+	p := &sessionParams{values: make(map[string]string), resets: make(map[string]string),
+		reported: make(map[string]string), changed: true}
+	for _, def := range paramDefs {
+		p.values[strings.ToLower(def.name)] = def.dflt
+	}
+	p.values["server_version"] = rz.cfg.ServerVersion
+	p.values["session_authorization"] = rz.db.User
+	if rz.sqlConn != nil {
+		_ = rz.sqlConn.QueryRowContext(rz.ctx, "PRAGMA busy_timeout").Scan(&p.busyTimeout)
+	}
+	rz.params = p
+
+	requested := make(map[string]string)
+	for name, val := range startup {
+		switch name {
+		case "user", "database", "replication":
+		case "options":
+			for name, val := range parseStartupOptions(val) {
+				requested[name] = val
+			}
+		default:
+			requested[name] = val
+		}
+	}
+	for name, val := range requested {
+		if err := rz.setParam(name, val, false); err != nil && rz.cfg.LogLevel >= constants.LogLevelDebug {
+			deck.Infof("ignoring startup parameter %s=%q: %s", name, val, err.Error())
+		}
+	}
+	for name, val := range p.values {
+		p.resets[name] = val
+	}
+}
+
+/*
+parseStartupOptions() reads the -c name=value (or --name=value) settings from the options startup parameter.
+*/
+func parseStartupOptions(options string) map[string]string {
+	settings := make(map[string]string)
+	fields := strings.Fields(options)
+	for i := 0; i < len(fields); i++ {
+		opt := fields[i]
+		switch {
+		case opt == "-c" && i+1 < len(fields):
+			i++
+			opt = fields[i]
+		case strings.HasPrefix(opt, "-c"):
+			opt = opt[2:]
+		case strings.HasPrefix(opt, "--"):
+			opt = opt[2:]
+		default:
+			continue
+		}
+		if name, val, ok := strings.Cut(opt, "="); ok {
+			settings[strings.ReplaceAll(name, "-", "_")] = val
+		}
+	}
+	return settings
+}
+
+/*
+param() returns a parameter's current value.
+*/
+func (rz *RhizomeBackend) param(name string) string {
+	if rz.params == nil {
+		if def, ok := paramsByName[strings.ToLower(name)]; ok {
+			return def.dflt
+		}
+		return ""
+	}
+	return rz.params.values[strings.ToLower(name)]
+}
+
+/*
+lookupParam() returns the definition of a parameter, or nil for a custom (dotted) parameter, which Postgres lets
+clients set to anything.
+*/
+func lookupParam(name string) (*paramDef, error) {
+	if def, ok := paramsByName[strings.ToLower(name)]; ok {
+		return def, nil
+	}
+	if strings.Contains(name, ".") {
+		return nil, nil
+	}
+	return nil, newPgError("42704", "unrecognized configuration parameter \"%s\"", name)
+}
+
+/*
+setParam() sets a parameter for the session, or (if local is set) for the rest of the current transaction.
+*/
+func (rz *RhizomeBackend) setParam(name, val string, local bool) error {
+	def, err := lookupParam(name)
+	if err != nil {
+		return err
+	}
+	if def != nil && def.readOnly {
+		return newPgError("55P02", "parameter \"%s\" cannot be changed", def.name)
+	}
+	if def != nil && def.check != nil {
+		if val, err = def.check(val); err != nil {
+			return err
+		}
+	}
+	p := rz.params
+	key := strings.ToLower(name)
+	if rz.sqlConn != nil && !connAutoCommit(rz.sqlConn) {
+		if p.saved == nil {
+			p.saved = make(map[string]string, len(p.values))
+			for k, v := range p.values {
+				p.saved[k] = v
+			}
+			p.local = make(map[string]bool)
+		}
+		if local {
+			p.local[key] = true
+		}
+	}
+	p.values[key] = val
+	p.changed = true
+	if key == "timezone" {
+		p.zoneSet = true
+	}
+	return rz.applyParam(key)
+}
+
+/*
+resetParam() sets a parameter back to its value at the start of the session.
+*/
+func (rz *RhizomeBackend) resetParam(name string) error {
+	def, err := lookupParam(name)
+	if err != nil {
+		return err
+	}
+	if def != nil && def.readOnly {
+		return newPgError("55P02", "parameter \"%s\" cannot be changed", def.name)
+	}
+	return rz.setParam(name, rz.params.resets[strings.ToLower(name)], false)
+}
+
+/*
+endTxParams() is called when a transaction ends: a rollback undoes the SETs made in it, and either way SET LOCAL values
+are dropped.
+*/
+func (rz *RhizomeBackend) endTxParams(committed bool) {
+	p := rz.params
+	if p == nil || p.saved == nil {
+		return
+	}
+	for key, old := range p.saved {
+		if (!committed || p.local[key]) && p.values[key] != old {
+			p.values[key] = old
+			_ = rz.applyParam(key)
+		}
+	}
+	if !committed {
+		// custom parameters first set in the transaction
+		for key := range p.values {
+			if _, ok := p.saved[key]; !ok {
+				delete(p.values, key)
+			}
+		}
+	}
+	p.saved, p.local = nil, nil
+	p.changed = true
+}
+
+/*
+applyParam() puts a parameter's new value into effect, for the parameters that have one outside of this file.
+*/
+func (rz *RhizomeBackend) applyParam(key string) error {
+	if key != "lock_timeout" || rz.sqlConn == nil {
+		return nil
+	}
+	ms := rz.params.busyTimeout
+	if d, _ := parseDuration(rz.params.values[key]); d > 0 {
+		ms = d.Milliseconds()
+	}
+	_, err := rz.sqlConn.ExecContext(rz.ctx, "PRAGMA busy_timeout = "+strconv.FormatInt(ms, 10))
+	return err
+}
+
+/*
+paramReports() returns a ParameterStatus for each reported parameter whose value has changed since the client was last
+told about it.
+*/
+func (rz *RhizomeBackend) paramReports() []pgproto3.ParameterStatus {
+	p := rz.params
+	if p == nil {
+		return nil
+	}
+	var reports []pgproto3.ParameterStatus
+	for _, def := range paramDefs {
+		key := strings.ToLower(def.name)
+		val, ok := p.values[key]
+		if !def.report || !ok || (key == "server_version" && val == "") {
+			continue
+		}
+		if old, sent := p.reported[key]; sent && old == val {
+			continue
+		}
+		p.reported[key] = val
+		reports = append(reports, pgproto3.ParameterStatus{Name: def.name, Value: val})
+	}
+	return reports
+}
+
+/*
+valueEncoding() returns the settings for sending values to the client.
+*/
+func (rz *RhizomeBackend) valueEncoding() valueEncoding {
+	enc := valueEncoding{invalid: rz.cfg.InvalidValues}
+	if rz.params != nil && rz.params.zoneSet {
+		enc.loc = zoneLocation(rz.param("TimeZone"))
+	}
+	return enc
+}
+
+/*
+statementTimeout() returns the session's statement_timeout, or 0 if there isn't one.
+*/
+func (rz *RhizomeBackend) statementTimeout() time.Duration {
+	d, _ := parseDuration(rz.param("statement_timeout"))
+	return d
+}
+
+/*
+settingsRows() returns the name, value, and description of every parameter, sorted by name, for SHOW ALL and pg_settings.
+*/
+func (rz *RhizomeBackend) settingsRows() [][3]string {
+	var rows [][3]string
+	for _, def := range paramDefs {
+		rows = append(rows, [3]string{def.name, rz.param(def.name), def.desc})
+	}
+	if rz.params != nil {
+		for key, val := range rz.params.values {
+			if _, known := paramsByName[key]; !known {
+				rows = append(rows, [3]string{key, val, ""})
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return strings.ToLower(rows[i][0]) < strings.ToLower(rows[j][0]) })
+	return rows
+}
+
+/*
+sessionStmt is a parsed SET, SHOW, or RESET.
+*/
+type sessionStmt struct {
+	verb string
+	// name is the parameter's name, or empty for SHOW ALL and RESET ALL
+	name  string
+	value string
+	local bool
+	// reset is set for SET ... TO DEFAULT (and SET TIME ZONE LOCAL), which act like RESET
+	reset bool
+}
+
+/*
+isSessionStmt() reports whether a statement is one we handle ourselves rather than passing to Sqlite: SET, SHOW, and
+RESET, or LISTEN, UNLISTEN, and NOTIFY (see notify.go).
+*/
+func isSessionStmt(info stmtInfo) bool {
+	switch info.Command {
+	case "SET", "SHOW", "RESET", "LISTEN", "UNLISTEN", "NOTIFY":
+		return true
+	}
+	return false
+}
+
+func isNotifyStmt(query string) bool {
+	kw := firstKeyword(query)
+	return kw == "LISTEN" || kw == "UNLISTEN" || kw == "NOTIFY"
+}
+
+/*
+parseSessionStmt() parses a SET, SHOW, or RESET.
+*/
+func parseSessionStmt(query string) (*sessionStmt, error) {
+	toks := significant(tokenizeSQL(query))
+	for len(toks) > 0 && toks[len(toks)-1].isOp(";") {
+		toks = toks[:len(toks)-1]
+	}
+	if len(toks) == 0 {
+		return nil, newPgError("42601", "syntax error")
+	}
+	stmt := &sessionStmt{verb: toks[0].upper()}
+	toks = toks[1:]
+	if stmt.verb == "SET" && len(toks) > 0 && (toks[0].is("SESSION") || toks[0].is("LOCAL")) {
+		if toks[0].is("SESSION") && len(toks) > 1 && (toks[1].is("AUTHORIZATION") || toks[1].is("CHARACTERISTICS")) {
+			return nil, newPgError("0A000", "SET SESSION %s is not supported", toks[1].upper())
+		}
+		stmt.local = toks[0].is("LOCAL")
+		toks = toks[1:]
+	}
+	syntaxErr := func() error {
+		return newPgError("42601", "syntax error in %s statement", stmt.verb)
+	}
+	if len(toks) == 0 {
+		return nil, syntaxErr()
+	}
+
+	// multi-word parameter names
+	switch {
+	case len(toks) >= 2 && toks[0].is("TIME") && toks[1].is("ZONE"):
+		stmt.name, toks = "TimeZone", toks[2:]
+	case len(toks) >= 3 && toks[0].is("TRANSACTION") && toks[1].is("ISOLATION") && toks[2].is("LEVEL") &&
+		stmt.verb == "SHOW":
+		stmt.name, toks = "transaction_isolation", toks[3:]
+	case toks[0].is("TRANSACTION") && stmt.verb == "SET":
+		return nil, newPgError("0A000", "SET TRANSACTION is not supported")
+	case toks[0].is("SESSION") && len(toks) > 1 && toks[1].is("AUTHORIZATION"):
+		stmt.name, toks = "session_authorization", toks[2:]
+	case toks[0].is("SCHEMA") && stmt.verb == "SET":
+		stmt.name, toks = "search_path", toks[1:]
+	case toks[0].is("NAMES") && stmt.verb == "SET":
+		stmt.name, toks = "client_encoding", toks[1:]
+	case toks[0].is("ALL") && stmt.verb != "SET":
+		toks = toks[1:]
+	case toks[0].Kind == tokWord || toks[0].Kind == tokQuotedIdent:
+		// possibly dotted, for custom parameters
+		name := toks[0].ident()
+		toks = toks[1:]
+		for len(toks) >= 2 && toks[0].isOp(".") && (toks[1].Kind == tokWord || toks[1].Kind == tokQuotedIdent) {
+			name += "." + toks[1].ident()
+			toks = toks[2:]
+		}
+		stmt.name = name
+		if stmt.verb == "SET" {
+			if len(toks) == 0 || !(toks[0].is("TO") || toks[0].isOp("=")) {
+				return nil, syntaxErr()
+			}
+			toks = toks[1:]
+		}
+	default:
+		return nil, syntaxErr()
+	}
+	if stmt.verb != "SET" {
+		if len(toks) > 0 {
+			return nil, syntaxErr()
+		}
+		return stmt, nil
+	}
+
+	// the value: DEFAULT, or a list of words, strings, and (signed) numbers
+	switch {
+	case len(toks) == 1 && (toks[0].is("DEFAULT") || (stmt.name == "TimeZone" && toks[0].is("LOCAL"))):
+		stmt.reset = true
+		return stmt, nil
+	case len(toks) >= 2 && stmt.name == "TimeZone" && toks[0].is("INTERVAL") && toks[1].Kind == tokString:
+		// SET TIME ZONE INTERVAL '+02:00' HOUR TO MINUTE
+		stmt.value = toks[1].unquote()
+		return stmt, nil
+	}
+	var vals []string
+	for len(toks) > 0 {
+		val := ""
+		if toks[0].isOp("-") || toks[0].isOp("+") {
+			val, toks = toks[0].Text, toks[1:]
+			if len(toks) == 0 || toks[0].Kind != tokNumber {
+				return nil, syntaxErr()
+			}
+		}
+		switch toks[0].Kind {
+		case tokString:
+			val += toks[0].unquote()
+		case tokWord, tokQuotedIdent, tokNumber:
+			val += toks[0].ident()
+		default:
+			return nil, syntaxErr()
+		}
+		vals = append(vals, val)
+		toks = toks[1:]
+		if len(toks) > 0 {
+			if !toks[0].isOp(",") || len(toks) == 1 {
+				return nil, syntaxErr()
+			}
+			toks = toks[1:]
+		}
+	}
+	if len(vals) == 0 {
+		return nil, syntaxErr()
+	}
+	stmt.value = strings.Join(vals, ", ")
+	return stmt, nil
+}
+
+/*
+cols() returns the result columns of a SHOW, or nil for statements that don't return rows.
+*/
+func (stmt *sessionStmt) cols() []resultCol {
+	if stmt.verb != "SHOW" {
+		return nil
+	}
+	text := typeForOID(pgtype.TextOID)
+	if stmt.name == "" {
+		return []resultCol{{Name: "name", Type: text}, {Name: "setting", Type: text}, {Name: "description", Type: text}}
+	}
+	name := stmt.name
+	if def, ok := paramsByName[strings.ToLower(name)]; ok {
+		name = def.name
+	}
+	return []resultCol{{Name: name, Type: text}}
+}
+
+/*
+runSessionStmt() carries out a SET, SHOW, or RESET, returning the rows of a SHOW and any warning for the client.
+*/
+func (rz *RhizomeBackend) runSessionStmt(stmt *sessionStmt) ([][]string, *pgproto3.NoticeResponse, error) {
+	switch {
+	case stmt.verb == "SHOW" && stmt.name == "":
+		var rows [][]string
+		for _, row := range rz.settingsRows() {
+			rows = append(rows, row[:])
+		}
+		return rows, nil, nil
+	case stmt.verb == "SHOW":
+		def, err := lookupParam(stmt.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		val, ok := rz.params.values[strings.ToLower(stmt.name)]
+		if def == nil && !ok {
+			return nil, nil, newPgError("42704", "unrecognized configuration parameter \"%s\"", stmt.name)
+		}
+		return [][]string{{val}}, nil, nil
+	case stmt.local && connAutoCommit(rz.sqlConn):
+		// as Postgres does, SET LOCAL outside of a transaction block is ignored with a warning
+		if _, err := lookupParam(stmt.name); err != nil {
+			return nil, nil, err
+		}
+		return nil, txWarning("25P01", "SET LOCAL can only be used in transaction blocks"), nil
+	case stmt.verb == "RESET" && stmt.name == "":
+		for _, def := range paramDefs {
+			if !def.readOnly {
+				if err := rz.resetParam(def.name); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		return nil, nil, nil
+	case stmt.verb == "RESET" || stmt.reset:
+		return nil, nil, rz.resetParam(stmt.name)
+	}
+	return nil, nil, rz.setParam(stmt.name, stmt.value, stmt.local)
+}
+
+/*
+sessionStmtMsgs() runs a statement isSessionStmt() accepts, for a simple query or an Execute, returning the messages to
+send (with a RowDescription only if describe is set).
+*/
+func (rz *RhizomeBackend) sessionStmtMsgs(query string, describe bool) ([]pgproto3.Message, error) {
+	if isNotifyStmt(query) {
+		tag, err := rz.runNotifyStmt(query)
+		if err != nil {
+			return nil, err
+		}
+		return []pgproto3.Message{&pgproto3.CommandComplete{CommandTag: []byte(tag)}}, nil
+	}
+	stmt, err := parseSessionStmt(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, notice, err := rz.runSessionStmt(stmt)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []pgproto3.Message
+	if notice != nil {
+		msgs = append(msgs, notice)
+	}
+	if cols := stmt.cols(); cols != nil && describe {
+		msgs = append(msgs, describeCols(cols, nil))
+	}
+	for _, row := range rows {
+		vals := make([][]byte, len(row))
+		for i, v := range row {
+			vals[i] = []byte(v)
+		}
+		msgs = append(msgs, &pgproto3.DataRow{Values: vals})
+	}
+	return append(msgs, &pgproto3.CommandComplete{CommandTag: []byte(stmt.verb)}), nil
+}
+
+/*
+sessionStmtCols() returns the result columns of a statement isSessionStmt() accepts, as it's prepared.
+*/
+func sessionStmtCols(query string) ([]resultCol, error) {
+	if isNotifyStmt(query) {
+		_, err := parseNotifyStmt(query)
+		return nil, err
+	}
+	stmt, err := parseSessionStmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.cols(), nil
+}
+
+func invalidParamValue(name, val string) error {
+	return newPgError("22023", "invalid value for parameter \"%s\": \"%s\"", name, val)
+}
+
+func checkEnum(allowed ...string) func(string) (string, error) {
+	return func(val string) (string, error) {
+		for _, a := range allowed {
+			if strings.EqualFold(val, a) {
+				return a, nil
+			}
+		}
+		return "", newPgError("22023", "invalid value \"%s\" (allowed values: %s)", val, strings.Join(allowed, ", "))
+	}
+}
+
+func checkIntRange(min, max int) func(string) (string, error) {
+	return func(val string) (string, error) {
+		n, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil {
+			return "", newPgError("22023", "invalid value \"%s\": an integer is required", val)
+		}
+		if n < min || n > max {
+			return "", newPgError("22023", "%d is outside the valid range (%d .. %d)", n, min, max)
+		}
+		return strconv.Itoa(n), nil
+	}
+}
+
+func checkEncoding(val string) (string, error) {
+	switch strings.ToUpper(strings.ReplaceAll(val, "-", "")) {
+	case "UTF8", "UNICODE":
+		return "UTF8", nil
+	}
+	return "", newPgError("22023", "invalid value for parameter \"client_encoding\": \"%s\" (only UTF8 is supported)", val)
+}
+
+/*
+checkDateStyle() accepts the ISO output style (the only one we print dates in), with any field order.
+*/
+func checkDateStyle(val string) (string, error) {
+	style, order := "ISO", "MDY"
+	for _, part := range strings.Split(val, ",") {
+		switch p := strings.ToUpper(strings.TrimSpace(part)); p {
+		case "ISO":
+		case "MDY", "DMY", "YMD":
+			order = p
+		case "US", "NONEURO", "NONEUROPEAN":
+			order = "MDY"
+		case "EURO", "EUROPEAN":
+			order = "DMY"
+		case "SQL", "POSTGRES", "GERMAN":
+			return "", newPgError("0A000", "DateStyle %s is not supported, only ISO", p)
+		default:
+			return "", invalidParamValue("DateStyle", val)
+		}
+	}
+	return style + ", " + order, nil
+}
+
+func checkDuration(val string) (string, error) {
+	d, err := parseDuration(val)
+	if err != nil {
+		return "", err
+	}
+	return formatDuration(d), nil
+}
+
+// durationUnits are the units timeouts can be given in, largest first
+var durationUnits = []struct {
+	name string
+	d    time.Duration
+}{
+	{"d", 24 * time.Hour}, {"h", time.Hour}, {"min", time.Minute}, {"s", time.Second}, {"ms", time.Millisecond},
+}
+
+/*
+parseDuration() parses a timeout, which is a number of milliseconds, optionally followed by a unit.
+*/
+func parseDuration(val string) (time.Duration, error) {
+	s := strings.TrimSpace(val)
+	i := 0
+	for i < len(s) && (isDigit(s[i]) || (i == 0 && s[i] == '-')) {
+		i++
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || n < 0 {
+		return 0, newPgError("22023", "invalid value for a timeout: \"%s\"", val)
+	}
+	unit := strings.TrimSpace(s[i:])
+	if unit == "" {
+		return time.Duration(n) * time.Millisecond, nil
+	}
+	for _, u := range durationUnits {
+		if unit == u.name {
+			return time.Duration(n) * u.d, nil
+		}
+	}
+	if unit == "us" {
+		return time.Duration(n) * time.Microsecond, nil
+	}
+	return 0, newPgError("22023", "invalid value for a timeout: \"%s\" (valid units are \"us\", \"ms\", \"s\", \"min\", \"h\", and \"d\")", val)
+}
+
+/*
+formatDuration() shows a timeout the way Postgres does, in the largest unit that divides it.
+*/
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0"
+	}
+	for _, u := range durationUnits {
+		if d%u.d == 0 {
+			return fmt.Sprintf("%d%s", d/u.d, u.name)
+		}
+	}
+	return fmt.Sprintf("%dus", d/time.Microsecond)
+}
+
+/*
+checkTimeZone() accepts a time zone name, UTC, or a numeric offset from UTC in hours (or hours and minutes).
+*/
+func checkTimeZone(val string) (string, error) {
+	switch {
+	case strings.EqualFold(val, "UTC"), strings.EqualFold(val, "Z"), strings.EqualFold(val, "GMT"):
+		return "UTC", nil
+	case val == "" || strings.EqualFold(val, "Local"):
+		return "", invalidParamValue("TimeZone", val)
+	}
+	if _, ok := parseZoneOffset(val); ok {
+		return val, nil
+	}
+	if _, err := time.LoadLocation(val); err == nil {
+		return val, nil
+	}
+	return "", newPgError("22023", "invalid value for parameter \"TimeZone\": \"%s\"", val)
+}
+
+/*
+zoneLocation() returns the location for a (checked) TimeZone value.
+*/
+func zoneLocation(zone string) *time.Location {
+	if zone == "" || zone == "UTC" {
+		return time.UTC
+	}
+	if offset, ok := parseZoneOffset(zone); ok {
+		return time.FixedZone(zone, offset)
+	}
+	if loc, err := time.LoadLocation(zone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+/*
+parseZoneOffset() parses an offset like "-7", "+05:30", or "5.5" (hours east of UTC), returning it in seconds.
+*/
+func parseZoneOffset(val string) (int, bool) {
+	s := strings.TrimSpace(val)
+	sign := 1
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+	}
+	var secs float64
+	if h, m, ok := strings.Cut(s, ":"); ok {
+		hours, err1 := strconv.Atoi(h)
+		mins, err2 := strconv.Atoi(m)
+		if err1 != nil || err2 != nil || mins >= 60 {
+			return 0, false
+		}
+		secs = float64(hours*3600 + mins*60)
+	} else {
+		hours, err := strconv.ParseFloat(s, 64)
+		if err != nil || s == "" || !isDigit(s[0]) {
+			return 0, false
+		}
+		secs = hours * 3600
+	}
+	if secs > 15*3600 {
+		return 0, false
+	}
+	return sign * int(secs), true
+}
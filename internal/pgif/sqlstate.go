@@ -0,0 +1,190 @@
+package pgif
+
+import (
+	"errors"
+	"fmt"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"strings"
+)
+
+/*
+Mapping Sqlite errors onto Postgres SQLSTATEs. Sqlite's result codes are much coarser than SQLSTATEs: constraint
+violations are told apart by their extended codes, but almost every error in a statement itself (syntax errors,
+missing tables and columns, and so on) is a plain SQLITE_ERROR, so for those we go by the message. Sqlite's messages
+are kept as they are, and where they name a table, column, or constraint, that goes in the matching ErrorResponse
+field, as Postgres does.
+*/
+
+// sqliteConstraintDataType is SQLITE_CONSTRAINT_DATATYPE (a value of the wrong type in a STRICT table)
+var sqliteConstraintDataType = sqlite3.ErrConstraint.Extend(12)
+
+// sqliteErrorPrefixes maps the beginnings of SQLITE_ERROR messages to SQLSTATEs, and whether what follows is a table
+var sqliteErrorPrefixes = []struct {
+	prefix  string
+	code    string
+	isTable bool
+}{
+	{"no such table: ", "42P01", true},
+	{"no such view: ", "42P01", true},
+	{"no such column: ", "42703", false},
+	{"no such function: ", "42883", false},
+	{"no such index: ", "42704", false},
+	{"no such collation sequence: ", "42704", false},
+	{"no such savepoint: ", "3B001", false},
+	{"ambiguous column name: ", "42702", false},
+	{"table ", "42P07", true},
+	{"index ", "42P07", false},
+	{"view ", "42P07", true},
+	{"trigger ", "42710", false},
+	{"wrong number of arguments to function ", "42883", false},
+	{"not authorized to use function: ", "42501", false},
+	{"cannot start a transaction within a transaction", "25001", false},
+	{"cannot commit - no transaction is active", "25P01", false},
+	{"cannot rollback - no transaction is active", "25P01", false},
+	{"cannot commit transaction - SQL statements in progress", "25000", false},
+	{"near ", "42601", false},
+	{"incomplete input", "42601", false},
+	{"unrecognized token: ", "42601", false},
+	{"sub-select returns ", "42601", false},
+}
+
+/*
+fromSqliteError() converts an error from go-sqlite3 into a pgError with the closest matching SQLSTATE.
+*/
+func fromSqliteError(err sqlite3.Error) *pgError {
+	msg := err.Error()
+	pgerr := &pgError{Code: "XX000", Message: msg}
+	switch err.Code {
+	case sqlite3.ErrConstraint:
+		constraintError(pgerr, err.ExtendedCode, msg)
+	case sqlite3.ErrError:
+		for _, p := range sqliteErrorPrefixes {
+			if !strings.HasPrefix(msg, p.prefix) {
+				continue
+			}
+			// "table x already exists" and friends share their beginnings with other messages
+			if p.code == "42P07" || p.code == "42710" {
+				if !strings.HasSuffix(msg, " already exists") {
+					continue
+				}
+				name := strings.TrimSuffix(strings.TrimPrefix(msg, p.prefix), " already exists")
+				if p.isTable {
+					pgerr.Schema, pgerr.Table = splitQualified(name)
+				}
+			} else if p.isTable {
+				pgerr.Schema, pgerr.Table = splitQualified(strings.TrimPrefix(msg, p.prefix))
+			}
+			pgerr.Code = p.code
+			break
+		}
+		if pgerr.Code == "XX000" && (strings.HasSuffix(msg, " values were supplied") ||
+			(strings.Contains(msg, " values for ") && strings.HasSuffix(msg, " columns"))) {
+			pgerr.Code = "42601"
+		} else if pgerr.Code == "XX000" && strings.Contains(msg, " has no column named ") {
+			pgerr.Code = "42703"
+			pgerr.Table = strings.TrimPrefix(msg[:strings.Index(msg, " has no column named ")], "table ")
+			pgerr.Column = msg[strings.Index(msg, " has no column named ")+len(" has no column named "):]
+		}
+	case sqlite3.ErrBusy:
+		pgerr.Code = "40001"
+		pgerr.Hint = "The database is being written by another session; retry the transaction."
+	case sqlite3.ErrLocked:
+		pgerr.Code = "55P03"
+	case sqlite3.ErrFull:
+		pgerr.Code = "53100"
+	case sqlite3.ErrNomem:
+		pgerr.Code = "53200"
+	case sqlite3.ErrReadonly:
+		pgerr.Code = "25006"
+	case sqlite3.ErrInterrupt:
+		pgerr.Code = "57014"
+	case sqlite3.ErrIoErr, sqlite3.ErrCantOpen:
+		pgerr.Code = "58030"
+	case sqlite3.ErrCorrupt, sqlite3.ErrNotADB:
+		pgerr.Code = "XX001"
+	case sqlite3.ErrTooBig:
+		pgerr.Code = "54000"
+	case sqlite3.ErrMismatch:
+		pgerr.Code = "42804"
+	case sqlite3.ErrAuth, sqlite3.ErrPerm:
+		pgerr.Code = "42501"
+	case sqlite3.ErrRange:
+		pgerr.Code = "22023"
+	}
+	return pgerr
+}
+
+/*
+constraintError() fills in a constraint violation, from messages like "UNIQUE constraint failed: t.a, t.b".
+*/
+func constraintError(pgerr *pgError, ext sqlite3.ErrNoExtended, msg string) {
+	failed := ""
+	if i := strings.Index(msg, " constraint failed: "); i >= 0 {
+		failed = msg[i+len(" constraint failed: "):]
+	}
+	var table string
+	var cols []string
+	for _, qual := range strings.Split(failed, ", ") {
+		if i := strings.LastIndexByte(qual, '.'); i > 0 {
+			table = qual[:i]
+			cols = append(cols, qual[i+1:])
+		}
+	}
+	pgerr.Table = table
+	if len(cols) == 1 {
+		pgerr.Column = cols[0]
+	}
+
+	switch ext {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey, sqlite3.ErrConstraintRowID:
+		pgerr.Code = "23505"
+		// Sqlite doesn't name unique constraints, so we give them the names Postgres would have
+		if ext == sqlite3.ErrConstraintUnique && table != "" {
+			pgerr.Constraint = table + "_" + strings.Join(cols, "_") + "_key"
+		} else if table != "" {
+			pgerr.Constraint = table + "_pkey"
+		}
+		if len(cols) > 0 {
+			pgerr.Detail = fmt.Sprintf("Key (%s) already exists.", strings.Join(cols, ", "))
+		}
+	case sqlite3.ErrConstraintForeignKey:
+		pgerr.Code = "23503"
+	case sqlite3.ErrConstraintNotNull:
+		pgerr.Code = "23502"
+	case sqlite3.ErrConstraintCheck:
+		pgerr.Code = "23514"
+		pgerr.Constraint = failed
+	case sqlite3.ErrConstraintTrigger:
+		// RAISE(ABORT, ...) and friends in a trigger
+		pgerr.Code = "P0001"
+	case sqliteConstraintDataType:
+		pgerr.Code = "22P02"
+	default:
+		pgerr.Code = "23000"
+	}
+}
+
+/*
+splitQualified() splits a possibly schema-qualified name.
+*/
+func splitQualified(name string) (schema, table string) {
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+/*
+asPgError() returns the pgError an error carries or, failing that, the one for the Sqlite error it carries.
+*/
+func asPgError(err error) (*pgError, bool) {
+	var pgerr *pgError
+	if errors.As(err, &pgerr) {
+		return pgerr, true
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return fromSqliteError(sqliteErr), true
+	}
+	return nil, false
+}
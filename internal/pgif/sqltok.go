@@ -0,0 +1,374 @@
+package pgif
+
+import (
+	"strings"
+)
+
+/*
+A minimal SQL tokenizer. It doesn't try to understand grammar; it only splits a statement into words, literals,
+parameters, and punctuation so that we can recognize statements (COPY, SET, BEGIN, etc.) and rewrite small pieces of
+them without being fooled by keywords that appear inside strings, quoted identifiers, or comments.
+*/
+
+type sqlTokenKind int
+
+const (
+	tokWord sqlTokenKind = iota
+	tokQuotedIdent
+	tokString
+	tokNumber
+	tokParam
+	tokOp
+	tokSpace
+	tokComment
+	// tokExpr is an expression rewritten by the dialect translation (see translate.go); the tokenizer never produces it
+	tokExpr
+)
+
+type sqlToken struct {
+	Kind sqlTokenKind
+	Text string
+	Pos  int
+}
+
+/*
+upper() returns the upper-cased text of a bare word, or the empty string for anything else, which makes keyword
+matching a single comparison.
+*/
+func (tok sqlToken) upper() string {
+	if tok.Kind != tokWord {
+		return ""
+	}
+	return strings.ToUpper(tok.Text)
+}
+
+func (tok sqlToken) is(kw string) bool {
+	return tok.Kind == tokWord && strings.EqualFold(tok.Text, kw)
+}
+
+func (tok sqlToken) isOp(op string) bool {
+	return tok.Kind == tokOp && tok.Text == op
+}
+
+/*
+ident() returns the identifier a word or quoted identifier refers to, with quoting removed.
+*/
+func (tok sqlToken) ident() string {
+	if tok.Kind == tokQuotedIdent {
+		return strings.ReplaceAll(tok.Text[1:len(tok.Text)-1], `""`, `"`)
+	}
+	return tok.Text
+}
+
+/*
+unquote() returns the value of a string literal, handling doubled quotes and (for E-prefixed strings) backslash escapes.
+*/
+func (tok sqlToken) unquote() string {
+	if tok.Kind != tokString {
+		return tok.Text
+	}
+	txt := tok.Text
+	escaped := false
+	if txt[0] == 'e' || txt[0] == 'E' {
+		escaped = true
+		txt = txt[1:]
+	}
+	txt = strings.ReplaceAll(txt[1:len(txt)-1], "''", "'")
+	if escaped {
+		txt = unescapeBackslashes(txt)
+	}
+	return txt
+}
+
+func unescapeBackslashes(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'v':
+			sb.WriteByte('\v')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '$'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+/*
+tokenizeSQL() splits a query into tokens. Every byte of the input belongs to exactly one token, so joining the token
+texts reproduces the original string. Unterminated strings or comments run to the end of the input.
+*/
+func tokenizeSQL(s string) []sqlToken {
+	toks := make([]sqlToken, 0, len(s)/4)
+	i := 0
+	for i < len(s) {
+		start := i
+		c := s[i]
+		kind := tokOp
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			kind = tokSpace
+			for i < len(s) && strings.IndexByte(" \t\n\r\f\v", s[i]) >= 0 {
+				i++
+			}
+		case c == '-' && i+1 < len(s) && s[i+1] == '-':
+			kind = tokComment
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(s) && s[i+1] == '*':
+			kind = tokComment
+			depth := 0
+			for i < len(s) {
+				if s[i] == '/' && i+1 < len(s) && s[i+1] == '*' {
+					depth++
+					i += 2
+				} else if s[i] == '*' && i+1 < len(s) && s[i+1] == '/' {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+		case (c == 'e' || c == 'E') && i+1 < len(s) && s[i+1] == '\'':
+			kind = tokString
+			i = scanQuoted(s, i+1, '\'', true)
+		case c == '\'':
+			kind = tokString
+			i = scanQuoted(s, i, '\'', false)
+		case c == '"':
+			kind = tokQuotedIdent
+			i = scanQuoted(s, i, '"', false)
+		case c == '`' || c == '[':
+			// Sqlite also accepts MySQL- and MSSQL-style quoted identifiers
+			kind = tokQuotedIdent
+			end := byte('`')
+			if c == '[' {
+				end = ']'
+			}
+			i++
+			for i < len(s) && s[i] != end {
+				i++
+			}
+			if i < len(s) {
+				i++
+			}
+		case c == '$' && i+1 < len(s) && isDigit(s[i+1]):
+			kind = tokParam
+			i++
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+		case c == '$' && i+1 < len(s) && (s[i+1] == '$' || isIdentStart(s[i+1])):
+			// possibly a dollar-quoted string ($$...$$ or $tag$...$tag$)
+			j := i + 1
+			for j < len(s) && s[j] != '$' && isIdentChar(s[j]) {
+				j++
+			}
+			if j < len(s) && s[j] == '$' {
+				tag := s[i : j+1]
+				end := strings.Index(s[j+1:], tag)
+				kind = tokString
+				if end < 0 {
+					i = len(s)
+				} else {
+					i = j + 1 + end + len(tag)
+				}
+			} else {
+				kind = tokParam
+				i = j
+			}
+		case (c == '?' || c == ':' || c == '@') && i+1 < len(s) && isIdentChar(s[i+1]) && !(c == ':' && s[i+1] == ':'):
+			// Sqlite-style parameters (?NNN, :name, @name)
+			kind = tokParam
+			i++
+			for i < len(s) && isIdentChar(s[i]) {
+				i++
+			}
+		case c == '?':
+			kind = tokParam
+			i++
+		case isDigit(c) || (c == '.' && i+1 < len(s) && isDigit(s[i+1])):
+			kind = tokNumber
+			i = scanNumber(s, i)
+		case isIdentStart(c):
+			kind = tokWord
+			for i < len(s) && isIdentChar(s[i]) {
+				i++
+			}
+		default:
+			i += opLength(s, i)
+		}
+		toks = append(toks, sqlToken{Kind: kind, Text: s[start:i], Pos: start})
+	}
+	return toks
+}
+
+func scanQuoted(s string, i int, q byte, backslashes bool) int {
+	i++
+	for i < len(s) {
+		if backslashes && s[i] == '\\' {
+			i += 2
+			continue
+		}
+		if s[i] == q {
+			if i+1 < len(s) && s[i+1] == q {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(s)
+}
+
+func scanNumber(s string, i int) int {
+	if s[i] == '0' && i+1 < len(s) && (s[i+1] == 'x' || s[i+1] == 'X') {
+		i += 2
+		for i < len(s) && strings.IndexByte("0123456789abcdefABCDEF", s[i]) >= 0 {
+			i++
+		}
+		return i
+	}
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			i = j
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+var multiCharOps = []string{"::", "<>", "!=", "<=", ">=", "||", "->>", "->", "!~*", "!~", "~*", "<<", ">>", "=="}
+
+func opLength(s string, i int) int {
+	for _, op := range multiCharOps {
+		if strings.HasPrefix(s[i:], op) {
+			return len(op)
+		}
+	}
+	return 1
+}
+
+/*
+matchParen() returns the index of the parenthesis matching the one at i (searching forwards from "(" and backwards from
+")"), or -1.
+*/
+func matchParen(toks []sqlToken, i int) int {
+	step, open, close := 1, "(", ")"
+	if toks[i].isOp(")") {
+		step, open, close = -1, ")", "("
+	}
+	depth := 0
+	for ; i >= 0 && i < len(toks); i += step {
+		if toks[i].isOp(open) {
+			depth++
+		} else if toks[i].isOp(close) {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+/*
+significant() filters out whitespace and comments.
+*/
+func significant(toks []sqlToken) []sqlToken {
+	out := make([]sqlToken, 0, len(toks))
+	for _, tok := range toks {
+		if tok.Kind != tokSpace && tok.Kind != tokComment {
+			out = append(out, tok)
+		}
+	}
+	return out
+}
+
+/*
+isBlankSQL() reports whether a query contains nothing but whitespace, comments, and semicolons.
+*/
+func isBlankSQL(query string) bool {
+	for _, tok := range tokenizeSQL(query) {
+		if tok.Kind != tokSpace && tok.Kind != tokComment && !tok.isOp(";") {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+firstKeyword() returns the first word of a statement, upper-cased.
+*/
+func firstKeyword(query string) string {
+	for _, tok := range tokenizeSQL(query) {
+		if tok.Kind == tokSpace || tok.Kind == tokComment || tok.isOp("(") {
+			continue
+		}
+		return tok.upper()
+	}
+	return ""
+}
+
+/*
+quoteString() quotes a string literal for use in a generated Sqlite statement.
+*/
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+/*
+quoteIdent() quotes an identifier for use in a generated Sqlite statement.
+*/
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
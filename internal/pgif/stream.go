@@ -0,0 +1,58 @@
+package pgif
+
+import (
+	"database/sql"
+	"github.com/jackc/pgproto3/v2"
+	"io"
+)
+
+/*
+rowWriter streams the rows of a result to the client one DataRow at a time, rather than collecting them all first, and
+enforces BackendConfig.MaxResultBytes across everything a single query (or portal) returns.
+*/
+type rowWriter struct {
+	w    io.Writer
+	max  int64
+	sent int64
+	enc  valueEncoding
+	buf  []byte
+}
+
+func (rz *RhizomeBackend) newRowWriter() *rowWriter {
+	return &rowWriter{w: rz.out, max: rz.cfg.MaxResultBytes, enc: rz.valueEncoding()}
+}
+
+func resultTooLarge(max int64) error {
+	return newPgError("54000", "query result exceeds the maximum of %d bytes", max)
+}
+
+func (rw *rowWriter) writeRow(row *pgproto3.DataRow) error {
+	rw.buf = row.Encode(rw.buf[:0])
+	rw.sent += int64(len(rw.buf))
+	if rw.max > 0 && rw.sent > rw.max {
+		return resultTooLarge(rw.max)
+	}
+	_, err := rw.w.Write(rw.buf)
+	return err
+}
+
+/*
+writeRows() streams up to limit rows (or all of them, if limit is 0), with columns in the given formats, and returns
+how many it sent, and whether the rows ran out.
+*/
+func (rw *rowWriter) writeRows(rows *sql.Rows, cols []resultCol, formats []bool, limit int64) (n int64, done bool, err error) {
+	for limit == 0 || n < limit {
+		if !rows.Next() {
+			return n, true, rows.Err()
+		}
+		pgrow, err := scanPgRow(rows, cols, formats, rw.enc)
+		if err != nil {
+			return n, false, err
+		}
+		if err := rw.writeRow(pgrow); err != nil {
+			return n, false, err
+		}
+		n++
+	}
+	return n, false, nil
+}
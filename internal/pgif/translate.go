@@ -0,0 +1,769 @@
+package pgif
+
+import (
+	"strings"
+)
+
+/*
+Dialect translation. Sqlite and Postgres agree on most everyday SQL, and Sqlite is forgiving about the rest (it
+accepts any type name, TRUE and FALSE, RETURNING, and upserts with EXCLUDED), but the Postgres-specific constructs
+that clients and migrations commonly use are syntax errors to Sqlite. With BackendConfig.Dialect set, every query is
+rewritten before Sqlite sees it:
+  - expr::type casts become CAST(expr AS ...) (or date()/time() for those types, and nothing at all for types Sqlite
+    stores as text anyway, such as timestamps, uuids and json);
+  - E'...' and $$...$$ strings become ordinary strings;
+  - ILIKE becomes LIKE (which is case-insensitive in Sqlite), and the ~ family of regular expression matches become
+    REGEXP;
+  - functions, types, and operators lose any pg_catalog qualifier, and COLLATE clauses naming Postgres' built-in
+    collations are dropped;
+  - now(), CURRENT_TIMESTAMP and friends give an ISO timestamp with microseconds and offset, as Postgres does;
+  - gen_random_uuid() gives a random (version 4) uuid, and string_agg() becomes group_concat();
+  - SERIAL types and GENERATED ... AS IDENTITY columns become INTEGER (a rowid alias, when they're the primary key);
+  - TIMESTAMP WITH TIME ZONE and friends become single-word type names, and the public schema is Sqlite's main;
+  - CREATE INDEX loses CONCURRENTLY and USING btree;
+  - ON CONFLICT ON CONSTRAINT name loses the constraint (Sqlite applies a target-less last ON CONFLICT clause to any
+    conflict), and INSERT ... SELECT ... FROM ... ON CONFLICT gains the WHERE true Sqlite needs to parse it;
+  - SELECT DISTINCT ON (...) over a single table is rewritten with row_number().
+In strict mode, constructs we recognize but can't translate are rejected with feature_not_supported; in best-effort
+mode they are passed to Sqlite as they are (or, for casts to types we don't know, the cast is dropped).
+
+The translation works on tokens rather than a parse tree, so it only rewrites what it can recognize locally.
+*/
+
+const nowSQL = `(strftime('%Y-%m-%d %H:%M:%f+00', 'now'))`
+
+const uuidSQL = `(lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || ` +
+	`substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + (abs(random()) % 4), 1) || ` +
+	`substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6))))`
+
+type translator struct {
+	strict bool
+}
+
+/*
+translateSQL() translates a query (which may hold several statements) from Postgres' dialect to Sqlite's.
+*/
+func translateSQL(query string, mode DialectMode) (string, error) {
+	if mode != DialectBestEffort && mode != DialectStrict {
+		return query, nil
+	}
+	tr := &translator{strict: mode == DialectStrict}
+	var sb strings.Builder
+	for rest := query; rest != ""; {
+		stmt, tail := splitFirstStmt(rest)
+		out, err := tr.translateStmt(stmt)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(out)
+		rest = tail
+	}
+	return sb.String(), nil
+}
+
+/*
+unsupported() reports a construct we can't translate: an error in strict mode, and nothing in best-effort mode.
+*/
+func (tr *translator) unsupported(what string) error {
+	if !tr.strict {
+		return nil
+	}
+	return newPgError("0A000", "%s cannot be translated to Sqlite", what)
+}
+
+func (tr *translator) translateStmt(stmt string) (string, error) {
+	toks := tokenizeSQL(stmt)
+	var err error
+	for _, pass := range []func([]sqlToken) ([]sqlToken, error){
+		tr.literals, tr.qualifiers, tr.typeNames, tr.functions, tr.casts, tr.ddl, tr.upsert, tr.distinctOn,
+	} {
+		if toks, err = pass(toks); err != nil {
+			return "", err
+		}
+	}
+	return joinTokens(toks), nil
+}
+
+func joinTokens(toks []sqlToken) string {
+	var sb strings.Builder
+	for _, tok := range toks {
+		sb.WriteString(tok.Text)
+	}
+	return sb.String()
+}
+
+func tokAt(toks []sqlToken, i int) sqlToken {
+	if i < 0 || i >= len(toks) {
+		return sqlToken{Kind: tokSpace}
+	}
+	return toks[i]
+}
+
+func nextSig(toks []sqlToken, i int) int {
+	for i++; i < len(toks) && (toks[i].Kind == tokSpace || toks[i].Kind == tokComment); i++ {
+	}
+	return i
+}
+
+func prevSig(toks []sqlToken, i int) int {
+	for i--; i >= 0 && (toks[i].Kind == tokSpace || toks[i].Kind == tokComment); i-- {
+	}
+	return i
+}
+
+/*
+findTopLevel() returns the index of the first of the given keywords at or after i that isn't inside parentheses, or
+-1. It stops at an unmatched ")".
+*/
+func findTopLevel(toks []sqlToken, i int, words ...string) int {
+	depth := 0
+	for ; i < len(toks); i++ {
+		switch {
+		case toks[i].isOp("("):
+			depth++
+		case toks[i].isOp(")"):
+			if depth--; depth < 0 {
+				return -1
+			}
+		case depth == 0 && toks[i].Kind == tokWord:
+			for _, w := range words {
+				if toks[i].is(w) {
+					return i
+				}
+			}
+		}
+	}
+	return -1
+}
+
+/*
+splice() replaces toks[start:end+1] with a single token.
+*/
+func splice(toks []sqlToken, start, end int, kind sqlTokenKind, text string) []sqlToken {
+	out := make([]sqlToken, 0, len(toks)-(end-start))
+	out = append(out, toks[:start]...)
+	out = append(out, sqlToken{Kind: kind, Text: text, Pos: toks[start].Pos})
+	return append(out, toks[end+1:]...)
+}
+
+/*
+literals() turns E'...' and dollar-quoted strings, which Sqlite doesn't have, into ordinary string literals.
+*/
+func (tr *translator) literals(toks []sqlToken) ([]sqlToken, error) {
+	for i, tok := range toks {
+		if tok.Kind != tokString {
+			continue
+		}
+		switch tok.Text[0] {
+		case 'e', 'E':
+			toks[i].Text = quoteString(tok.unquote())
+		case '$':
+			tag := tok.Text[:strings.IndexByte(tok.Text[1:], '$')+2]
+			body := strings.TrimPrefix(tok.Text, tag)
+			toks[i].Text = quoteString(strings.TrimSuffix(body, tag))
+		}
+	}
+	return toks, nil
+}
+
+/*
+qualifiers() drops the pg_catalog qualifier that Postgres tools put on functions, types, and operators (so
+OPERATOR(pg_catalog.~) is just ~), but not on the catalog tables, and drops COLLATE clauses naming the built-in
+collations.
+*/
+func (tr *translator) qualifiers(toks []sqlToken) ([]sqlToken, error) {
+	for i := 0; i < len(toks); i++ {
+		tok := toks[i]
+		switch {
+		case tok.is("OPERATOR") && tokAt(toks, nextSig(toks, i)).isOp("("):
+			close := matchParen(toks, nextSig(toks, i))
+			if close < 0 {
+				continue
+			}
+			op := strings.TrimSpace(joinTokens(toks[nextSig(toks, i)+1 : close]))
+			toks = splice(toks, i, close, tokOp, strings.TrimPrefix(op, "pg_catalog."))
+		case tok.is("COLLATE"):
+			end := nextSig(toks, i)
+			if tokAt(toks, end).is("PG_CATALOG") && tokAt(toks, nextSig(toks, end)).isOp(".") {
+				end = nextSig(toks, nextSig(toks, end))
+			}
+			if name := tokAt(toks, end); name.Kind == tokWord || name.Kind == tokQuotedIdent {
+				switch strings.ToLower(name.ident()) {
+				case "default", "c", "posix":
+					toks = splice(toks, i, end, tokSpace, "")
+				}
+			}
+		case tok.is("PG_CATALOG") && tokAt(toks, nextSig(toks, i)).isOp(".") && !tokAt(toks, prevSig(toks, i)).isOp("."):
+			name := tokAt(toks, nextSig(toks, nextSig(toks, i)))
+			if (name.Kind == tokWord || name.Kind == tokQuotedIdent) && catalogNames[strings.ToLower(name.ident())] {
+				continue
+			}
+			toks = splice(toks, i, nextSig(toks, i), tokSpace, "")
+		}
+	}
+	return toks, nil
+}
+
+/*
+typeNames() rewrites the type names that Sqlite can't parse (because they contain keywords) into ones it can, and
+which the type registry recognizes.
+*/
+func (tr *translator) typeNames(toks []sqlToken) ([]sqlToken, error) {
+	for i := 0; i < len(toks); i++ {
+		if !toks[i].is("TIMESTAMP") && !toks[i].is("TIME") {
+			continue
+		}
+		with := nextSig(toks, i)
+		tz := nextSig(toks, with)
+		zone := nextSig(toks, tz)
+		if !tokAt(toks, tz).is("TIME") || !tokAt(toks, zone).is("ZONE") {
+			continue
+		}
+		switch {
+		case tokAt(toks, with).is("WITH"):
+			toks = splice(toks, i, zone, tokWord, toks[i].Text+"TZ")
+		case tokAt(toks, with).is("WITHOUT"):
+			toks = splice(toks, i, zone, tokWord, toks[i].Text)
+		}
+	}
+	return toks, nil
+}
+
+// castTypes maps the Postgres types we can CAST to onto Sqlite's type affinities
+var castTypes = map[string]string{
+	"int": "INTEGER", "integer": "INTEGER", "int2": "INTEGER", "int4": "INTEGER", "int8": "INTEGER",
+	"smallint": "INTEGER", "bigint": "INTEGER",
+	"real": "REAL", "float": "REAL", "float4": "REAL", "float8": "REAL", "double precision": "REAL",
+	"numeric": "NUMERIC", "decimal": "NUMERIC",
+	"text": "TEXT", "varchar": "TEXT", "character varying": "TEXT", "char": "TEXT", "character": "TEXT",
+	"bpchar": "TEXT", "name": "TEXT", "citext": "TEXT",
+	"bytea": "BLOB",
+	"oid":   "INTEGER", "regtype": "INTEGER", "regproc": "INTEGER", "regprocedure": "INTEGER", "regnamespace": "INTEGER",
+	"regrole": "INTEGER",
+}
+
+// textTypes are types whose values Sqlite keeps as text already, so casts to them can just be dropped
+var textTypes = map[string]bool{
+	"timestamp": true, "timestamptz": true, "uuid": true, "json": true, "jsonb": true, "unknown": true,
+}
+
+// nonFunctionWords are keywords that can come before a parenthesized expression without being a function call
+var nonFunctionWords = map[string]bool{
+	"SELECT": true, "WHERE": true, "AND": true, "OR": true, "NOT": true, "IN": true, "ON": true, "WHEN": true,
+	"THEN": true, "ELSE": true, "VALUES": true, "AS": true, "BY": true, "FROM": true, "JOIN": true, "SET": true,
+	"HAVING": true, "CASE": true, "IS": true, "LIKE": true, "BETWEEN": true, "RETURNING": true, "USING": true,
+	"DISTINCT": true, "ALL": true, "ANY": true, "RETURN": true,
+}
+
+/*
+operandStart() returns the index of the first token of the operand ending at toks[end], or -1 if there isn't one we
+recognize: a literal, parameter, (qualified) name, parenthesized expression, or function call.
+*/
+func operandStart(toks []sqlToken, end int) int {
+	if end < 0 {
+		return -1
+	}
+	start := end
+	switch tok := toks[end]; {
+	case tok.isOp(")"):
+		if start = matchParen(toks, end); start < 0 {
+			return -1
+		}
+		if f := prevSig(toks, start); f >= 0 && (toks[f].Kind == tokWord || toks[f].Kind == tokQuotedIdent) &&
+			!nonFunctionWords[toks[f].upper()] {
+			start = f
+		}
+	case tok.is("END"):
+		// CASE ... END
+		depth := 0
+		for start = end; start >= 0; start-- {
+			if toks[start].is("END") {
+				depth++
+			} else if toks[start].is("CASE") {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+		if start < 0 {
+			return -1
+		}
+		return start
+	case tok.Kind == tokWord, tok.Kind == tokQuotedIdent, tok.Kind == tokString, tok.Kind == tokNumber,
+		tok.Kind == tokParam, tok.Kind == tokExpr:
+	default:
+		return -1
+	}
+	for {
+		dot := prevSig(toks, start)
+		if dot < 0 || !toks[dot].isOp(".") {
+			return start
+		}
+		q := prevSig(toks, dot)
+		if q < 0 || (toks[q].Kind != tokWord && toks[q].Kind != tokQuotedIdent) {
+			return start
+		}
+		start = q
+	}
+}
+
+/*
+readTypeName() reads a type name starting at toks[i], returning it (lower-cased, without modifiers), whether it's an
+array type, and the index of its last token.
+*/
+func readTypeName(toks []sqlToken, i int) (name string, isArray bool, end int) {
+	if tokAt(toks, i).Kind != tokWord && tokAt(toks, i).Kind != tokQuotedIdent {
+		return "", false, -1
+	}
+	name, end = strings.ToLower(toks[i].ident()), i
+	if n := nextSig(toks, end); tokAt(toks, n).Kind == tokWord {
+		switch two := name + " " + strings.ToLower(toks[n].Text); two {
+		case "double precision", "character varying", "bit varying":
+			name, end = two, n
+		}
+	}
+	if n := nextSig(toks, end); tokAt(toks, n).isOp("(") {
+		if close := matchParen(toks, n); close > 0 {
+			end = close
+		}
+	}
+	for n := nextSig(toks, end); isArraySuffix(tokAt(toks, n)); n = nextSig(toks, end) {
+		isArray, end = true, n
+	}
+	return name, isArray, end
+}
+
+/*
+isArraySuffix() reports whether a token is the [] (or [n]) of an array type, which the tokenizer reads as a quoted
+identifier.
+*/
+func isArraySuffix(tok sqlToken) bool {
+	if tok.Kind != tokQuotedIdent || !strings.HasPrefix(tok.Text, "[") {
+		return false
+	}
+	return strings.Trim(tok.Text[1:len(tok.Text)-1], "0123456789") == ""
+}
+
+/*
+casts() rewrites expr::type casts.
+*/
+func (tr *translator) casts(toks []sqlToken) ([]sqlToken, error) {
+	for i := 0; i < len(toks); i++ {
+		if !toks[i].isOp("::") {
+			continue
+		}
+		start := operandStart(toks, prevSig(toks, i))
+		name, isArray, end := readTypeName(toks, nextSig(toks, i))
+		if start < 0 || end < 0 {
+			if err := tr.unsupported("this :: cast"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		operand := joinTokens(toks[start : prevSig(toks, i)+1])
+		single := start == prevSig(toks, i)
+		var expr string
+		switch {
+		case isArray:
+			if err := tr.unsupported("a cast to an array type"); err != nil {
+				return nil, err
+			}
+			expr = operand
+		case castTypes[name] != "":
+			expr = "CAST(" + operand + " AS " + castTypes[name] + ")"
+		case name == "bool" || name == "boolean":
+			expr = "CAST(" + operand + " AS INTEGER)"
+			if single && toks[start].Kind == tokString {
+				b, ok := parseBool(toks[start].unquote())
+				if !ok {
+					return nil, newPgError("22P02", "invalid input syntax for type boolean: %s", operand)
+				}
+				expr = "FALSE"
+				if b {
+					expr = "TRUE"
+				}
+			}
+		case name == "regclass":
+			// a table name (or OID), looked up in the emulated pg_class (see catalog.go)
+			expr = "(SELECT rz_c.oid FROM pg_catalog.pg_class rz_c WHERE rz_c.oid = (" + operand +
+				") OR rz_c.relname = (" + operand + ") OR 'public.' || rz_c.relname = (" + operand + "))"
+		case name == "date":
+			expr = "date(" + operand + ")"
+		case name == "time" || name == "timetz":
+			expr = "time(" + operand + ")"
+		case textTypes[name]:
+			expr = operand
+		default:
+			if err := tr.unsupported("a cast to " + name); err != nil {
+				return nil, err
+			}
+			expr = operand
+		}
+		toks = splice(toks, start, end, tokExpr, expr)
+		i = start
+	}
+	return toks, nil
+}
+
+/*
+functions() rewrites ILIKE and the functions and special values Sqlite doesn't have.
+*/
+func (tr *translator) functions(toks []sqlToken) ([]sqlToken, error) {
+	for i := 0; i < len(toks); i++ {
+		tok := toks[i]
+		if tok.Kind == tokOp {
+			if err := tr.regexOp(toks, i); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if tok.Kind != tokWord || tokAt(toks, prevSig(toks, i)).isOp(".") {
+			continue
+		}
+		open := nextSig(toks, i)
+		close := -1
+		if tokAt(toks, open).isOp("(") {
+			close = matchParen(toks, open)
+		}
+		noArgs := close > 0 && nextSig(toks, open) == close
+		switch tok.upper() {
+		case "ILIKE":
+			toks[i].Text = "LIKE"
+		case "NOW", "TRANSACTION_TIMESTAMP", "STATEMENT_TIMESTAMP", "CLOCK_TIMESTAMP":
+			if noArgs {
+				toks = splice(toks, i, close, tokExpr, nowSQL)
+			}
+		case "CURRENT_TIMESTAMP":
+			end := i
+			if close > 0 {
+				// CURRENT_TIMESTAMP(precision)
+				end = close
+			}
+			toks = splice(toks, i, end, tokExpr, nowSQL)
+		case "GEN_RANDOM_UUID", "UUID_GENERATE_V4":
+			if noArgs {
+				toks = splice(toks, i, close, tokExpr, uuidSQL)
+			}
+		case "STRING_AGG":
+			if close < 0 {
+				continue
+			}
+			if findTopLevel(toks, open+1, "ORDER") > 0 {
+				// Sqlite's group_concat() only takes ORDER BY from 3.44
+				if err := tr.unsupported("ORDER BY in string_agg()"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			toks[i].Text = "group_concat"
+		}
+	}
+	return toks, nil
+}
+
+/*
+regexOp() rewrites a regular expression match operator as Sqlite's REGEXP, which calls the regexp() function registered
+on every session's connection (see catalog.go). Case-insensitive matches need a literal pattern, to add the (?i) flag to.
+*/
+func (tr *translator) regexOp(toks []sqlToken, i int) error {
+	op := toks[i].Text
+	if op != "~" && op != "!~" && op != "~*" && op != "!~*" {
+		return nil
+	}
+	// without a left operand, ~ is bitwise not
+	if left := prevSig(toks, i); operandStart(toks, left) < 0 || nonFunctionWords[toks[left].upper()] {
+		return nil
+	}
+	if strings.HasSuffix(op, "*") {
+		if pat := nextSig(toks, i); tokAt(toks, pat).Kind == tokString {
+			toks[pat].Text = quoteString("(?i)" + toks[pat].unquote())
+		} else if err := tr.unsupported("a case-insensitive match against a pattern that isn't a literal"); err != nil {
+			return err
+		}
+	}
+	toks[i] = sqlToken{Kind: tokExpr, Text: " REGEXP ", Pos: toks[i].Pos}
+	if strings.HasPrefix(op, "!") {
+		toks[i].Text = " NOT REGEXP "
+	}
+	return nil
+}
+
+// serialTypes are Postgres' auto-incrementing integer types
+var serialTypes = map[string]bool{
+	"SERIAL": true, "BIGSERIAL": true, "SMALLSERIAL": true, "SERIAL2": true, "SERIAL4": true, "SERIAL8": true,
+}
+
+// unsupportedStmts are statements (by their leading words) that have no Sqlite equivalent
+var unsupportedStmts = []string{
+	"CREATE FUNCTION", "CREATE OR REPLACE FUNCTION", "CREATE PROCEDURE", "CREATE OR REPLACE PROCEDURE",
+	"CREATE EXTENSION", "CREATE TYPE", "CREATE DOMAIN", "CREATE SEQUENCE", "ALTER SEQUENCE", "CREATE SCHEMA",
+	"COMMENT ON", "GRANT", "REVOKE",
+}
+
+/*
+ddl() rewrites the parts of table and index definitions Sqlite doesn't understand, and the public schema.
+*/
+func (tr *translator) ddl(toks []sqlToken) ([]sqlToken, error) {
+	var lead []string
+	for i := nextSig(toks, -1); i < len(toks) && len(lead) < 4; i = nextSig(toks, i) {
+		lead = append(lead, toks[i].upper())
+	}
+	leading := strings.Join(lead, " ")
+	for _, stmt := range unsupportedStmts {
+		if strings.HasPrefix(leading, stmt+" ") || leading == stmt {
+			return toks, tr.unsupported(stmt + " statements")
+		}
+	}
+	isTable := strings.HasPrefix(leading, "CREATE TABLE") || strings.HasPrefix(leading, "CREATE TEMP TABLE") ||
+		strings.HasPrefix(leading, "CREATE TEMPORARY TABLE") || strings.HasPrefix(leading, "ALTER TABLE")
+	isIndex := strings.HasPrefix(leading, "CREATE INDEX") || strings.HasPrefix(leading, "CREATE UNIQUE INDEX") ||
+		strings.HasPrefix(leading, "DROP INDEX")
+
+	for i := 0; i < len(toks); i++ {
+		tok := toks[i]
+		switch {
+		case tok.is("PUBLIC") && tokAt(toks, nextSig(toks, i)).isOp(".") && !tokAt(toks, prevSig(toks, i)).isOp("."):
+			toks[i].Text = "main"
+		case isIndex && tok.is("CONCURRENTLY"):
+			toks[i].Text = ""
+		case isIndex && tok.is("USING") && tokAt(toks, nextSig(toks, nextSig(toks, i))).isOp("("):
+			method := nextSig(toks, i)
+			if m := toks[method].upper(); m != "BTREE" && m != "HASH" {
+				if err := tr.unsupported(strings.ToLower(m) + " indexes"); err != nil {
+					return nil, err
+				}
+			}
+			toks = splice(toks, i, method, tokSpace, "")
+		case isTable && tok.Kind == tokWord && serialTypes[tok.upper()]:
+			toks[i].Text = "INTEGER"
+			if !isPrimaryKeyCol(toks, i) {
+				if err := tr.unsupported("a SERIAL column that isn't the table's primary key"); err != nil {
+					return nil, err
+				}
+			}
+		case isTable && tok.is("GENERATED"):
+			as := nextSig(toks, i)
+			if tokAt(toks, as).is("BY") {
+				as = nextSig(toks, nextSig(toks, as))
+			} else if tokAt(toks, as).is("ALWAYS") {
+				as = nextSig(toks, as)
+			}
+			ident := nextSig(toks, as)
+			if !tokAt(toks, as).is("AS") || !tokAt(toks, ident).is("IDENTITY") {
+				continue
+			}
+			end := ident
+			if n := nextSig(toks, ident); tokAt(toks, n).isOp("(") {
+				if close := matchParen(toks, n); close > 0 {
+					end = close
+				}
+			}
+			toks = splice(toks, i, end, tokSpace, "")
+			// an identity column has to be INTEGER to become the rowid
+			if typ := colDefType(toks, i); typ >= 0 && castTypes[strings.ToLower(toks[typ].Text)] == "INTEGER" {
+				toks[typ].Text = "INTEGER"
+			}
+			if !isPrimaryKeyCol(toks, i) {
+				if err := tr.unsupported("an identity column that isn't the table's primary key"); err != nil {
+					return nil, err
+				}
+			}
+		case isTable && isArraySuffix(tok) && tokAt(toks, prevSig(toks, i)).Kind == tokWord:
+			if err := tr.unsupported("array columns"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return toks, nil
+}
+
+/*
+colDefStart() returns the index of the first token of the column definition containing toks[i].
+*/
+func colDefStart(toks []sqlToken, i int) int {
+	depth := 0
+	for j := i; j >= 0; j-- {
+		switch {
+		case toks[j].isOp(")"):
+			depth++
+		case toks[j].isOp("(") && depth == 0, toks[j].isOp(",") && depth == 0:
+			return nextSig(toks, j)
+		case toks[j].isOp("("):
+			depth--
+		case toks[j].is("COLUMN") && depth == 0, toks[j].is("ADD") && depth == 0:
+			// ALTER TABLE ... ADD [COLUMN]
+			return nextSig(toks, j)
+		}
+	}
+	return -1
+}
+
+/*
+colDefType() returns the index of the type of the column definition containing toks[i], or -1.
+*/
+func colDefType(toks []sqlToken, i int) int {
+	start := colDefStart(toks, i)
+	if start < 0 {
+		return -1
+	}
+	if typ := nextSig(toks, start); typ < len(toks) && toks[typ].Kind == tokWord {
+		return typ
+	}
+	return -1
+}
+
+/*
+isPrimaryKeyCol() reports whether the column whose definition contains toks[i] is the table's primary key, either in
+its own definition or in a PRIMARY KEY (col) table constraint.
+*/
+func isPrimaryKeyCol(toks []sqlToken, i int) bool {
+	start := colDefStart(toks, i)
+	if start < 0 {
+		return false
+	}
+	if pk := findTopLevel(toks, start, "PRIMARY", ","); pk > 0 && toks[pk].is("PRIMARY") {
+		return true
+	}
+	name := strings.ToLower(toks[start].ident())
+	for j := 0; j < len(toks); j++ {
+		if !toks[j].is("PRIMARY") || !tokAt(toks, nextSig(toks, j)).is("KEY") {
+			continue
+		}
+		open := nextSig(toks, nextSig(toks, j))
+		if !tokAt(toks, open).isOp("(") {
+			continue
+		}
+		col, close := nextSig(toks, open), matchParen(toks, open)
+		if nextSig(toks, col) == close && strings.ToLower(toks[col].ident()) == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+upsert() smooths over the differences between Postgres' and Sqlite's INSERT ... ON CONFLICT.
+*/
+func (tr *translator) upsert(toks []sqlToken) ([]sqlToken, error) {
+	first := nextSig(toks, -1)
+	if !tokAt(toks, first).is("INSERT") && !tokAt(toks, first).is("WITH") {
+		return toks, nil
+	}
+	on := -1
+	for i := findTopLevel(toks, first, "ON"); i > 0; i = findTopLevel(toks, i+1, "ON") {
+		if tokAt(toks, nextSig(toks, i)).is("CONFLICT") {
+			on = i
+			break
+		}
+	}
+	if on < 0 {
+		return toks, nil
+	}
+	conflict := nextSig(toks, on)
+	if onc := nextSig(toks, conflict); tokAt(toks, onc).is("ON") && tokAt(toks, nextSig(toks, onc)).is("CONSTRAINT") {
+		toks = splice(toks, onc, nextSig(toks, nextSig(toks, onc)), tokSpace, "")
+	}
+
+	// Sqlite can't tell ON CONFLICT from a join's ON when it follows INSERT ... SELECT ... FROM ...
+	sel := findTopLevel(toks, first, "SELECT", "VALUES")
+	if sel < 0 || sel > on || !toks[sel].is("SELECT") {
+		return toks, nil
+	}
+	from := -1
+	for i := findTopLevel(toks, sel, "FROM"); i > 0 && i < on; i = findTopLevel(toks, i+1, "FROM") {
+		from = i
+	}
+	if from < 0 {
+		return toks, nil
+	}
+	if clause := findTopLevel(toks, from, "WHERE", "GROUP", "HAVING", "WINDOW", "ORDER", "LIMIT"); clause > 0 && clause < on {
+		return toks, nil
+	}
+	toks[on].Text = "WHERE true " + toks[on].Text
+	return toks, nil
+}
+
+/*
+distinctOn() rewrites SELECT DISTINCT ON (keys) ... FROM table ... into a query that picks the first row for each key
+with row_number(). Only queries over a single table can be rewritten, since we go by its rowid.
+*/
+func (tr *translator) distinctOn(toks []sqlToken) ([]sqlToken, error) {
+	sel := nextSig(toks, -1)
+	distinct := nextSig(toks, sel)
+	on := nextSig(toks, distinct)
+	open := nextSig(toks, on)
+	if !tokAt(toks, sel).is("SELECT") || !tokAt(toks, distinct).is("DISTINCT") || !tokAt(toks, on).is("ON") ||
+		!tokAt(toks, open).isOp("(") {
+		return toks, nil
+	}
+	close := matchParen(toks, open)
+	from := findTopLevel(toks, open, "FROM")
+	if close < 0 || from < 0 {
+		return toks, tr.unsupported("this DISTINCT ON")
+	}
+	// FROM table [[AS] alias], followed by nothing but WHERE, ORDER BY, and LIMIT
+	i := nextSig(toks, from)
+	if _, table, next := readTableName(toks[i:], 0); table == "" {
+		return toks, tr.unsupported("DISTINCT ON without a table")
+	} else {
+		i += next
+	}
+	i = nextSig(toks, i-1)
+	if tokAt(toks, i).is("AS") {
+		i = nextSig(toks, nextSig(toks, i))
+	} else if t := tokAt(toks, i); (t.Kind == tokWord || t.Kind == tokQuotedIdent) && !clauseKeywords[t.upper()] {
+		i = nextSig(toks, i)
+	}
+	end := len(toks)
+	if last := prevSig(toks, end); last >= 0 && toks[last].isOp(";") {
+		end = last
+	}
+	where, order, limit := -1, -1, -1
+	for i < end {
+		switch {
+		case toks[i].is("WHERE") && order < 0 && limit < 0:
+			where = i
+		case toks[i].is("ORDER") && limit < 0:
+			order = i
+		case toks[i].is("LIMIT"):
+			limit = i
+		default:
+			return toks, tr.unsupported("DISTINCT ON over more than a single table")
+		}
+		if i = findTopLevel(toks, i+1, "WHERE", "ORDER", "LIMIT"); i < 0 {
+			i = end
+		}
+	}
+	part := func(start int, ends ...int) string {
+		if start < 0 {
+			return ""
+		}
+		stop := end
+		for _, e := range ends {
+			if e > start && e < stop {
+				stop = e
+			}
+		}
+		return strings.TrimSpace(joinTokens(toks[start:stop]))
+	}
+	keys := strings.TrimSpace(joinTokens(toks[open+1 : close]))
+	cols := strings.TrimSpace(joinTokens(toks[close+1 : from]))
+	fromClause := part(from, where, order, limit)
+	windowOrder := keys
+	if order >= 0 {
+		windowOrder = part(nextSig(toks, nextSig(toks, order)), limit)
+	}
+	sql := "SELECT " + cols + " " + fromClause + ` WHERE rowid IN (SELECT "rz_rowid" FROM (SELECT rowid AS "rz_rowid", ` +
+		"row_number() OVER (PARTITION BY " + keys + " ORDER BY " + windowOrder + `) AS "rz_rn" ` + fromClause
+	if where >= 0 {
+		sql += " " + part(where, order, limit)
+	}
+	sql += `) WHERE "rz_rn" = 1)`
+	if order >= 0 {
+		sql += " " + part(order, limit)
+	}
+	if limit >= 0 {
+		sql += " " + part(limit)
+	}
+	return append([]sqlToken{{Kind: tokExpr, Text: sql}}, toks[end:]...), nil
+}
@@ -0,0 +1,185 @@
+package pgif
+
+import (
+	"context"
+	"database/sql"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/jackc/pgproto3/v2"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+/*
+Transaction handling. Postgres reports the session's transaction state in every ReadyForQuery ('I' idle, 'T' in a
+transaction block, 'E' in a failed transaction block). Every statement in a session runs on the session's own Sqlite
+connection, so we can tell whether a transaction is open by asking that connection whether it's in autocommit mode.
+Sqlite's own rules differ from Postgres' in a few places, which we paper over here:
+  - after an error, Postgres rejects everything but ROLLBACK until the transaction ends;
+  - COMMIT of a failed transaction rolls it back;
+  - BEGIN inside a transaction, and COMMIT or ROLLBACK outside one, are warnings rather than errors.
+*/
+
+const (
+	txIdle    byte = 'I'
+	txInBlock byte = 'T'
+	txFailed  byte = 'E'
+)
+
+/*
+querier is the set of database/sql methods shared by DBConn, *sql.Conn, and *sql.Tx, so statements can run on whichever
+one holds the session's state.
+*/
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+func (rz *RhizomeBackend) querier() querier {
+	if rz.sqlConn != nil {
+		return rz.sqlConn
+	}
+	return rz.db
+}
+
+/*
+readyMessage is a ReadyForQuery, preceded by a ParameterStatus for each reported parameter that changed while the
+client's request ran and by any notifications waiting for the client (as Postgres does, the client hears about these
+just before it's told it can go on).
+*/
+type readyMessage struct {
+	pgproto3.ReadyForQuery
+	reports       []pgproto3.ParameterStatus
+	notifications []pgproto3.NotificationResponse
+}
+
+func (msg *readyMessage) Encode(dst []byte) []byte {
+	for i := range msg.reports {
+		dst = msg.reports[i].Encode(dst)
+	}
+	for i := range msg.notifications {
+		dst = msg.notifications[i].Encode(dst)
+	}
+	return msg.ReadyForQuery.Encode(dst)
+}
+
+func (rz *RhizomeBackend) readyForQuery() *readyMessage {
+	return &readyMessage{
+		ReadyForQuery: pgproto3.ReadyForQuery{TxStatus: rz.txStatus},
+		reports:       rz.paramReports(),
+		notifications: rz.readyNotifications(),
+	}
+}
+
+/*
+connAutoCommit() reports whether the Sqlite connection is outside of a transaction.
+*/
+func connAutoCommit(conn *sql.Conn) bool {
+	autocommit := true
+	_ = conn.Raw(func(dc any) error {
+		if sc, ok := dc.(*sqlite3.SQLiteConn); ok {
+			autocommit = sc.AutoCommit()
+		}
+		return nil
+	})
+	return autocommit
+}
+
+/*
+beforeStmt() is called before each statement runs. It returns handled=true (with the tag to send, and possibly a
+warning) for statements it has dealt with itself, or an error for statements that may not run; otherwise the caller
+runs the statement on the session's connection and then calls afterStmt().
+*/
+func (rz *RhizomeBackend) beforeStmt(info stmtInfo) (handled bool, tag []byte, notice *pgproto3.NoticeResponse, err error) {
+	isEnd := info.Command == "COMMIT" || (info.Command == "ROLLBACK" && !info.Savepoint)
+	switch rz.txStatus {
+	case txFailed:
+		if isEnd {
+			// COMMIT can't succeed, so both end the transaction by rolling back
+			if !connAutoCommit(rz.sqlConn) {
+				if _, err := rz.sqlConn.ExecContext(rz.ctx, "ROLLBACK"); err != nil {
+					return false, nil, nil, err
+				}
+			}
+			rz.closePortals()
+			rz.endTx(false)
+			rz.txStatus = txIdle
+			return true, []byte("ROLLBACK"), nil, nil
+		}
+		if info.Command == "ROLLBACK" {
+			return false, nil, nil, nil
+		}
+		return false, nil, nil, newPgError("25P02", "current transaction is aborted, commands ignored until end of transaction block")
+	case txInBlock:
+		if info.Command == "BEGIN" {
+			return true, info.tag(0), txWarning("25001", "there is already a transaction in progress"), nil
+		}
+	default:
+		if isEnd {
+			return true, info.tag(0), txWarning("25P01", "there is no transaction in progress"), nil
+		}
+	}
+	return false, nil, nil, nil
+}
+
+/*
+afterStmt() updates the transaction state once a statement has finished (with err set if it failed).
+*/
+func (rz *RhizomeBackend) afterStmt(info stmtInfo, err error) {
+	autocommit := connAutoCommit(rz.sqlConn)
+	switch {
+	case err != nil && autocommit && rz.txStatus == txIdle:
+		// a failed statement outside of a transaction block doesn't change anything, apart from dropping whatever it
+		// queued to happen on commit
+		rz.endTx(false)
+	case err != nil && autocommit && info.Command == "COMMIT":
+		// a COMMIT that fails (say, because a commit hook vetoed it) rolls the transaction back, as in Postgres
+		rz.closePortals()
+		rz.endTx(false)
+		rz.txStatus = txIdle
+	case err != nil:
+		rz.txStatus = txFailed
+	case autocommit:
+		if rz.txStatus != txIdle {
+			// portals don't outlive the transaction block they were opened in
+			rz.closePortals()
+		}
+		rz.endTx(info.Command != "ROLLBACK")
+		rz.txStatus = txIdle
+	default:
+		rz.txStatus = txInBlock
+	}
+}
+
+/*
+endTx() is called whenever a transaction ends, including the implicit transaction of a statement run outside of a
+transaction block, to settle the session state that depends on whether it committed.
+*/
+func (rz *RhizomeBackend) endTx(committed bool) {
+	rz.endTxParams(committed)
+	rz.endTxNotify(committed)
+	rz.endTxChanges()
+}
+
+/*
+endTxChanges() publishes the captured changes of a transaction that committed (see dbmgr.PublishChanges(), which
+knows whether it did).
+*/
+func (rz *RhizomeBackend) endTxChanges() {
+	if rz.sqlConn == nil {
+		return
+	}
+	_ = rz.sqlConn.Raw(func(dc any) error {
+		if sc, ok := dc.(*sqlite3.SQLiteConn); ok {
+			dbmgr.PublishChanges(sc)
+		}
+		return nil
+	})
+}
+
+func txWarning(code, msg string) *pgproto3.NoticeResponse {
+	return &pgproto3.NoticeResponse{
+		Severity: "WARNING",
+		Code:     code,
+		Message:  msg,
+	}
+}
@@ -0,0 +1,258 @@
+package pgif
+
+import (
+	"github.com/jackc/pgtype"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The type registry maps Sqlite's declared column types onto Postgres types, and holds the encoders and decoders used to
+exchange values of each Postgres type with clients. Sqlite lets a column be declared with nearly any type name, so
+each PG type lists the declared types it covers; anything not listed falls back to Sqlite's own affinity rules, and
+columns with no declared type at all (expressions) are typed by their values where we can see them.
+
+Applications can add types, or take over existing ones, with RegisterType().
+*/
+
+/*
+PgType describes a Postgres type that Sqlite values can be sent as.
+*/
+type PgType struct {
+	// Name is the Postgres type name, e.g. "uuid"
+	Name string
+	OID  uint32
+	// Size is the type's fixed size in bytes, or -1 for variable-length types
+	Size int16
+	// DeclTypes are the declared column types (case-insensitive) that map to this type. A name matches with or without
+	// a length or precision ("varchar" matches "VARCHAR(255)"); a name ending in "*" matches any declared type starting
+	// with the rest of it.
+	DeclTypes []string
+	// EncodeText and EncodeBinary convert a (non-nil) value scanned from Sqlite to the text and binary formats. If nil,
+	// the built-in conversions for the OID are used (for OIDs we don't know, values are sent as text).
+	EncodeText   func(val any) ([]byte, error)
+	EncodeBinary func(val any) ([]byte, error)
+	// Decode converts a (non-nil) parameter value from a client, in text (0) or binary (1) format, to a value to bind.
+	// If nil, the built-in conversion for the OID is used.
+	Decode func(data []byte, format int16) (any, error)
+}
+
+func (t *PgType) encode(val any, format int16) ([]byte, error) {
+	if val == nil {
+		return nil, nil
+	}
+	if format == 1 {
+		if t.EncodeBinary != nil {
+			return t.EncodeBinary(val)
+		}
+		return encodeBinaryValue(val, t.OID)
+	}
+	if t.EncodeText != nil {
+		return t.EncodeText(val)
+	}
+	return encodeTextValue(val, t.OID)
+}
+
+func (t *PgType) decode(data []byte, format int16) (any, error) {
+	if data == nil {
+		return nil, nil
+	}
+	if t.Decode != nil {
+		return t.Decode(data, format)
+	}
+	return decodeParam(data, format, t.OID)
+}
+
+type declPrefix struct {
+	prefix string
+	typ    *PgType
+}
+
+type typeRegistry struct {
+	sync.RWMutex
+	byOID    map[uint32]*PgType
+	byDecl   map[string]*PgType
+	prefixes []declPrefix
+}
+
+var pgTypes = newTypeRegistry()
+
+func builtinTypes() []*PgType {
+	return []*PgType{
+		{Name: "int8", OID: pgtype.Int8OID, Size: 8, DeclTypes: []string{"integer", "int", "bigint", "int8", "unsigned big int", "mediumint"}},
+		{Name: "text", OID: pgtype.TextOID, Size: -1, DeclTypes: []string{"text", "clob", "string"}},
+		{Name: "float8", OID: pgtype.Float8OID, Size: 8, DeclTypes: []string{"real", "double", "double precision", "float", "float8"}},
+		{Name: "bytea", OID: pgtype.ByteaOID, Size: -1, DeclTypes: []string{"blob", "bytea"}},
+		{Name: "bool", OID: pgtype.BoolOID, Size: 1, DeclTypes: []string{"boolean", "bool"}},
+		{Name: "timestamptz", OID: pgtype.TimestamptzOID, Size: 8, DeclTypes: []string{"timestamptz", "timestamp with time zone", "datetime"}},
+		{Name: "int2", OID: pgtype.Int2OID, Size: 2, DeclTypes: []string{"smallint", "int2", "tinyint"}},
+		{Name: "int4", OID: pgtype.Int4OID, Size: 4, DeclTypes: []string{"int4", "integer4"}},
+		{Name: "float4", OID: pgtype.Float4OID, Size: 4, DeclTypes: []string{"float4"}},
+		{Name: "numeric", OID: pgtype.NumericOID, Size: -1, DeclTypes: []string{"numeric", "decimal"}},
+		{Name: "varchar", OID: pgtype.VarcharOID, Size: -1, DeclTypes: []string{"varchar", "character varying", "varying character", "nvarchar"}},
+		{Name: "bpchar", OID: pgtype.BPCharOID, Size: -1, DeclTypes: []string{"char", "character", "nchar", "native character"}},
+		{Name: "date", OID: pgtype.DateOID, Size: 4, DeclTypes: []string{"date"}},
+		{Name: "time", OID: pgtype.TimeOID, Size: 8, DeclTypes: []string{"time", "time without time zone"}},
+		{Name: "timestamp", OID: pgtype.TimestampOID, Size: 8, DeclTypes: []string{"timestamp", "timestamp without time zone"}},
+		{Name: "interval", OID: pgtype.IntervalOID, Size: 16, DeclTypes: []string{"interval"}},
+		{Name: "uuid", OID: pgtype.UUIDOID, Size: 16, DeclTypes: []string{"uuid"}},
+		{Name: "json", OID: pgtype.JSONOID, Size: -1, DeclTypes: []string{"json"}},
+		{Name: "jsonb", OID: pgtype.JSONBOID, Size: -1, DeclTypes: []string{"jsonb"}},
+	}
+}
+
+func newTypeRegistry() *typeRegistry {
+	reg := &typeRegistry{byOID: make(map[uint32]*PgType), byDecl: make(map[string]*PgType)}
+	for _, t := range builtinTypes() {
+		reg.add(t)
+	}
+	return reg
+}
+
+func (reg *typeRegistry) add(t *PgType) {
+	// the declared types that led to the type being replaced now lead to its replacement
+	if old, ok := reg.byOID[t.OID]; ok {
+		for decl, typ := range reg.byDecl {
+			if typ == old {
+				reg.byDecl[decl] = t
+			}
+		}
+		for i := range reg.prefixes {
+			if reg.prefixes[i].typ == old {
+				reg.prefixes[i].typ = t
+			}
+		}
+	}
+	reg.byOID[t.OID] = t
+	for _, decl := range t.DeclTypes {
+		decl = normalizeDeclType(decl)
+		if strings.HasSuffix(decl, "*") {
+			// later registrations take precedence, so they go first
+			reg.prefixes = append([]declPrefix{{prefix: strings.TrimSuffix(decl, "*"), typ: t}}, reg.prefixes...)
+		} else {
+			reg.byDecl[decl] = t
+		}
+	}
+}
+
+/*
+RegisterType() adds a type to the registry, replacing any existing type with the same OID or declared type names.
+A type that replaces another by OID also takes over the declared types that mapped to it.
+*/
+func RegisterType(t PgType) {
+	if t.Size == 0 {
+		t.Size = -1
+	}
+	pgTypes.Lock()
+	defer pgTypes.Unlock()
+	pgTypes.add(&t)
+}
+
+/*
+normalizeDeclType() lower-cases a declared type and strips any length or precision, so "VARCHAR(255)" and "varchar"
+look the same.
+*/
+func normalizeDeclType(decltype string) string {
+	decltype = strings.ToLower(decltype)
+	if i := strings.IndexByte(decltype, '('); i >= 0 {
+		rest := ""
+		if j := strings.IndexByte(decltype[i:], ')'); j >= 0 {
+			rest = decltype[i+j+1:]
+		}
+		decltype = decltype[:i] + " " + rest
+	}
+	return strings.Join(strings.Fields(decltype), " ")
+}
+
+/*
+declType() returns the PG type for a declared column type, or nil if the column has no declared type. Declared types
+we don't recognize are mapped the way Sqlite decides a column's affinity.
+*/
+func declType(decltype string) *PgType {
+	decl := normalizeDeclType(decltype)
+	if decl == "" {
+		return nil
+	}
+	pgTypes.RLock()
+	defer pgTypes.RUnlock()
+	if t, ok := pgTypes.byDecl[decl]; ok {
+		return t
+	}
+	for _, p := range pgTypes.prefixes {
+		if strings.HasPrefix(decl, p.prefix) {
+			return p.typ
+		}
+	}
+	switch {
+	case strings.Contains(decl, "int"):
+		return pgTypes.byOID[pgtype.Int8OID]
+	case strings.Contains(decl, "char"), strings.Contains(decl, "clob"), strings.Contains(decl, "text"):
+		return pgTypes.byOID[pgtype.TextOID]
+	case strings.Contains(decl, "blob"):
+		return pgTypes.byOID[pgtype.ByteaOID]
+	case strings.Contains(decl, "real"), strings.Contains(decl, "floa"), strings.Contains(decl, "doub"):
+		return pgTypes.byOID[pgtype.Float8OID]
+	}
+	// Sqlite would give this column numeric affinity, but it may hold anything, so text is the safe choice
+	return pgTypes.byOID[pgtype.TextOID]
+}
+
+/*
+valueType() returns the PG type for a value from a column with no declared type.
+*/
+func valueType(val any) *PgType {
+	oid := uint32(pgtype.TextOID)
+	switch val.(type) {
+	case int64:
+		oid = pgtype.Int8OID
+	case float64:
+		oid = pgtype.Float8OID
+	case []byte:
+		oid = pgtype.ByteaOID
+	case bool:
+		oid = pgtype.BoolOID
+	case time.Time:
+		oid = pgtype.TimestamptzOID
+	}
+	return typeForOID(oid)
+}
+
+/*
+columnType() returns the PG type to send a result column as, given its declared type and (if we have one) a sample
+value from it.
+*/
+func columnType(decltype string, sample any) *PgType {
+	if t := declType(decltype); t != nil {
+		return t
+	}
+	return valueType(sample)
+}
+
+/*
+typeForOID() returns the registered type for an OID, or a bare type (handled as text) if there isn't one.
+*/
+func typeForOID(oid uint32) *PgType {
+	pgTypes.RLock()
+	t, ok := pgTypes.byOID[oid]
+	pgTypes.RUnlock()
+	if !ok {
+		return &PgType{Name: "unknown", OID: oid, Size: -1}
+	}
+	return t
+}
+
+/*
+registeredTypes() returns every type in the registry, ordered by OID.
+*/
+func registeredTypes() []*PgType {
+	pgTypes.RLock()
+	defer pgTypes.RUnlock()
+	types := make([]*PgType, 0, len(pgTypes.byOID))
+	for _, t := range pgTypes.byOID {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].OID < types[j].OID })
+	return types
+}
@@ -0,0 +1,332 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"golang.org/x/crypto/pbkdf2"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (c *testClient) sendStartup(dbname, user string) pgproto3.BackendMessage {
+	c.send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"database": dbname, "user": user},
+	})
+	return c.receive()
+}
+
+/*
+startTLS() negotiates TLS the way libpq does, with an SSLRequest before the startup message, and returns the
+tls-server-end-point channel binding data for the server's certificate.
+*/
+func (c *testClient) startTLS() []byte {
+	c.send(&pgproto3.SSLRequest{})
+	resp := make([]byte, 1)
+	if _, err := c.conn.Read(resp); err != nil || resp[0] != 'S' {
+		c.t.Fatalf("server refused TLS: %q %v", resp, err)
+	}
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatal(err.Error())
+	}
+	c.conn = tlsConn
+	c.fe = pgproto3.NewFrontend(pgproto3.NewChunkReader(tlsConn), tlsConn)
+	sum := sha256.Sum256(tlsConn.ConnectionState().PeerCertificates[0].Raw)
+	return sum[:]
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+/*
+scramLogin() plays the client side of SCRAM-SHA-256 after the server has sent AuthenticationSASL. If cbind is non-nil
+it uses SCRAM-SHA-256-PLUS with tls-server-end-point channel binding.
+*/
+func (c *testClient) scramLogin(sasl *pgproto3.AuthenticationSASL, pwd string, cbind []byte) testResult {
+	mech, gs2 := "SCRAM-SHA-256", "n,,"
+	if cbind != nil {
+		mech, gs2 = "SCRAM-SHA-256-PLUS", "p=tls-server-end-point,,"
+	}
+	found := false
+	for _, m := range sasl.AuthMechanisms {
+		found = found || m == mech
+	}
+	if !found {
+		c.t.Fatalf("server did not offer %s: %v", mech, sasl.AuthMechanisms)
+	}
+	clientFirstBare := "n=,r=fyko+d2lbbFgONRv9qkxdawL"
+	c.send(&pgproto3.SASLInitialResponse{AuthMechanism: mech, Data: []byte(gs2 + clientFirstBare)})
+	msg := c.receive()
+	cont, ok := msg.(*pgproto3.AuthenticationSASLContinue)
+	if !ok {
+		res := testResult{}
+		res.collect(msg)
+		return res
+	}
+	serverFirst := string(cont.Data)
+	var nonce, salt string
+	var iters int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			_, _ = fmt.Sscan(attr[2:], &iters)
+		}
+	}
+	if !strings.HasPrefix(nonce, "fyko+d2lbbFgONRv9qkxdawL") {
+		c.t.Fatalf("server nonce doesn't extend ours: %q", nonce)
+	}
+	saltBytes, _ := base64.StdEncoding.DecodeString(salt)
+	salted := pbkdf2.Key([]byte(pwd), saltBytes, iters, 32, sha256.New)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientFinalNoProof := "c=" + base64.StdEncoding.EncodeToString(append([]byte(gs2), cbind...)) + ",r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalNoProof
+	clientSig := hmacSHA256(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSig[i]
+	}
+	c.send(&pgproto3.SASLResponse{Data: []byte(clientFinalNoProof + ",p=" + base64.StdEncoding.EncodeToString(proof))})
+
+	msg = c.receive()
+	final, ok := msg.(*pgproto3.AuthenticationSASLFinal)
+	if !ok {
+		res := testResult{}
+		res.collect(msg)
+		return res
+	}
+	serverSig := base64.StdEncoding.EncodeToString(hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage))
+	if string(final.Data) != "v="+serverSig {
+		c.t.Fatalf("server signature didn't verify: %q", final.Data)
+	}
+	return c.readStartupResult()
+}
+
+func (c *testClient) md5Login(req *pgproto3.AuthenticationMD5Password, user, pwd string) testResult {
+	inner := md5.Sum([]byte(pwd + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), req.Salt[:]...))
+	c.send(&pgproto3.PasswordMessage{Password: "md5" + hex.EncodeToString(outer[:])})
+	return c.readStartupResult()
+}
+
+/*
+readStartupResult() reads until the server is ready for queries, or has rejected the login and closed the connection.
+*/
+func (c *testClient) readStartupResult() testResult {
+	res := testResult{}
+	for {
+		msg := c.receive()
+		res.collect(msg)
+		switch msg.(type) {
+		case *pgproto3.ReadyForQuery, *pgproto3.ErrorResponse:
+			return res
+		}
+	}
+}
+
+func newTestSecrets(t *testing.T) map[string]string {
+	scram, err := pgif.NewScramSecret("secret")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return map[string]string{
+		"md5user":   pgif.NewMD5Secret("md5user", "secret"),
+		"scramuser": scram,
+	}
+}
+
+func secretLookup(secrets map[string]string) pgif.FnGetUserSecret {
+	return func(db, username string) (string, error) {
+		if s, ok := secrets[username]; ok && db == "test" {
+			return s, nil
+		}
+		return "", errors.New("no such user")
+	}
+}
+
+func TestMD5Auth(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	addr := startTestServer(t, dbm, pgif.BackendConfig{
+		AuthMethod:      pgif.AuthMethodMD5,
+		FnGetUserSecret: secretLookup(newTestSecrets(t)),
+	})
+
+	for _, tc := range []struct {
+		user, pwd, code string
+	}{
+		{"md5user", "secret", ""},
+		{"md5user", "wrong", "28P01"},
+		{"nobody", "secret", "28P01"},
+	} {
+		c := dialTestClient(t, addr)
+		req, ok := c.sendStartup("test", tc.user).(*pgproto3.AuthenticationMD5Password)
+		if !ok {
+			t.Fatal("expected an md5 password request")
+		}
+		if res := c.md5Login(req, tc.user, tc.pwd); res.errCode() != tc.code {
+			t.Errorf("%s/%s: expected %q, got %+v", tc.user, tc.pwd, tc.code, res)
+		}
+	}
+
+	// a user with only a SCRAM secret is upgraded to SCRAM
+	c := dialTestClient(t, addr)
+	sasl, ok := c.sendStartup("test", "scramuser").(*pgproto3.AuthenticationSASL)
+	if !ok {
+		t.Fatal("expected md5 to be upgraded to SCRAM")
+	}
+	if res := c.scramLogin(sasl, "secret", nil); res.errCode() != "" {
+		t.Errorf("SCRAM login failed: %+v", res.Errs)
+	}
+}
+
+func TestScramAuth(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	addr := startTestServer(t, dbm, pgif.BackendConfig{
+		AuthMethod:      pgif.AuthMethodScramSHA256,
+		FnGetUserSecret: secretLookup(newTestSecrets(t)),
+		FnGetAuthMethod: func(db, username string) pgif.AuthMethod {
+			if username == "md5user" {
+				return pgif.AuthMethodMD5
+			}
+			return ""
+		},
+	})
+
+	for _, tc := range []struct {
+		user, pwd, code string
+	}{
+		{"scramuser", "secret", ""},
+		{"scramuser", "wrong", "28P01"},
+		{"nobody", "secret", "28P01"},
+	} {
+		c := dialTestClient(t, addr)
+		sasl, ok := c.sendStartup("test", tc.user).(*pgproto3.AuthenticationSASL)
+		if !ok {
+			t.Fatal("expected a SASL request")
+		}
+		if len(sasl.AuthMechanisms) != 1 {
+			t.Errorf("channel binding should only be offered over TLS: %v", sasl.AuthMechanisms)
+		}
+		res := c.scramLogin(sasl, tc.pwd, nil)
+		if res.errCode() != tc.code {
+			t.Errorf("%s/%s: expected %q, got %+v", tc.user, tc.pwd, tc.code, res)
+		}
+		if tc.code == "" && res.KeyData == nil {
+			t.Error("expected startup to complete after SCRAM")
+		}
+	}
+
+	c := dialTestClient(t, addr)
+	if _, ok := c.sendStartup("test", "md5user").(*pgproto3.AuthenticationMD5Password); !ok {
+		t.Error("expected the per-user auth method to override the server default")
+	}
+}
+
+func TestDBAccessAfterAuth(t *testing.T) {
+	secrets := newTestSecrets(t)
+	for _, cfg := range []dbmgr.DBManagerConfig{
+		{FnCheckDBUser: func(username, db string) (bool, error) { return username == "md5user", nil }},
+		// without FnCheckDBUser, FnCheckDBAccess gets no password
+		{FnCheckDBAccess: func(username, pwd, db string) (bool, error) { return pwd == "" && username == "md5user", nil }},
+	} {
+		dbm := newTestManager(t, cfg)
+		addr := startTestServer(t, dbm, pgif.BackendConfig{
+			AuthMethod:      pgif.AuthMethodScramSHA256,
+			FnGetUserSecret: secretLookup(secrets),
+			FnGetAuthMethod: func(db, username string) pgif.AuthMethod {
+				if username == "md5user" {
+					return pgif.AuthMethodMD5
+				}
+				return ""
+			},
+		})
+
+		// the password is right, but the user may not open the database
+		c := dialTestClient(t, addr)
+		sasl, ok := c.sendStartup("test", "scramuser").(*pgproto3.AuthenticationSASL)
+		if !ok {
+			t.Fatal("expected a SASL request")
+		}
+		if res := c.scramLogin(sasl, "secret", nil); res.errCode() != "28000" || res.KeyData != nil {
+			t.Errorf("expected SCRAM to succeed but access to be denied, got %+v", res)
+		}
+
+		c = dialTestClient(t, addr)
+		req, ok := c.sendStartup("test", "md5user").(*pgproto3.AuthenticationMD5Password)
+		if !ok {
+			t.Fatal("expected an md5 password request")
+		}
+		if res := c.md5Login(req, "md5user", "secret"); res.errCode() != "" {
+			t.Errorf("expected md5user to be let in, got %+v", res)
+		}
+	}
+}
+
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestScramChannelBinding(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	addr := startTestServer(t, dbm, pgif.BackendConfig{
+		AuthMethod:      pgif.AuthMethodScramSHA256,
+		FnGetUserSecret: secretLookup(newTestSecrets(t)),
+		UseTLS:          true,
+		TLS:             newTestTLSConfig(t),
+	})
+
+	c := dialTestClient(t, addr)
+	cbind := c.startTLS()
+	sasl, ok := c.sendStartup("test", "scramuser").(*pgproto3.AuthenticationSASL)
+	if !ok || sasl.AuthMechanisms[0] != "SCRAM-SHA-256-PLUS" {
+		t.Fatalf("expected SCRAM-SHA-256-PLUS to be offered over TLS")
+	}
+	if res := c.scramLogin(sasl, "secret", cbind); res.errCode() != "" {
+		t.Fatalf("SCRAM-SHA-256-PLUS login failed: %+v", res.Errs)
+	}
+
+	// binding to some other certificate fails, even with the right password
+	c = dialTestClient(t, addr)
+	c.startTLS()
+	sasl = c.sendStartup("test", "scramuser").(*pgproto3.AuthenticationSASL)
+	if res := c.scramLogin(sasl, "secret", make([]byte, 32)); res.errCode() != "28000" {
+		t.Errorf("expected channel binding failure, got %+v", res.Errs)
+	}
+}
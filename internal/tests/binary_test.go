@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"encoding/binary"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBinaryFormats(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE vals (i INTEGER, f REAL, b BLOB, t TEXT, d DATE, flag BOOLEAN, n REAL, u TEXT)")
+
+	num := pgtype.Numeric{}
+	_ = num.Set("12.25")
+	numBin, _ := num.EncodeBinary(nil, nil)
+	uuid := pgtype.UUID{}
+	_ = uuid.Set("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	uuidBin, _ := uuid.EncodeBinary(nil, nil)
+	minus7 := int32(-7)
+	days := time.Date(2023, 4, 5, 0, 0, 0, 0, time.UTC).Sub(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).Hours() / 24
+
+	c.send(
+		&pgproto3.Parse{
+			Query: "INSERT INTO vals VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			ParameterOIDs: []uint32{pgtype.Int4OID, pgtype.Float4OID, pgtype.ByteaOID, pgtype.TextOID, pgtype.DateOID,
+				pgtype.BoolOID, pgtype.NumericOID, pgtype.UUIDOID},
+		},
+		&pgproto3.Bind{
+			ParameterFormatCodes: []int16{1},
+			Parameters: [][]byte{
+				binary.BigEndian.AppendUint32(nil, uint32(minus7)),
+				binary.BigEndian.AppendUint32(nil, math.Float32bits(1.5)),
+				{0, 1, 2, 255},
+				[]byte("hello"),
+				binary.BigEndian.AppendUint32(nil, uint32(int32(days))),
+				{1},
+				numBin,
+				uuidBin,
+			},
+		},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	if res := c.readUntilReady(); len(res.Errs) > 0 {
+		t.Fatalf("binary insert failed: %+v", res.Errs)
+	}
+	res := c.mustQuery("SELECT i, f, hex(b), t, d || '', flag + 0, n, u FROM vals")
+	for i, expected := range []string{"-7", "1.5", "000102FF", "hello", "2023-04-05", "1", "12.25", "6ba7b810-9dad-11d1-80b4-00c04fd430c8"} {
+		if v := res.value(0, i); v != expected {
+			t.Errorf("column %d: expected %q to be stored, got %q", i, expected, v)
+		}
+	}
+
+	// results in binary, for some columns only
+	c.send(
+		&pgproto3.Parse{Query: "SELECT i, f, b, t, flag FROM vals"},
+		&pgproto3.Bind{ResultFormatCodes: []int16{1, 1, 1, 0, 1}},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	res = c.readUntilReady()
+	if len(res.Errs) > 0 || len(res.Rows) != 1 {
+		t.Fatalf("binary select failed: %+v", res)
+	}
+	row := res.Rows[0]
+	if v := int64(binary.BigEndian.Uint64([]byte(*row[0]))); v != -7 {
+		t.Errorf("expected int8 -7, got %d", v)
+	}
+	if v := math.Float64frombits(binary.BigEndian.Uint64([]byte(*row[1]))); v != 1.5 {
+		t.Errorf("expected float8 1.5, got %v", v)
+	}
+	if v := []byte(*row[2]); string(v) != string([]byte{0, 1, 2, 255}) {
+		t.Errorf("expected raw bytea, got %v", v)
+	}
+	if *row[3] != "hello" || *row[4] != "\x01" {
+		t.Errorf("expected text and binary bool, got %q %q", *row[3], *row[4])
+	}
+}
+
+func TestBinaryDateRange(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE times (d DATE, ts TIMESTAMP)")
+
+	// far enough from 2000 that a time.Duration would overflow
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	for _, tm := range []time.Time{
+		time.Date(1, 1, 1, 0, 0, 0, 123456000, time.UTC),
+		time.Date(1969, 12, 31, 23, 59, 59, 999999000, time.UTC),
+		time.Date(9999, 12, 31, 23, 59, 59, 654321000, time.UTC),
+	} {
+		days := (tm.Unix() - epoch) / (24 * 60 * 60)
+		if tm.Unix() < epoch {
+			days--
+		}
+		us := (tm.Unix()-epoch)*1e6 + int64(tm.Nanosecond()/1e3)
+		date := binary.BigEndian.AppendUint32(nil, uint32(int32(days)))
+		stamp := binary.BigEndian.AppendUint64(nil, uint64(us))
+
+		c.mustQuery("DELETE FROM times")
+		c.send(
+			&pgproto3.Parse{
+				Query:         "INSERT INTO times VALUES ($1, $2)",
+				ParameterOIDs: []uint32{pgtype.DateOID, pgtype.TimestampOID},
+			},
+			&pgproto3.Bind{ParameterFormatCodes: []int16{1}, Parameters: [][]byte{date, stamp}},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+		)
+		if res := c.readUntilReady(); len(res.Errs) > 0 {
+			t.Fatalf("binary insert of %s failed: %+v", tm, res.Errs)
+		}
+		c.send(
+			&pgproto3.Parse{Query: "SELECT d, ts FROM times"},
+			&pgproto3.Bind{ResultFormatCodes: []int16{1}},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+		)
+		res := c.readUntilReady()
+		if len(res.Errs) > 0 || len(res.Rows) != 1 {
+			t.Fatalf("binary select of %s failed: %+v", tm, res)
+		}
+		if v := []byte(*res.Rows[0][0]); string(v) != string(date) {
+			t.Errorf("expected date %s to round-trip as %d days, got %d", tm.Format("2006-01-02"), days,
+				int32(binary.BigEndian.Uint32(v)))
+		}
+		if v := []byte(*res.Rows[0][1]); string(v) != string(stamp) {
+			t.Errorf("expected timestamp %s to round-trip as %d, got %d", tm, us, int64(binary.BigEndian.Uint64(v)))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"io"
+	"testing"
+	"time"
+)
+
+/*
+sendCancel() opens a separate connection and sends a CancelRequest on it, as libpq does. The server closes the
+connection without replying.
+*/
+func (c *testClient) sendCancel(pid, secretKey uint32) {
+	cc := dialTestClient(c.t, c.addr)
+	cc.send(&pgproto3.CancelRequest{ProcessID: pid, SecretKey: secretKey})
+	if _, err := cc.conn.Read(make([]byte, 1)); err != io.EOF {
+		c.t.Errorf("expected the server to close the cancel connection, got %v", err)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	if c.pid == 0 {
+		t.Fatal("expected BackendKeyData after authentication")
+	}
+	other := dialTestClient(t, c.addr)
+	other.startup("test", "tester", "secret")
+	if other.pid == c.pid {
+		t.Fatal("sessions should get distinct process IDs")
+	}
+
+	// a cancel with the wrong key, or for an idle session, is ignored
+	c.sendCancel(c.pid, c.secretKey+1)
+	other.sendCancel(other.pid, other.secretKey)
+	c.mustQuery("SELECT 1")
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		// the cancel may race ahead of the query starting, so keep trying until it lands
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+				c.sendCancel(c.pid, c.secretKey)
+			}
+		}
+	}()
+	res := c.query("WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n) SELECT count(*) FROM n")
+	close(done)
+	<-stopped
+	if res.errCode() != "57014" {
+		t.Fatalf("expected query_canceled, got %+v", res)
+	}
+
+	// both sessions are still usable afterwards
+	if v := c.mustQuery("SELECT 2").value(0, 0); v != "2" {
+		t.Errorf("expected 2, got %s", v)
+	}
+	if v := other.mustQuery("SELECT 3").value(0, 0); v != "3" {
+		t.Errorf("expected 3, got %s", v)
+	}
+}
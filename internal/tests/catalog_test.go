@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"testing"
+)
+
+// psqlListTables is the query psql runs for \dt
+const psqlListTables = `SELECT n.nspname as "Schema",
+  c.relname as "Name",
+  CASE c.relkind WHEN 'r' THEN 'table' WHEN 'v' THEN 'view' WHEN 'm' THEN 'materialized view' WHEN 'i' THEN 'index' WHEN 'S' THEN 'sequence' WHEN 't' THEN 'TOAST table' WHEN 'f' THEN 'foreign table' WHEN 'p' THEN 'partitioned table' WHEN 'I' THEN 'partitioned index' END as "Type",
+  pg_catalog.pg_get_userbyid(c.relowner) as "Owner"
+FROM pg_catalog.pg_class c
+     LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+     LEFT JOIN pg_catalog.pg_am am ON am.oid = c.relam
+WHERE c.relkind IN ('r','p','')
+      AND n.nspname <> 'pg_catalog'
+      AND n.nspname !~ '^pg_toast'
+      AND n.nspname <> 'information_schema'
+  AND pg_catalog.pg_table_is_visible(c.oid)
+ORDER BY 1,2;`
+
+// psqlFindTable and psqlDescribeColumns are the first and third queries psql runs for \d orders
+const psqlFindTable = `SELECT c.oid,
+  n.nspname,
+  c.relname
+FROM pg_catalog.pg_class c
+     LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relname OPERATOR(pg_catalog.~) '^(orders)$' COLLATE pg_catalog.default
+  AND pg_catalog.pg_table_is_visible(c.oid)
+ORDER BY 2, 3;`
+
+const psqlDescribeColumns = `SELECT a.attname,
+  pg_catalog.format_type(a.atttypid, a.atttypmod),
+  (SELECT pg_catalog.pg_get_expr(d.adbin, d.adrelid, true)
+   FROM pg_catalog.pg_attrdef d
+   WHERE d.adrelid = a.attrelid AND d.adnum = a.attnum AND a.atthasdef),
+  a.attnotnull,
+  (SELECT c.collname FROM pg_catalog.pg_collation c, pg_catalog.pg_type t
+   WHERE c.oid = a.attcollation AND t.oid = a.atttypid AND a.attcollation <> t.typcollation) AS attcollation,
+  a.attidentity,
+  a.attgenerated
+FROM pg_catalog.pg_attribute a
+WHERE a.attrelid = '%s' AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attnum;`
+
+func TestSystemCatalogs(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery(`CREATE TABLE customers (id INTEGER PRIMARY KEY, email VARCHAR(80) NOT NULL UNIQUE);
+		CREATE TABLE orders (id INTEGER PRIMARY KEY, customer_id INTEGER REFERENCES customers (id),
+			total NUMERIC(10,2) DEFAULT 0, placed TIMESTAMPTZ);
+		CREATE INDEX orders_customer ON orders (customer_id);
+		CREATE VIEW big_orders AS SELECT * FROM orders WHERE total > 100;`)
+
+	res := c.mustQuery(psqlListTables)
+	if len(res.Rows) != 2 || res.value(0, 0) != "public" || res.value(0, 1) != "customers" ||
+		res.value(1, 1) != "orders" || res.value(1, 2) != "table" || res.value(1, 3) != "tester" {
+		t.Errorf("unexpected \\dt result: %d rows, %q", len(res.Rows), res.value(0, 1))
+	}
+
+	res = c.mustQuery(psqlFindTable)
+	if len(res.Rows) != 1 || res.value(0, 2) != "orders" {
+		t.Fatalf("expected to find orders, got %d rows", len(res.Rows))
+	}
+	res = c.mustQuery(fmt.Sprintf(psqlDescribeColumns, res.value(0, 0)))
+	var cols []string
+	for i := range res.Rows {
+		cols = append(cols, fmt.Sprintf("%s %s %s %s %s", res.value(i, 0), res.value(i, 1), res.value(i, 2),
+			res.value(i, 3), res.value(i, 5)))
+	}
+	if fmt.Sprint(cols) != "[id bigint <nil> t d customer_id bigint <nil> f  total numeric(10,2) 0 f  "+
+		"placed timestamp with time zone <nil> f ]" {
+		t.Errorf("unexpected columns: %q", cols)
+	}
+
+	// the information_schema queries ORMs use
+	res = c.mustQuery(`SELECT table_name, table_type FROM information_schema.tables
+		WHERE table_schema = 'public' ORDER BY table_name`)
+	if len(res.Rows) != 3 || res.value(0, 0) != "big_orders" || res.value(0, 1) != "VIEW" {
+		t.Errorf("unexpected tables: %d rows", len(res.Rows))
+	}
+	res = c.mustQuery(`SELECT column_name, data_type, character_maximum_length, is_nullable
+		FROM information_schema.columns WHERE table_name = 'customers' ORDER BY ordinal_position`)
+	if len(res.Rows) != 2 || res.value(1, 1) != "character varying" || res.value(1, 2) != "80" || res.value(1, 3) != "NO" {
+		t.Errorf("unexpected columns: %d rows", len(res.Rows))
+	}
+	res = c.mustQuery(`SELECT tc.constraint_type, tc.table_name, kcu.column_name
+		FROM information_schema.table_constraints tc
+		JOIN information_schema.key_column_usage kcu ON kcu.constraint_name = tc.constraint_name
+		ORDER BY tc.table_name, tc.constraint_type`)
+	var keys []string
+	for i := range res.Rows {
+		keys = append(keys, res.value(i, 0)+" "+res.value(i, 1)+"."+res.value(i, 2))
+	}
+	if fmt.Sprint(keys) != "[PRIMARY KEY customers.id UNIQUE customers.email FOREIGN KEY orders.customer_id PRIMARY KEY orders.id]" {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+	res = c.mustQuery(`SELECT i.relname, x.indisunique FROM pg_index x JOIN pg_class i ON i.oid = x.indexrelid
+		WHERE x.indrelid = 'orders'::regclass ORDER BY 1`)
+	if len(res.Rows) != 2 || res.value(0, 0) != "orders_customer" || res.value(1, 0) != "orders_pkey" || res.value(1, 1) != "t" {
+		t.Errorf("unexpected indexes: %d rows", len(res.Rows))
+	}
+
+	// the catalogs follow schema changes, including ones that are rolled back
+	c.mustQuery("BEGIN")
+	c.mustQuery("CREATE TABLE scratch (x TEXT)")
+	if res := c.mustQuery("SELECT count(*) FROM pg_class WHERE relname = 'scratch'"); res.value(0, 0) != "1" {
+		t.Errorf("expected the new table in pg_class")
+	}
+	c.mustQuery("ROLLBACK")
+	if res := c.mustQuery("SELECT count(*) FROM pg_class WHERE relname = 'scratch'"); res.value(0, 0) != "0" {
+		t.Errorf("expected the rolled back table to be gone from pg_class")
+	}
+
+	// filling in the catalogs doesn't disturb last_insert_rowid()
+	c.mustQuery("INSERT INTO customers (email) VALUES ('a@example.com')")
+	c.mustQuery("ALTER TABLE customers ADD COLUMN name TEXT")
+	c.mustQuery("SELECT count(*) FROM information_schema.columns")
+	if res := c.mustQuery("SELECT last_insert_rowid()"); res.value(0, 0) != "1" {
+		t.Errorf("expected last_insert_rowid() to be 1, got %s", res.value(0, 0))
+	}
+
+	res = c.mustQuery(`SELECT current_database(), current_schema(), pg_catalog.format_type(1043, 24),
+		(SELECT datname FROM pg_database), (SELECT rolname FROM pg_roles),
+		(SELECT setting FROM pg_settings WHERE name = 'search_path')`)
+	var vals []string
+	for i := range res.Rows[0] {
+		vals = append(vals, res.value(0, i))
+	}
+	if fmt.Sprint(vals) != `[test public character varying(20) test tester "$user", public]` {
+		t.Errorf("unexpected values: %q", vals)
+	}
+
+	// the extended protocol sees the catalogs too
+	ext := c.execPrepared("SELECT typname FROM pg_catalog.pg_type WHERE oid = $1", "25")
+	if len(ext.Rows) != 1 || ext.value(0, 0) != "text" {
+		t.Errorf("unexpected extended result: %+v", ext)
+	}
+}
@@ -0,0 +1,117 @@
+//go:build sqlite_preupdate_hook
+
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+nextChangeSet() waits for a subscription's next transaction.
+*/
+func nextChangeSet(t *testing.T, sub *dbmgr.ChangeSubscription) dbmgr.ChangeSet {
+	t.Helper()
+	select {
+	case cs, ok := <-sub.C:
+		if !ok {
+			t.Fatalf("subscription ended: %v", sub.Err())
+		}
+		return cs
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a change set")
+	}
+	return dbmgr.ChangeSet{}
+}
+
+func TestChangeFeed(t *testing.T) {
+	var veto atomic.Bool
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{
+		CaptureChanges: true,
+		TenantHooks: []dbmgr.TenantHooks{{
+			CommitHook: func(cc *dbmgr.ConnContext) int {
+				if veto.Load() {
+					return 1
+				}
+				return 0
+			},
+		}},
+	})
+	c := connectTestClient(t, dbm, pgif.BackendConfig{})
+	c.startup("test", "tester", "secret")
+
+	sub, err := dbm.Subscribe("test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sub.Close()
+
+	c.mustQuery("CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, price REAL, data BLOB)")
+	c.mustQuery("INSERT INTO items VALUES (1, 'widget', 2.0, x'00ff')")
+	cs := nextChangeSet(t, sub)
+	if cs.Position != 1 || len(cs.Changes) != 1 {
+		t.Fatalf("unexpected change set %+v", cs)
+	}
+	ch := cs.Changes[0]
+	if ch.Op != "INSERT" || ch.Table != "items" || ch.NewRowID != 1 || ch.Old != nil ||
+		fmt.Sprintf("%#v", ch.NewValues()) != `[]interface {}{1, "widget", 2, []uint8{0x0, 0xff}}` {
+		t.Errorf("unexpected insert %+v %#v", ch, ch.NewValues())
+	}
+
+	// changes are grouped by transaction, and rolled back transactions are dropped
+	c.mustQuery("BEGIN; UPDATE items SET price = 2.5 WHERE id = 1; INSERT INTO items (id, name) VALUES (2, 'gadget'); COMMIT")
+	c.mustQuery("BEGIN; DELETE FROM items; ROLLBACK")
+	c.mustQuery("DELETE FROM items WHERE id = 2")
+	cs = nextChangeSet(t, sub)
+	if cs.Position != 2 || len(cs.Changes) != 2 || cs.Changes[0].Op != "UPDATE" || cs.Changes[1].Op != "INSERT" {
+		t.Fatalf("unexpected change set %+v", cs)
+	}
+	if old, updated := cs.Changes[0].OldValues(), cs.Changes[0].NewValues(); old[2] != 2.0 || updated[2] != 2.5 {
+		t.Errorf("unexpected before and after images %v %v", old, updated)
+	}
+	cs = nextChangeSet(t, sub)
+	if cs.Position != 3 || len(cs.Changes) != 1 || cs.Changes[0].Op != "DELETE" || cs.Changes[0].OldRowID != 2 ||
+		cs.Changes[0].New != nil || cs.Changes[0].OldValues()[1] != "gadget" {
+		t.Fatalf("unexpected change set %+v", cs)
+	}
+
+	// a subscriber can resume from the last position it handled
+	resumed, err := dbm.Subscribe("test", 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resumed.Close()
+	if cs := nextChangeSet(t, resumed); cs.Position != 3 {
+		t.Errorf("expected to resume at position 3, got %d", cs.Position)
+	}
+
+	// a transaction that a commit hook vetoes never reaches the log
+	veto.Store(true)
+	for _, q := range []string{
+		"INSERT INTO items (id, name) VALUES (3, 'gizmo')",
+		"BEGIN; INSERT INTO items (id, name) VALUES (3, 'gizmo'); COMMIT",
+	} {
+		if res := c.query(q); res.errCode() == "" {
+			t.Errorf("expected the commit hook to veto %q", q)
+		}
+	}
+	veto.Store(false)
+	c.mustQuery("INSERT INTO items (id, name) VALUES (4, 'doohickey')")
+	if cs := nextChangeSet(t, sub); cs.Position != 4 || len(cs.Changes) != 1 || cs.Changes[0].NewRowID != 4 {
+		t.Errorf("expected only the committed insert, got %+v", cs)
+	}
+
+	fname, _ := dbm.GetFilename("test")
+	if _, err := os.Stat(fname + "-changes"); err != nil {
+		t.Errorf("expected a change log: %s", err.Error())
+	}
+
+	if _, err := dbm.Subscribe("nonesuch", 0); err != dbmgr.ErrDBDoesNotExist {
+		t.Errorf("expected ErrDBDoesNotExist, got %v", err)
+	}
+}
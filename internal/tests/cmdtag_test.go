@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"testing"
+)
+
+func TestCommandTags(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+
+	for _, tc := range []struct {
+		sql, tag string
+		rows     int
+	}{
+		{"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, version INTEGER)", "CREATE TABLE", 0},
+		{"CREATE UNIQUE INDEX items_name ON items (name)", "CREATE INDEX", 0},
+		{"INSERT INTO items (name, version) VALUES ('a', 1), ('b', 1), ('c', 1)", "INSERT 0 3", 0},
+		{"INSERT INTO items (name, version) VALUES ('d', 1), ('e', 1) RETURNING id", "INSERT 0 2", 2},
+		{"UPDATE items SET version = version + 1 WHERE version = 1 AND name < 'c'", "UPDATE 2", 0},
+		{"UPDATE items SET version = 9 WHERE id = 99", "UPDATE 0", 0},
+		{"update items set version = 3 where name = 'c' returning id, version", "UPDATE 1", 1},
+		{"SELECT * FROM items", "SELECT 5", 5},
+		{"WITH old AS (SELECT id FROM items WHERE version = 1) DELETE FROM items WHERE id IN (SELECT id FROM old)", "DELETE 2", 0},
+		{"/* comment */ SELECT 'DELETE' FROM items WHERE id < 0", "SELECT 0", 0},
+		{"BEGIN", "BEGIN", 0},
+		{"COMMIT", "COMMIT", 0},
+		{"DROP TABLE items", "DROP TABLE", 0},
+	} {
+		res := c.mustQuery(tc.sql)
+		if len(res.Tags) != 1 || res.Tags[0] != tc.tag || len(res.Rows) != tc.rows {
+			t.Errorf("%q: expected tag %q with %d rows, got %v with %d rows", tc.sql, tc.tag, tc.rows, res.Tags, len(res.Rows))
+		}
+		if tc.rows == 0 && tc.tag != "SELECT 0" && len(res.Fields) > 0 {
+			t.Errorf("%q: expected no RowDescription, got %v", tc.sql, res.Fields)
+		}
+	}
+
+	res := c.mustQuery("  -- nothing here\n")
+	if fmt.Sprint(res.Types) != "[EmptyQueryResponse ReadyForQuery]" {
+		t.Errorf("expected an empty query response, got %v", res.Types)
+	}
+}
+
+func TestCommandTagsExtended(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE docs (id INTEGER, version INTEGER)")
+	c.mustQuery("INSERT INTO docs VALUES (1, 1), (2, 1)")
+
+	c.send(
+		&pgproto3.Parse{Query: "UPDATE docs SET version = version + 1 WHERE id > 0"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	res := c.readUntilReady()
+	if len(res.Errs) > 0 || len(res.Tags) != 1 || res.Tags[0] != "UPDATE 2" {
+		t.Errorf("expected UPDATE 2, got %+v", res)
+	}
+}
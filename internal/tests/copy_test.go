@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"testing"
+)
+
+func (c *testClient) copyIn(query string, chunks ...string) testResult {
+	c.send(&pgproto3.Query{String: query})
+	msg := c.receive()
+	if _, ok := msg.(*pgproto3.CopyInResponse); !ok {
+		res := testResult{}
+		res.collect(msg)
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			return res
+		}
+		rest := c.readUntilReady()
+		rest.Errs = append(res.Errs, rest.Errs...)
+		return rest
+	}
+	for _, chunk := range chunks {
+		c.send(&pgproto3.CopyData{Data: []byte(chunk)})
+	}
+	c.send(&pgproto3.CopyDone{})
+	return c.readUntilReady()
+}
+
+func (c *testClient) copyOut(query string) (string, testResult) {
+	c.send(&pgproto3.Query{String: query})
+	var data bytes.Buffer
+	res := testResult{}
+	for {
+		msg := c.receive()
+		res.collect(msg)
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			data.Write(msg.Data)
+		case *pgproto3.ReadyForQuery:
+			return data.String(), res
+		}
+	}
+}
+
+func TestCopyFromStdin(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE people (id INTEGER, name TEXT, note TEXT)")
+
+	// rows split across CopyData messages at arbitrary points
+	res := c.copyIn("COPY people FROM STDIN", "1\tAnn\ttab\\there\n2\tB", "ob\t\\N\n\\.\n")
+	if len(res.Errs) > 0 || len(res.Tags) != 1 || res.Tags[0] != "COPY 2" {
+		t.Fatalf("unexpected text copy result: %+v", res)
+	}
+
+	res = c.copyIn("COPY people (id, name, note) FROM STDIN WITH (FORMAT csv, HEADER true)",
+		"id,name,note\n3,\"Smith, Jo\",\"\"\n4,\"multi\nline\",\n")
+	if len(res.Errs) > 0 || res.Tags[0] != "COPY 2" {
+		t.Fatalf("unexpected csv copy result: %+v", res)
+	}
+
+	res = c.mustQuery("SELECT id, name, note FROM people ORDER BY id")
+	want := [][]string{{"1", "Ann", "tab\there"}, {"2", "Bob", "<nil>"}, {"3", "Smith, Jo", ""}, {"4", "multi\nline", "<nil>"}}
+	for i, row := range want {
+		for j, v := range row {
+			if got := res.value(i, j); got != v {
+				t.Errorf("row %d col %d: expected %q, got %q", i, j, v, got)
+			}
+		}
+	}
+
+	// binary: one row of (int4 5, text "bin", NULL)
+	var bin bytes.Buffer
+	bin.WriteString("PGCOPY\n\377\r\n\000")
+	bin.Write(make([]byte, 8))
+	_ = binary.Write(&bin, binary.BigEndian, int16(3))
+	_ = binary.Write(&bin, binary.BigEndian, int32(4))
+	_ = binary.Write(&bin, binary.BigEndian, int32(5))
+	_ = binary.Write(&bin, binary.BigEndian, int32(3))
+	bin.WriteString("bin")
+	_ = binary.Write(&bin, binary.BigEndian, int32(-1))
+	_ = binary.Write(&bin, binary.BigEndian, int16(-1))
+	res = c.copyIn("COPY people FROM STDIN (FORMAT binary)", bin.String())
+	if len(res.Errs) > 0 || res.Tags[0] != "COPY 1" {
+		t.Fatalf("unexpected binary copy result: %+v", res)
+	}
+	if v := c.mustQuery("SELECT name FROM people WHERE id = 5").value(0, 0); v != "bin" {
+		t.Errorf("binary row not inserted, got %q", v)
+	}
+}
+
+func TestCopyFromStdinErrorsRollBack(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE nums (n INTEGER)")
+
+	res := c.copyIn("COPY nums FROM STDIN", "1\n2\n3\t4\n")
+	if res.errCode() != "22P04" {
+		t.Errorf("expected bad_copy_file_format, got %+v", res.Errs)
+	}
+
+	c.send(&pgproto3.Query{String: "COPY nums FROM STDIN"})
+	if _, ok := c.receive().(*pgproto3.CopyInResponse); !ok {
+		t.Fatal("expected CopyInResponse")
+	}
+	c.send(&pgproto3.CopyData{Data: []byte("7\n")}, &pgproto3.CopyFail{Message: "client gave up"})
+	if res := c.readUntilReady(); res.errCode() != "57014" {
+		t.Errorf("expected query_canceled, got %+v", res.Errs)
+	}
+
+	if v := c.mustQuery("SELECT count(*) FROM nums").value(0, 0); v != "0" {
+		t.Errorf("failed COPYs should insert nothing, found %s rows", v)
+	}
+	if code := c.copyIn("COPY nums FROM '/etc/passwd'").errCode(); code != "0A000" {
+		t.Errorf("expected file COPY to be refused, got %q", code)
+	}
+	if code := c.copyIn("COPY missing FROM STDIN").errCode(); code != "42P01" {
+		t.Errorf("expected undefined_table, got %q", code)
+	}
+}
+
+func TestCopyToStdout(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE t (id INTEGER, name TEXT)")
+	c.mustQuery("INSERT INTO t VALUES (1, 'a\tb'), (2, NULL), (3, 'x,\"y\"')")
+
+	data, res := c.copyOut("COPY t TO STDOUT")
+	if data != "1\ta\\tb\n2\t\\N\n3\tx,\"y\"\n" || res.Tags[0] != "COPY 3" {
+		t.Errorf("unexpected text output %q (%v)", data, res.Tags)
+	}
+	data, res = c.copyOut("COPY (SELECT name FROM t WHERE id > 1 ORDER BY id) TO STDOUT WITH CSV HEADER")
+	if data != "name\n\n\"x,\"\"y\"\"\"\n" || res.Tags[0] != "COPY 2" {
+		t.Errorf("unexpected csv output %q (%v)", data, res.Tags)
+	}
+}
@@ -58,7 +58,7 @@ func TestNewDB(t *testing.T) {
 	os.Remove(fname)
 
 	driver := &sqlite3.SQLiteDriver{}
-	conn, err := dbmgr.OpenOrCreateDBConn(dbm, driver, fid, fnGet, fnCreate, dbmgr.DBConnOptions{})
+	conn, err := dbmgr.OpenOrCreateDBConn(dbm, nil, driver, fid, fnGet, fnCreate, dbmgr.DBConnOptions{})
 	if err != nil {
 		fmt.Println("Error opening/creating db: " + err.Error())
 		t.Error(err.Error())
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/highgrav/rhizome"
 	"github.com/highgrav/rhizome/internal/dbmgr"
+	"os"
 	"runtime"
 	"strconv"
 	"testing"
@@ -13,6 +14,9 @@ import (
 
 func TestCreateDBMgr(t *testing.T) {
 	rhizome.Init(rhizome.RhizomeConfig{})
+	if err := os.MkdirAll("/tmp/dbs", 0755); err != nil {
+		t.Fatal(err.Error())
+	}
 	fnCreate := func(id string, opts dbmgr.DBConnOptions) error {
 		fname := "/tmp/dbs/" + id + ".db"
 		connstr := "file:" + fname + opts.ConnstrOpts("rwc")
@@ -55,17 +59,17 @@ func TestCreateDBMgr(t *testing.T) {
 
 	for i := 0; i < dbm.Cfg.MaxDBsOpen; i++ {
 		id := strconv.FormatInt(int64(i), 10)
-		err := dbm.OpenOrCreate(id, dbmgr.DBConnOptions{})
+		err := dbm.OpenOrCreate(id)
 		if err != nil {
 			t.Error(err.Error())
 			return
 		}
-		err = dbm.DBs[id].Ping()
+		conn, err := dbm.GetOrCreate(id)
 		if err != nil {
 			t.Error(err.Error())
 			return
 		}
-		conn, err := dbm.GetOrCreate(id)
+		err = conn.Ping()
 		if err != nil {
 			t.Error(err.Error())
 			return
@@ -0,0 +1,250 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"testing"
+)
+
+func TestExtendedErrorRecovery(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE docs (id INTEGER)")
+
+	// a pipelined flow that fails at Parse: everything up to Sync is skipped, and there's exactly one ReadyForQuery
+	c.send(
+		&pgproto3.Parse{Query: "SELEKT nonsense"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Parse{Query: "INSERT INTO docs VALUES (1)"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	res := c.readUntilReady()
+	if fmt.Sprint(res.Types) != "[ErrorResponse ReadyForQuery]" {
+		t.Errorf("expected the rest of the flow to be skipped, got %v", res.Types)
+	}
+	if v := c.mustQuery("SELECT count(*) FROM docs").value(0, 0); v != "0" {
+		t.Errorf("expected the skipped INSERT not to run, got %s rows", v)
+	}
+
+	// the session is usable again after Sync
+	c.send(
+		&pgproto3.Parse{Query: "INSERT INTO docs VALUES (2)"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	res = c.readUntilReady()
+	if fmt.Sprint(res.Types) != "[ParseComplete BindComplete CommandComplete ReadyForQuery]" {
+		t.Errorf("expected a clean flow after Sync, got %v", res.Types)
+	}
+
+	for _, tc := range []struct {
+		name string
+		msgs []pgproto3.FrontendMessage
+		code string
+	}{
+		{"missing statement", []pgproto3.FrontendMessage{&pgproto3.Bind{PreparedStatement: "nope"}}, "26000"},
+		{"missing portal", []pgproto3.FrontendMessage{&pgproto3.Execute{Portal: "nope"}}, "34000"},
+		{"duplicate statement", []pgproto3.FrontendMessage{
+			&pgproto3.Parse{Name: "s1", Query: "SELECT 1"},
+			&pgproto3.Parse{Name: "s1", Query: "SELECT 2"},
+		}, "42P05"},
+		{"several statements", []pgproto3.FrontendMessage{
+			&pgproto3.Parse{Query: "INSERT INTO docs VALUES (3); DELETE FROM docs"},
+		}, "42601"},
+	} {
+		c.send(append(tc.msgs, &pgproto3.Flush{}, &pgproto3.Sync{})...)
+		if res := c.readUntilReady(); res.errCode() != tc.code {
+			t.Errorf("%s: expected %s, got %+v", tc.name, tc.code, res.Errs)
+		}
+	}
+	if v := c.mustQuery("SELECT count(*) FROM docs").value(0, 0); v != "1" {
+		t.Errorf("expected nothing to run from a rejected Parse, got %s rows", v)
+	}
+	// a trailing semicolon or comment is still a single statement
+	c.execPrepared("INSERT INTO docs VALUES (4); -- done")
+	if v := c.mustQuery("SELECT count(*) FROM docs").value(0, 0); v != "2" {
+		t.Errorf("expected a single statement with a trailing semicolon to run, got %s rows", v)
+	}
+}
+
+func TestPortalRowLimits(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE docs (id INTEGER)")
+	c.mustQuery("INSERT INTO docs VALUES (1), (2), (3), (4), (5)")
+
+	c.mustQuery("BEGIN")
+	c.send(
+		&pgproto3.Parse{Name: "s", Query: "SELECT id FROM docs ORDER BY id"},
+		&pgproto3.Bind{PreparedStatement: "s", DestinationPortal: "p"},
+		&pgproto3.Execute{Portal: "p", MaxRows: 2},
+		&pgproto3.Execute{Portal: "p", MaxRows: 2},
+		&pgproto3.Sync{},
+	)
+	res := c.readUntilReady()
+	if fmt.Sprint(res.Types) != "[ParseComplete BindComplete DataRow DataRow PortalSuspended DataRow DataRow PortalSuspended ReadyForQuery]" {
+		t.Fatalf("expected two suspended batches, got %v", res.Types)
+	}
+	if res.value(3, 0) != "4" {
+		t.Errorf("expected the second batch to resume the cursor, got %+v", res.Rows)
+	}
+
+	// inside a transaction block the portal survives Sync, and can be fetched from alongside other statements
+	c.send(
+		&pgproto3.Parse{Query: "SELECT count(*) FROM docs"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Execute{Portal: "p", MaxRows: 2},
+		&pgproto3.Execute{Portal: "p", MaxRows: 2},
+		&pgproto3.Sync{},
+	)
+	res = c.readUntilReady()
+	if len(res.Errs) > 0 || fmt.Sprint(res.Tags) != "[SELECT 1 SELECT 1 SELECT 0]" || res.value(1, 0) != "5" {
+		t.Errorf("expected the portal to finish with its last row, got %+v", res)
+	}
+
+	// the portal ends with the transaction
+	c.mustQuery("COMMIT")
+	c.send(&pgproto3.Execute{Portal: "p"}, &pgproto3.Sync{})
+	if res := c.readUntilReady(); res.errCode() != "34000" {
+		t.Errorf("expected the portal to be closed at COMMIT, got %+v", res)
+	}
+
+	// outside of a transaction block it ends at Sync
+	c.send(
+		&pgproto3.Bind{PreparedStatement: "s", DestinationPortal: "q"},
+		&pgproto3.Execute{Portal: "q", MaxRows: 1},
+		&pgproto3.Sync{},
+		&pgproto3.Execute{Portal: "q", MaxRows: 1},
+		&pgproto3.Sync{},
+	)
+	c.readUntilReady()
+	if res := c.readUntilReady(); res.errCode() != "34000" {
+		t.Errorf("expected the portal to be closed at Sync, got %+v", res)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE docs (id INTEGER, body TEXT, score REAL)")
+
+	c.send(
+		&pgproto3.Parse{Name: "sel", Query: "SELECT id, body, score, id * 2 AS twice FROM docs"},
+		&pgproto3.Describe{ObjectType: 'S', Name: "sel"},
+		&pgproto3.Parse{Name: "ins", Query: "INSERT INTO docs VALUES (1, 'a', 0.5)"},
+		&pgproto3.Describe{ObjectType: 'S', Name: "ins"},
+		&pgproto3.Bind{PreparedStatement: "sel", ResultFormatCodes: []int16{1, 0, 1, 0}},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Sync{},
+	)
+	var descs []*pgproto3.RowDescription
+	var types []string
+	for {
+		msg := c.receive()
+		types = append(types, fmt.Sprintf("%T", msg))
+		if rd, ok := msg.(*pgproto3.RowDescription); ok {
+			cp := *rd
+			cp.Fields = append([]pgproto3.FieldDescription(nil), rd.Fields...)
+			descs = append(descs, &cp)
+		}
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+	if len(descs) != 2 || fmt.Sprint(types[:5]) != "[*pgproto3.ParseComplete *pgproto3.ParameterDescription "+
+		"*pgproto3.RowDescription *pgproto3.ParseComplete *pgproto3.ParameterDescription]" || types[5] != "*pgproto3.NoData" {
+		t.Fatalf("unexpected describe responses: %v", types)
+	}
+	var oids []uint32
+	for _, f := range descs[0].Fields {
+		oids = append(oids, f.DataTypeOID)
+	}
+	// INTEGER, TEXT, and REAL columns, and an expression with no declared type
+	if fmt.Sprint(oids) != "[20 25 701 25]" || string(descs[0].Fields[3].Name) != "twice" {
+		t.Errorf("unexpected statement description: %+v", descs[0].Fields)
+	}
+	var formats []int16
+	for _, f := range descs[1].Fields {
+		formats = append(formats, f.Format)
+	}
+	if fmt.Sprint(formats) != "[1 0 1 0]" {
+		t.Errorf("expected the portal description to use the bound result formats, got %v", formats)
+	}
+}
+
+/*
+paramTypes() prepares a query as the unnamed statement and returns the parameter types the server describes for it.
+*/
+func (c *testClient) paramTypes(query string) []uint32 {
+	c.send(&pgproto3.Parse{Query: query}, &pgproto3.Describe{ObjectType: 'S'}, &pgproto3.Sync{})
+	var oids []uint32
+	for {
+		switch msg := c.receive().(type) {
+		case *pgproto3.ParameterDescription:
+			oids = append([]uint32{}, msg.ParameterOIDs...)
+		case *pgproto3.ErrorResponse:
+			c.t.Errorf("failed to describe %q: %s", query, msg.Message)
+		case *pgproto3.ReadyForQuery:
+			return oids
+		}
+	}
+}
+
+func (c *testClient) execPrepared(query string, params ...string) testResult {
+	vals := make([][]byte, len(params))
+	for i, p := range params {
+		vals[i] = []byte(p)
+	}
+	c.send(
+		&pgproto3.Parse{Query: query},
+		&pgproto3.Bind{Parameters: vals},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	return c.readUntilReady()
+}
+
+func TestParameterTypes(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE docs (id INTEGER, score REAL, body TEXT)")
+	c.mustQuery("INSERT INTO docs VALUES (1, 0.5, 'a'), (2, 1.5, 'b')")
+
+	for query, expected := range map[string]string{
+		"SELECT body FROM docs WHERE id = $1":                                 "[20]",
+		"SELECT body FROM docs d WHERE $1 < d.score":                          "[701]",
+		"INSERT INTO docs (body, id) VALUES ($2, $1)":                         "[20 25]",
+		"INSERT INTO docs VALUES ($1, $2, $3), ($4, 1.0, $5)":                 "[20 701 25 20 25]",
+		"UPDATE docs SET score = $1 WHERE id IN ($2, $3)":                     "[701 20 20]",
+		"SELECT id FROM docs WHERE id BETWEEN $1 AND $2 ORDER BY id LIMIT $3": "[20 20 20]",
+		"SELECT upper($1)": "[25]",
+	} {
+		if oids := fmt.Sprint(c.paramTypes(query)); oids != expected {
+			t.Errorf("%s: expected parameter types %s, got %s", query, expected, oids)
+		}
+	}
+
+	// integer parameters now match integer columns
+	if res := c.execPrepared("SELECT body FROM docs WHERE id = $1", "2"); res.value(0, 0) != "b" {
+		t.Errorf("expected to find the row by id, got %+v", res)
+	}
+	// and parameters are bound by number, not by the order they appear in
+	c.execPrepared("INSERT INTO docs (body, id) VALUES ($2, $1)", "3", "c")
+	if v := c.mustQuery("SELECT typeof(id) || ':' || body FROM docs WHERE id = 3").value(0, 0); v != "integer:c" {
+		t.Errorf("expected an integer id and text body, got %s", v)
+	}
+
+	if code := c.execPrepared("SELECT body FROM docs WHERE id = $1", "x").errCode(); code != "22P02" {
+		t.Errorf("expected a bad integer to be rejected, got %q", code)
+	}
+	if code := c.execPrepared("SELECT body FROM docs WHERE id = $1").errCode(); code != "08P01" {
+		t.Errorf("expected a missing parameter to be rejected, got %q", code)
+	}
+}
@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"testing"
+)
+
+func TestValueFormatting(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE vals (f REAL, r FLOAT4, b BLOB, ts TIMESTAMPTZ, plain TIMESTAMP, flag BOOLEAN, n NUMERIC)")
+	c.mustQuery("INSERT INTO vals VALUES (0.1, 1.5, x'0102ff', '2004-10-19 10:23:54.5+02:00', '2004-10-19 10:23:54', 1, 12.5)")
+	c.mustQuery("INSERT INTO vals VALUES (1e20, 1234567, 'ab', '2004-10-19 10:23:54+05:30', '2004-10-19', 0, 3)")
+	c.mustQuery("INSERT INTO vals VALUES (1e-5, 0, NULL, NULL, NULL, NULL, NULL)")
+
+	res := c.mustQuery("SELECT * FROM vals")
+	for i, expected := range [][]string{
+		{"0.1", "1.5", `\x0102ff`, "2004-10-19 10:23:54.5+02", "2004-10-19 10:23:54", "t", "12.5"},
+		{"1e+20", "1.234567e+06", `\x6162`, "2004-10-19 10:23:54+05:30", "2004-10-19 00:00:00", "f", "3"},
+		{"1e-05", "0", "<nil>", "<nil>", "<nil>", "<nil>", "<nil>"},
+	} {
+		for j, v := range expected {
+			if got := res.value(i, j); got != v {
+				t.Errorf("row %d column %s: expected %q, got %q", i, res.Fields[j], v, got)
+			}
+		}
+	}
+
+	res = c.mustQuery("SELECT 1e999, -1e999, 1.0 / 3, 100000.0")
+	for i, expected := range []string{"Infinity", "-Infinity", "0.3333333333333333", "100000"} {
+		if got := res.value(0, i); got != expected {
+			t.Errorf("column %d: expected %q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestInvalidValues(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	setup := newTestClient(t, dbm, pgif.BackendConfig{})
+	setup.mustQuery("CREATE TABLE odd (i INTEGER, flag BOOLEAN)")
+	setup.mustQuery("INSERT INTO odd VALUES ('abc', 'maybe')")
+
+	if res := setup.mustQuery("SELECT i FROM odd"); res.value(0, 0) != "abc" {
+		t.Errorf("expected the value to be passed through by default, got %q", res.value(0, 0))
+	}
+	nulls := newTestClient(t, dbm, pgif.BackendConfig{InvalidValues: pgif.InvalidValueNull})
+	if res := nulls.mustQuery("SELECT i FROM odd"); len(res.Rows) != 1 || res.Rows[0][0] != nil {
+		t.Errorf("expected a NULL, got %+v", res.Rows)
+	}
+	errs := newTestClient(t, dbm, pgif.BackendConfig{InvalidValues: pgif.InvalidValueError})
+	if code := errs.query("SELECT i FROM odd").errCode(); code != "22P02" {
+		t.Errorf("expected 22P02, got %q", code)
+	}
+}
@@ -0,0 +1,253 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/highgrav/rhizome"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"net"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Helpers for driving a RhizomeBackend over a loopback TCP connection with a raw pgproto3 frontend, so tests can
+check the exact message flow a Postgres client would see.
+*/
+
+type testClient struct {
+	t         *testing.T
+	addr      string
+	conn      net.Conn
+	fe        *pgproto3.Frontend
+	pid       uint32
+	secretKey uint32
+}
+
+type testResult struct {
+	Types    []string
+	Fields   []string
+	OIDs     []uint32
+	Rows     [][]*string
+	Tags     []string
+	Errs     []pgproto3.ErrorResponse
+	TxStatus byte
+	KeyData  *pgproto3.BackendKeyData
+	// Params are the ParameterStatus messages received, by name
+	Params map[string]string
+	// Notifications are the NotificationResponses received, as "channel: payload"
+	Notifications []string
+}
+
+func newTestManager(t *testing.T, cfg dbmgr.DBManagerConfig) *dbmgr.DBManager {
+	rhizome.Init(rhizome.RhizomeConfig{})
+	dir := t.TempDir()
+	if cfg.FnGetDB == nil {
+		cfg.FnGetDB = func(id string) (string, error) {
+			return path.Join(dir, id+".db"), nil
+		}
+	}
+	if cfg.FnNewDB == nil {
+		fnGet := cfg.FnGetDB
+		cfg.FnNewDB = func(id string, opts dbmgr.DBConnOptions) error {
+			fname, err := fnGet(id)
+			if err != nil {
+				return err
+			}
+			db, err := sql.Open("sqlite3", "file:"+fname+opts.ConnstrOpts("rwc"))
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			return db.Ping()
+		}
+	}
+	if cfg.MaxDBsOpen == 0 {
+		cfg.MaxDBsOpen = 100
+	}
+	if cfg.SweepEach == 0 {
+		cfg.SweepEach = time.Minute
+	}
+	if cfg.MaxIdleTime == 0 {
+		cfg.MaxIdleTime = time.Minute
+	}
+	dbm := dbmgr.NewDBManager(cfg, dbmgr.DBConnOptions{UseJModeWAL: true})
+	if err := dbm.Create("test"); err != nil {
+		t.Fatalf("could not create test db: %s", err.Error())
+	}
+	return dbm
+}
+
+/*
+startTestServer() listens on a loopback port and runs a backend for every connection until the test ends.
+*/
+func startTestServer(t *testing.T, dbm *dbmgr.DBManager, cfg pgif.BackendConfig) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = rhizome.NewRhizomeBackend(context.Background(), conn, dbm, cfg).Run()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	c := &testClient{
+		t:    t,
+		addr: addr,
+		conn: conn,
+		fe:   pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn),
+	}
+	t.Cleanup(c.close)
+	return c
+}
+
+func connectTestClient(t *testing.T, dbm *dbmgr.DBManager, cfg pgif.BackendConfig) *testClient {
+	return dialTestClient(t, startTestServer(t, dbm, cfg))
+}
+
+func newTestClient(t *testing.T, dbm *dbmgr.DBManager, cfg pgif.BackendConfig) *testClient {
+	c := connectTestClient(t, dbm, cfg)
+	c.startup("test", "tester", "secret")
+	return c
+}
+
+func (c *testClient) startup(dbname, user, pwd string) testResult {
+	c.send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"database": dbname, "user": user},
+	})
+	msg := c.receive()
+	if _, ok := msg.(*pgproto3.AuthenticationCleartextPassword); !ok {
+		c.t.Fatalf("expected cleartext password request, got %T", msg)
+	}
+	c.send(&pgproto3.PasswordMessage{Password: pwd})
+	res := c.readUntilReady()
+	if res.KeyData != nil {
+		c.pid, c.secretKey = res.KeyData.ProcessID, res.KeyData.SecretKey
+	}
+	return res
+}
+
+func (c *testClient) close() {
+	_ = c.fe.Send(&pgproto3.Terminate{})
+	_ = c.conn.Close()
+}
+
+func (c *testClient) send(msgs ...pgproto3.FrontendMessage) {
+	for _, msg := range msgs {
+		if err := c.fe.Send(msg); err != nil {
+			c.t.Fatalf("error sending %T: %s", msg, err.Error())
+		}
+	}
+}
+
+func (c *testClient) receive() pgproto3.BackendMessage {
+	msg, err := c.fe.Receive()
+	if err != nil {
+		c.t.Fatalf("error receiving message: %s", err.Error())
+	}
+	return msg
+}
+
+/*
+collect() records a single backend message in the result, copying anything the frontend will reuse.
+*/
+func (r *testResult) collect(msg pgproto3.BackendMessage) {
+	r.Types = append(r.Types, strings.TrimPrefix(fmt.Sprintf("%T", msg), "*pgproto3."))
+	switch msg := msg.(type) {
+	case *pgproto3.RowDescription:
+		r.Fields = r.Fields[:0]
+		r.OIDs = r.OIDs[:0]
+		for _, f := range msg.Fields {
+			r.Fields = append(r.Fields, string(f.Name))
+			r.OIDs = append(r.OIDs, f.DataTypeOID)
+		}
+	case *pgproto3.DataRow:
+		row := make([]*string, len(msg.Values))
+		for i, v := range msg.Values {
+			if v != nil {
+				s := string(v)
+				row[i] = &s
+			}
+		}
+		r.Rows = append(r.Rows, row)
+	case *pgproto3.CommandComplete:
+		r.Tags = append(r.Tags, string(msg.CommandTag))
+	case *pgproto3.ErrorResponse:
+		r.Errs = append(r.Errs, *msg)
+	case *pgproto3.ReadyForQuery:
+		r.TxStatus = msg.TxStatus
+	case *pgproto3.BackendKeyData:
+		kd := *msg
+		r.KeyData = &kd
+	case *pgproto3.NotificationResponse:
+		r.Notifications = append(r.Notifications, msg.Channel+": "+msg.Payload)
+	case *pgproto3.ParameterStatus:
+		if r.Params == nil {
+			r.Params = make(map[string]string)
+		}
+		r.Params[msg.Name] = msg.Value
+	}
+}
+
+func (c *testClient) readUntilReady() testResult {
+	res := testResult{}
+	for {
+		msg := c.receive()
+		res.collect(msg)
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			return res
+		}
+	}
+}
+
+func (c *testClient) query(sql string) testResult {
+	c.send(&pgproto3.Query{String: sql})
+	return c.readUntilReady()
+}
+
+/*
+mustQuery() runs a simple query and fails the test if the server reported an error.
+*/
+func (c *testClient) mustQuery(sql string) testResult {
+	res := c.query(sql)
+	if len(res.Errs) > 0 {
+		c.t.Fatalf("query %q failed: %s (%s)", sql, res.Errs[0].Message, res.Errs[0].Code)
+	}
+	return res
+}
+
+func (r testResult) errCode() string {
+	if len(r.Errs) == 0 {
+		return ""
+	}
+	return r.Errs[0].Code
+}
+
+func (r testResult) value(row, col int) string {
+	if row >= len(r.Rows) || col >= len(r.Rows[row]) || r.Rows[row][col] == nil {
+		return "<nil>"
+	}
+	return *r.Rows[row][col]
+}
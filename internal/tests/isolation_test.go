@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsolationPolicy(t *testing.T) {
+	shared := filepath.Join(t.TempDir(), "shared.db")
+	backups := t.TempDir()
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{
+		Isolation: dbmgr.IsolationPolicy{
+			AttachAllowed:   []string{shared},
+			AllowPragmas:    []string{"mmap_size"},
+			FnVacuumIntoDir: func(tenantID string) string { return filepath.Join(backups, tenantID) },
+		},
+	})
+	if err := dbm.Create("other"); err != nil {
+		t.Fatal(err.Error())
+	}
+	other, _ := dbm.GetFilename("other")
+	if err := os.Mkdir(filepath.Join(backups, "test"), 0o700); err != nil {
+		t.Fatal(err.Error())
+	}
+	c := connectTestClient(t, dbm, pgif.BackendConfig{})
+	c.startup("test", "tester", "secret")
+	c.mustQuery("CREATE TABLE items (id INTEGER PRIMARY KEY)")
+
+	for _, q := range []string{
+		"ATTACH DATABASE '" + other + "' AS other",
+		"ATTACH DATABASE 'file:" + other + "?mode=ro' AS other",
+		"DETACH DATABASE pg_catalog",
+		"VACUUM INTO '" + filepath.Join(filepath.Dir(other), "copy.db") + "'",
+		"VACUUM INTO '" + filepath.Join(backups, "test", "..", "escape.db") + "'",
+		"SELECT load_extension('mod_spatialite')",
+		"PRAGMA writable_schema = ON",
+		"PRAGMA journal_mode = OFF",
+		"PRAGMA temp_store_directory = '/tmp'",
+		"ATTACH DATABASE '" + filepath.Dir(other) + "/' || 'other.db' AS other",
+		"ATTACH DATABASE '" + filepath.Dir(other) + "/' || 'planted.db' AS planted",
+		"VACUUM",
+	} {
+		if res := c.query(q); res.errCode() != "42501" {
+			t.Errorf("expected %q to be denied, got %q", q, res.errCode())
+		}
+	}
+	for _, f := range []string{"copy.db", "planted.db"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(other), f)); err == nil {
+			t.Errorf("expected %s not to be written", f)
+		}
+	}
+
+	// the safe PRAGMAs, allowed files, and the tenant's own backup directory are fine
+	for _, q := range []string{
+		"PRAGMA journal_mode", "PRAGMA cache_size = 500", "PRAGMA user_version = 2", "PRAGMA mmap_size = 0",
+		"SELECT * FROM pragma_table_info('items')",
+		"VACUUM INTO '" + filepath.Join(backups, "test", "items.db") + "'",
+		"ATTACH DATABASE '" + shared + "' AS shared", "DETACH DATABASE shared",
+	} {
+		c.mustQuery(q)
+	}
+	// but only into a new file, so nothing already in the directory can be attached, overwritten, or reached through
+	// a symlink
+	backup := filepath.Join(backups, "test", "items.db")
+	if err := os.Symlink(filepath.Dir(other), filepath.Join(backups, "test", "link")); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, q := range []string{
+		"VACUUM INTO '" + backup + "'",
+		"ATTACH DATABASE '" + backup + "' AS backup",
+		"VACUUM INTO '" + filepath.Join(backups, "test", "link", "copy.db") + "'",
+	} {
+		if res := c.query(q); res.errCode() != "42501" {
+			t.Errorf("expected %q to be denied, got %q", q, res.errCode())
+		}
+	}
+	// the attach limit leaves room for the shared file and VACUUM INTO, and nothing else, even in memory
+	c.mustQuery("ATTACH DATABASE ':memory:' AS scratch1; ATTACH DATABASE ':memory:' AS scratch2")
+	if res := c.query("ATTACH DATABASE ':memory:' AS scratch3"); res.errCode() == "" {
+		t.Error("expected the attach limit to hold")
+	}
+	if res := c.mustQuery("SELECT relname FROM pg_catalog.pg_class WHERE relname = 'items'"); len(res.Rows) != 1 {
+		t.Errorf("expected the catalogs to work, got %v", res.Rows)
+	}
+	// a plain VACUUM is left to the server
+	if err := dbm.Vacuum("test"); err != nil {
+		t.Errorf("expected Vacuum() to work: %s", err.Error())
+	}
+
+	// with nothing to attach, there's no room for anything but the catalogs
+	closed := newTestManager(t, dbmgr.DBManagerConfig{})
+	c = connectTestClient(t, closed, pgif.BackendConfig{})
+	c.startup("test", "tester", "secret")
+	if res := c.query("ATTACH DATABASE ':memory:' AS scratch"); res.errCode() == "" {
+		t.Error("expected the attach limit to be 0")
+	}
+	if res := c.mustQuery("SELECT nspname FROM pg_catalog.pg_namespace"); len(res.Rows) == 0 {
+		t.Error("expected the catalogs to work")
+	}
+
+	// with the policy off, anything goes
+	open := newTestManager(t, dbmgr.DBManagerConfig{Isolation: dbmgr.IsolationPolicy{Disabled: true}})
+	c = connectTestClient(t, open, pgif.BackendConfig{})
+	c.startup("test", "tester", "secret")
+	c.mustQuery("ATTACH DATABASE '" + other + "' AS other")
+	c.mustQuery("VACUUM")
+}
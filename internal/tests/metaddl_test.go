@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"testing"
+)
+
+func TestParseMetaDDL(t *testing.T) {
+	ddl, err := pgif.ParseMetaDDL(`[[CREATE DATABASE 'MyDatabase' AS 'My Personal Database' WITH NOCONFLICT;
+		create user 'bob@example.com' with pwd 'some-password';
+		REMOVE USER ' jane@example.com' FROM DB 'MyDatabase';
+		ADD RIGHT 'db::admin' TO 'bob@example.com' ON DB 'MyDatabase';]]`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ddl.Stmts) != 4 {
+		t.Fatalf("expected 4 statements, got %d", len(ddl.Stmts))
+	}
+	if ddl.Stmts[0].CreateDB == nil || ddl.Stmts[0].CreateDB.ID != "MyDatabase" || !ddl.Stmts[0].CreateDB.NoConflict {
+		t.Errorf("bad CREATE DATABASE parse: %+v", ddl.Stmts[0].CreateDB)
+	}
+	if ddl.Stmts[1].AddUser == nil || ddl.Stmts[1].AddUser.Password != "some-password" {
+		t.Errorf("bad CREATE USER parse: %+v", ddl.Stmts[1].AddUser)
+	}
+	if ddl.Stmts[2].RemoveUserFromDB == nil || ddl.Stmts[2].RemoveUserFromDB.Username != "jane@example.com" {
+		t.Errorf("bad REMOVE USER parse: %+v", ddl.Stmts[2].RemoveUserFromDB)
+	}
+	if ddl.Stmts[3].AddUserRight == nil || ddl.Stmts[3].AddUserRight.Right != "db::admin" || ddl.Stmts[3].AddUserRight.DB != "MyDatabase" {
+		t.Errorf("bad ADD RIGHT parse: %+v", ddl.Stmts[3].AddUserRight)
+	}
+
+	for _, bad := range []string{`[[CREATE DATABASE;]]`, `[[ADD USER 'bob' TO 'db';]]`, `[[CREATE DATABASE 'x';`} {
+		if _, err := pgif.ParseMetaDDL(bad); err == nil {
+			t.Errorf("expected %q to fail parsing", bad)
+		}
+	}
+}
+
+func TestMetaDDLOverWire(t *testing.T) {
+	calls := make([]string, 0)
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{
+		FnAddUser: func(username, pwd string) error {
+			calls = append(calls, "add:"+username+":"+pwd)
+			return nil
+		},
+		FnModifyUser: func(username, action, db string, args ...any) error {
+			calls = append(calls, fmt.Sprintf("%s:%s:%s:%v", action, username, db, args))
+			return nil
+		},
+		FnCheckServerAdmin: func(username string) (bool, error) {
+			return username == "tester", nil
+		},
+	})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+
+	res := c.mustQuery(`[[CREATE DATABASE 'tenant1'; CREATE USER 'bob' WITH PWD 'pw'; ADD USER 'bob' TO DB 'tenant1'; ADD RIGHT 'db::read' TO 'bob' ON DB 'tenant1';]]`)
+	if fmt.Sprint(res.Tags) != "[CREATE DATABASE CREATE USER ADD USER ADD RIGHT]" {
+		t.Errorf("unexpected command tags %v", res.Tags)
+	}
+	if !dbm.Exists("tenant1") {
+		t.Error("tenant1 was not created")
+	}
+	if fmt.Sprint(calls) != "[add:bob:pw dbadduser:bob:tenant1:[] adduserright:bob:tenant1:[db::read]]" {
+		t.Errorf("unexpected hook calls %v", calls)
+	}
+
+	if code := c.query(`[[CREATE DATABASE 'tenant1';]]`).errCode(); code != "42P04" {
+		t.Errorf("expected duplicate_database, got %q", code)
+	}
+	c.mustQuery(`[[CREATE DATABASE 'tenant1' WITH NOCONFLICT;]]`)
+	for _, q := range []string{`[[CREATE DATABASE '../escape';]]`, `[[CREATE DATABASE '../test' WITH NOCONFLICT;]]`} {
+		if code := c.query(q).errCode(); code != "42602" {
+			t.Errorf("expected invalid_name for %s, got %q", q, code)
+		}
+	}
+	if code := c.query(`[[DELETE USER 'bob';]]`).errCode(); code != "0A000" {
+		t.Errorf("expected feature_not_supported for unconfigured hook, got %q", code)
+	}
+	if code := c.query(`[[CREATE TABLE foo;]]`).errCode(); code != "42601" {
+		t.Errorf("expected syntax_error, got %q", code)
+	}
+}
+
+func TestMetaDDLPermissions(t *testing.T) {
+	calls := make([]string, 0)
+	record := func(call string) {
+		calls = append(calls, call)
+	}
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{
+		FnAddUser: func(username, pwd string) error {
+			record("add:" + username)
+			return nil
+		},
+		FnDeleteUser: func(username string) error {
+			record("delete:" + username)
+			return nil
+		},
+		FnModifyUser: func(username, action, db string, args ...any) error {
+			record(fmt.Sprintf("%s:%s:%s", action, username, db))
+			return nil
+		},
+		// each tenant has its own admin, and root runs the server
+		DFnCheckDBRight: func(username, pwd, db, right string) (bool, error) {
+			return right == dbmgr.RightAdmin && username == db+"-admin", nil
+		},
+		FnCheckServerAdmin: func(username string) (bool, error) {
+			return username == "root", nil
+		},
+	})
+	for _, id := range []string{"a", "b"} {
+		if err := dbm.Create(id); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	addr := startTestServer(t, dbm, pgif.BackendConfig{})
+	connect := func(db, user string) *testClient {
+		c := dialTestClient(t, addr)
+		c.startup(db, user, "secret")
+		return c
+	}
+
+	// a tenant's admin manages its users and rights, and nothing else
+	admin := connect("a", "a-admin")
+	admin.mustQuery(`[[ADD USER 'bob' TO DB 'a'; ADD RIGHT 'db::read' TO 'bob' ON DB 'a';]]`)
+	for _, q := range []string{
+		`[[ADD USER 'a-admin' TO DB 'b';]]`,
+		`[[ADD RIGHT 'db::admin' TO 'a-admin' ON DB 'b';]]`,
+		`[[REMOVE USER 'b-admin' FROM DB 'b';]]`,
+		`[[ALTER USER 'b-admin' WITH PWD 'stolen';]]`,
+		`[[DELETE USER 'b-admin';]]`,
+		`[[CREATE USER 'eve' WITH PWD 'pw';]]`,
+		`[[CREATE DATABASE 'c';]]`,
+		// nothing in a block runs unless all of it may
+		`[[ADD USER 'carol' TO DB 'a'; ADD USER 'carol' TO DB 'b';]]`,
+	} {
+		if code := admin.query(q).errCode(); code != "42501" {
+			t.Errorf("expected %s to be denied to a's admin, got %q", q, code)
+		}
+	}
+	if dbm.Exists("c") {
+		t.Error("expected c not to be created")
+	}
+	if fmt.Sprint(calls) != "[dbadduser:bob:a adduserright:bob:a]" {
+		t.Errorf("unexpected hook calls %v", calls)
+	}
+	// the session carries on afterwards
+	admin.mustQuery("SELECT 1")
+
+	// a user without db::admin can't manage even their own database
+	if code := connect("a", "bob").query(`[[ADD USER 'carol' TO DB 'a';]]`).errCode(); code != "42501" {
+		t.Errorf("expected a non-admin to be denied meta-DDL, got %q", code)
+	}
+
+	// a server admin can do anything
+	root := connect("a", "root")
+	root.mustQuery(`[[CREATE DATABASE 'c'; CREATE USER 'carol' WITH PWD 'pw'; ADD USER 'carol' TO DB 'b'; DELETE USER 'bob';]]`)
+	if !dbm.Exists("c") {
+		t.Error("c was not created")
+	}
+
+	// without the hooks, nobody can run meta-DDL
+	open := newTestManager(t, dbmgr.DBManagerConfig{})
+	if code := newTestClient(t, open, pgif.BackendConfig{}).query(`[[CREATE DATABASE 'c';]]`).errCode(); code != "42501" {
+		t.Errorf("expected meta-DDL to be denied without rights, got %q", code)
+	}
+}
@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"testing"
+)
+
+func TestMultiStatementQueries(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+
+	// a schema script, with a trigger body and a semicolon in a string
+	res := c.mustQuery(`CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT);
+		CREATE TABLE audit (msg TEXT);
+		CREATE TRIGGER items_ai AFTER INSERT ON items BEGIN
+			INSERT INTO audit VALUES ('added; ' || NEW.name);
+		END;
+		INSERT INTO items (name) VALUES ('a'), ('b');
+		SELECT name FROM items ORDER BY id;
+		SELECT count(*) FROM audit;`)
+	if fmt.Sprint(res.Tags) != "[CREATE TABLE CREATE TABLE CREATE TRIGGER INSERT 0 2 SELECT 2 SELECT 1]" {
+		t.Errorf("unexpected tags: %v", res.Tags)
+	}
+	if len(res.Rows) != 3 || res.value(2, 0) != "2" || res.TxStatus != 'I' {
+		t.Errorf("unexpected results: %+v", res)
+	}
+
+	// an error part way through rolls back the whole implicit transaction
+	res = c.query("INSERT INTO items (name) VALUES ('c'); SELECT * FROM no_such_table; INSERT INTO items (name) VALUES ('d')")
+	if len(res.Errs) != 1 || fmt.Sprint(res.Tags) != "[INSERT 0 1]" || res.TxStatus != 'I' {
+		t.Errorf("expected the script to stop at the error, got %+v", res)
+	}
+	if res := c.mustQuery("SELECT count(*) FROM items"); res.value(0, 0) != "2" {
+		t.Errorf("expected the implicit transaction to be rolled back, got %s items", res.value(0, 0))
+	}
+
+	// a script that opens its own transaction leaves it open
+	res = c.mustQuery("INSERT INTO items (name) VALUES ('e'); BEGIN; INSERT INTO items (name) VALUES ('f')")
+	if res.TxStatus != 'T' {
+		t.Errorf("expected the transaction to be left open, got %c", res.TxStatus)
+	}
+	c.mustQuery("ROLLBACK")
+	if res := c.mustQuery("SELECT group_concat(name) FROM items"); res.value(0, 0) != "a,b" {
+		t.Errorf("expected everything to be rolled back, got %s", res.value(0, 0))
+	}
+
+	for _, blank := range []string{"", "  ;  ", "-- nothing\n;;"} {
+		if res := c.query(blank); fmt.Sprint(res.Types) != "[EmptyQueryResponse ReadyForQuery]" {
+			t.Errorf("expected an empty query response for %q, got %v", blank, res.Types)
+		}
+	}
+}
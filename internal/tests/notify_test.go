@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"testing"
+)
+
+/*
+receiveNotification() waits for a notification sent to an idle client.
+*/
+func (c *testClient) receiveNotification() string {
+	msg := c.receive()
+	n, ok := msg.(*pgproto3.NotificationResponse)
+	if !ok {
+		c.t.Fatalf("expected a notification, got %T", msg)
+	}
+	return n.Channel + ": " + n.Payload
+}
+
+func TestListenNotify(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	if err := dbm.Create("other"); err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := startTestServer(t, dbm, pgif.BackendConfig{TableChannels: true})
+	sender := dialTestClient(t, addr)
+	sender.startup("test", "tester", "secret")
+	listener := dialTestClient(t, addr)
+	listener.startup("test", "tester", "secret")
+	outsider := dialTestClient(t, addr)
+	outsider.startup("other", "tester", "secret")
+
+	if res := listener.mustQuery(`LISTEN jobs; LISTEN "Mixed"`); fmt.Sprint(res.Tags) != "[LISTEN LISTEN]" {
+		t.Errorf("unexpected tags %v", res.Tags)
+	}
+	outsider.mustQuery("LISTEN jobs")
+
+	// an idle listener is told straight away
+	if res := sender.mustQuery("NOTIFY jobs, 'first'"); fmt.Sprint(res.Tags) != "[NOTIFY]" {
+		t.Errorf("unexpected tags %v", res.Tags)
+	}
+	if n := listener.receiveNotification(); n != "jobs: first" {
+		t.Errorf("unexpected notification %q", n)
+	}
+
+	// notifications are sent on commit, once each, and dropped on rollback
+	sender.mustQuery("BEGIN")
+	sender.mustQuery("NOTIFY jobs, 'lost'")
+	sender.mustQuery("ROLLBACK")
+	sender.mustQuery("BEGIN")
+	sender.mustQuery("SELECT pg_notify('Mixed', 'second'), pg_notify('jobs', 'third')")
+	sender.mustQuery("NOTIFY jobs, 'third'")
+	sender.mustQuery("COMMIT")
+	for _, expected := range []string{"Mixed: second", "jobs: third"} {
+		if n := listener.receiveNotification(); n != expected {
+			t.Errorf("expected %q, got %q", expected, n)
+		}
+	}
+	if res := sender.query("NOTIFY jobs, ''; SELECT 1/0 FROM no_such_table"); res.errCode() != "42P01" {
+		t.Errorf("expected the script to fail, got %q", res.errCode())
+	}
+
+	// a busy listener gets notifications with its next ReadyForQuery, and none while it's in a transaction block
+	listener.mustQuery("BEGIN")
+	sender.mustQuery("NOTIFY jobs, 'fourth'")
+	if res := listener.mustQuery("SELECT 1"); len(res.Notifications) != 0 {
+		t.Errorf("expected no notifications in a transaction block, got %v", res.Notifications)
+	}
+	if res := listener.mustQuery("COMMIT"); fmt.Sprint(res.Notifications) != "[jobs: fourth]" {
+		t.Errorf("expected the notification at commit, got %v", res.Notifications)
+	}
+
+	// rows changed in a table are notified on its channel
+	sender.mustQuery("CREATE TABLE orders (id INTEGER PRIMARY KEY, total REAL)")
+	listener.mustQuery("UNLISTEN *; LISTEN rz_table_orders")
+	sender.mustQuery("INSERT INTO orders (total) VALUES (10)")
+	sender.mustQuery("UPDATE orders SET total = 12 WHERE id = 1")
+	for _, expected := range []string{"rz_table_orders: INSERT 1", "rz_table_orders: UPDATE 1"} {
+		if n := listener.receiveNotification(); n != expected {
+			t.Errorf("expected %q, got %q", expected, n)
+		}
+	}
+
+	// the session hears its own notifications, and other databases hear nothing
+	sender.mustQuery("LISTEN self")
+	if res := sender.mustQuery("NOTIFY self"); fmt.Sprint(res.Notifications) != "[self: ]" {
+		t.Errorf("expected the session's own notification, got %v", res.Notifications)
+	}
+	if res := outsider.mustQuery("SELECT 1"); len(res.Notifications) != 0 {
+		t.Errorf("expected no notifications from another database, got %v", res.Notifications)
+	}
+	if res := sender.query("NOTIFY"); res.errCode() != "42601" {
+		t.Errorf("expected a syntax error, got %q", res.errCode())
+	}
+}
@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"sync"
+	"testing"
+)
+
+func TestUserRights(t *testing.T) {
+	rights := map[string][]string{
+		"owner":   {dbmgr.RightAdmin},
+		"writer":  {dbmgr.RightRead, dbmgr.RightWrite},
+		"analyst": {dbmgr.RightRead},
+		"clerk":   {dbmgr.RightRead + ":orders", dbmgr.RightWrite + ":orders"},
+	}
+	var mu sync.Mutex
+	asked := make(map[string]int)
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{
+		TableRights: true,
+		DFnCheckDBRight: func(username, pwd, db, right string) (bool, error) {
+			if pwd != "" {
+				t.Errorf("expected rights to be checked without a password, got %q", pwd)
+			}
+			mu.Lock()
+			asked[username+" "+right]++
+			mu.Unlock()
+			for _, r := range rights[username] {
+				if r == right {
+					return db == "test", nil
+				}
+			}
+			return false, nil
+		},
+	})
+	addr := startTestServer(t, dbm, pgif.BackendConfig{})
+	connect := func(user string) *testClient {
+		c := dialTestClient(t, addr)
+		c.startup("test", user, "secret")
+		return c
+	}
+
+	owner := connect("owner")
+	owner.mustQuery("CREATE TABLE orders (id INTEGER PRIMARY KEY, total REAL)")
+	owner.mustQuery("CREATE TABLE secrets (v TEXT)")
+	owner.mustQuery("INSERT INTO orders (total) VALUES (1.5)")
+	owner.mustQuery("PRAGMA user_version = 3")
+
+	analyst := connect("analyst")
+	if res := analyst.mustQuery("SELECT count(*) FROM orders"); res.value(0, 0) != "1" {
+		t.Errorf("expected the analyst to read orders, got %q", res.value(0, 0))
+	}
+	for _, q := range []string{
+		"INSERT INTO orders (total) VALUES (2)", "UPDATE orders SET total = 0", "DELETE FROM orders",
+		"CREATE TABLE mine (x INTEGER)", "DROP TABLE secrets", "ALTER TABLE orders ADD COLUMN note TEXT",
+		"PRAGMA user_version = 4", "ATTACH DATABASE 'other.db' AS other",
+	} {
+		if res := analyst.query(q); res.errCode() != "42501" {
+			t.Errorf("expected %q to be denied to the analyst, got %q", q, res.errCode())
+		}
+	}
+	// session state, temp tables, and the system catalogs don't need rights
+	analyst.mustQuery("SET statement_timeout = 1000")
+	analyst.mustQuery("CREATE TEMP TABLE scratch (x INTEGER)")
+	analyst.mustQuery("INSERT INTO scratch VALUES (1)")
+	analyst.mustQuery("PRAGMA user_version")
+	if res := analyst.mustQuery("SELECT relname FROM pg_catalog.pg_class WHERE relname = 'orders'"); len(res.Rows) != 1 {
+		t.Errorf("expected the catalogs to work for the analyst, got %v", res.Rows)
+	}
+
+	writer := connect("writer")
+	writer.mustQuery("INSERT INTO orders (total) VALUES (2)")
+	if res := writer.query("CREATE INDEX orders_total ON orders (total)"); res.errCode() != "42501" {
+		t.Errorf("expected DDL to be denied to the writer, got %q", res.errCode())
+	}
+
+	// table rights
+	clerk := connect("clerk")
+	clerk.mustQuery("UPDATE orders SET total = 3 WHERE id = 1")
+	if res := clerk.query("SELECT * FROM secrets"); res.errCode() != "42501" {
+		t.Errorf("expected the clerk to be denied secrets, got %q", res.errCode())
+	}
+
+	// answers are cached for the session
+	analyst.mustQuery("SELECT * FROM orders")
+	analyst.mustQuery("SELECT * FROM orders")
+	mu.Lock()
+	defer mu.Unlock()
+	if n := asked["analyst "+dbmgr.RightRead]; n != 1 {
+		t.Errorf("expected the read right to be checked once, was checked %d times", n)
+	}
+}
@@ -0,0 +1,41 @@
+package tests
+
+import (
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"testing"
+)
+
+func TestSessionStatePersists(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+
+	c.mustQuery("CREATE TEMP TABLE scratch (id INTEGER PRIMARY KEY, v TEXT)")
+	c.mustQuery("INSERT INTO scratch (v) VALUES ('a'), ('b')")
+	if v := c.mustQuery("SELECT last_insert_rowid()").value(0, 0); v != "2" {
+		t.Errorf("expected last_insert_rowid() of 2, got %s", v)
+	}
+	c.mustQuery("PRAGMA cache_size = 1234")
+	if v := c.mustQuery("PRAGMA cache_size").value(0, 0); v != "1234" {
+		t.Errorf("expected the PRAGMA to persist, got %s", v)
+	}
+
+	// other sessions don't see this session's temp tables
+	other := newTestClient(t, dbm, pgif.BackendConfig{})
+	if code := other.query("SELECT * FROM scratch").errCode(); code == "" {
+		t.Error("expected temp table to be private to its session")
+	}
+
+	// prepared statements run on the session's connection too
+	c.send(
+		&pgproto3.Parse{Query: "SELECT v FROM scratch ORDER BY id"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	res := c.readUntilReady()
+	if len(res.Errs) > 0 || len(res.Rows) != 2 || res.value(1, 0) != "b" {
+		t.Errorf("expected the prepared statement to see the temp table, got %+v", res)
+	}
+}
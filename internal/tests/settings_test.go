@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"testing"
+)
+
+func TestSessionParameters(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := connectTestClient(t, dbm, pgif.BackendConfig{ServerVersion: "15.0"})
+	start := c.startup("test", "tester", "secret")
+	for name, expected := range map[string]string{
+		"DateStyle": "ISO, MDY", "TimeZone": "UTC", "integer_datetimes": "on", "standard_conforming_strings": "on",
+		"session_authorization": "tester", "is_superuser": "off", "server_version": "15.0", "IntervalStyle": "postgres",
+	} {
+		if got, ok := start.Params[name]; !ok || got != expected {
+			t.Errorf("expected startup parameter %s = %q, got %q", name, expected, got)
+		}
+	}
+
+	res := c.mustQuery("SET application_name = 'reports'")
+	if fmt.Sprint(res.Tags) != "[SET]" || res.Params["application_name"] != "reports" {
+		t.Errorf("expected a SET tag and a ParameterStatus, got %v %v", res.Tags, res.Params)
+	}
+	res = c.mustQuery("SHOW application_name")
+	if res.Fields[0] != "application_name" || res.value(0, 0) != "reports" || fmt.Sprint(res.Tags) != "[SHOW]" {
+		t.Errorf("unexpected SHOW result: %+v", res)
+	}
+	if res := c.mustQuery("SHOW server_version"); res.value(0, 0) != "15.0" {
+		t.Errorf("unexpected server_version %q", res.value(0, 0))
+	}
+	c.mustQuery("SET statement_timeout TO 5000")
+	if res := c.mustQuery("show STATEMENT_TIMEOUT"); res.value(0, 0) != "5s" {
+		t.Errorf("expected the timeout in seconds, got %q", res.value(0, 0))
+	}
+	c.mustQuery("RESET statement_timeout")
+	if res := c.mustQuery("SHOW statement_timeout"); res.value(0, 0) != "0" {
+		t.Errorf("expected the timeout to be reset, got %q", res.value(0, 0))
+	}
+
+	// errors
+	for q, code := range map[string]string{
+		"SET no_such_param = 1":               "42704",
+		"SHOW no_such_param":                  "42704",
+		"SET server_version = '16'":           "55P02",
+		"SET statement_timeout = 'soon'":      "22023",
+		"SET client_encoding = 'LATIN1'":      "22023",
+		"SET standard_conforming_strings off": "42601",
+	} {
+		if res := c.query(q); res.errCode() != code {
+			t.Errorf("expected %s for %q, got %q", code, q, res.errCode())
+		}
+	}
+	c.mustQuery("SET myapp.tenant = 'acme'")
+	if res := c.mustQuery("SHOW myapp.tenant"); res.value(0, 0) != "acme" {
+		t.Errorf("expected a custom parameter, got %q", res.value(0, 0))
+	}
+
+	// SETs are undone by a rollback, and SET LOCAL lasts only until the transaction ends
+	c.mustQuery("BEGIN")
+	c.mustQuery("SET search_path TO app, public")
+	c.mustQuery("ROLLBACK")
+	if res := c.mustQuery("SHOW search_path"); res.value(0, 0) != `"$user", public` {
+		t.Errorf("expected the SET to be rolled back, got %q", res.value(0, 0))
+	}
+	c.mustQuery("BEGIN; SET LOCAL DateStyle = 'ISO, DMY'; SET application_name = 'batch'")
+	if res := c.mustQuery("SHOW DateStyle"); res.value(0, 0) != "ISO, DMY" {
+		t.Errorf("expected the local DateStyle, got %q", res.value(0, 0))
+	}
+	res = c.mustQuery("COMMIT")
+	if res.Params["DateStyle"] != "ISO, MDY" {
+		t.Errorf("expected DateStyle to be reported as reverted, got %v", res.Params)
+	}
+	if res := c.mustQuery("SHOW application_name"); res.value(0, 0) != "batch" {
+		t.Errorf("expected the committed SET to stick, got %q", res.value(0, 0))
+	}
+	if res := c.mustQuery("SET LOCAL application_name = 'x'"); fmt.Sprint(res.Types) != "[NoticeResponse CommandComplete ReadyForQuery]" {
+		t.Errorf("expected a warning for SET LOCAL outside a transaction, got %v", res.Types)
+	}
+
+	// the time zone is used to show timestamptz values
+	c.mustQuery("CREATE TABLE events (at TIMESTAMPTZ)")
+	c.mustQuery("INSERT INTO events VALUES ('2004-10-19 10:23:54.5+02:00')")
+	res = c.mustQuery("SET TIME ZONE 5")
+	if res.Params["TimeZone"] != "5" {
+		t.Errorf("expected TimeZone to be reported, got %v", res.Params)
+	}
+	if res := c.mustQuery("SELECT at FROM events"); res.value(0, 0) != "2004-10-19 13:23:54.5+05" {
+		t.Errorf("expected the timestamp in the session's zone, got %q", res.value(0, 0))
+	}
+	if res := c.execPrepared("SHOW TimeZone"); res.value(0, 0) != "5" {
+		t.Errorf("unexpected extended SHOW result: %+v", res)
+	}
+
+	// statement_timeout interrupts long queries
+	c.mustQuery("SET statement_timeout = '50ms'")
+	res = c.query("WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n) SELECT count(*) FROM n")
+	if res.errCode() != "57014" {
+		t.Errorf("expected the query to time out, got %q", res.errCode())
+	}
+	res = c.execPrepared("WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n) SELECT count(*) FROM n")
+	if res.errCode() != "57014" {
+		t.Errorf("expected the extended query to time out, got %q", res.errCode())
+	}
+	if res := c.execPrepared("SELECT 1"); res.value(0, 0) != "1" {
+		t.Errorf("expected the session to carry on after a timeout, got %+v", res)
+	}
+
+	if res := c.mustQuery("SHOW ALL"); fmt.Sprint(res.Fields) != "[name setting description]" || len(res.Rows) < 10 {
+		t.Errorf("unexpected SHOW ALL result: %v, %d rows", res.Fields, len(res.Rows))
+	}
+	if res := c.mustQuery("SELECT setting FROM pg_settings WHERE name = 'application_name'"); res.value(0, 0) != "batch" {
+		t.Errorf("expected pg_settings to follow SET, got %q", res.value(0, 0))
+	}
+}
@@ -0,0 +1,43 @@
+package tests
+
+import (
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"testing"
+)
+
+func TestSqliteErrorCodes(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("PRAGMA foreign_keys = ON")
+	c.mustQuery("CREATE TABLE parents (id INTEGER PRIMARY KEY, name TEXT NOT NULL UNIQUE, age INTEGER CONSTRAINT adult CHECK (age >= 18))")
+	c.mustQuery("CREATE TABLE kids (id INTEGER PRIMARY KEY, parent INTEGER REFERENCES parents (id))")
+	c.mustQuery("INSERT INTO parents VALUES (1, 'ann', 40)")
+
+	for _, tc := range []struct {
+		query, code, table, column, constraint string
+	}{
+		{"INSERT INTO parents VALUES (2, 'ann', 30)", "23505", "parents", "name", "parents_name_key"},
+		{"INSERT INTO parents VALUES (1, 'bob', 30)", "23505", "parents", "id", "parents_pkey"},
+		{"INSERT INTO parents (id, age) VALUES (3, 30)", "23502", "parents", "name", ""},
+		{"INSERT INTO parents VALUES (4, 'cal', 5)", "23514", "", "", "adult"},
+		{"INSERT INTO kids VALUES (1, 99)", "23503", "", "", ""},
+		{"SELEKT 1", "42601", "", "", ""},
+		{"SELECT * FROM nowhere", "42P01", "nowhere", "", ""},
+		{"SELECT nope FROM parents", "42703", "", "", ""},
+		{"SELECT nope(1)", "42883", "", "", ""},
+		{"CREATE TABLE parents (x)", "42P07", "parents", "", ""},
+		{"INSERT INTO parents VALUES (1)", "42601", "", "", ""},
+	} {
+		res := c.query(tc.query)
+		if len(res.Errs) != 1 {
+			t.Errorf("%s: expected an error, got %+v", tc.query, res)
+			continue
+		}
+		e := res.Errs[0]
+		if e.Code != tc.code || e.TableName != tc.table || e.ColumnName != tc.column || e.ConstraintName != tc.constraint || e.Severity != "ERROR" {
+			t.Errorf("%s: expected %s (%q %q %q), got %s (%q %q %q): %s", tc.query, tc.code, tc.table, tc.column, tc.constraint,
+				e.Code, e.TableName, e.ColumnName, e.ConstraintName, e.Message)
+		}
+	}
+}
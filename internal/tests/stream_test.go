@@ -0,0 +1,45 @@
+package tests
+
+import (
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"strings"
+	"testing"
+)
+
+func TestStreamedResults(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{FlushThreshold: 64, MaxResultBytes: 8000})
+	c.mustQuery("CREATE TABLE docs (id INTEGER, body TEXT)")
+	c.mustQuery("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 100) " +
+		"INSERT INTO docs SELECT i, '" + strings.Repeat("x", 100) + "' FROM n")
+
+	// results bigger than the flush threshold arrive intact
+	res := c.mustQuery("SELECT id, body FROM docs WHERE id <= 50 ORDER BY id")
+	if len(res.Rows) != 50 || res.value(49, 0) != "50" || res.Tags[0] != "SELECT 50" {
+		t.Errorf("expected 50 rows, got %d (%v)", len(res.Rows), res.Tags)
+	}
+
+	// results bigger than MaxResultBytes are cut off with an error, and the session carries on
+	res = c.query("SELECT id, body FROM docs")
+	if res.errCode() != "54000" || len(res.Rows) >= 100 || len(res.Tags) != 0 {
+		t.Errorf("expected the result to be cut off, got %d rows and %+v", len(res.Rows), res.Errs)
+	}
+	if v := c.mustQuery("SELECT count(*) FROM docs").value(0, 0); v != "100" {
+		t.Errorf("expected the session to be usable after the error, got %s", v)
+	}
+
+	// the limit covers everything a portal returns, across Executes
+	c.send(
+		&pgproto3.Parse{Query: "SELECT id, body FROM docs"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{MaxRows: 60},
+		&pgproto3.Execute{MaxRows: 60},
+		&pgproto3.Sync{},
+	)
+	res = c.readUntilReady()
+	if res.errCode() != "54000" || len(res.Rows) < 60 {
+		t.Errorf("expected the portal to be cut off in its second batch, got %d rows and %+v", len(res.Rows), res.Errs)
+	}
+}
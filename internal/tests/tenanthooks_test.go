@@ -0,0 +1,83 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTenantHooks(t *testing.T) {
+	var updates atomic.Int64
+	readOnly := func(cc *dbmgr.ConnContext, action int, arg1, arg2, arg3 string) int {
+		if cc.Username() != "analyst" || arg3 != "main" {
+			return sqlite3.SQLITE_OK
+		}
+		switch action {
+		case sqlite3.SQLITE_INSERT, sqlite3.SQLITE_UPDATE, sqlite3.SQLITE_DELETE:
+			return sqlite3.SQLITE_DENY
+		}
+		return sqlite3.SQLITE_OK
+	}
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{
+		FnTenantClass: func(tenantID string) string {
+			if tenantID == "test" {
+				return "premium"
+			}
+			return "basic"
+		},
+		TenantHooks: []dbmgr.TenantHooks{
+			{Functions: []dbmgr.TenantFunction{{Name: "whoami", Fn: func(cc *dbmgr.ConnContext) any {
+				return func() string { return fmt.Sprintf("%s/%s/%t", cc.TenantID, cc.Username(), cc.SessionID() != 0) }
+			}}}},
+			{Class: "premium", Functions: []dbmgr.TenantFunction{{Name: "tier", Fn: func(cc *dbmgr.ConnContext) any {
+				return func() string { return cc.Class }
+			}, IsPure: true}}},
+			{Tenant: "other", Authorizer: readOnly, UpdateHook: func(cc *dbmgr.ConnContext, op int, db, table string, rowid int64) {
+				if cc.TenantID == "other" && db == "main" {
+					updates.Add(1)
+				}
+			}},
+		},
+	})
+	if err := dbm.Create("other"); err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := startTestServer(t, dbm, pgif.BackendConfig{})
+
+	c := dialTestClient(t, addr)
+	c.startup("test", "tester", "secret")
+	res := c.mustQuery("SELECT current_tenant(), whoami(), tier()")
+	if res.value(0, 0) != "test" || res.value(0, 1) != "test/tester/true" || res.value(0, 2) != "premium" {
+		t.Errorf("unexpected tenant context %q %q %q", res.value(0, 0), res.value(0, 1), res.value(0, 2))
+	}
+
+	owner := dialTestClient(t, addr)
+	owner.startup("other", "owner", "secret")
+	owner.mustQuery("CREATE TABLE facts (n INTEGER)")
+	owner.mustQuery("INSERT INTO facts VALUES (1), (2)")
+	if n := updates.Load(); n != 2 {
+		t.Errorf("expected the tenant update hook to see 2 rows, saw %d", n)
+	}
+	if res := owner.query("SELECT tier()"); res.errCode() != "42883" {
+		t.Errorf("expected tier() to be missing outside its class, got %q", res.errCode())
+	}
+
+	// the authorizer only lets the analyst read
+	analyst := dialTestClient(t, addr)
+	analyst.startup("other", "analyst", "secret")
+	if res := analyst.mustQuery("SELECT count(*), current_tenant() FROM facts"); res.value(0, 0) != "2" || res.value(0, 1) != "other" {
+		t.Errorf("unexpected result %q %q", res.value(0, 0), res.value(0, 1))
+	}
+	for _, q := range []string{"INSERT INTO facts VALUES (3)", "DELETE FROM facts"} {
+		if res := analyst.query(q); res.errCode() != "42501" {
+			t.Errorf("expected %q to be denied, got %q", q, res.errCode())
+		}
+	}
+	// the catalogs (which aren't in main) still work for the analyst
+	if res := analyst.mustQuery("SELECT relname FROM pg_catalog.pg_class WHERE relname = 'facts'"); len(res.Rows) != 1 {
+		t.Errorf("expected the catalogs to work, got %v", res.Rows)
+	}
+}
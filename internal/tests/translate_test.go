@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"strings"
+	"testing"
+)
+
+func TestDialectTranslation(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{Dialect: pgif.DialectBestEffort})
+
+	c.mustQuery(`CREATE TABLE public.events (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(40) NOT NULL UNIQUE,
+		kind TEXT,
+		at TIMESTAMP WITH TIME ZONE DEFAULT now()
+	);
+	CREATE TABLE tags (id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, tag TEXT);
+	CREATE INDEX CONCURRENTLY events_kind ON events USING btree (kind)`)
+
+	c.mustQuery(`INSERT INTO events (name, kind) VALUES ('a', 'x'), ('B', 'x'), (E'c\'s', 'y'), ($$d$$, 'y')`)
+	res := c.mustQuery("SELECT id, '42'::int + 1, name FROM events WHERE name ILIKE 'b' AND at <= now()")
+	if len(res.Rows) != 1 || res.value(0, 0) != "2" || res.value(0, 1) != "43" || res.value(0, 2) != "B" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if res := c.mustQuery("SELECT name FROM events WHERE id = 3"); res.value(0, 0) != "c's" {
+		t.Errorf("expected an escape string, got %q", res.value(0, 0))
+	}
+	if res := c.mustQuery("SELECT at FROM events WHERE id = 1"); !strings.HasSuffix(res.value(0, 0), "+00") {
+		t.Errorf("expected a timestamp with an offset, got %q", res.value(0, 0))
+	}
+	res = c.mustQuery("SELECT kind, string_agg(name, '|') FROM events GROUP BY kind ORDER BY kind")
+	if len(res.Rows) != 2 || res.value(0, 1) != "a|B" {
+		t.Errorf("unexpected aggregate: %+v", res)
+	}
+	if res := c.mustQuery("SELECT length(gen_random_uuid()::text)"); res.value(0, 0) != "36" {
+		t.Errorf("expected a uuid, got length %s", res.value(0, 0))
+	}
+	c.mustQuery("INSERT INTO tags (tag) VALUES ('t')")
+	if res := c.mustQuery("SELECT id FROM tags"); res.value(0, 0) != "1" {
+		t.Errorf("expected an identity column, got %q", res.value(0, 0))
+	}
+
+	// upserts, including the INSERT ... SELECT form Sqlite can't parse as it stands
+	c.mustQuery("INSERT INTO events (name, kind) VALUES ('a', 'z') ON CONFLICT ON CONSTRAINT events_name_key DO UPDATE SET kind = EXCLUDED.kind")
+	c.mustQuery("INSERT INTO events (name, kind) SELECT name, 'w' FROM events WHERE kind = 'y' ON CONFLICT (name) DO NOTHING")
+	if res := c.mustQuery("SELECT kind FROM events WHERE name = 'a'"); res.value(0, 0) != "z" {
+		t.Errorf("expected the upsert to update, got %q", res.value(0, 0))
+	}
+
+	res = c.mustQuery("SELECT DISTINCT ON (kind) kind, name FROM events e ORDER BY kind, id DESC")
+	var got []string
+	for i := range res.Rows {
+		got = append(got, res.value(i, 0)+":"+res.value(i, 1))
+	}
+	if fmt.Sprint(got) != "[x:B y:d z:a]" {
+		t.Errorf("unexpected DISTINCT ON result: %v", got)
+	}
+
+	// the extended protocol is translated too
+	ext := c.execPrepared("SELECT $1::int * 2", "21")
+	if len(ext.Rows) != 1 || ext.value(0, 0) != "42" {
+		t.Errorf("unexpected extended result: %+v", ext)
+	}
+
+	// strict mode rejects what it can't translate, and best-effort mode leaves it for Sqlite
+	strict := newTestClient(t, dbm, pgif.BackendConfig{Dialect: pgif.DialectStrict})
+	for _, q := range []string{
+		"SELECT string_agg(name, ',' ORDER BY name) FROM events",
+		"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1 $$ LANGUAGE sql",
+		"SELECT ARRAY[1, 2]::int[]",
+	} {
+		if res := strict.query(q); res.errCode() != "0A000" {
+			t.Errorf("expected feature_not_supported for %q, got %q", q, res.errCode())
+		}
+	}
+	if res := c.query("CREATE FUNCTION f() RETURNS int AS $$ SELECT 1 $$ LANGUAGE sql"); res.errCode() != "42601" {
+		t.Errorf("expected a syntax error from Sqlite, got %q", res.errCode())
+	}
+	if res := strict.mustQuery("SELECT 'yes'::boolean, 'x'::text"); res.value(0, 0) != "1" || res.value(0, 1) != "x" {
+		t.Errorf("unexpected strict result: %+v", res)
+	}
+
+	// without a dialect, queries go to Sqlite as they are
+	plain := newTestClient(t, dbm, pgif.BackendConfig{})
+	if res := plain.query("SELECT '1'::int"); res.errCode() != "42601" {
+		t.Errorf("expected a syntax error, got %q", res.errCode())
+	}
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"testing"
+)
+
+func TestTransactionStatus(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE accounts (id INTEGER, balance INTEGER)")
+
+	steps := []struct {
+		sql, tag, code string
+		status         byte
+	}{
+		{"BEGIN", "BEGIN", "", 'T'},
+		{"INSERT INTO accounts VALUES (1, 100)", "INSERT 0 1", "", 'T'},
+		{"SELECT * FROM accounts", "SELECT 1", "", 'T'},
+		{"ROLLBACK", "ROLLBACK", "", 'I'},
+		{"SELECT * FROM accounts", "SELECT 0", "", 'I'},
+
+		// errors fail the transaction until it ends, and COMMIT then rolls back
+		{"BEGIN", "BEGIN", "", 'T'},
+		{"INSERT INTO accounts VALUES (2, 200)", "INSERT 0 1", "", 'T'},
+		{"SELECT * FROM no_such_table", "", "42P01", 'E'},
+		{"SELECT 1", "", "25P02", 'E'},
+		{"COMMIT", "ROLLBACK", "", 'I'},
+		{"SELECT * FROM accounts", "SELECT 0", "", 'I'},
+
+		// a savepoint can recover a failed transaction
+		{"BEGIN", "BEGIN", "", 'T'},
+		{"INSERT INTO accounts VALUES (3, 300)", "INSERT 0 1", "", 'T'},
+		{"SAVEPOINT sp", "SAVEPOINT", "", 'T'},
+		{"INSERT INTO no_such_table VALUES (1)", "", "42P01", 'E'},
+		{"ROLLBACK TO SAVEPOINT sp", "ROLLBACK", "", 'T'},
+		{"COMMIT", "COMMIT", "", 'I'},
+		{"SELECT * FROM accounts", "SELECT 1", "", 'I'},
+	}
+	for i, step := range steps {
+		res := c.query(step.sql)
+		if res.errCode() != step.code || res.TxStatus != step.status {
+			t.Fatalf("step %d %q: expected code %q and status %c, got %+v (status %c)", i, step.sql, step.code, step.status, res.Errs, res.TxStatus)
+		}
+		if step.tag != "" && (len(res.Tags) != 1 || res.Tags[0] != step.tag) {
+			t.Errorf("step %d %q: expected tag %q, got %v", i, step.sql, step.tag, res.Tags)
+		}
+	}
+}
+
+func TestTransactionWarnings(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+
+	res := c.mustQuery("COMMIT")
+	if fmt.Sprint(res.Types) != "[NoticeResponse CommandComplete ReadyForQuery]" || res.TxStatus != 'I' {
+		t.Errorf("expected a warning for COMMIT outside a transaction, got %v", res.Types)
+	}
+	c.mustQuery("BEGIN")
+	res = c.mustQuery("BEGIN")
+	if fmt.Sprint(res.Types) != "[NoticeResponse CommandComplete ReadyForQuery]" || res.TxStatus != 'T' {
+		t.Errorf("expected a warning for nested BEGIN, got %v", res.Types)
+	}
+	if res = c.mustQuery("ROLLBACK"); res.TxStatus != 'I' {
+		t.Errorf("expected to be idle after ROLLBACK, got %c", res.TxStatus)
+	}
+}
+
+func TestCopyInsideTransaction(t *testing.T) {
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE nums (n INTEGER)")
+
+	c.mustQuery("BEGIN")
+	if res := c.copyIn("COPY nums FROM STDIN", "1\n2\n"); res.TxStatus != 'T' || res.Tags[0] != "COPY 2" {
+		t.Fatalf("unexpected COPY result in transaction: %+v", res)
+	}
+	if v := c.mustQuery("SELECT count(*) FROM nums").value(0, 0); v != "2" {
+		t.Errorf("expected the copied rows to be visible in the transaction, got %s", v)
+	}
+	if res := c.copyIn("COPY nums FROM STDIN", "x\ty\n"); res.TxStatus != 'E' {
+		t.Errorf("expected a failed COPY to fail the transaction, got %c", res.TxStatus)
+	}
+	c.mustQuery("ROLLBACK")
+	if v := c.mustQuery("SELECT count(*) FROM nums").value(0, 0); v != "0" {
+		t.Errorf("expected the rollback to discard the copied rows, got %s", v)
+	}
+}
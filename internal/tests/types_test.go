@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"strings"
+	"testing"
+)
+
+func TestTypeRegistry(t *testing.T) {
+	pgif.RegisterType(pgif.PgType{
+		Name:      "citext",
+		OID:       90001,
+		DeclTypes: []string{"citext"},
+		EncodeText: func(val any) ([]byte, error) {
+			return []byte(strings.ToLower(fmt.Sprint(val))), nil
+		},
+	})
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE things (a VARCHAR(255), b NUMERIC(10, 2), c UUID, d JSON, e SMALLINT, f INT4, g CITEXT, h WIDGET, i BIGINT)")
+	c.mustQuery("INSERT INTO things VALUES ('x', 1.25, 'u', '{}', 1, 2, 'MiXeD', 'w', 3)")
+
+	res := c.mustQuery("SELECT * FROM things")
+	expected := []uint32{pgtype.VarcharOID, pgtype.NumericOID, pgtype.UUIDOID, pgtype.JSONOID, pgtype.Int2OID,
+		pgtype.Int4OID, 90001, pgtype.TextOID, pgtype.Int8OID}
+	if fmt.Sprint(res.OIDs) != fmt.Sprint(expected) {
+		t.Errorf("expected column types %v, got %v", expected, res.OIDs)
+	}
+	if v := res.value(0, 6); v != "mixed" {
+		t.Errorf("expected the custom type's encoder to be used, got %q", v)
+	}
+
+	// expressions have no declared type, so they're typed by value
+	res = c.mustQuery("SELECT 1 + 1, 2.5, 'a', x'00', NULL")
+	if fmt.Sprint(res.OIDs) != fmt.Sprint([]uint32{pgtype.Int8OID, pgtype.Float8OID, pgtype.TextOID, pgtype.ByteaOID, pgtype.TextOID}) {
+		t.Errorf("unexpected expression types: %v", res.OIDs)
+	}
+
+	// prepared statements are described from declared types, and parameters take the column's type
+	if oids := c.paramTypes("SELECT a FROM things WHERE e = $1 AND c = $2"); fmt.Sprint(oids) != fmt.Sprint([]uint32{pgtype.Int2OID, pgtype.UUIDOID}) {
+		t.Errorf("unexpected parameter types: %v", oids)
+	}
+	c.send(
+		&pgproto3.Parse{Query: "SELECT i FROM things WHERE e = $1"},
+		&pgproto3.Bind{Parameters: [][]byte{[]byte("1")}},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	res = c.readUntilReady()
+	if len(res.Errs) > 0 || len(res.Rows) != 1 || res.value(0, 0) != "3" || fmt.Sprint(res.OIDs) != fmt.Sprint([]uint32{pgtype.Int8OID}) {
+		t.Errorf("unexpected prepared result: %+v", res)
+	}
+}
+
+func TestTypeRegistryReplace(t *testing.T) {
+	// replacing a builtin by OID also replaces it for the declared types that mapped to it
+	pgif.RegisterType(pgif.PgType{
+		Name:      "json",
+		OID:       pgtype.JSONOID,
+		DeclTypes: []string{"jsondoc"},
+		EncodeText: func(val any) ([]byte, error) {
+			return []byte("json:" + fmt.Sprint(val)), nil
+		},
+	})
+	t.Cleanup(func() {
+		pgif.RegisterType(pgif.PgType{Name: "json", OID: pgtype.JSONOID, Size: -1, DeclTypes: []string{"json"}})
+	})
+	dbm := newTestManager(t, dbmgr.DBManagerConfig{})
+	c := newTestClient(t, dbm, pgif.BackendConfig{})
+	c.mustQuery("CREATE TABLE docs (a JSON, b JSONDOC)")
+	c.mustQuery("INSERT INTO docs VALUES ('{}', '[]')")
+
+	res := c.mustQuery("SELECT * FROM docs")
+	if fmt.Sprint(res.OIDs) != fmt.Sprint([]uint32{pgtype.JSONOID, pgtype.JSONOID}) {
+		t.Errorf("expected both columns to be json, got %v", res.OIDs)
+	}
+	if a, b := res.value(0, 0), res.value(0, 1); a != "json:{}" || b != "json:[]" {
+		t.Errorf("expected the replacement's encoder for both columns, got %q and %q", a, b)
+	}
+}
@@ -1,6 +1,10 @@
 package rhizome
 
-import "github.com/mattn/go-sqlite3"
+import (
+	"github.com/highgrav/rhizome/internal/dbmgr"
+	"github.com/highgrav/rhizome/internal/pgif"
+	"github.com/mattn/go-sqlite3"
+)
 
 type ISqlAggregator interface {
 }
@@ -26,6 +30,20 @@ type CustomFunction struct {
 	IsPure bool
 }
 
+/*
+CustomType maps declared column types onto a Postgres type, optionally with its own encoders and decoder. See
+pgif.PgType.
+*/
+type CustomType = pgif.PgType
+
+/*
+TenantHooks are functions and hooks set per tenant, or per class of tenants, which are told the tenant, user, and
+session they're working for. See dbmgr.TenantHooks.
+*/
+type TenantHooks = dbmgr.TenantHooks
+type TenantFunction = dbmgr.TenantFunction
+type ConnContext = dbmgr.ConnContext
+
 type FnPreUpdateHook func(data sqlite3.SQLitePreUpdateData)
 type FnRollbackHook func()
 type FnUpdateHook func(int, string, string, int64)
@@ -40,4 +58,5 @@ type RhizomeConfig struct {
 	RollbackHook  FnRollbackHook
 	UpdateHook    FnUpdateHook
 	CustomFns     []CustomFunction
+	Types         []CustomType
 }